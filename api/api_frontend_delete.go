@@ -27,7 +27,6 @@ func (a *APIForFrontend) DeleteMessage(jwtRes secure.JWTResponse, id uuid.UUID)
 		InactivePeriodDays:   row.InactivePeriodDays,
 		ReminderIntervalDays: row.ReminderIntervalDays,
 		IsActive:             row.IsActive,
-		ExtensionSecret:      row.ExtensionSecret,
 		InactiveAt:           row.InactiveAt,
 		NextReminderAt:       row.NextReminderAt,
 	}
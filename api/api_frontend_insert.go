@@ -3,19 +3,28 @@ package api
 import (
 	"net/http"
 	"net/mail"
-	"os"
 
 	"github.com/asendia/legacy-api/data"
 	"github.com/asendia/legacy-api/secure"
 )
 
 func (a *APIForFrontend) InsertMessage(jwtRes secure.JWTResponse, param APIParamInsertMessage) (res APIResponse, err error) {
-	extensionSecret, err := secure.GenerateRandomString(ExtensionSecretLength)
+	hasher, err := secure.LoadSecretHasherFromEnv()
 	if err != nil {
 		res.StatusCode = http.StatusInternalServerError
 		return res, err
 	}
-	encrypted, err := EncryptMessageContent(param.MessageContent, os.Getenv("ENCRYPTION_KEY"))
+	extensionSecretHash, err := newSecretHash(hasher)
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	keys, err := LoadMessageKeysFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	encrypted, err := EncryptMessageContent(a.Context, param.MessageContent, keys)
 	if err != nil {
 		res.StatusCode = http.StatusInternalServerError
 		return res, err
@@ -23,17 +32,21 @@ func (a *APIForFrontend) InsertMessage(jwtRes secure.JWTResponse, param APIParam
 	queries := data.New(a.Tx)
 	row, err := queries.InsertMessage(a.Context, data.InsertMessageParams{
 		EmailCreator:         jwtRes.Email,
-		ContentEncrypted:     encrypted,
+		ContentEncrypted:     encrypted.ContentEncrypted,
 		InactivePeriodDays:   param.InactivePeriodDays,
 		ReminderIntervalDays: param.ReminderIntervalDays,
-		ExtensionSecret:      extensionSecret,
+		ExtensionSecretHash:  extensionSecretHash,
 	})
 	if err != nil {
 		res.StatusCode = http.StatusBadRequest
 		return res, err
 	}
+	if err = saveMessageDataKey(a.Context, queries, row.ID, encrypted); err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
 	emailReceivers := []string{}
-	unsubscribeSecrets := []string{}
+	unsubscribeSecretHashes := []string{}
 	for _, emailReceiver := range param.EmailReceivers {
 		_, err := mail.ParseAddress(emailReceiver)
 		if err != nil {
@@ -41,18 +54,18 @@ func (a *APIForFrontend) InsertMessage(jwtRes secure.JWTResponse, param APIParam
 			res.ResponseMsg = "Inavlid receiver email: " + emailReceiver
 			return res, err
 		}
-		unsubscribeSecret, err := secure.GenerateRandomString(ExtensionSecretLength)
+		unsubscribeSecretHash, err := newSecretHash(hasher)
 		if err != nil {
 			res.StatusCode = http.StatusInternalServerError
 			return res, err
 		}
 		emailReceivers = append(emailReceivers, emailReceiver)
-		unsubscribeSecrets = append(unsubscribeSecrets, unsubscribeSecret)
+		unsubscribeSecretHashes = append(unsubscribeSecretHashes, unsubscribeSecretHash)
 	}
 	rcvRows, err := queries.UpsertReceivers(a.Context, data.UpsertReceiversParams{
-		MessageID:          row.ID,
-		EmailReceivers:     emailReceivers,
-		UnsubscribeSecrets: unsubscribeSecrets,
+		MessageID:               row.ID,
+		EmailReceivers:          emailReceivers,
+		UnsubscribeSecretHashes: unsubscribeSecretHashes,
 	})
 	if err != nil {
 		res.StatusCode = http.StatusInternalServerError
@@ -73,7 +86,6 @@ func (a *APIForFrontend) InsertMessage(jwtRes secure.JWTResponse, param APIParam
 		InactivePeriodDays:   row.InactivePeriodDays,
 		ReminderIntervalDays: row.ReminderIntervalDays,
 		IsActive:             row.IsActive,
-		ExtensionSecret:      row.ExtensionSecret,
 		InactiveAt:           row.InactiveAt,
 		NextReminderAt:       row.NextReminderAt,
 	}
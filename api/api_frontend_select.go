@@ -2,7 +2,6 @@ package api
 
 import (
 	"net/http"
-	"os"
 
 	"github.com/asendia/legacy-api/data"
 	"github.com/asendia/legacy-api/mail"
@@ -22,11 +21,15 @@ func (a *APIForFrontend) SelectMessagesByEmailCreator(jwtRes secure.JWTResponse)
 	if err != nil {
 		return res, err
 	}
+	keys, err := LoadMessageKeysFromEnv()
+	if err != nil {
+		return res, err
+	}
 	msgMap := map[uuid.UUID]*MessageData{}
 	msgs := []*MessageData{}
 	for _, row := range rows {
 		if msgMap[row.MsgID] == nil {
-			msgContent, err := DecryptMessageContent(row.MsgContentEncrypted, os.Getenv("ENCRYPTION_KEY"))
+			msgContent, err := DecryptMessageContent(a.Context, row.MsgContentEncrypted, row.DkWrappedKey.String, keys)
 			if err != nil {
 				return res, err
 			}
@@ -39,7 +42,6 @@ func (a *APIForFrontend) SelectMessagesByEmailCreator(jwtRes secure.JWTResponse)
 				InactivePeriodDays:   row.MsgInactivePeriodDays,
 				ReminderIntervalDays: row.MsgReminderIntervalDays,
 				IsActive:             row.MsgIsActive,
-				ExtensionSecret:      row.MsgExtensionSecret,
 				InactiveAt:           row.MsgInactiveAt,
 				NextReminderAt:       row.MsgNextReminderAt}
 			msgs = append(msgs, msgMap[row.MsgID])
@@ -3,7 +3,6 @@ package api
 import (
 	"fmt"
 	"net/http"
-	"os"
 
 	"github.com/asendia/legacy-api/data"
 	"github.com/asendia/legacy-api/secure"
@@ -11,29 +10,37 @@ import (
 
 func (a *APIForFrontend) UpdateMessage(jwtRes secure.JWTResponse, param APIParamUpdateMessage) (res APIResponse, err error) {
 	queries := data.New(a.Tx)
+	hasher, err := secure.LoadSecretHasherFromEnv()
+	if err != nil {
+		return res, err
+	}
 	// Refresh extension secret on every update
-	extensionSecret, err := secure.GenerateRandomString(ExtensionSecretLength)
+	extensionSecretHash, err := newSecretHash(hasher)
 	if err != nil {
 		return res, err
 	}
-	contentEncrypted, err := EncryptMessageContent(param.MessageContent, os.Getenv("ENCRYPTION_KEY"))
+	keys, err := LoadMessageKeysFromEnv()
 	if err != nil {
 		return res, err
 	}
-	unsubscribeSecrets := []string{}
+	encrypted, err := EncryptMessageContent(a.Context, param.MessageContent, keys)
+	if err != nil {
+		return res, err
+	}
+	unsubscribeSecretHashes := []string{}
 	for i := 0; i < len(param.EmailReceivers); i++ {
-		unsubscribeSecret, err := secure.GenerateRandomString(ExtensionSecretLength)
+		unsubscribeSecretHash, err := newSecretHash(hasher)
 		if err != nil {
 			return res, err
 		}
-		unsubscribeSecrets = append(unsubscribeSecrets, unsubscribeSecret)
+		unsubscribeSecretHashes = append(unsubscribeSecretHashes, unsubscribeSecretHash)
 	}
 	row, err := queries.UpdateMessage(a.Context, data.UpdateMessageParams{
-		ContentEncrypted:     contentEncrypted,
+		ContentEncrypted:     encrypted.ContentEncrypted,
 		InactivePeriodDays:   param.InactivePeriodDays,
 		ReminderIntervalDays: param.ReminderIntervalDays,
 		IsActive:             param.IsActive,
-		ExtensionSecret:      extensionSecret,
+		ExtensionSecretHash:  extensionSecretHash,
 		ID:                   param.ID,
 		EmailCreator:         jwtRes.Email,
 	})
@@ -42,10 +49,15 @@ func (a *APIForFrontend) UpdateMessage(jwtRes secure.JWTResponse, param APIParam
 		res.StatusCode = http.StatusInternalServerError
 		return res, err
 	}
+	if err = saveMessageDataKey(a.Context, queries, row.ID, encrypted); err != nil {
+		fmt.Printf("Failed to save message data key: %v", err)
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
 	_, err = queries.UpsertReceivers(a.Context, data.UpsertReceiversParams{
-		MessageID:          row.ID,
-		EmailReceivers:     param.EmailReceivers,
-		UnsubscribeSecrets: unsubscribeSecrets,
+		MessageID:               row.ID,
+		EmailReceivers:          param.EmailReceivers,
+		UnsubscribeSecretHashes: unsubscribeSecretHashes,
 	})
 	if err != nil {
 		fmt.Printf("Failed to UpsertReceivers: %v", err)
@@ -63,7 +75,6 @@ func (a *APIForFrontend) UpdateMessage(jwtRes secure.JWTResponse, param APIParam
 		InactivePeriodDays:   row.InactivePeriodDays,
 		ReminderIntervalDays: row.ReminderIntervalDays,
 		IsActive:             row.IsActive,
-		ExtensionSecret:      row.ExtensionSecret,
 		InactiveAt:           row.InactiveAt,
 		NextReminderAt:       row.NextReminderAt,
 	}
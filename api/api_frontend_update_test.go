@@ -46,7 +46,6 @@ func TestUpdateMessage(t *testing.T) {
 				InactivePeriodDays:   row.InactivePeriodDays,
 				ReminderIntervalDays: row.ReminderIntervalDays,
 				IsActive:             row.IsActive,
-				ExtensionSecret:      row.ExtensionSecret,
 				ID:                   row.ID,
 				EmailReceivers: []string{
 					"email-" + strconv.Itoa(id) + "-1@sejiwo.com",
@@ -105,7 +104,6 @@ func TestUpdateMessageDoNothing(t *testing.T) {
 			InactivePeriodDays:   row.InactivePeriodDays,
 			ReminderIntervalDays: row.ReminderIntervalDays,
 			IsActive:             row.IsActive,
-			ExtensionSecret:      row.ExtensionSecret,
 			ID:                   row.ID,
 			EmailReceivers:       row.EmailReceivers,
 		})
@@ -167,7 +165,6 @@ func TestUpdateMessageNoReceiver(t *testing.T) {
 				InactivePeriodDays:   row.InactivePeriodDays,
 				ReminderIntervalDays: row.ReminderIntervalDays,
 				IsActive:             row.IsActive,
-				ExtensionSecret:      row.ExtensionSecret,
 				ID:                   row.ID,
 				EmailReceivers:       []string{},
 			})
@@ -228,7 +225,6 @@ func BenchmarkUpdateMessage(b *testing.B) {
 				InactivePeriodDays:   row.InactivePeriodDays,
 				ReminderIntervalDays: row.ReminderIntervalDays,
 				IsActive:             row.IsActive,
-				ExtensionSecret:      row.ExtensionSecret,
 				ID:                   row.ID,
 				EmailReceivers:       rows[id].EmailReceivers,
 			})
@@ -9,16 +9,23 @@ import (
 )
 
 func (a *APIForFrontend) ExtendMessageInactiveAt(secret string, id uuid.UUID) (res APIResponse, err error) {
-	newSecret, err := secure.GenerateRandomString(ExtensionSecretLength)
+	hasher, err := secure.LoadSecretHasherFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	// The used secret & the secrets of the earlier reminders are invalidated, the next reminder email brings a new one
+	newSecretHash, err := newSecretHash(hasher)
 	if err != nil {
 		res.StatusCode = http.StatusInternalServerError
 		return res, err
 	}
 	queries := data.New(a.Tx)
 	row, err := queries.UpdateMessageExtendsInactiveAt(a.Context, data.UpdateMessageExtendsInactiveAtParams{
-		ExtensionSecret:   newSecret,
-		ID:                id,
-		ExtensionSecret_2: secret,
+		NewExtensionSecretHash: newSecretHash,
+		ID:                     id,
+		ExtensionSecretHash:    hasher.Hash(secret),
+		ExtensionSecret:        secret,
 	})
 	if err != nil {
 		res.StatusCode = http.StatusUnauthorized
@@ -33,7 +40,6 @@ func (a *APIForFrontend) ExtendMessageInactiveAt(secret string, id uuid.UUID) (r
 		InactivePeriodDays:   row.InactivePeriodDays,
 		ReminderIntervalDays: row.ReminderIntervalDays,
 		IsActive:             row.IsActive,
-		ExtensionSecret:      row.ExtensionSecret,
 		InactiveAt:           row.InactiveAt,
 		NextReminderAt:       row.NextReminderAt,
 	}
@@ -41,10 +47,16 @@ func (a *APIForFrontend) ExtendMessageInactiveAt(secret string, id uuid.UUID) (r
 }
 
 func (a *APIForFrontend) UnsubscribeMessage(secret string, messageID uuid.UUID) (res APIResponse, err error) {
+	hasher, err := secure.LoadSecretHasherFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
 	queries := data.New(a.Tx)
 	msgRcvr, err := queries.UpdateReceiverUnsubscribe(a.Context, data.UpdateReceiverUnsubscribeParams{
-		MessageID:         messageID,
-		UnsubscribeSecret: secret,
+		MessageID:             messageID,
+		UnsubscribeSecretHash: hasher.Hash(secret),
+		UnsubscribeSecret:     secret,
 	})
 	if err != nil {
 		res.StatusCode = http.StatusForbidden
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/asendia/legacy-api/secure"
 	"github.com/asendia/legacy-api/simple"
 )
 
@@ -32,13 +33,22 @@ func TestUpdateMessageExtendMessageInactiveAt(t *testing.T) {
 		return
 	}
 	row := res.Data.(MessageData)
-	err = tx.QueryRow(ctx, "UPDATE messages SET inactive_at = $1 WHERE id = $2 RETURNING inactive_at;",
-		simple.TimeTodayUTC().Add(simple.DaysToDuration(1)), row.ID).Scan(&row.InactiveAt)
+	hasher, err := secure.LoadSecretHasherFromEnv()
+	if err != nil {
+		t.Fatalf("Failed to load secret hasher: %v", err)
+	}
+	// Only the hash is stored, the secret is normally sent in the reminder email
+	secret, secretHash, err := hasher.GenerateHashedSecret(ExtensionSecretLength)
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	err = tx.QueryRow(ctx, "UPDATE messages SET inactive_at = $1, extension_secret_hash = $2 WHERE id = $3 RETURNING inactive_at;",
+		simple.TimeTodayUTC().Add(simple.DaysToDuration(1)), secretHash, row.ID).Scan(&row.InactiveAt)
 	if err != nil {
 		t.Errorf("Failed to update inactive_at: %v\n", err)
 		return
 	}
-	res, err = a.ExtendMessageInactiveAt(row.ExtensionSecret, row.ID)
+	res, err = a.ExtendMessageInactiveAt(secret, row.ID)
 	if err != nil {
 		t.Fatalf("ExtendMessage failed: %v", err)
 	}
@@ -55,7 +65,115 @@ func TestUpdateMessageExtendMessageInactiveAt(t *testing.T) {
 	if row.ID != msgRow.ID || inactiveDaysDiff >= 1 {
 		t.Errorf("Unexpected inactiveAt: %v expected: %v\n",
 			msgRow.InactiveAt, expectedInactiveAt)
-	} else if msgRow.ExtensionSecret == row.ExtensionSecret {
-		t.Errorf("Extension secret does not change: %s old: %s", msgRow.ExtensionSecret, row.ExtensionSecret)
+	}
+	var storedSecret, storedHash string
+	err = tx.QueryRow(ctx, "SELECT extension_secret, extension_secret_hash FROM messages WHERE id = $1", row.ID).
+		Scan(&storedSecret, &storedHash)
+	if err != nil {
+		t.Fatalf("Failed to select extension secret: %v", err)
+	}
+	if storedSecret != "" || storedHash == "" || storedHash == secretHash {
+		t.Errorf("Extension secret hash does not change: %s old: %s", storedHash, secretHash)
+	}
+	if _, err = a.ExtendMessageInactiveAt(secret, row.ID); err == nil {
+		t.Errorf("A used extension secret should be rejected")
+	}
+}
+
+func TestExtendMessageInactiveAtLegacyPlaintextSecret(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	a := APIForFrontend{Context: ctx, Tx: tx}
+	msg := generateMessageTemplate()
+	res, err := a.InsertMessage(
+		generateJwtMessageTemplate(msg.EmailCreator),
+		APIParamInsertMessage{
+			EmailReceivers:       msg.EmailReceivers,
+			MessageContent:       msg.MessageContent,
+			InactivePeriodDays:   msg.InactivePeriodDays,
+			ReminderIntervalDays: msg.ReminderIntervalDays,
+		})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	row := res.Data.(MessageData)
+	// A row written before the hashes existed, its secret is in an email already sent
+	secret, err := secure.GenerateRandomString(ExtensionSecretLength)
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	_, err = tx.Exec(ctx, "UPDATE messages SET extension_secret = $1, extension_secret_hash = '' WHERE id = $2", secret, row.ID)
+	if err != nil {
+		t.Fatalf("Failed to set plaintext secret: %v", err)
+	}
+	if _, err = a.ExtendMessageInactiveAt("wrong-secret", row.ID); err == nil {
+		t.Errorf("A wrong extension secret should be rejected")
+	}
+	if _, err = a.ExtendMessageInactiveAt(secret, row.ID); err != nil {
+		t.Fatalf("ExtendMessage with legacy secret failed: %v", err)
+	}
+	var storedSecret, storedHash string
+	err = tx.QueryRow(ctx, "SELECT extension_secret, extension_secret_hash FROM messages WHERE id = $1", row.ID).
+		Scan(&storedSecret, &storedHash)
+	if err != nil {
+		t.Fatalf("Failed to select extension secret: %v", err)
+	}
+	if storedSecret != "" || storedHash == "" {
+		t.Errorf("Plaintext secret should be replaced by a hash, secret: %s hash: %s", storedSecret, storedHash)
+	}
+}
+
+func TestUnsubscribeMessage(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	a := APIForFrontend{Context: ctx, Tx: tx}
+	msg := generateMessageTemplate()
+	res, err := a.InsertMessage(
+		generateJwtMessageTemplate(msg.EmailCreator),
+		APIParamInsertMessage{
+			EmailReceivers:       msg.EmailReceivers,
+			MessageContent:       msg.MessageContent,
+			InactivePeriodDays:   msg.InactivePeriodDays,
+			ReminderIntervalDays: msg.ReminderIntervalDays,
+		})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	row := res.Data.(MessageData)
+	hasher, err := secure.LoadSecretHasherFromEnv()
+	if err != nil {
+		t.Fatalf("Failed to load secret hasher: %v", err)
+	}
+	secret, secretHash, err := hasher.GenerateHashedSecret(ExtensionSecretLength)
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	_, err = tx.Exec(ctx, "UPDATE messages_email_receivers SET unsubscribe_secret_hash = $1 WHERE message_id = $2 AND email_receiver = $3",
+		secretHash, row.ID, msg.EmailReceivers[0])
+	if err != nil {
+		t.Fatalf("Failed to set unsubscribe secret hash: %v", err)
+	}
+	if _, err = a.UnsubscribeMessage(secretHash, row.ID); err == nil {
+		t.Errorf("The stored hash should not be accepted as a secret")
+	}
+	if _, err = a.UnsubscribeMessage(secret, row.ID); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+	var isUnsubscribed bool
+	err = tx.QueryRow(ctx, "SELECT is_unsubscribed FROM messages_email_receivers WHERE message_id = $1 AND email_receiver = $2",
+		row.ID, msg.EmailReceivers[0]).Scan(&isUnsubscribed)
+	if err != nil {
+		t.Fatalf("Failed to select receiver: %v", err)
+	}
+	if !isUnsubscribed {
+		t.Errorf("Receiver should be unsubscribed")
 	}
 }
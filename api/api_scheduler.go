@@ -2,11 +2,37 @@ package api
 
 import (
 	"context"
+	"time"
 
+	"github.com/asendia/legacy-api/mail"
 	"github.com/jackc/pgx/v5"
 )
 
+// TxBeginner is satisfied by *pgxpool.Pool, and by pgx.Tx through savepoints
+type TxBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
 type APIForScheduler struct {
 	Context context.Context
 	Tx      pgx.Tx
+	// DB is used by the actions that need their own short transactions,
+	// e.g. DispatchEmailOutbox
+	DB TxBeginner
+	// Options of the run, the zero value is the default run
+	Params SchedulerParams
+	// The actions draining the due messages stop starting chunks when it is near, zero means no deadline
+	Deadline time.Time
+	// Sends the outbox emails, the vendors configured by the envs with their daily quotas in DB if nil
+	Mail mail.Sender
+}
+
+func (a *APIForScheduler) sendEmails(mails []mail.MailItem) []mail.SendEmailsResponse {
+	if a.Mail == nil {
+		cfg := mail.LoadSendMailConfigFromEnv()
+		cfg.Quota = PostgresQuotaStore{DB: a.DB}
+		cfg.Context = a.Context
+		return cfg.SendEmails(mails)
+	}
+	return a.Mail.SendEmails(mails)
 }
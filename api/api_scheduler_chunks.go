@@ -0,0 +1,85 @@
+package api
+
+import (
+	"time"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/google/uuid"
+)
+
+// No chunk is started when less than twice the longest chunk, or this, is left before the deadline
+const minChunkTimeLeft = time.Second
+
+// SchedulerRunSummary is the result of the actions which drain the due messages in chunks
+type SchedulerRunSummary struct {
+	Chunks   int `json:"chunks"`
+	Messages int `json:"messages"`
+	Queued   int `json:"queued"`
+	// Emails which could not be generated, their messages stay due
+	Skipped int `json:"skipped"`
+	// Due messages left for the next run
+	Remaining int64 `json:"remaining"`
+	// True when the run stopped early because its deadline was near
+	IsStopped bool `json:"isStopped"`
+	// The messages processed by the chunks & the emails they queued, for the dry run report
+	messageIDs   []uuid.UUID
+	queuedEmails []data.EmailOutbox
+}
+
+// messageCursor is the position of the last message of a chunk in the (created_at, id) order
+type messageCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+type chunkFunc func(queries *data.Queries, after messageCursor) (count int, last messageCursor, err error)
+
+// drainInChunks commits every chunk in its own transaction until a chunk is not full or the deadline is near,
+// the returned cursor is the last message processed
+func (a *APIForScheduler) drainInChunks(summary *SchedulerRunSummary, chunk chunkFunc) (last messageCursor, err error) {
+	var longestChunk time.Duration
+	for {
+		if a.isDeadlineNear(longestChunk) {
+			summary.IsStopped = true
+			return last, nil
+		}
+		startedAt := time.Now()
+		tx, err := a.DB.Begin(a.Context)
+		if err != nil {
+			return last, err
+		}
+		count, chunkLast, err := chunk(data.New(tx), last)
+		if err == nil {
+			err = tx.Commit(a.Context)
+		}
+		tx.Rollback(a.Context)
+		if err != nil {
+			return last, err
+		}
+		summary.Chunks++
+		summary.Messages += count
+		if count > 0 {
+			last = chunkLast
+		}
+		if d := time.Since(startedAt); d > longestChunk {
+			longestChunk = d
+		}
+		if count < int(a.Params.batchSize()) {
+			return last, nil
+		}
+	}
+}
+
+func (a *APIForScheduler) isDeadlineNear(longestChunk time.Duration) bool {
+	if a.Context.Err() != nil {
+		return true
+	}
+	if a.Deadline.IsZero() {
+		return false
+	}
+	timeLeft := 2 * longestChunk
+	if timeLeft < minChunkTimeLeft {
+		timeLeft = minChunkTimeLeft
+	}
+	return time.Until(a.Deadline) < timeLeft
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/asendia/legacy-api/simple"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+func TestSendReminderMessagesInChunks(t *testing.T) {
+	t.Setenv("SERVERLESS_FUNCTION_SOURCE_CODE", "../mail/")
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	msgIDs, _ := insertDueMessages(t, ctx, tx, 3, "next_reminder_at")
+	// The deadline has passed, nothing is started
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx, Params: SchedulerParams{BatchSize: 1, MessageIDs: msgIDs},
+		Deadline: time.Now()}
+	res, err := a.SendReminderMessages()
+	if err != nil {
+		t.Fatalf("SendReminderMessages failed: %v", err)
+	}
+	summary := res.Data.(*SchedulerRunSummary)
+	if !summary.IsStopped || summary.Messages != 0 || summary.Remaining != 3 {
+		t.Fatalf("Run past its deadline should stop with every message remaining: %+v", summary)
+	}
+	a.Deadline = time.Time{}
+	res, err = a.SendReminderMessages()
+	if err != nil {
+		t.Fatalf("SendReminderMessages failed: %v", err)
+	}
+	summary = res.Data.(*SchedulerRunSummary)
+	if summary.IsStopped || summary.Chunks != 4 || summary.Messages != 3 || summary.Queued != 3 || summary.Remaining != 0 {
+		t.Fatalf("Every message should be drained one chunk at a time: %+v", summary)
+	}
+}
+
+func TestSendTestamentsInMessageAlignedChunks(t *testing.T) {
+	t.Setenv("SERVERLESS_FUNCTION_SOURCE_CODE", "../mail/")
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	msgIDs, receiversCount := insertDueMessages(t, ctx, tx, 2, "inactive_at")
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx, Params: SchedulerParams{BatchSize: 1, MessageIDs: msgIDs}}
+	res, err := a.SendTestamentsOfInactiveMessages()
+	if err != nil {
+		t.Fatalf("SendTestamentsOfInactiveMessages failed: %v", err)
+	}
+	// Every receiver of a message is in the chunk of its message
+	summary := res.Data.(*SchedulerRunSummary)
+	if summary.Chunks != 3 || summary.Messages != 2 || summary.Queued != receiversCount || summary.Remaining != 0 {
+		t.Fatalf("Expected 2 messages & %d testaments in 3 chunks: %+v", receiversCount, summary)
+	}
+}
+
+// insertDueMessages inserts messages whose dateColumn is 2 days ago & returns their ids & receivers count
+func insertDueMessages(t *testing.T, ctx context.Context, tx pgx.Tx, count int, dateColumn string) (msgIDs []uuid.UUID, receiversCount int) {
+	aFe := APIForFrontend{Context: ctx, Tx: tx}
+	for i := 0; i < count; i++ {
+		msg := generateMessageTemplate()
+		res, err := aFe.InsertMessage(
+			generateJwtMessageTemplate(msg.EmailCreator),
+			APIParamInsertMessage{
+				EmailReceivers:       msg.EmailReceivers,
+				MessageContent:       msg.MessageContent,
+				InactivePeriodDays:   msg.InactivePeriodDays,
+				ReminderIntervalDays: msg.ReminderIntervalDays,
+			})
+		if err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		row := res.Data.(MessageData)
+		_, err = tx.Exec(ctx, "UPDATE messages SET "+dateColumn+" = $1 WHERE id = $2",
+			simple.TimeTodayUTC().Add(-simple.DaysToDuration(2)), row.ID)
+		if err != nil {
+			t.Fatalf("Failed to update %s: %v", dateColumn, err)
+		}
+		msgIDs = append(msgIDs, row.ID)
+		receiversCount += len(msg.EmailReceivers)
+	}
+	return msgIDs, receiversCount
+}
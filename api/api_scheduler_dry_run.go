@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/mail"
+	"github.com/google/uuid"
+)
+
+var ErrDryRunAction = errors.New("dry run report is only available for send-reminder-messages & send-testaments")
+
+// DryRunReport is what a run would do: the messages with their state before & after it, and the emails it would send
+type DryRunReport struct {
+	Action   string               `json:"action"`
+	Summary  *SchedulerRunSummary `json:"summary"`
+	Messages []DryRunMessage      `json:"messages"`
+	Emails   []DryRunEmail        `json:"emails"`
+}
+
+type DryRunMessage struct {
+	ID           uuid.UUID    `json:"id"`
+	EmailCreator string       `json:"emailCreator"`
+	Before       MessageState `json:"before"`
+	After        MessageState `json:"after"`
+	// The testament deliveries after the run
+	Deliveries []DryRunDelivery `json:"deliveries,omitempty"`
+}
+
+type MessageState struct {
+	IsActive       bool   `json:"isActive"`
+	InactiveAt     string `json:"inactiveAt"`
+	NextReminderAt string `json:"nextReminderAt"`
+	SentCounter    int32  `json:"sentCounter"`
+}
+
+type DryRunDelivery struct {
+	EmailReceiver string `json:"emailReceiver"`
+	Status        string `json:"status"`
+	Attempt       int32  `json:"attempt"`
+}
+
+// DryRunEmail is a rendered email which was captured instead of sent
+type DryRunEmail struct {
+	IdempotencyKey string   `json:"idempotencyKey"`
+	To             []string `json:"to"`
+	Subject        string   `json:"subject"`
+}
+
+func newMessageState(msg data.Message) MessageState {
+	return MessageState{
+		IsActive:       msg.IsActive,
+		InactiveAt:     msg.InactiveAt.Format("2006-01-02"),
+		NextReminderAt: msg.NextReminderAt.Format("2006-01-02"),
+		SentCounter:    msg.SentCounter,
+	}
+}
+
+// DryRun runs send-reminder-messages or send-testaments & dispatches the emails it queued to a capturing vendor,
+// everything is done in a savepoint of a.Tx which is rolled back. The due messages are read without claiming them
+// & only the emails queued by the run are dispatched, the rows claimed by the other runs are left alone.
+func (a *APIForScheduler) DryRun(action string) (res APIResponse, err error) {
+	keys, err := LoadMessageKeysFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to load encryption keys"
+		return res, err
+	}
+	sp, err := a.Tx.Begin(a.Context)
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	defer sp.Rollback(a.Context)
+	sender, capture := mail.NewCapturingSender()
+	dry := *a
+	dry.Tx, dry.DB, dry.Mail = sp, sp, sender
+	dry.Params.DryRun = true
+	var actionRes APIResponse
+	switch action {
+	case "send-reminder-messages":
+		actionRes, err = dry.SendReminderMessages()
+	case "send-testaments":
+		actionRes, err = dry.SendTestamentsOfInactiveMessages()
+	default:
+		res.StatusCode = http.StatusBadRequest
+		return res, ErrDryRunAction
+	}
+	if err != nil {
+		return actionRes, err
+	}
+	summary := actionRes.Data.(*SchedulerRunSummary)
+	dry.dispatchOutboxRows(summary.queuedEmails, keys)
+	report := DryRunReport{Action: action, Summary: summary, Messages: []DryRunMessage{}, Emails: []DryRunEmail{}}
+	queries := data.New(sp)
+	after, err := queries.SelectMessagesByIDs(a.Context, summary.messageIDs)
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	isReported := map[string]bool{}
+	for _, msg := range after {
+		isReported[msg.ID.String()] = true
+		reportMsg := DryRunMessage{ID: msg.ID, EmailCreator: msg.EmailCreator, After: newMessageState(msg)}
+		deliveries, err := queries.SelectTestamentDeliveries(a.Context, msg.ID)
+		if err != nil {
+			res.StatusCode = http.StatusInternalServerError
+			return res, err
+		}
+		for _, delivery := range deliveries {
+			reportMsg.Deliveries = append(reportMsg.Deliveries, DryRunDelivery{
+				EmailReceiver: delivery.EmailReceiver,
+				Status:        delivery.Status,
+				Attempt:       delivery.Attempt,
+			})
+		}
+		report.Messages = append(report.Messages, reportMsg)
+	}
+	for _, item := range capture.Mails() {
+		// The idempotency key is "<kind>:<message id>:..."
+		if parts := strings.SplitN(item.IdempotencyKey, ":", 3); len(parts) < 2 || !isReported[parts[1]] {
+			continue
+		}
+		email := DryRunEmail{IdempotencyKey: item.IdempotencyKey, To: []string{}, Subject: item.Subject}
+		for _, to := range item.To {
+			email.To = append(email.To, to.Email)
+		}
+		report.Emails = append(report.Emails, email)
+	}
+	// The state before the run, once the savepoint is rolled back
+	if err = sp.Rollback(a.Context); err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	before, err := data.New(a.Tx).SelectMessagesByIDs(a.Context, summary.messageIDs)
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	for _, msg := range before {
+		for id := range report.Messages {
+			if report.Messages[id].ID == msg.ID {
+				report.Messages[id].Before = newMessageState(msg)
+			}
+		}
+	}
+	res.StatusCode = http.StatusOK
+	res.ResponseMsg = "Dry run rolled back, nothing is sent"
+	res.Data = &report
+	return res, nil
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/asendia/legacy-api/data"
+)
+
+func TestDryRunSendTestaments(t *testing.T) {
+	t.Setenv("SERVERLESS_FUNCTION_SOURCE_CODE", "../mail/")
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	msgIDs, receiversCount := insertDueMessages(t, ctx, tx, 2, "inactive_at")
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx, Params: SchedulerParams{BatchSize: 1, MessageIDs: msgIDs}}
+	res, err := a.DryRun("send-testaments")
+	if err != nil {
+		t.Fatalf("DryRun failed: %v", err)
+	}
+	report := res.Data.(*DryRunReport)
+	if report.Summary.Messages != 2 || len(report.Messages) != 2 || len(report.Emails) != receiversCount {
+		t.Fatalf("Expected 2 messages & %d emails in the report: %+v", receiversCount, report)
+	}
+	for _, msg := range report.Messages {
+		// Every receiver got the testament, so the message is deactivated
+		if !msg.Before.IsActive || msg.After.IsActive || msg.After.SentCounter != msg.Before.SentCounter+1 ||
+			len(msg.Deliveries) != 2 || msg.Deliveries[0].Status != DeliveryStatusSent {
+			t.Fatalf("Unexpected transition: %+v", msg)
+		}
+	}
+	if email := report.Emails[0]; email.Subject != "Message from "+report.Messages[0].EmailCreator+" sent by sejiwo.com" ||
+		len(email.To) != 1 {
+		t.Fatalf("Unexpected email: %+v", email)
+	}
+	// Nothing is kept
+	queries := data.New(tx)
+	msgs, err := queries.SelectMessagesByIDs(ctx, msgIDs)
+	if err != nil {
+		t.Fatalf("SelectMessagesByIDs failed: %v", err)
+	}
+	for _, msg := range msgs {
+		outboxRows, err := queries.SelectEmailOutboxByMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatalf("Select email outbox failed: %v", err)
+		}
+		if !msg.IsActive || msg.SentCounter != 0 || len(outboxRows) != 0 {
+			t.Fatalf("The dry run should be rolled back: %+v %+v", msg, outboxRows)
+		}
+	}
+	if _, err = a.DryRun("dispatch-emails"); err != ErrDryRunAction {
+		t.Fatalf("Only the message actions have a dry run report, got: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
+)
+
+type HashSecretsResult struct {
+	ExtensionSecrets   int `json:"extensionSecrets"`
+	UnsubscribeSecrets int `json:"unsubscribeSecrets"`
+}
+
+// HashStoredSecrets replaces the plaintext secrets stored before the hashes existed,
+// the links of emails already sent keep working. Every batch is committed on its own.
+func (a *APIForScheduler) HashStoredSecrets() (res APIResponse, err error) {
+	hasher, err := secure.LoadSecretHasherFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to load secret pepper"
+		return res, err
+	}
+	result := HashSecretsResult{}
+	batchSize := int(a.Params.batchSize())
+	// Hashed rows leave the selection, so every batch selects the next plaintext ones
+	for count := batchSize; err == nil && count == batchSize; {
+		count, err = a.inBatchTx(func(queries *data.Queries) (int, error) {
+			return a.hashExtensionSecretsBatch(queries, hasher)
+		})
+		result.ExtensionSecrets += count
+	}
+	for count := batchSize; err == nil && count == batchSize; {
+		count, err = a.inBatchTx(func(queries *data.Queries) (int, error) {
+			return a.hashUnsubscribeSecretsBatch(queries, hasher)
+		})
+		result.UnsubscribeSecrets += count
+	}
+	res.Data = result
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to hash stored secrets"
+		return res, err
+	}
+	res.StatusCode = http.StatusOK
+	res.ResponseMsg = "Stored secrets hashed successfully"
+	return res, nil
+}
+
+func (a *APIForScheduler) inBatchTx(batchFunc func(queries *data.Queries) (int, error)) (int, error) {
+	tx, err := a.DB.Begin(a.Context)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(a.Context)
+	count, err := batchFunc(data.New(tx))
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit(a.Context)
+}
+
+func (a *APIForScheduler) hashExtensionSecretsBatch(queries *data.Queries, hasher secure.SecretHasher) (int, error) {
+	rows, err := queries.SelectMessagesWithPlaintextSecret(a.Context, a.Params.batchSize())
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		// Skipped when the secret has been used or refreshed since the select
+		err = queries.BackfillMessageExtensionSecretHash(a.Context, data.BackfillMessageExtensionSecretHashParams{
+			ExtensionSecretHash: hasher.Hash(row.ExtensionSecret),
+			ID:                  row.ID,
+			ExtensionSecret:     row.ExtensionSecret,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+func (a *APIForScheduler) hashUnsubscribeSecretsBatch(queries *data.Queries, hasher secure.SecretHasher) (int, error) {
+	rows, err := queries.SelectReceiversWithPlaintextSecret(a.Context, a.Params.batchSize())
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		err = queries.BackfillReceiverUnsubscribeSecretHash(a.Context, data.BackfillReceiverUnsubscribeSecretHashParams{
+			UnsubscribeSecretHash: hasher.Hash(row.UnsubscribeSecret),
+			MessageID:             row.MessageID,
+			EmailReceiver:         row.EmailReceiver,
+			UnsubscribeSecret:     row.UnsubscribeSecret,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+// legacySecretHash hashes the plaintext secret of a row which is not backfilled yet, empty when there is none
+func legacySecretHash(hasher secure.SecretHasher, plaintextSecret string) string {
+	if plaintextSecret == "" {
+		return ""
+	}
+	return hasher.Hash(plaintextSecret)
+}
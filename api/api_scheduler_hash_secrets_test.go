@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
+	"github.com/asendia/legacy-api/simple"
+)
+
+var linkSecretRegexp = regexp.MustCompile(`secret=([0-9A-Za-z-]{69})`)
+
+func TestSendReminderMessagesIssuesExtensionSecret(t *testing.T) {
+	t.Setenv("SERVERLESS_FUNCTION_SOURCE_CODE", "../mail/")
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	aFe := APIForFrontend{Context: ctx, Tx: tx}
+	msg := generateMessageTemplate()
+	res, err := aFe.InsertMessage(
+		generateJwtMessageTemplate(msg.EmailCreator),
+		APIParamInsertMessage{
+			EmailReceivers:       msg.EmailReceivers,
+			MessageContent:       msg.MessageContent,
+			InactivePeriodDays:   msg.InactivePeriodDays,
+			ReminderIntervalDays: msg.ReminderIntervalDays,
+		})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	row := res.Data.(MessageData)
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx}
+	// Two reminders, each brings a new secret
+	reminderDays := []time.Time{
+		simple.TimeTodayUTC().Add(-simple.DaysToDuration(2)),
+		simple.TimeTodayUTC().Add(-simple.DaysToDuration(1)),
+	}
+	for _, day := range reminderDays {
+		_, err = tx.Exec(ctx, `UPDATE messages SET next_reminder_at = $1 WHERE id = $2`, day, row.ID)
+		if err != nil {
+			t.Fatalf("Failed to update next_reminder_at: %v", err)
+		}
+		if _, err = a.SendReminderMessages(); err != nil {
+			t.Fatalf("SendReminderMessages failed: %v", err)
+		}
+	}
+	outboxRows, err := data.New(tx).SelectEmailOutboxByMessage(ctx, row.ID)
+	if err != nil || len(outboxRows) != 2 {
+		t.Fatalf("Expected two reminders in the outbox: %v %+v", err, outboxRows)
+	}
+	keys, err := LoadMessageKeysFromEnv()
+	if err != nil {
+		t.Fatalf("Cannot load encryption keys: %v", err)
+	}
+	secrets := map[string]string{}
+	for _, outboxRow := range outboxRows {
+		if linkSecretRegexp.MatchString(outboxRow.MailItemSealed) || string(outboxRow.MailItem) != "{}" {
+			t.Fatalf("The extension link should not be stored in plaintext: %+v", outboxRow)
+		}
+		mailItem, err := openMailItem(ctx, outboxRow, keys)
+		if err != nil {
+			t.Fatalf("Cannot open the sealed reminder: %v", err)
+		}
+		matches := linkSecretRegexp.FindStringSubmatch(mailItem.HtmlContent)
+		if matches == nil {
+			t.Fatalf("Reminder email has no extension link: %s", mailItem.HtmlContent)
+		}
+		secrets[outboxRow.IdempotencyKey] = matches[1]
+	}
+	var storedSecret string
+	err = tx.QueryRow(ctx, "SELECT extension_secret FROM messages WHERE id = $1", row.ID).Scan(&storedSecret)
+	if err != nil {
+		t.Fatalf("Failed to select extension secret: %v", err)
+	}
+	if storedSecret != "" {
+		t.Errorf("Plaintext extension secret should not be stored: %s", storedSecret)
+	}
+	firstSecret := secrets[outboxIdempotencyKey(EmailKindReminder, row.ID, reminderDays[0].Format("2006-01-02"))]
+	secondSecret := secrets[outboxIdempotencyKey(EmailKindReminder, row.ID, reminderDays[1].Format("2006-01-02"))]
+	if firstSecret == "" || firstSecret == secondSecret {
+		t.Fatalf("Each reminder should bring its own secret: %+v", secrets)
+	}
+	// The link of the first reminder still works after the second one is sent
+	if _, err = aFe.ExtendMessageInactiveAt(firstSecret, row.ID); err != nil {
+		t.Errorf("The secret of the first reminder link should extend the message: %v", err)
+	}
+	if _, err = aFe.ExtendMessageInactiveAt(secondSecret, row.ID); err == nil {
+		t.Errorf("An extension should invalidate the secrets of every reminder")
+	}
+}
+
+func TestHashStoredSecrets(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	aFe := APIForFrontend{Context: ctx, Tx: tx}
+	msg := generateMessageTemplate()
+	res, err := aFe.InsertMessage(
+		generateJwtMessageTemplate(msg.EmailCreator),
+		APIParamInsertMessage{
+			EmailReceivers:       msg.EmailReceivers,
+			MessageContent:       msg.MessageContent,
+			InactivePeriodDays:   msg.InactivePeriodDays,
+			ReminderIntervalDays: msg.ReminderIntervalDays,
+		})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	row := res.Data.(MessageData)
+	// Rows written before the hashes existed
+	extensionSecret, _ := secure.GenerateRandomString(ExtensionSecretLength)
+	unsubscribeSecret, _ := secure.GenerateRandomString(ExtensionSecretLength)
+	_, err = tx.Exec(ctx, "UPDATE messages SET extension_secret = $1, extension_secret_hash = '' WHERE id = $2",
+		extensionSecret, row.ID)
+	if err != nil {
+		t.Fatalf("Failed to set plaintext extension secret: %v", err)
+	}
+	_, err = tx.Exec(ctx, "UPDATE messages_email_receivers SET unsubscribe_secret = $1, unsubscribe_secret_hash = '' WHERE message_id = $2",
+		unsubscribeSecret, row.ID)
+	if err != nil {
+		t.Fatalf("Failed to set plaintext unsubscribe secrets: %v", err)
+	}
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx}
+	res, err = a.HashStoredSecrets()
+	if err != nil {
+		t.Fatalf("HashStoredSecrets failed: %v", err)
+	}
+	result := res.Data.(HashSecretsResult)
+	if result.ExtensionSecrets < 1 || result.UnsubscribeSecrets < len(msg.EmailReceivers) {
+		t.Errorf("Unexpected hashed secrets count: %+v", result)
+	}
+	var plaintextCount int
+	err = tx.QueryRow(ctx, `SELECT
+  (SELECT count(*) FROM messages WHERE id = $1 AND extension_secret <> '') +
+  (SELECT count(*) FROM messages_email_receivers WHERE message_id = $1 AND unsubscribe_secret <> '')`,
+		row.ID).Scan(&plaintextCount)
+	if err != nil {
+		t.Fatalf("Failed to count plaintext secrets: %v", err)
+	}
+	if plaintextCount != 0 {
+		t.Errorf("Plaintext secrets should be removed, found: %d", plaintextCount)
+	}
+	// The links of emails sent before the backfill keep working
+	if _, err = aFe.ExtendMessageInactiveAt(extensionSecret, row.ID); err != nil {
+		t.Errorf("ExtendMessage with backfilled secret failed: %v", err)
+	}
+	if _, err = aFe.UnsubscribeMessage(unsubscribeSecret, row.ID); err != nil {
+		t.Errorf("Unsubscribe with backfilled secret failed: %v", err)
+	}
+}
+
+func TestSendReminderMessagesKeepsLegacySecret(t *testing.T) {
+	t.Setenv("SERVERLESS_FUNCTION_SOURCE_CODE", "../mail/")
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	aFe := APIForFrontend{Context: ctx, Tx: tx}
+	msg := generateMessageTemplate()
+	res, err := aFe.InsertMessage(
+		generateJwtMessageTemplate(msg.EmailCreator),
+		APIParamInsertMessage{
+			EmailReceivers:       msg.EmailReceivers,
+			MessageContent:       msg.MessageContent,
+			InactivePeriodDays:   msg.InactivePeriodDays,
+			ReminderIntervalDays: msg.ReminderIntervalDays,
+		})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	row := res.Data.(MessageData)
+	// A row written before the hashes existed, hash-secrets has not run yet
+	extensionSecret, _ := secure.GenerateRandomString(ExtensionSecretLength)
+	_, err = tx.Exec(ctx, `UPDATE messages SET extension_secret = $1, extension_secret_hash = '', next_reminder_at = $2
+WHERE id = $3`, extensionSecret, simple.TimeTodayUTC().Add(-simple.DaysToDuration(1)), row.ID)
+	if err != nil {
+		t.Fatalf("Failed to set plaintext extension secret: %v", err)
+	}
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx}
+	if _, err = a.SendReminderMessages(); err != nil {
+		t.Fatalf("SendReminderMessages failed: %v", err)
+	}
+	var storedSecret string
+	err = tx.QueryRow(ctx, "SELECT extension_secret FROM messages WHERE id = $1", row.ID).Scan(&storedSecret)
+	if err != nil || storedSecret != "" {
+		t.Fatalf("The plaintext secret should be removed by the reminder: %q %v", storedSecret, err)
+	}
+	// The link of an email sent before the migration still works
+	if _, err = aFe.ExtendMessageInactiveAt(extensionSecret, row.ID); err != nil {
+		t.Errorf("The legacy secret should extend the message: %v", err)
+	}
+}
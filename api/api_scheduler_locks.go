@@ -0,0 +1,15 @@
+package api
+
+import "github.com/asendia/legacy-api/data"
+
+const schedulerLockPrefix = "scheduler:"
+
+// LockAction takes the advisory lock of the action until the run transaction ends, false if a conflicting run holds it.
+// Runs share the lock & split the due messages, an exclusive run is the only run of its action.
+func (a *APIForScheduler) LockAction(action string) (isLocked bool, err error) {
+	queries := data.New(a.Tx)
+	if a.Params.Exclusive {
+		return queries.TryAdvisoryXactLock(a.Context, schedulerLockPrefix+action)
+	}
+	return queries.TryAdvisoryXactLockShared(a.Context, schedulerLockPrefix+action)
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestLockAction(t *testing.T) {
+	ctx := context.Background()
+	begin := func() *APIForScheduler {
+		tx, err := pgxPoolConn.Begin(ctx)
+		if err != nil {
+			t.Fatalf("Cannot begin transaction: %v", err)
+		}
+		t.Cleanup(func() { tx.Rollback(ctx) })
+		return &APIForScheduler{Context: ctx, Tx: tx}
+	}
+	lock := func(a *APIForScheduler, action string, exclusive bool) bool {
+		a.Params.Exclusive = exclusive
+		isLocked, err := a.LockAction(action)
+		if err != nil {
+			t.Fatalf("LockAction failed: %v", err)
+		}
+		return isLocked
+	}
+	a1, a2, a3 := begin(), begin(), begin()
+	if !lock(a1, "send-reminder-messages", false) || !lock(a2, "send-reminder-messages", false) {
+		t.Fatalf("Runs should share the lock of an action")
+	}
+	if lock(a3, "send-reminder-messages", true) {
+		t.Fatalf("An exclusive run should be skipped while other runs hold the lock")
+	}
+	if !lock(a3, "send-testaments", true) {
+		t.Fatalf("The lock of another action should be free")
+	}
+	if lock(a1, "send-testaments", false) {
+		t.Fatalf("A run should be skipped while an exclusive run holds the lock")
+	}
+	// The lock is released with the run transaction
+	a3.Tx.Rollback(ctx)
+	if !lock(a1, "send-testaments", false) {
+		t.Fatalf("The lock should be released after the exclusive run")
+	}
+}
+
+func TestConcurrentSchedulerRuns(t *testing.T) {
+	t.Setenv("SERVERLESS_FUNCTION_SOURCE_CODE", "../mail/")
+	ctx := context.Background()
+	// The runs only see committed messages, they are deleted at the end
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	msgIDs, _ := insertDueMessages(t, ctx, tx, 6, "next_reminder_at")
+	if err = tx.Commit(ctx); err != nil {
+		t.Fatalf("Cannot commit the messages: %v", err)
+	}
+	defer deleteCommittedMessages(t, ctx, msgIDs)
+	// Each run holds a connection for its transaction & takes another one per chunk, 6 of the 8 connections of the pool
+	const workers = 3
+	dbCfg := data.LoadDBURLConfig()
+	dbCfg.PoolMaxConns = 8
+	pool, err := data.ConnectDB(ctx, dbCfg)
+	if err != nil {
+		t.Fatalf("Cannot connect to DB: %v", err)
+	}
+	defer pool.Close()
+	summaries := make([]*SchedulerRunSummary, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			summaries[i], errs[i] = runSendReminderMessages(ctx, pool, SchedulerParams{BatchSize: 1, MessageIDs: msgIDs})
+		}(i)
+	}
+	wg.Wait()
+	messages, queued := 0, 0
+	for i := 0; i < workers; i++ {
+		if errs[i] != nil {
+			t.Fatalf("Run %d failed: %v", i, errs[i])
+		}
+		messages += summaries[i].Messages
+		queued += summaries[i].Queued
+	}
+	// Every message is claimed by exactly one run
+	if messages != len(msgIDs) || queued != len(msgIDs) {
+		t.Fatalf("Expected %d messages & reminders in total, got: %d messages, %d reminders", len(msgIDs), messages, queued)
+	}
+	var outboxCount int
+	err = pgxPoolConn.QueryRow(ctx, "SELECT COUNT(*) FROM email_outbox WHERE message_id = ANY ($1) AND kind = $2",
+		msgIDs, EmailKindReminder).Scan(&outboxCount)
+	if err != nil {
+		t.Fatalf("Cannot count the queued reminders: %v", err)
+	}
+	if outboxCount != len(msgIDs) {
+		t.Fatalf("Expected %d queued reminders, got: %d", len(msgIDs), outboxCount)
+	}
+	// Nothing is left for a later run
+	summary, err := runSendReminderMessages(ctx, pool, SchedulerParams{MessageIDs: msgIDs})
+	if err != nil || summary.Messages != 0 {
+		t.Fatalf("Every message should already be reminded: %+v %v", summary, err)
+	}
+}
+
+// runSendReminderMessages runs send-reminder-messages like the scheduler, with its own transaction & chunks
+func runSendReminderMessages(ctx context.Context, pool *pgxpool.Pool, params SchedulerParams) (*SchedulerRunSummary, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: pool, Params: params}
+	if _, err = a.LockAction("send-reminder-messages"); err != nil {
+		return nil, err
+	}
+	res, err := a.SendReminderMessages()
+	if err != nil {
+		return nil, err
+	}
+	return res.Data.(*SchedulerRunSummary), tx.Commit(ctx)
+}
+
+// deleteCommittedMessages deletes the messages with their creators & receivers
+func deleteCommittedMessages(t *testing.T, ctx context.Context, msgIDs []uuid.UUID) {
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	var receivers []string
+	err = tx.QueryRow(ctx, "SELECT array_agg(email_receiver) FROM messages_email_receivers WHERE message_id = ANY ($1)",
+		msgIDs).Scan(&receivers)
+	if err != nil {
+		t.Fatalf("Cannot select the receivers: %v", err)
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM emails WHERE email IN (SELECT email_creator FROM messages WHERE id = ANY ($1))", msgIDs)
+	if err != nil {
+		t.Fatalf("Cannot delete the creators: %v", err)
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM emails WHERE email = ANY ($1)", receivers); err != nil {
+		t.Fatalf("Cannot delete the receivers: %v", err)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		t.Fatalf("Cannot commit the deletion: %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/mail"
+	"github.com/asendia/legacy-api/secure"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	EmailKindReminder  = "reminder"
+	EmailKindTestament = "testament"
+
+	OutboxStatusPending = "pending"
+	OutboxStatusSending = "sending"
+	OutboxStatusSent    = "sent"
+	OutboxStatusFailed  = "failed"
+	// Not stored, a deferred email stays pending until the daily quotas of the mail vendors are reset
+	OutboxStatusDeferred = "deferred"
+
+	outboxMaxAttempts = 5
+	// A claimed email becomes claimable again after this, e.g. when the dispatcher crashed
+	outboxLease = 10 * time.Minute
+)
+
+// DispatchSummary is the result of DispatchEmailOutbox
+type DispatchSummary struct {
+	Claimed  int               `json:"claimed"`
+	Sent     int               `json:"sent"`
+	Failed   int               `json:"failed"`
+	Deferred int               `json:"deferred"`
+	Emails   []DispatchedEmail `json:"emails"`
+}
+
+// DispatchedEmail is the result of one outbox email, as returned by mail.SendEmails
+type DispatchedEmail struct {
+	OutboxID      uuid.UUID `json:"outboxId"`
+	Kind          string    `json:"kind"`
+	MessageID     uuid.UUID `json:"messageId"`
+	EmailReceiver string    `json:"emailReceiver"`
+	Status        string    `json:"status"`
+	VendorID      string    `json:"vendorId"`
+	Error         string    `json:"error,omitempty"`
+}
+
+func (s *DispatchSummary) add(row data.EmailOutbox, smRes mail.SendEmailsResponse) {
+	email := DispatchedEmail{
+		OutboxID:      row.ID,
+		Kind:          row.Kind,
+		MessageID:     row.MessageID,
+		EmailReceiver: row.EmailReceiver,
+		Status:        OutboxStatusSent,
+		VendorID:      smRes.VendorID,
+	}
+	if errors.Is(smRes.Err, mail.ErrDailyQuotaExceeded) {
+		email.Status = OutboxStatusDeferred
+		email.Error = smRes.Err.Error()
+		s.Deferred++
+	} else if smRes.Err != nil {
+		email.Status = OutboxStatusFailed
+		email.Error = truncateString(smRes.Err.Error(), 500)
+		s.Failed++
+	} else {
+		s.Sent++
+	}
+	s.Emails = append(s.Emails, email)
+}
+
+// enqueueEmail writes the sealed email into email_outbox using the caller's transaction,
+// isQueued is false when an email with the same idempotency key already exists
+func enqueueEmail(ctx context.Context, queries *data.Queries, keys MessageKeys, param data.InsertEmailOutboxParams, mailItem mail.MailItem) (row data.EmailOutbox, isQueued bool, err error) {
+	param.MailItemSealed, param.WrappedKey, err = sealMailItem(ctx, mailItem, keys)
+	if err != nil {
+		return row, false, err
+	}
+	row, err = queries.InsertEmailOutbox(ctx, param)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return row, false, nil
+	}
+	return row, err == nil, err
+}
+
+// sealMailItem seals the email with its own data key, the testament & the secrets of the email links
+// are never stored in plaintext
+func sealMailItem(ctx context.Context, mailItem mail.MailItem, keys MessageKeys) (sealed string, wrappedKey string, err error) {
+	mailJSON, err := json.Marshal(mailItem)
+	if err != nil {
+		return "", "", err
+	}
+	sealed, dataKey, err := secure.SealWithDataKey(string(mailJSON))
+	if err != nil {
+		return "", "", err
+	}
+	wrappedKey, _, err = keys.KeyProvider.WrapKey(ctx, dataKey)
+	return sealed, wrappedKey, err
+}
+
+// openMailItem opens the sealed email, or reads mail_item of an email queued before the emails were sealed
+func openMailItem(ctx context.Context, row data.EmailOutbox, keys MessageKeys) (mailItem mail.MailItem, err error) {
+	mailJSON := row.MailItem
+	if row.MailItemSealed != "" {
+		dataKey, err := keys.KeyProvider.UnwrapKey(ctx, row.WrappedKey)
+		if err != nil {
+			return mailItem, err
+		}
+		opened, err := secure.OpenWithDataKey(row.MailItemSealed, dataKey)
+		if err != nil {
+			return mailItem, err
+		}
+		mailJSON = []byte(opened)
+	}
+	return mailItem, json.Unmarshal(mailJSON, &mailItem)
+}
+
+// DispatchEmailOutbox sends the emails committed into email_outbox.
+// Claiming and recording the results use separate transactions, so no vendor call
+// happens inside an open transaction and nothing is sent for uncommitted state.
+func (a *APIForScheduler) DispatchEmailOutbox() (res APIResponse, err error) {
+	keys, err := LoadMessageKeysFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to load encryption keys"
+		return res, err
+	}
+	claimTx, err := a.DB.Begin(a.Context)
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to begin claim transaction"
+		return res, err
+	}
+	defer claimTx.Rollback(a.Context)
+	rows, err := data.New(claimTx).ClaimEmailOutbox(a.Context, data.ClaimEmailOutboxParams{
+		LeaseUntil: time.Now().Add(outboxLease),
+		BatchSize:  a.dispatchBatchSize(),
+	})
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to claim emails from the outbox"
+		return res, err
+	}
+	if err = claimTx.Commit(a.Context); err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to commit claimed emails"
+		return res, err
+	}
+	if len(rows) == 0 {
+		res.StatusCode = http.StatusOK
+		res.ResponseMsg = "No email is waiting in the outbox"
+		res.Data = &DispatchSummary{Emails: []DispatchedEmail{}}
+		return res, nil
+	}
+	res.Data = a.dispatchOutboxRows(rows, keys)
+	res.StatusCode = http.StatusOK
+	res.ResponseMsg = "Outbox emails dispatched"
+	return res, nil
+}
+
+// dispatchBatchSize claims no more emails than the slowest mail vendor can send before the deadline,
+// the emails left are claimed by the next runs instead of being sent after the run is over
+func (a *APIForScheduler) dispatchBatchSize() int32 {
+	batchSize := a.Params.batchSize()
+	if a.Mail != nil || a.Deadline.IsZero() {
+		return batchSize
+	}
+	count := mail.LoadSendMailConfigFromEnv().EmailsWithin(time.Until(a.Deadline))
+	if count < 0 || count >= int(batchSize) {
+		return batchSize
+	}
+	// Every run sends at least one email
+	return int32(max(count, 1))
+}
+
+// dispatchOutboxRows sends the claimed emails & records the result of each one
+func (a *APIForScheduler) dispatchOutboxRows(rows []data.EmailOutbox, keys MessageKeys) *DispatchSummary {
+	summary := &DispatchSummary{Claimed: len(rows), Emails: []DispatchedEmail{}}
+	mailItems := []mail.MailItem{}
+	mailRows := []data.EmailOutbox{}
+	for _, row := range rows {
+		mailItem, errO := openMailItem(a.Context, row, keys)
+		if errO != nil {
+			row.Attempts = outboxMaxAttempts
+			a.recordOutboxResult(row, mail.SendEmailsResponse{Err: errO})
+			summary.add(row, mail.SendEmailsResponse{Err: errO})
+			continue
+		}
+		mailItem.IdempotencyKey = row.IdempotencyKey
+		mailItem.CorrelationID = row.ID.String()
+		mailItems = append(mailItems, mailItem)
+		mailRows = append(mailRows, row)
+	}
+	smResByID := map[string]mail.SendEmailsResponse{}
+	for _, smRes := range a.sendEmails(mailItems) {
+		smResByID[smRes.CorrelationID] = smRes
+	}
+	for _, row := range mailRows {
+		smRes, ok := smResByID[row.ID.String()]
+		if !ok {
+			smRes = mail.SendEmailsResponse{Err: errors.New("no response from any mail vendor")}
+		}
+		a.recordOutboxResult(row, smRes)
+		summary.add(row, smRes)
+	}
+	return summary
+}
+
+// recordOutboxResult stores the result of one email in its own transaction,
+// a failing row should not roll back the results of the other emails.
+// A sent email is recorded even when the run is canceled, otherwise it is sent again after the lease.
+func (a *APIForScheduler) recordOutboxResult(row data.EmailOutbox, smRes mail.SendEmailsResponse) {
+	ctx := context.WithoutCancel(a.Context)
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		fmt.Printf("Failed to begin outbox result transaction: %v\n", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	queries := data.New(tx)
+	if smRes.Err == nil {
+		err = recordOutboxSent(ctx, queries, row, smRes.VendorID)
+	} else if errors.Is(smRes.Err, mail.ErrDailyQuotaExceeded) {
+		// Not an attempt, it is sent the next day
+		err = queries.DeferEmailOutbox(ctx, data.DeferEmailOutboxParams{
+			LastError:     smRes.Err.Error(),
+			NextAttemptAt: mail.NextQuotaDay(),
+			ID:            row.ID,
+		})
+	} else {
+		err = recordOutboxFailure(ctx, queries, row, smRes.Err)
+	}
+	if err != nil {
+		fmt.Printf("Failed to record outbox result of %s: %v\n", row.ID, err)
+		return
+	}
+	if err = tx.Commit(ctx); err != nil {
+		fmt.Printf("Failed to commit outbox result of %s: %v\n", row.ID, err)
+	}
+}
+
+func recordOutboxSent(ctx context.Context, queries *data.Queries, row data.EmailOutbox, vendorID string) error {
+	err := queries.UpdateEmailOutboxAfterSending(ctx, data.UpdateEmailOutboxAfterSendingParams{
+		ID:       row.ID,
+		VendorID: vendorID,
+	})
+	if err != nil || !row.DeliveryID.Valid {
+		return err
+	}
+	err = queries.UpdateTestamentDelivery(ctx, data.UpdateTestamentDeliveryParams{
+		ID:       row.DeliveryID.UUID,
+		Status:   DeliveryStatusSent,
+		VendorID: vendorID,
+		SentAt:   sql.NullTime{Time: time.Now(), Valid: true},
+	})
+	if err != nil {
+		return err
+	}
+	return queries.DeactivateDeliveredMessage(ctx, row.MessageID)
+}
+
+func recordOutboxFailure(ctx context.Context, queries *data.Queries, row data.EmailOutbox, sendErr error) error {
+	fmt.Printf("An email probably gets an error: %v\n", sendErr)
+	errMsg := truncateString(sendErr.Error(), 500)
+	if row.Attempts < outboxMaxAttempts {
+		// Exponential backoff: 2, 4, 8, 16 minutes
+		return queries.UpdateEmailOutboxAfterFailure(ctx, data.UpdateEmailOutboxAfterFailureParams{
+			ID:            row.ID,
+			Status:        OutboxStatusPending,
+			LastError:     errMsg,
+			NextAttemptAt: time.Now().Add(time.Minute * time.Duration(int64(1)<<row.Attempts)),
+		})
+	}
+	err := queries.UpdateEmailOutboxAfterFailure(ctx, data.UpdateEmailOutboxAfterFailureParams{
+		ID:            row.ID,
+		Status:        OutboxStatusFailed,
+		LastError:     errMsg,
+		NextAttemptAt: time.Now(),
+	})
+	if err != nil || !row.DeliveryID.Valid {
+		return err
+	}
+	err = queries.UpdateTestamentDelivery(ctx, data.UpdateTestamentDeliveryParams{
+		ID:           row.DeliveryID.UUID,
+		Status:       DeliveryStatusFailed,
+		VendorID:     row.VendorID,
+		ErrorMessage: errMsg,
+	})
+	if err != nil {
+		return err
+	}
+	return queries.UpdateEmail(ctx, data.UpdateEmailParams{
+		IsActive: false,
+		Email:    row.EmailReceiver,
+	})
+}
+
+func outboxIdempotencyKey(kind string, msgID uuid.UUID, parts ...interface{}) string {
+	key := kind + ":" + msgID.String()
+	for _, p := range parts {
+		key += ":" + fmt.Sprint(p)
+	}
+	return key
+}
+
+// truncateString keeps the first maxLength runes, varchar(n) of Postgres counts characters, not bytes
+func truncateString(str string, maxLength int) string {
+	runes := []rune(str)
+	if len(runes) <= maxLength {
+		return str
+	}
+	return string(runes[:maxLength])
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/simple"
+	"github.com/google/uuid"
+)
+
+func TestSendReminderMessagesQueuesOutbox(t *testing.T) {
+	t.Setenv("SERVERLESS_FUNCTION_SOURCE_CODE", "../mail/")
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Errorf("Cannot begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	aFe := APIForFrontend{Context: ctx, Tx: tx}
+	msg := generateMessageTemplate()
+	res, err := aFe.InsertMessage(
+		generateJwtMessageTemplate(msg.EmailCreator),
+		APIParamInsertMessage{
+			EmailReceivers:       msg.EmailReceivers,
+			MessageContent:       msg.MessageContent,
+			InactivePeriodDays:   msg.InactivePeriodDays,
+			ReminderIntervalDays: msg.ReminderIntervalDays,
+		})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	row := res.Data.(MessageData)
+	_, err = tx.Exec(ctx, `UPDATE messages SET next_reminder_at = $1 WHERE id = $2`,
+		simple.TimeTodayUTC().Add(-simple.DaysToDuration(1)), row.ID)
+	if err != nil {
+		t.Fatalf("Failed to update next_reminder_at: %v", err)
+	}
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx}
+	if _, err = a.SendReminderMessages(); err != nil {
+		t.Fatalf("SendReminderMessages failed: %v", err)
+	}
+	// The message is not due anymore, running again should not queue a duplicate
+	if _, err = a.SendReminderMessages(); err != nil {
+		t.Fatalf("SendReminderMessages failed: %v", err)
+	}
+	queries := data.New(tx)
+	outboxRows, err := queries.SelectEmailOutboxByMessage(ctx, row.ID)
+	if err != nil {
+		t.Fatalf("Select email outbox failed: %v", err)
+	}
+	if len(outboxRows) != 1 || outboxRows[0].Kind != EmailKindReminder ||
+		outboxRows[0].Status != OutboxStatusPending || outboxRows[0].EmailReceiver != msg.EmailCreator {
+		t.Fatalf("Expected exactly one pending reminder in the outbox: %+v", outboxRows)
+	}
+	res, err = a.DispatchEmailOutbox()
+	if err != nil {
+		t.Fatalf("DispatchEmailOutbox failed: %v", err)
+	}
+	summary := res.Data.(*DispatchSummary)
+	if summary.Claimed == 0 || summary.Sent+summary.Failed != summary.Claimed || len(summary.Emails) != summary.Claimed {
+		t.Fatalf("Every claimed email should have a result: %+v", summary)
+	}
+	outboxRows, err = queries.SelectEmailOutboxByMessage(ctx, row.ID)
+	if err != nil {
+		t.Fatalf("Select email outbox failed: %v", err)
+	}
+	// Without vendor API keys the email is rescheduled instead of sent
+	if outboxRows[0].Attempts != 1 ||
+		(outboxRows[0].Status != OutboxStatusSent && outboxRows[0].Status != OutboxStatusPending) {
+		t.Fatalf("Outbox email should be attempted once: %+v", outboxRows[0])
+	}
+}
+
+func TestSendTestamentsQueuesOutboxPerReceiver(t *testing.T) {
+	t.Setenv("SERVERLESS_FUNCTION_SOURCE_CODE", "../mail/")
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Errorf("Cannot begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	aFe := APIForFrontend{Context: ctx, Tx: tx}
+	msg := generateMessageTemplate()
+	res, err := aFe.InsertMessage(
+		generateJwtMessageTemplate(msg.EmailCreator),
+		APIParamInsertMessage{
+			EmailReceivers:       msg.EmailReceivers,
+			MessageContent:       msg.MessageContent,
+			InactivePeriodDays:   msg.InactivePeriodDays,
+			ReminderIntervalDays: msg.ReminderIntervalDays,
+		})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	row := res.Data.(MessageData)
+	_, err = tx.Exec(ctx, "UPDATE messages SET inactive_at = $1 WHERE id = $2",
+		simple.TimeTodayUTC().Add(-simple.DaysToDuration(2)), row.ID)
+	if err != nil {
+		t.Fatalf("Failed to update inactive_at: %v", err)
+	}
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx}
+	if _, err = a.SendTestamentsOfInactiveMessages(); err != nil {
+		t.Fatalf("SendTestamentsOfInactiveMessages failed: %v", err)
+	}
+	queries := data.New(tx)
+	outboxRows, err := queries.SelectEmailOutboxByMessage(ctx, row.ID)
+	if err != nil {
+		t.Fatalf("Select email outbox failed: %v", err)
+	}
+	if len(outboxRows) != len(msg.EmailReceivers) {
+		t.Fatalf("Expected one outbox email per receiver, got: %d", len(outboxRows))
+	}
+	deliveries, err := queries.SelectTestamentDeliveries(ctx, row.ID)
+	if err != nil {
+		t.Fatalf("Select testament deliveries failed: %v", err)
+	}
+	for _, d := range deliveries {
+		if d.Status != DeliveryStatusQueued {
+			t.Fatalf("Delivery should be queued until the dispatcher runs: %+v", d)
+		}
+	}
+	// Queued receivers are not selected again
+	inactiveRows, err := queries.SelectInactiveMessages(ctx, data.SelectInactiveMessagesParams{
+		Today:      simple.TimeTodayUTC(),
+		MessageIds: []uuid.UUID{row.ID},
+		BatchSize:  100,
+	})
+	if err != nil {
+		t.Fatalf("Select inactive messages failed: %v", err)
+	}
+	for _, r := range inactiveRows {
+		if r.MsgID == row.ID {
+			t.Fatalf("Queued receiver should not be selected again: %s", r.RcvEmailReceiver)
+		}
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	if str := truncateString("héllo wörld", 7); str != "héllo w" {
+		t.Fatalf("Should keep 7 characters: %q", str)
+	}
+	if str := truncateString("héllo", 5); str != "héllo" {
+		t.Fatalf("Should not truncate: %q", str)
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/asendia/legacy-api/simple"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSchedulerBatchSize = 100
+	maxSchedulerBatchSize     = 1000
+)
+
+var ErrInvalidSchedulerParams = errors.New("invalid scheduler params")
+
+// SchedulerParams are the options of a scheduler action, the JSON data of its Pub/Sub message
+type SchedulerParams struct {
+	// Rows selected per batch, defaultSchedulerBatchSize if 0
+	BatchSize int `json:"batchSize,omitempty"`
+	// Runs the action then rolls its transaction back
+	DryRun bool `json:"dryRun,omitempty"`
+	// Only these messages if not empty
+	MessageIDs []uuid.UUID `json:"messageIds,omitempty"`
+	// YYYY-MM-DD replacing the current date, e.g. to catch up the runs missed during an outage
+	Today string `json:"today,omitempty"`
+	// Skips the run while another run of the action holds its lock, & the other way around
+	Exclusive bool `json:"exclusive,omitempty"`
+}
+
+// ParseSchedulerParams decodes & validates the params, an empty data is the default params
+func ParseSchedulerParams(data []byte) (p SchedulerParams, err error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return p, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&p); err != nil {
+		return p, fmt.Errorf("%w: %v", ErrInvalidSchedulerParams, err)
+	}
+	return p, p.Validate()
+}
+
+func (p SchedulerParams) Validate() error {
+	if p.BatchSize < 0 || p.BatchSize > maxSchedulerBatchSize {
+		return fmt.Errorf("%w: batchSize should be between 1 and %d", ErrInvalidSchedulerParams, maxSchedulerBatchSize)
+	}
+	if len(p.MessageIDs) > maxSchedulerBatchSize {
+		return fmt.Errorf("%w: at most %d messageIds", ErrInvalidSchedulerParams, maxSchedulerBatchSize)
+	}
+	for _, id := range p.MessageIDs {
+		if id == uuid.Nil {
+			return fmt.Errorf("%w: messageIds should not contain the nil uuid", ErrInvalidSchedulerParams)
+		}
+	}
+	if p.Today == "" {
+		return nil
+	}
+	today, err := time.Parse("2006-01-02", p.Today)
+	if err != nil {
+		return fmt.Errorf("%w: today should be YYYY-MM-DD", ErrInvalidSchedulerParams)
+	}
+	// Only catching up is allowed, a future date would send the reminders & testaments early
+	if today.After(simple.TimeTodayUTC()) {
+		return fmt.Errorf("%w: today should not be in the future", ErrInvalidSchedulerParams)
+	}
+	return nil
+}
+
+func (p SchedulerParams) String() string {
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+func (p SchedulerParams) batchSize() int32 {
+	if p.BatchSize == 0 {
+		return defaultSchedulerBatchSize
+	}
+	return int32(p.BatchSize)
+}
+
+func (p SchedulerParams) today() time.Time {
+	if today, err := time.Parse("2006-01-02", p.Today); err == nil {
+		return today
+	}
+	return simple.TimeTodayUTC()
+}
+
+func (p SchedulerParams) messageIDs() []uuid.UUID {
+	if p.MessageIDs == nil {
+		return []uuid.UUID{}
+	}
+	return p.MessageIDs
+}
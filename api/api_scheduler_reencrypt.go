@@ -0,0 +1,169 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
+	"github.com/google/uuid"
+)
+
+type ReencryptResult struct {
+	Reencrypted int         `json:"reencrypted"`
+	Failed      []uuid.UUID `json:"failed"`
+}
+
+// ReencryptMessages moves message contents which have no data key yet,
+// i.e. sealed with a keyring key or in the legacy AES-CFB format, to their own data keys.
+// Every batch is committed on its own, so an interrupted run resumes where it stopped.
+func (a *APIForScheduler) ReencryptMessages() (res APIResponse, err error) {
+	keys, err := LoadMessageKeysFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to load encryption keys"
+		return res, err
+	}
+	result, err := a.runInBatches(func(queries *data.Queries, afterID uuid.UUID) (int, uuid.UUID, ReencryptResult, error) {
+		return a.reencryptMessagesBatch(queries, keys, afterID)
+	})
+	res.Data = result
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to re-encrypt messages"
+		return res, err
+	}
+	res.StatusCode = http.StatusOK
+	res.ResponseMsg = "Messages re-encrypted successfully"
+	return res, nil
+}
+
+// RewrapDataKeys re-wraps the data keys which are not wrapped by the active KEK,
+// the message contents are left untouched
+func (a *APIForScheduler) RewrapDataKeys() (res APIResponse, err error) {
+	keys, err := LoadMessageKeysFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to load encryption keys"
+		return res, err
+	}
+	result, err := a.runInBatches(func(queries *data.Queries, afterID uuid.UUID) (int, uuid.UUID, ReencryptResult, error) {
+		return a.rewrapDataKeysBatch(queries, keys, afterID)
+	})
+	res.Data = result
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to re-wrap data keys"
+		return res, err
+	}
+	res.StatusCode = http.StatusOK
+	res.ResponseMsg = "Data keys re-wrapped successfully"
+	return res, nil
+}
+
+type reencryptBatchFunc func(queries *data.Queries, afterID uuid.UUID) (count int, lastID uuid.UUID, result ReencryptResult, err error)
+
+// runInBatches commits every batch in its own transaction until a batch is not full
+func (a *APIForScheduler) runInBatches(batchFunc reencryptBatchFunc) (result ReencryptResult, err error) {
+	result.Failed = []uuid.UUID{}
+	afterID := uuid.Nil
+	for {
+		tx, err := a.DB.Begin(a.Context)
+		if err != nil {
+			return result, err
+		}
+		count, lastID, batch, err := batchFunc(data.New(tx), afterID)
+		if err == nil {
+			err = tx.Commit(a.Context)
+		}
+		tx.Rollback(a.Context)
+		if err != nil {
+			return result, err
+		}
+		result.Reencrypted += batch.Reencrypted
+		result.Failed = append(result.Failed, batch.Failed...)
+		if count < int(a.Params.batchSize()) {
+			return result, nil
+		}
+		afterID = lastID
+	}
+}
+
+func (a *APIForScheduler) reencryptMessagesBatch(queries *data.Queries, keys MessageKeys, afterID uuid.UUID) (count int, lastID uuid.UUID, result ReencryptResult, err error) {
+	rows, err := queries.SelectMessagesToReencrypt(a.Context, data.SelectMessagesToReencryptParams{
+		AfterID:        afterID,
+		EnvelopePrefix: secure.EnvelopePrefix(secure.DataKeyID),
+		BatchSize:      a.Params.batchSize(),
+	})
+	if err != nil {
+		return 0, afterID, result, err
+	}
+	lastID = afterID
+	for _, row := range rows {
+		lastID = row.ID
+		msgContent, err := DecryptMessageContent(a.Context, row.ContentEncrypted, "", keys)
+		if err != nil {
+			// Skipped rows are picked up again by the next run, e.g. after the missing key is configured
+			fmt.Printf("Cannot decrypt message %s: %v\n", row.ID, err)
+			result.Failed = append(result.Failed, row.ID)
+			continue
+		}
+		encrypted, err := EncryptMessageContent(a.Context, msgContent, keys)
+		if err != nil {
+			return 0, afterID, result, err
+		}
+		// The update is skipped when the content has been edited since the select
+		affected, err := queries.UpdateMessageContentEncrypted(a.Context, data.UpdateMessageContentEncryptedParams{
+			NewContentEncrypted: encrypted.ContentEncrypted,
+			ID:                  row.ID,
+			OldContentEncrypted: row.ContentEncrypted,
+		})
+		if err != nil {
+			return 0, afterID, result, err
+		}
+		if affected == 0 {
+			continue
+		}
+		if err = saveMessageDataKey(a.Context, queries, row.ID, encrypted); err != nil {
+			return 0, afterID, result, err
+		}
+		result.Reencrypted++
+	}
+	return len(rows), lastID, result, nil
+}
+
+func (a *APIForScheduler) rewrapDataKeysBatch(queries *data.Queries, keys MessageKeys, afterID uuid.UUID) (count int, lastID uuid.UUID, result ReencryptResult, err error) {
+	rows, err := queries.SelectMessageDataKeysToRewrap(a.Context, data.SelectMessageDataKeysToRewrapParams{
+		AfterMessageID: afterID,
+		ActiveKekID:    keys.KeyProvider.ActiveKeyID(),
+		BatchSize:      a.Params.batchSize(),
+	})
+	if err != nil {
+		return 0, afterID, result, err
+	}
+	lastID = afterID
+	for _, row := range rows {
+		lastID = row.MessageID
+		dataKey, err := keys.KeyProvider.UnwrapKey(a.Context, row.WrappedKey)
+		if err != nil {
+			fmt.Printf("Cannot unwrap data key of message %s: %v\n", row.MessageID, err)
+			result.Failed = append(result.Failed, row.MessageID)
+			continue
+		}
+		wrappedKey, kekID, err := keys.KeyProvider.WrapKey(a.Context, dataKey)
+		if err != nil {
+			return 0, afterID, result, err
+		}
+		affected, err := queries.UpdateMessageDataKeyWrapped(a.Context, data.UpdateMessageDataKeyWrappedParams{
+			NewKekID:      kekID,
+			NewWrappedKey: wrappedKey,
+			MessageID:     row.MessageID,
+			OldWrappedKey: row.WrappedKey,
+		})
+		if err != nil {
+			return 0, afterID, result, err
+		}
+		result.Reencrypted += int(affected)
+	}
+	return len(rows), lastID, result, nil
+}
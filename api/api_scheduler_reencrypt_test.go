@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+func TestReencryptMessagesToDataKeys(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Errorf("Cannot begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	msg, msgID := insertMessageForReencryption(t, ctx, tx)
+	// Store the content in the legacy AES-CFB "iv.base64" format, without data key
+	legacy, err := secure.Encrypt(msg.MessageContent, os.Getenv("ENCRYPTION_KEY"))
+	if err != nil {
+		t.Fatalf("Legacy encryption failed: %v", err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE messages SET content_encrypted = $1 WHERE id = $2`,
+		legacy.IV+"."+legacy.Text, msgID)
+	if err != nil {
+		t.Fatalf("Failed to update content_encrypted: %v", err)
+	}
+	if err = data.New(tx).DeleteMessageDataKey(ctx, msgID); err != nil {
+		t.Fatalf("Failed to delete data key: %v", err)
+	}
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx}
+	res, err := a.ReencryptMessages()
+	if err != nil {
+		t.Fatalf("ReencryptMessages failed: %v", err)
+	}
+	if res.Data.(ReencryptResult).Reencrypted < 1 {
+		t.Fatalf("At least the legacy message should be re-encrypted: %+v", res)
+	}
+	rows, err := data.New(tx).SelectMessage(ctx, msgID)
+	if err != nil || len(rows) == 0 {
+		t.Fatalf("Select message failed: %v", err)
+	}
+	if !strings.HasPrefix(rows[0].MsgContentEncrypted, "v2:gcm:dek:") || !rows[0].DkWrappedKey.Valid {
+		t.Fatalf("Message content should be sealed with its own data key: %+v", rows[0])
+	}
+	keys, err := LoadMessageKeysFromEnv()
+	if err != nil {
+		t.Fatalf("Cannot load message keys: %v", err)
+	}
+	msgContent, err := DecryptMessageContent(ctx, rows[0].MsgContentEncrypted, rows[0].DkWrappedKey.String, keys)
+	if err != nil || msgContent != msg.MessageContent {
+		t.Fatalf("Re-encrypted message content does not match: %s %v", msgContent, err)
+	}
+	// Running again should not touch the upgraded row
+	if _, err = a.ReencryptMessages(); err != nil {
+		t.Fatalf("ReencryptMessages failed: %v", err)
+	}
+	rowsAgain, _ := data.New(tx).SelectMessage(ctx, msgID)
+	if rowsAgain[0].MsgContentEncrypted != rows[0].MsgContentEncrypted {
+		t.Fatal("Message content with a data key should not be re-encrypted")
+	}
+}
+
+func TestRewrapDataKeysToActiveKey(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Errorf("Cannot begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	msg, msgID := insertMessageForReencryption(t, ctx, tx)
+	before, err := data.New(tx).SelectMessage(ctx, msgID)
+	if err != nil || len(before) == 0 {
+		t.Fatalf("Select message failed: %v", err)
+	}
+	// Rotate: the legacy key is retired, new data keys are wrapped by the 2026-10 key
+	t.Setenv("ENCRYPTION_KEYS", `{"2026-10":"rotated key with 32 characters!!"}`)
+	t.Setenv("ENCRYPTION_ACTIVE_KEY_ID", "2026-10")
+	a := APIForScheduler{Context: ctx, Tx: tx, DB: tx}
+	res, err := a.RewrapDataKeys()
+	if err != nil {
+		t.Fatalf("RewrapDataKeys failed: %v", err)
+	}
+	if res.Data.(ReencryptResult).Reencrypted < 1 {
+		t.Fatalf("At least one data key should be re-wrapped: %+v", res)
+	}
+	after, err := data.New(tx).SelectMessage(ctx, msgID)
+	if err != nil || len(after) == 0 {
+		t.Fatalf("Select message failed: %v", err)
+	}
+	if after[0].MsgContentEncrypted != before[0].MsgContentEncrypted {
+		t.Fatal("Re-wrapping should not rewrite the message content")
+	}
+	if !strings.HasPrefix(after[0].DkWrappedKey.String, "v2:gcm:2026-10:") {
+		t.Fatalf("Data key should be wrapped by the active key: %s", after[0].DkWrappedKey.String)
+	}
+	keys, err := LoadMessageKeysFromEnv()
+	if err != nil {
+		t.Fatalf("Cannot load message keys: %v", err)
+	}
+	msgContent, err := DecryptMessageContent(ctx, after[0].MsgContentEncrypted, after[0].DkWrappedKey.String, keys)
+	if err != nil || msgContent != msg.MessageContent {
+		t.Fatalf("Message content does not match after re-wrapping: %s %v", msgContent, err)
+	}
+}
+
+func insertMessageForReencryption(t *testing.T, ctx context.Context, tx pgx.Tx) (MessageData, uuid.UUID) {
+	aFe := APIForFrontend{Context: ctx, Tx: tx}
+	msg := generateMessageTemplate()
+	res, err := aFe.InsertMessage(
+		generateJwtMessageTemplate(msg.EmailCreator),
+		APIParamInsertMessage{
+			EmailReceivers:       msg.EmailReceivers,
+			MessageContent:       msg.MessageContent,
+			InactivePeriodDays:   msg.InactivePeriodDays,
+			ReminderIntervalDays: msg.ReminderIntervalDays,
+		})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	return msg, res.Data.(MessageData).ID
+}
@@ -6,22 +6,66 @@ import (
 
 	"github.com/asendia/legacy-api/data"
 	"github.com/asendia/legacy-api/mail"
+	"github.com/asendia/legacy-api/secure"
 	"github.com/google/uuid"
 )
 
+// SendReminderMessages queues the reminders of every due message, one committed chunk of messages at a time
 func (a *APIForScheduler) SendReminderMessages() (res APIResponse, err error) {
-	queries := data.New(a.Tx)
-	rows, err := queries.SelectMessagesNeedReminding(a.Context)
+	hasher, err := secure.LoadSecretHasherFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to load secret pepper"
+		return res, err
+	}
+	keys, err := LoadMessageKeysFromEnv()
 	if err != nil {
 		res.StatusCode = http.StatusInternalServerError
-		res.ResponseMsg = "Failed to select messages need reminding"
+		res.ResponseMsg = "Failed to load encryption keys"
 		return res, err
 	}
-	mailItems := []mail.MailItem{}
+	summary := SchedulerRunSummary{}
+	last, err := a.drainInChunks(&summary, func(queries *data.Queries, after messageCursor) (int, messageCursor, error) {
+		return a.sendReminderMessagesChunk(queries, keys, hasher, after, &summary)
+	})
+	res.Data = &summary
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to queue reminder emails"
+		return res, err
+	}
+	summary.Remaining, err = data.New(a.Tx).CountMessagesNeedReminding(a.Context, data.CountMessagesNeedRemindingParams{
+		Today:          a.Params.today(),
+		MessageIds:     a.Params.messageIDs(),
+		AfterCreatedAt: last.CreatedAt,
+		AfterID:        last.ID,
+	})
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to count remaining messages need reminding"
+		return res, err
+	}
+	res.StatusCode = http.StatusOK
+	if summary.Queued == 0 {
+		res.ResponseMsg = "No reminder message is sent this time"
+		return res, nil
+	}
+	res.ResponseMsg = "Reminder emails queued successfully"
+	return res, nil
+}
+
+func (a *APIForScheduler) sendReminderMessagesChunk(queries *data.Queries, keys MessageKeys, hasher secure.SecretHasher, after messageCursor,
+	summary *SchedulerRunSummary) (count int, last messageCursor, err error) {
+	rows, err := a.selectMessagesNeedReminding(queries, after, a.Params.DryRun)
+	if err != nil {
+		return 0, last, err
+	}
 	msgs := []*MessageData{}
 	msgMap := map[uuid.UUID]*MessageData{}
+	legacySecretHashes := map[uuid.UUID]string{}
 	for _, row := range rows {
 		if msgMap[row.MsgID] == nil {
+			legacySecretHashes[row.MsgID] = legacySecretHash(hasher, row.MsgExtensionSecret)
 			msgMap[row.MsgID] = &MessageData{
 				ID:                   row.MsgID,
 				CreatedAt:            row.MsgCreatedAt,
@@ -30,7 +74,6 @@ func (a *APIForScheduler) SendReminderMessages() (res APIResponse, err error) {
 				InactivePeriodDays:   row.MsgInactivePeriodDays,
 				ReminderIntervalDays: row.MsgReminderIntervalDays,
 				IsActive:             row.MsgIsActive,
-				ExtensionSecret:      row.MsgExtensionSecret,
 				InactiveAt:           row.MsgInactiveAt,
 				NextReminderAt:       row.MsgNextReminderAt,
 			}
@@ -39,19 +82,27 @@ func (a *APIForScheduler) SendReminderMessages() (res APIResponse, err error) {
 		msgMap[row.MsgID].EmailReceivers = append(msgMap[row.MsgID].EmailReceivers, row.RcvEmailReceiver)
 	}
 	for _, msg := range msgs {
+		last = messageCursor{CreatedAt: msg.CreatedAt, ID: msg.ID}
+		summary.messageIDs = append(summary.messageIDs, msg.ID)
+		// Only the hash is stored, the plaintext secret lives in the email link
+		extensionSecret, extensionSecretHash, err := hasher.GenerateHashedSecret(ExtensionSecretLength)
+		if err != nil {
+			return 0, last, err
+		}
 		param := mail.ReminderEmailParams{
 			Title:              "Reminder to extend your sejiwo.com message",
 			FullName:           "Sejiwo User",
 			InactiveAt:         msg.InactiveAt.Local().Format("2006-01-02"),
 			TestamentReceivers: msg.EmailReceivers,
-			ExtensionURL:       fmt.Sprintf("https://sejiwo.com/extend?id=%s&secret=%s", msg.ID, msg.ExtensionSecret),
+			ExtensionURL:       fmt.Sprintf("https://sejiwo.com/extend?id=%s&secret=%s", msg.ID, extensionSecret),
 		}
 		htmlContent, err := mail.GenerateReminderEmail(param)
 		if err != nil {
 			fmt.Printf("Cannot generate reminder email: %v\n", err)
+			summary.Skipped++
 			continue
 		}
-		mail := mail.MailItem{
+		mailItem := mail.MailItem{
 			From: mail.MailAddress{
 				Email: "noreply@sejiwo.com",
 				Name:  "Sejiwo Service",
@@ -65,33 +116,40 @@ func (a *APIForScheduler) SendReminderMessages() (res APIResponse, err error) {
 			Subject:     param.Title,
 			HtmlContent: htmlContent,
 		}
-		mailItems = append(mailItems, mail)
-	}
-	if len(mailItems) == 0 {
-		res.StatusCode = http.StatusOK
-		res.ResponseMsg = "No reminder message is sent this time"
-		return
-	}
-	smResList := mail.SendEmails(mailItems)
-	for id, smRes := range smResList {
-		if smRes.Err == nil {
-			_, err := queries.UpdateMessageAfterSendingReminder(a.Context, msgs[id].ID)
-			if err != nil {
-				fmt.Printf("Failed to update message inactive_at and next_reminder_at: %v\n", err)
-				smRes.Err = err
-			}
-			continue
+		outboxRow, isQueued, err := enqueueEmail(a.Context, queries, keys, data.InsertEmailOutboxParams{
+			IdempotencyKey: outboxIdempotencyKey(EmailKindReminder, msg.ID, msg.NextReminderAt.Format("2006-01-02")),
+			Kind:           EmailKindReminder,
+			MessageID:      msg.ID,
+			EmailReceiver:  msg.EmailCreator,
+		}, mailItem)
+		if err != nil {
+			return 0, last, err
+		}
+		// An email queued by an earlier run keeps the secret of its link
+		if !isQueued {
+			extensionSecretHash = ""
+		}
+		_, err = queries.UpdateMessageAfterSendingReminder(a.Context, data.UpdateMessageAfterSendingReminderParams{
+			Today:               a.Params.today(),
+			ExtensionSecretHash: extensionSecretHash,
+			// The links of the emails sent before the secret hashes keep working
+			LegacyExtensionSecretHash: legacySecretHashes[msg.ID],
+			ID:                        msg.ID,
+		})
+		if err != nil {
+			return 0, last, err
+		}
+		if isQueued {
+			summary.Queued++
+			summary.queuedEmails = append(summary.queuedEmails, outboxRow)
 		}
 	}
-	res.StatusCode = http.StatusOK
-	res.ResponseMsg = "Reminder emails sent successfully"
-	res.Data = smResList
-	return res, err
+	return len(msgs), last, nil
 }
 
 func (a *APIForScheduler) SelectMessagesNeedReminding() (res APIResponse, err error) {
 	queries := data.New(a.Tx)
-	rows, err := queries.SelectMessagesNeedReminding(a.Context)
+	rows, err := a.selectMessagesNeedReminding(queries, messageCursor{}, true)
 	if err != nil {
 		res.StatusCode = http.StatusInternalServerError
 		return res, err
@@ -105,7 +163,6 @@ func (a *APIForScheduler) SelectMessagesNeedReminding() (res APIResponse, err er
 			InactivePeriodDays:   row.MsgInactivePeriodDays,
 			ReminderIntervalDays: row.MsgReminderIntervalDays,
 			IsActive:             row.MsgIsActive,
-			ExtensionSecret:      row.MsgExtensionSecret,
 			InactiveAt:           row.MsgInactiveAt,
 			NextReminderAt:       row.MsgNextReminderAt,
 		})
@@ -113,3 +170,27 @@ func (a *APIForScheduler) SelectMessagesNeedReminding() (res APIResponse, err er
 	res.Data = msgs
 	return res, err
 }
+
+// selectMessagesNeedReminding claims the due messages after the cursor, read only they are not locked, e.g. for the dry run
+func (a *APIForScheduler) selectMessagesNeedReminding(queries *data.Queries, after messageCursor, isReadOnly bool) ([]data.SelectMessagesNeedRemindingRow, error) {
+	params := a.selectMessagesNeedRemindingParams(after)
+	if !isReadOnly {
+		return queries.SelectMessagesNeedReminding(a.Context, params)
+	}
+	readOnlyRows, err := queries.SelectMessagesNeedRemindingReadOnly(a.Context, data.SelectMessagesNeedRemindingReadOnlyParams(params))
+	rows := make([]data.SelectMessagesNeedRemindingRow, len(readOnlyRows))
+	for i, row := range readOnlyRows {
+		rows[i] = data.SelectMessagesNeedRemindingRow(row)
+	}
+	return rows, err
+}
+
+func (a *APIForScheduler) selectMessagesNeedRemindingParams(after messageCursor) data.SelectMessagesNeedRemindingParams {
+	return data.SelectMessagesNeedRemindingParams{
+		Today:          a.Params.today(),
+		MessageIds:     a.Params.messageIDs(),
+		AfterCreatedAt: after.CreatedAt,
+		AfterID:        after.ID,
+		BatchSize:      a.Params.batchSize(),
+	}
+}
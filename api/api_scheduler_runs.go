@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	SchedulerRunStatusRunning   = "running"
+	SchedulerRunStatusSucceeded = "succeeded"
+	SchedulerRunStatusFailed    = "failed"
+	// A conflicting run held the lock of the action
+	SchedulerRunStatusSkipped = "skipped"
+	SchedulerRunStatusDryRun  = "dry-run"
+
+	defaultSchedulerRunsLimit = 20
+	maxSchedulerRunsLimit     = 100
+)
+
+// SchedulerRunRecorder keeps the history of a run in scheduler_runs, DB should not be the run transaction
+// so that the failed runs are kept as well
+type SchedulerRunRecorder struct {
+	DB       data.DBTX
+	Run      data.SchedulerRun
+	Selected int
+	Queued   int
+	Sent     int
+	Failed   int
+	Skipped  int
+	Deferred int
+	Emails   []DispatchedEmail
+}
+
+// StartSchedulerRun inserts a running run, triggerID is e.g. the Pub/Sub message id
+func StartSchedulerRun(ctx context.Context, db data.DBTX, action string, params SchedulerParams, triggerID string) (*SchedulerRunRecorder, error) {
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	run, err := data.New(db).InsertSchedulerRun(ctx, data.InsertSchedulerRunParams{
+		Action:    action,
+		Params:    paramsJSON,
+		TriggerID: truncateString(triggerID, 200),
+	})
+	return &SchedulerRunRecorder{DB: db, Run: run}, err
+}
+
+// Add counts the items of an action response, the emails dispatched after the action are added the same way
+func (r *SchedulerRunRecorder) Add(res APIResponse) {
+	switch summary := res.Data.(type) {
+	case *SchedulerRunSummary:
+		r.Selected += summary.Messages
+		r.Queued += summary.Queued
+		r.Skipped += summary.Skipped
+	case *DryRunReport:
+		r.Add(APIResponse{Data: summary.Summary})
+	case *DispatchSummary:
+		if r.Run.Action == "dispatch-emails" {
+			r.Selected += summary.Claimed
+		}
+		r.Sent += summary.Sent
+		r.Failed += summary.Failed
+		r.Deferred += summary.Deferred
+		r.Emails = append(r.Emails, summary.Emails...)
+	}
+}
+
+// Finish stores the counts, the error & the result of every email of the run
+func (r *SchedulerRunRecorder) Finish(ctx context.Context, status string, runErr error) error {
+	errMsg := ""
+	if runErr != nil {
+		errMsg = truncateString(runErr.Error(), 500)
+	}
+	queries := data.New(r.DB)
+	err := queries.UpdateSchedulerRunAfterFinishing(ctx, data.UpdateSchedulerRunAfterFinishingParams{
+		Status:       status,
+		Selected:     int32(r.Selected),
+		Queued:       int32(r.Queued),
+		Sent:         int32(r.Sent),
+		Failed:       int32(r.Failed),
+		Skipped:      int32(r.Skipped),
+		Deferred:     int32(r.Deferred),
+		ErrorMessage: errMsg,
+		ID:           r.Run.ID,
+	})
+	if err != nil {
+		return err
+	}
+	for _, email := range r.Emails {
+		err = queries.InsertSchedulerRunEmail(ctx, data.InsertSchedulerRunEmailParams{
+			RunID:         r.Run.ID,
+			OutboxID:      email.OutboxID,
+			Kind:          email.Kind,
+			MessageID:     email.MessageID,
+			EmailReceiver: email.EmailReceiver,
+			Status:        email.Status,
+			VendorID:      email.VendorID,
+			ErrorMessage:  email.Error,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchedulerRunsQuery selects one run with its emails by ID, otherwise the latest runs
+type SchedulerRunsQuery struct {
+	ID     uuid.UUID `json:"id,omitempty"`
+	Action string    `json:"action,omitempty"`
+	Status string    `json:"status,omitempty"`
+	// defaultSchedulerRunsLimit if 0
+	Limit int `json:"limit,omitempty"`
+}
+
+type SchedulerRunData struct {
+	ID         uuid.UUID         `json:"id"`
+	Action     string            `json:"action"`
+	Params     json.RawMessage   `json:"params"`
+	TriggerID  string            `json:"triggerId"`
+	Status     string            `json:"status"`
+	Selected   int32             `json:"selected"`
+	Queued     int32             `json:"queued"`
+	Sent       int32             `json:"sent"`
+	Failed     int32             `json:"failed"`
+	Skipped    int32             `json:"skipped"`
+	Deferred   int32             `json:"deferred"`
+	Error      string            `json:"error,omitempty"`
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+	Emails     []DispatchedEmail `json:"emails,omitempty"`
+}
+
+func newSchedulerRunData(row data.SchedulerRun) SchedulerRunData {
+	run := SchedulerRunData{
+		ID:        row.ID,
+		Action:    row.Action,
+		Params:    row.Params,
+		TriggerID: row.TriggerID,
+		Status:    row.Status,
+		Selected:  row.Selected,
+		Queued:    row.Queued,
+		Sent:      row.Sent,
+		Failed:    row.Failed,
+		Skipped:   row.Skipped,
+		Deferred:  row.Deferred,
+		Error:     row.ErrorMessage,
+		StartedAt: row.StartedAt,
+	}
+	if row.FinishedAt.Valid {
+		run.FinishedAt = &row.FinishedAt.Time
+	}
+	return run
+}
+
+// SelectSchedulerRuns lists the latest runs, or one run with the result of its emails when q.ID is set
+func (a *APIForScheduler) SelectSchedulerRuns(q SchedulerRunsQuery) (res APIResponse, err error) {
+	if q.Limit < 0 || q.Limit > maxSchedulerRunsLimit {
+		res.StatusCode = http.StatusBadRequest
+		return res, fmt.Errorf("limit should be between 1 and %d", maxSchedulerRunsLimit)
+	}
+	if q.ID != uuid.Nil {
+		return a.selectSchedulerRun(q.ID)
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultSchedulerRunsLimit
+	}
+	rows, err := data.New(a.Tx).SelectSchedulerRuns(a.Context, data.SelectSchedulerRunsParams{
+		Action:   q.Action,
+		Status:   q.Status,
+		RowLimit: int32(q.Limit),
+	})
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	runs := []SchedulerRunData{}
+	for _, row := range rows {
+		runs = append(runs, newSchedulerRunData(row))
+	}
+	res.StatusCode = http.StatusOK
+	res.Data = runs
+	return res, nil
+}
+
+func (a *APIForScheduler) selectSchedulerRun(id uuid.UUID) (res APIResponse, err error) {
+	queries := data.New(a.Tx)
+	row, err := queries.SelectSchedulerRun(a.Context, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		res.StatusCode = http.StatusNotFound
+		res.ResponseMsg = "Scheduler run not found"
+		return res, nil
+	}
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	emailRows, err := queries.SelectSchedulerRunEmails(a.Context, id)
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	run := newSchedulerRunData(row)
+	run.Emails = []DispatchedEmail{}
+	for _, email := range emailRows {
+		run.Emails = append(run.Emails, DispatchedEmail{
+			OutboxID:      email.OutboxID,
+			Kind:          email.Kind,
+			MessageID:     email.MessageID,
+			EmailReceiver: email.EmailReceiver,
+			Status:        email.Status,
+			VendorID:      email.VendorID,
+			Error:         email.ErrorMessage,
+		})
+	}
+	res.StatusCode = http.StatusOK
+	res.Data = run
+	return res, nil
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSchedulerRunHistory(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	run, err := StartSchedulerRun(ctx, tx, "send-testaments", SchedulerParams{BatchSize: 10}, "pubsub-message-1")
+	if err != nil {
+		t.Fatalf("StartSchedulerRun failed: %v", err)
+	}
+	if run.Run.Status != SchedulerRunStatusRunning {
+		t.Fatalf("A started run should be running: %+v", run.Run)
+	}
+	run.Add(APIResponse{Data: &SchedulerRunSummary{Messages: 2, Queued: 3, Skipped: 1}})
+	receiver := generateMessageTemplate().EmailReceivers[0]
+	run.Add(APIResponse{Data: &DispatchSummary{Claimed: 2, Sent: 1, Failed: 1, Emails: []DispatchedEmail{
+		{OutboxID: uuid.New(), Kind: EmailKindTestament, MessageID: uuid.New(), EmailReceiver: receiver, Status: OutboxStatusSent, VendorID: "mailjet"},
+		{OutboxID: uuid.New(), Kind: EmailKindTestament, MessageID: uuid.New(), EmailReceiver: receiver, Status: OutboxStatusFailed, Error: "quota"},
+	}}})
+	if err = run.Finish(ctx, SchedulerRunStatusFailed, errors.New("deadline exceeded")); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	a := APIForScheduler{Context: ctx, Tx: tx}
+	res, err := a.SelectSchedulerRuns(SchedulerRunsQuery{Action: "send-testaments", Status: SchedulerRunStatusFailed})
+	if err != nil {
+		t.Fatalf("SelectSchedulerRuns failed: %v", err)
+	}
+	runs := res.Data.([]SchedulerRunData)
+	if len(runs) == 0 || runs[0].ID != run.Run.ID {
+		t.Fatalf("The latest run should be listed first: %+v", runs)
+	}
+	// The dispatch after the action adds the emails but not the selected items
+	r := runs[0]
+	if r.Selected != 2 || r.Queued != 3 || r.Sent != 1 || r.Failed != 1 || r.Skipped != 1 || r.Error != "deadline exceeded" ||
+		r.FinishedAt == nil || r.TriggerID != "pubsub-message-1" || string(r.Params) != `{"batchSize": 10}` {
+		t.Fatalf("Unexpected run: %+v", r)
+	}
+	res, err = a.SelectSchedulerRuns(SchedulerRunsQuery{ID: run.Run.ID})
+	if err != nil {
+		t.Fatalf("SelectSchedulerRuns failed: %v", err)
+	}
+	if emails := res.Data.(SchedulerRunData).Emails; len(emails) != 2 {
+		t.Fatalf("The run should have the result of its 2 emails: %+v", emails)
+	}
+	res, err = a.SelectSchedulerRuns(SchedulerRunsQuery{ID: uuid.New()})
+	if err != nil || res.StatusCode != http.StatusNotFound {
+		t.Fatalf("An unknown run should not be found: %+v %v", res, err)
+	}
+	if res, _ = a.SelectSchedulerRuns(SchedulerRunsQuery{Limit: 1000}); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("A too large limit should be rejected: %+v", res)
+	}
+}
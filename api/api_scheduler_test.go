@@ -2,7 +2,9 @@ package api
 
 import (
 	"context"
+	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/asendia/legacy-api/data"
 	"github.com/asendia/legacy-api/simple"
@@ -120,3 +122,165 @@ func TestSelectInactiveMessages(t *testing.T) {
 		}
 	}
 }
+
+func TestTestamentDeliveriesPerReceiver(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Errorf("Cannot begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	aFe := APIForFrontend{Context: ctx, Tx: tx}
+	msg := generateMessageTemplate()
+	res, err := aFe.InsertMessage(
+		generateJwtMessageTemplate(msg.EmailCreator),
+		APIParamInsertMessage{
+			EmailReceivers:       msg.EmailReceivers,
+			MessageContent:       msg.MessageContent,
+			InactivePeriodDays:   msg.InactivePeriodDays,
+			ReminderIntervalDays: msg.ReminderIntervalDays,
+		})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	row := res.Data.(MessageData)
+	_, err = tx.Exec(ctx, "UPDATE messages SET inactive_at = $1 WHERE id = $2",
+		simple.TimeTodayUTC().Add(-simple.DaysToDuration(2)), row.ID)
+	if err != nil {
+		t.Fatalf("Failed to update inactive_at: %v", err)
+	}
+	queries := data.New(tx)
+	// First receiver got the testament, second one failed
+	_, err = queries.InsertTestamentDelivery(ctx, data.InsertTestamentDeliveryParams{
+		MessageID:     row.ID,
+		EmailReceiver: msg.EmailReceivers[0],
+		Status:        DeliveryStatusSent,
+		VendorID:      "MAILJET",
+		SentAt:        sql.NullTime{Time: time.Now(), Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert testament delivery: %v", err)
+	}
+	_, err = queries.InsertTestamentDelivery(ctx, data.InsertTestamentDeliveryParams{
+		MessageID:     row.ID,
+		EmailReceiver: msg.EmailReceivers[1],
+		Status:        DeliveryStatusFailed,
+		VendorID:      "MAILJET",
+		ErrorMessage:  "Mailbox is full",
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert testament delivery: %v", err)
+	}
+	inactiveRows, err := queries.SelectInactiveMessages(ctx, data.SelectInactiveMessagesParams{
+		Today:      simple.TimeTodayUTC(),
+		MessageIds: []uuid.UUID{row.ID},
+		BatchSize:  100,
+	})
+	if err != nil {
+		t.Fatalf("Select inactive messages failed: %v", err)
+	}
+	retryReceivers := []string{}
+	for _, r := range inactiveRows {
+		if r.MsgID == row.ID {
+			retryReceivers = append(retryReceivers, r.RcvEmailReceiver)
+		}
+	}
+	if len(retryReceivers) != 1 || retryReceivers[0] != msg.EmailReceivers[1] {
+		t.Fatalf("Only the failed receiver should be retried, got: %v", retryReceivers)
+	}
+	msgRow, err := queries.UpdateMessageAfterSendingTestament(ctx, data.UpdateMessageAfterSendingTestamentParams{
+		Today: simple.TimeTodayUTC(),
+		ID:    row.ID,
+	})
+	if err != nil {
+		t.Fatalf("UpdateMessageAfterSendingTestament failed: %v", err)
+	}
+	if !msgRow.IsActive || msgRow.SentCounter != 1 {
+		t.Fatalf("Message should stay active until every receiver is delivered: %+v", msgRow)
+	}
+	delivery, err := queries.InsertTestamentDelivery(ctx, data.InsertTestamentDeliveryParams{
+		MessageID:     row.ID,
+		EmailReceiver: msg.EmailReceivers[1],
+		Status:        DeliveryStatusSent,
+		VendorID:      "MAILJET",
+		SentAt:        sql.NullTime{Time: time.Now(), Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert testament delivery: %v", err)
+	}
+	if delivery.Attempt != 2 {
+		t.Fatalf("Second delivery to the same receiver should be attempt 2, got: %d", delivery.Attempt)
+	}
+	msgRow, err = queries.UpdateMessageAfterSendingTestament(ctx, data.UpdateMessageAfterSendingTestamentParams{
+		Today: simple.TimeTodayUTC(),
+		ID:    row.ID,
+	})
+	if err != nil {
+		t.Fatalf("UpdateMessageAfterSendingTestament failed: %v", err)
+	}
+	if msgRow.IsActive {
+		t.Fatal("Message should be deactivated once every receiver is delivered")
+	}
+	deliveries, err := queries.SelectTestamentDeliveries(ctx, row.ID)
+	if err != nil {
+		t.Fatalf("Select testament deliveries failed: %v", err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("Expected 3 delivery records, got: %d", len(deliveries))
+	}
+}
+
+func TestSchedulerParamsSelectMessages(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	aFe := APIForFrontend{Context: ctx, Tx: tx}
+	msgIDs := []uuid.UUID{}
+	for i := 0; i < 2; i++ {
+		msg := generateMessageTemplate()
+		res, err := aFe.InsertMessage(
+			generateJwtMessageTemplate(msg.EmailCreator),
+			APIParamInsertMessage{
+				EmailReceivers:       msg.EmailReceivers,
+				MessageContent:       msg.MessageContent,
+				InactivePeriodDays:   msg.InactivePeriodDays,
+				ReminderIntervalDays: msg.ReminderIntervalDays,
+			})
+		if err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		row := res.Data.(MessageData)
+		_, err = tx.Exec(ctx, `UPDATE messages SET next_reminder_at = $1 WHERE id = $2`,
+			simple.TimeTodayUTC().Add(-simple.DaysToDuration(1)), row.ID)
+		if err != nil {
+			t.Fatalf("Failed to update next_reminder_at: %v", err)
+		}
+		msgIDs = append(msgIDs, row.ID)
+	}
+	a := APIForScheduler{Context: ctx, Tx: tx, Params: SchedulerParams{MessageIDs: msgIDs[:1]}}
+	res, err := a.SelectMessagesNeedReminding()
+	if err != nil {
+		t.Fatalf("Select messages need reminding failed: %v", err)
+	}
+	for _, msg := range res.Data.([]MessageData) {
+		if msg.ID != msgIDs[0] {
+			t.Fatalf("Only the message of messageIds should be selected, got: %s", msg.ID)
+		}
+	}
+	if len(res.Data.([]MessageData)) == 0 {
+		t.Fatalf("Message of messageIds should be selected")
+	}
+	// The messages were not due yet 2 days ago
+	a.Params.Today = simple.TimeTodayUTC().Add(-simple.DaysToDuration(2)).Format("2006-01-02")
+	res, err = a.SelectMessagesNeedReminding()
+	if err != nil {
+		t.Fatalf("Select messages need reminding failed: %v", err)
+	}
+	if len(res.Data.([]MessageData)) != 0 {
+		t.Fatalf("No message should be due 2 days ago, got: %d", len(res.Data.([]MessageData)))
+	}
+}
@@ -1,34 +1,95 @@
 package api
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/asendia/legacy-api/data"
 	"github.com/asendia/legacy-api/mail"
+	"github.com/asendia/legacy-api/secure"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	DeliveryStatusQueued = "queued"
+	DeliveryStatusSent   = "sent"
+	DeliveryStatusFailed = "failed"
+	// A concurrent insert of the same attempt is retried with the next attempt number
+	deliveryInsertRetries = 3
 )
 
 // Machine facing queries
+
+// SendTestamentsOfInactiveMessages queues the testaments of every inactive message, one committed chunk of messages at a time
 func (a *APIForScheduler) SendTestamentsOfInactiveMessages() (res APIResponse, err error) {
-	queries := data.New(a.Tx)
-	rows, err := queries.SelectInactiveMessages(a.Context)
+	keys, err := LoadMessageKeysFromEnv()
 	if err != nil {
 		res.StatusCode = http.StatusInternalServerError
-		res.ResponseMsg = "Failed to select inactive messages"
+		res.ResponseMsg = "Failed to load encryption keys"
 		return
 	}
-	mailItems := []mail.MailItem{}
+	hasher, err := secure.LoadSecretHasherFromEnv()
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to load secret pepper"
+		return
+	}
+	summary := SchedulerRunSummary{}
+	last, err := a.drainInChunks(&summary, func(queries *data.Queries, after messageCursor) (int, messageCursor, error) {
+		return a.sendTestamentsChunk(queries, keys, hasher, after, &summary)
+	})
+	res.Data = &summary
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to queue testament emails"
+		return res, err
+	}
+	summary.Remaining, err = data.New(a.Tx).CountInactiveMessages(a.Context, data.CountInactiveMessagesParams{
+		Today:          a.Params.today(),
+		MessageIds:     a.Params.messageIDs(),
+		AfterCreatedAt: last.CreatedAt,
+		AfterID:        last.ID,
+	})
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		res.ResponseMsg = "Failed to count remaining inactive messages"
+		return res, err
+	}
+	res.StatusCode = http.StatusOK
+	if summary.Queued == 0 {
+		res.ResponseMsg = "No testament message is sent this time"
+		return res, nil
+	}
+	res.ResponseMsg = "Testament emails queued successfully"
+	return res, nil
+}
+
+func (a *APIForScheduler) sendTestamentsChunk(queries *data.Queries, keys MessageKeys, hasher secure.SecretHasher,
+	after messageCursor, summary *SchedulerRunSummary) (count int, last messageCursor, err error) {
+	rows, err := a.selectInactiveMessages(queries, after, a.Params.DryRun)
+	if err != nil {
+		return 0, last, err
+	}
+	queued := 0
+	msgIDs := []uuid.UUID{}
+	msgIDsMap := map[uuid.UUID]bool{}
 	messageContentMap := map[uuid.UUID]string{}
 	for _, row := range rows {
+		if last.ID != row.MsgID {
+			count++
+			last = messageCursor{CreatedAt: row.MsgCreatedAt, ID: row.MsgID}
+			summary.messageIDs = append(summary.messageIDs, row.MsgID)
+		}
 		msgContent := messageContentMap[row.MsgID]
 		if msgContent == "" {
-			dMsgContent, err := DecryptMessageContent(row.MsgContentEncrypted, os.Getenv("ENCRYPTION_KEY"))
+			dMsgContent, err := DecryptMessageContent(a.Context, row.MsgContentEncrypted, row.DkWrappedKey.String, keys)
 			if err != nil {
 				fmt.Printf("Failed to decrypt message: %v\n", err)
+				summary.Skipped++
 				continue
 			}
 			messageContentMap[row.MsgID] = dMsgContent
@@ -41,20 +102,25 @@ func (a *APIForScheduler) SendTestamentsOfInactiveMessages() (res APIResponse, e
 				"secret text that should have been given to you by the writer of this will." +
 				``
 		}
+		unsubscribeSecret, unsubscribeSecretHash, err := hasher.GenerateHashedSecret(ExtensionSecretLength)
+		if err != nil {
+			return 0, last, err
+		}
 		msgParam := mail.TestamentEmailParams{
 			Title:                 "Message from " + row.MsgEmailCreator + " sent by sejiwo.com",
 			FullName:              row.RcvEmailReceiver,
 			EmailCreator:          row.MsgEmailCreator,
 			MessageContentPerLine: strings.Split(msgContent, "\n"),
-			UnsubscribeURL:        fmt.Sprintf("https://sejiwo.com/unsubscribe?id=%s&secret=%s", row.MsgID, row.RcvUnsubscribeSecret),
+			UnsubscribeURL:        fmt.Sprintf("https://sejiwo.com/unsubscribe?id=%s&secret=%s", row.MsgID, unsubscribeSecret),
 			HowToDecrypt:          howToDecrypt,
 		}
 		mmsgHTML, err := mail.GenerateTestamentEmail(msgParam)
 		if err != nil {
 			fmt.Printf("Failed generating testament email: %v\n", err)
+			summary.Skipped++
 			continue
 		}
-		mailItems = append(mailItems, mail.MailItem{
+		mailItem := mail.MailItem{
 			From: mail.MailAddress{
 				Email: "noreply@sejiwo.com",
 				Name:  "Sejiwo Service",
@@ -67,42 +133,76 @@ func (a *APIForScheduler) SendTestamentsOfInactiveMessages() (res APIResponse, e
 			},
 			Subject:     msgParam.Title,
 			HtmlContent: mmsgHTML,
+		}
+		delivery, err := insertTestamentDelivery(a.Context, queries, data.InsertTestamentDeliveryParams{
+			MessageID:     row.MsgID,
+			EmailReceiver: row.RcvEmailReceiver,
+			Status:        DeliveryStatusQueued,
 		})
-	}
-	if len(mailItems) == 0 {
-		res.StatusCode = http.StatusOK
-		res.ResponseMsg = "No testament message is sent this time"
-		return
-	}
-	smResList := mail.SendEmails(mailItems)
-	for id, smRes := range smResList {
-		if smRes.Err == nil {
-			_, err := queries.UpdateMessageAfterSendingTestament(a.Context, rows[id].MsgID)
+		if err != nil {
+			return 0, last, err
+		}
+		outboxRow, isQueued, err := enqueueEmail(a.Context, queries, keys, data.InsertEmailOutboxParams{
+			IdempotencyKey: outboxIdempotencyKey(EmailKindTestament, row.MsgID, row.RcvEmailReceiver, delivery.Attempt),
+			Kind:           EmailKindTestament,
+			MessageID:      row.MsgID,
+			EmailReceiver:  row.RcvEmailReceiver,
+			DeliveryID:     uuid.NullUUID{UUID: delivery.ID, Valid: true},
+		}, mailItem)
+		if err != nil {
+			return 0, last, err
+		}
+		if isQueued {
+			queued++
+			summary.queuedEmails = append(summary.queuedEmails, outboxRow)
+			err = queries.UpdateReceiverUnsubscribeSecretHash(a.Context, data.UpdateReceiverUnsubscribeSecretHashParams{
+				MessageID:             row.MsgID,
+				EmailReceiver:         row.RcvEmailReceiver,
+				UnsubscribeSecretHash: unsubscribeSecretHash,
+				// The links of the emails sent before the secret hashes keep working
+				LegacyUnsubscribeSecretHash: legacySecretHash(hasher, row.RcvUnsubscribeSecret),
+			})
 			if err != nil {
-				fmt.Printf("Failed to update message inactive_at and next_reminder_at: %v\n", err)
-				smRes.Err = err
+				return 0, last, err
 			}
-			continue
 		}
-		fmt.Printf("An email probably gets an error: %v\n", smRes.Err)
-		err := queries.UpdateEmail(a.Context, data.UpdateEmailParams{
-			IsActive: false,
-			Email:    rows[id].RcvEmailReceiver,
+		if !msgIDsMap[row.MsgID] {
+			msgIDsMap[row.MsgID] = true
+			msgIDs = append(msgIDs, row.MsgID)
+		}
+	}
+	summary.Queued += queued
+	if queued == 0 {
+		return count, last, nil
+	}
+	// Once per message, the receivers are marked as delivered by DispatchEmailOutbox
+	for _, msgID := range msgIDs {
+		_, err := queries.UpdateMessageAfterSendingTestament(a.Context, data.UpdateMessageAfterSendingTestamentParams{
+			Today: a.Params.today(),
+			ID:    msgID,
 		})
 		if err != nil {
-			fmt.Printf("Failed updating email IsActive status: %v\n", err.Error())
-			smRes.Err = errors.New(smRes.Err.Error() + " & " + err.Error())
+			return 0, last, err
 		}
 	}
-	res.StatusCode = http.StatusOK
-	res.ResponseMsg = "Testament emails sent successfully"
-	res.Data = smResList
-	return res, err
+	return count, last, nil
+}
+
+// insertTestamentDelivery inserts the next attempt of the receiver. The attempt number is computed by the insert,
+// two inserts of the same receiver can compute the same number, the one that loses the unique constraint retries.
+func insertTestamentDelivery(ctx context.Context, queries *data.Queries, param data.InsertTestamentDeliveryParams) (delivery data.TestamentDelivery, err error) {
+	for i := 0; i < deliveryInsertRetries; i++ {
+		delivery, err = queries.InsertTestamentDelivery(ctx, param)
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return delivery, err
+		}
+	}
+	return delivery, fmt.Errorf("cannot insert a testament delivery of %s to %s: %w", param.MessageID, param.EmailReceiver, err)
 }
 
 func (a *APIForScheduler) SelectInactiveMessages() (res APIResponse, err error) {
 	queries := data.New(a.Tx)
-	rows, err := queries.SelectInactiveMessages(a.Context)
+	rows, err := a.selectInactiveMessages(queries, messageCursor{}, true)
 	if err != nil {
 		res.StatusCode = http.StatusInternalServerError
 		return
@@ -110,3 +210,27 @@ func (a *APIForScheduler) SelectInactiveMessages() (res APIResponse, err error)
 	res.Data = rows
 	return res, err
 }
+
+// selectInactiveMessages claims the inactive messages after the cursor, read only they are not locked, e.g. for the dry run
+func (a *APIForScheduler) selectInactiveMessages(queries *data.Queries, after messageCursor, isReadOnly bool) ([]data.SelectInactiveMessagesRow, error) {
+	params := a.selectInactiveMessagesParams(after)
+	if !isReadOnly {
+		return queries.SelectInactiveMessages(a.Context, params)
+	}
+	readOnlyRows, err := queries.SelectInactiveMessagesReadOnly(a.Context, data.SelectInactiveMessagesReadOnlyParams(params))
+	rows := make([]data.SelectInactiveMessagesRow, len(readOnlyRows))
+	for i, row := range readOnlyRows {
+		rows[i] = data.SelectInactiveMessagesRow(row)
+	}
+	return rows, err
+}
+
+func (a *APIForScheduler) selectInactiveMessagesParams(after messageCursor) data.SelectInactiveMessagesParams {
+	return data.SelectInactiveMessagesParams{
+		Today:          a.Params.today(),
+		MessageIds:     a.Params.messageIDs(),
+		AfterCreatedAt: after.CreatedAt,
+		AfterID:        after.ID,
+		BatchSize:      a.Params.batchSize(),
+	}
+}
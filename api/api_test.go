@@ -41,27 +41,30 @@ func TestMain(m *testing.M) {
 
 func deleteAndCreateTableMessages(ctx context.Context, tx pgx.Tx) error {
 	// Delete the table "messages if any"
-	qDropTable := `DROP TABLE IF EXISTS public.messages_email_receivers;
+	qDropTable := `DROP TABLE IF EXISTS public.mail_vendor_quotas;
+	DROP TABLE IF EXISTS public.scheduler_run_emails;
+	DROP TABLE IF EXISTS public.scheduler_runs;
+	DROP TABLE IF EXISTS public.cron_jobs;
+	DROP TABLE IF EXISTS public.rate_limits;
+	DROP TABLE IF EXISTS public.secret_attempt_failures;
+	DROP TABLE IF EXISTS public.message_data_keys;
+	DROP TABLE IF EXISTS public.email_outbox;
+	DROP TABLE IF EXISTS public.testament_deliveries;
+	DROP TABLE IF EXISTS public.messages_email_receivers;
 	DROP TABLE IF EXISTS public.messages;
 	DROP TABLE IF EXISTS public.emails;
+	DROP TABLE IF EXISTS public.schema_migrations;
 	`
 	if _, err := tx.Exec(ctx, string(qDropTable)); err != nil {
 		return err
 	}
-	// Create the tables
-	qCreateTable, err := os.ReadFile("../data/schema.sql")
-	if err != nil {
-		return err
-	}
-	if _, err := tx.Exec(ctx, string(qCreateTable)); err != nil {
-		return err
-	}
-	return nil
+	// Create the tables, tx.Begin creates a savepoint for each migration
+	_, err := data.MigrateUp(ctx, tx, false)
+	return err
 }
 
 func generateMessageTemplate() MessageData {
 	rdstr, _ := secure.GenerateRandomString(10)
-	extensionSecret, _ := secure.GenerateRandomString(ExtensionSecretLength)
 	return MessageData{
 		InactivePeriodDays:   90,
 		ReminderIntervalDays: 15,
@@ -71,8 +74,7 @@ func generateMessageTemplate() MessageData {
 			rdstr + "-test-receiver-1@sejiwo.com",
 			rdstr + "-test-receiver-2@sejiwo.com",
 		},
-		ExtensionSecret: extensionSecret,
-		IsActive:        true,
+		IsActive: true,
 	}
 }
 
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/asendia/legacy-api/data"
+)
+
+// PostgresQuotaStore shares the daily quotas of the mail vendors between instances. Every call commits its own
+// transaction, a reservation has to be visible to the other instances before the emails are sent.
+type PostgresQuotaStore struct {
+	DB TxBeginner
+}
+
+func (s PostgresQuotaStore) ReserveQuota(ctx context.Context, vendorID string, day time.Time, count int, dailyLimit int) (int, error) {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	queries := data.New(tx)
+	err = queries.InsertMailVendorQuotaIfNotExists(ctx, data.InsertMailVendorQuotaIfNotExistsParams{VendorID: vendorID, Day: day})
+	if err != nil {
+		return 0, err
+	}
+	// Locks the row until the reservation is committed
+	sentCount, err := queries.SelectMailVendorQuotaForUpdate(ctx, data.SelectMailVendorQuotaForUpdateParams{VendorID: vendorID, Day: day})
+	if err != nil {
+		return 0, err
+	}
+	reserved := min(count, max(dailyLimit-int(sentCount), 0))
+	if reserved == 0 {
+		return 0, nil
+	}
+	err = queries.UpdateMailVendorQuota(ctx, data.UpdateMailVendorQuotaParams{
+		SentCount: sentCount + int32(reserved),
+		VendorID:  vendorID,
+		Day:       day,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return reserved, tx.Commit(ctx)
+}
+
+func (s PostgresQuotaStore) ReleaseQuota(ctx context.Context, vendorID string, day time.Time, count int) error {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	err = data.New(tx).ReleaseMailVendorQuota(ctx, data.ReleaseMailVendorQuotaParams{Count: int32(count), VendorID: vendorID, Day: day})
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
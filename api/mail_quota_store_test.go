@@ -0,0 +1,40 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/asendia/legacy-api/mail"
+	"github.com/asendia/legacy-api/simple"
+	"github.com/google/uuid"
+)
+
+func TestPostgresQuotaStore(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	store := PostgresQuotaStore{DB: tx}
+	vendorID := uuid.NewString()[:20]
+	today := simple.TimeTodayUTC()
+	if reserved, err := store.ReserveQuota(ctx, vendorID, today, 3, 5); err != nil || reserved != 3 {
+		t.Fatalf("Expected 3 reserved emails: %d %v", reserved, err)
+	}
+	if reserved, err := store.ReserveQuota(ctx, vendorID, today, 3, 5); err != nil || reserved != 2 {
+		t.Fatalf("Only 2 emails are left today: %d %v", reserved, err)
+	}
+	if reserved, err := store.ReserveQuota(ctx, vendorID, mail.NextQuotaDay(), 3, 5); err != nil || reserved != 3 {
+		t.Fatalf("The quota of the next day should be full: %d %v", reserved, err)
+	}
+	if err = store.ReleaseQuota(ctx, vendorID, today, 4); err != nil {
+		t.Fatalf("ReleaseQuota failed: %v", err)
+	}
+	if reserved, err := store.ReserveQuota(ctx, vendorID, today, 10, 5); err != nil || reserved != 4 {
+		t.Fatalf("The released emails should be reserved again: %d %v", reserved, err)
+	}
+	if reserved, err := store.ReserveQuota(ctx, vendorID, today, 1, 5); err != nil || reserved != 0 {
+		t.Fatalf("The daily limit is reached: %d %v", reserved, err)
+	}
+}
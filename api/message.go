@@ -1,10 +1,12 @@
 package api
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"strings"
 	"time"
 
+	"github.com/asendia/legacy-api/data"
 	"github.com/asendia/legacy-api/secure"
 	"github.com/google/uuid"
 )
@@ -34,7 +36,6 @@ type MessageData struct {
 	InactivePeriodDays   int32     `json:"inactivePeriodDays"`
 	ReminderIntervalDays int32     `json:"reminderIntervalDays"`
 	IsActive             bool      `json:"isActive"`
-	ExtensionSecret      string    `json:"extension_secret"`
 	InactiveAt           time.Time `json:"inactiveAt"`
 	NextReminderAt       time.Time `json:"nextReminderAt"`
 	SentCounter          int32     `json:"sentCounter"`
@@ -42,13 +43,72 @@ type MessageData struct {
 
 const encryptPrefixText = "aes.utf8:"
 
-func DecryptMessageContent(str string, secret string) (string, error) {
+// MessageKeys holds the keys of every message content format
+type MessageKeys struct {
+	// Keyring decrypts the content encrypted before the per-message data keys
+	Keyring     secure.Keyring
+	KeyProvider secure.KeyProvider
+}
+
+func LoadMessageKeysFromEnv() (keys MessageKeys, err error) {
+	keys.Keyring, err = secure.LoadKeyringFromEnv()
+	if err != nil {
+		return keys, err
+	}
+	keys.KeyProvider, err = secure.LoadKeyProviderFromEnv()
+	return keys, err
+}
+
+type EncryptedMessageContent struct {
+	ContentEncrypted string
+	// WrappedDataKey & KEKID are empty for client encrypted content, it has no data key
+	WrappedDataKey string
+	KEKID          string
+}
+
+// EncryptMessageContent encrypts the content with a new data key wrapped by the KeyProvider
+func EncryptMessageContent(ctx context.Context, str string, keys MessageKeys) (res EncryptedMessageContent, err error) {
+	if isProbablyClientEncrypted(str) {
+		return EncryptedMessageContent{ContentEncrypted: str}, nil
+	}
+	sealed, dataKey, err := secure.SealWithDataKey(str)
+	if err != nil {
+		return res, err
+	}
+	res.WrappedDataKey, res.KEKID, err = keys.KeyProvider.WrapKey(ctx, dataKey)
+	if err != nil {
+		return res, err
+	}
+	res.ContentEncrypted = sealed
+	return res, nil
+}
+
+// DecryptMessageContent supports the per-message data key envelope, the v2 AES-GCM envelope
+// sealed with a keyring key & the legacy AES-CFB "iv.base64" format
+func DecryptMessageContent(ctx context.Context, str string, wrappedDataKey string, keys MessageKeys) (string, error) {
 	if isProbablyClientEncrypted(str) {
 		return str, nil
 	}
+	if strings.HasPrefix(str, secure.EnvelopePrefix(secure.DataKeyID)) {
+		if wrappedDataKey == "" {
+			return "", secure.ErrDataKeyNotFound
+		}
+		dataKey, err := keys.KeyProvider.UnwrapKey(ctx, wrappedDataKey)
+		if err != nil {
+			return "", err
+		}
+		return secure.OpenWithDataKey(str, dataKey)
+	}
+	if secure.IsEnvelope(str) {
+		return keys.Keyring.Open(str)
+	}
 	encryptedArr := strings.Split(str, ".")
 	if len(encryptedArr) != 2 {
-		return "", errors.New("invalid encrypted string")
+		return "", fmt.Errorf("%w: unknown message content format", secure.ErrInvalidCiphertext)
+	}
+	secret, err := keys.Keyring.Secret(secure.LegacyKeyID)
+	if err != nil {
+		return "", err
 	}
 	msgContent, err := secure.Decrypt(
 		secure.EncryptResult{IV: encryptedArr[0], Text: encryptedArr[1]},
@@ -56,15 +116,28 @@ func DecryptMessageContent(str string, secret string) (string, error) {
 	return msgContent, err
 }
 
-func EncryptMessageContent(str string, secret string) (string, error) {
-	if isProbablyClientEncrypted(str) {
-		return str, nil
+// saveMessageDataKey stores the data key of the content, or removes the stale one of client encrypted content
+func saveMessageDataKey(ctx context.Context, queries *data.Queries, msgID uuid.UUID, encrypted EncryptedMessageContent) error {
+	if encrypted.WrappedDataKey == "" {
+		return queries.DeleteMessageDataKey(ctx, msgID)
 	}
-	encrypted, err := secure.Encrypt(str, secret)
-	if err != nil {
-		return "", err
-	}
-	return encrypted.IV + "." + encrypted.Text, nil
+	return queries.UpsertMessageDataKey(ctx, data.UpsertMessageDataKeyParams{
+		MessageID:  msgID,
+		KekID:      encrypted.KEKID,
+		WrappedKey: encrypted.WrappedDataKey,
+	})
+}
+
+// isReencryptionNeeded is true for server encrypted content which has no data key yet
+func isReencryptionNeeded(str string) bool {
+	return !isProbablyClientEncrypted(str) && !strings.HasPrefix(str, secure.EnvelopePrefix(secure.DataKeyID))
+}
+
+// newSecretHash returns the hash of a discarded random secret, the secrets of the email links
+// are only issued when the reminder & testament emails are queued
+func newSecretHash(hasher secure.SecretHasher) (string, error) {
+	_, hash, err := hasher.GenerateHashedSecret(ExtensionSecretLength)
+	return hash, err
 }
 
 func isProbablyClientEncrypted(str string) bool {
@@ -1,22 +1,111 @@
 package api
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/asendia/legacy-api/secure"
+)
+
+func generateMessageKeysTemplate() MessageKeys {
+	keyring := secure.Keyring{ActiveKeyID: "2026-10", Keys: map[string]string{
+		secure.LegacyKeyID: "32 characterslengthneedtosethere",
+		"2026-10":          "rotated key with 32 characters!!",
+	}}
+	return MessageKeys{Keyring: keyring, KeyProvider: secure.LocalKeyProvider{Keyring: keyring}}
+}
 
 func TestEncryptDecryptClientEncryptedMessage(t *testing.T) {
+	ctx := context.Background()
 	message := "aes.utf8:thisisclientencrypteddummy"
-	key := "uselesssecret"
-	result, err := EncryptMessageContent(message, key)
+	keys := MessageKeys{}
+	result, err := EncryptMessageContent(ctx, message, keys)
 	if err != nil {
 		t.Fatalf("EncryptMessageContent is failed to handle client encrypted message")
 	}
-	if message != result {
+	if message != result.ContentEncrypted || result.WrappedDataKey != "" {
 		t.Fatal("Client encrypted message should not be encrypted again")
 	}
-	result, err = DecryptMessageContent(result, key)
+	decrypted, err := DecryptMessageContent(ctx, result.ContentEncrypted, "", keys)
 	if err != nil {
 		t.Fatalf("DecryptMessageContent is failed to handle client encrypted message")
 	}
-	if message != result {
+	if message != decrypted {
 		t.Fatal("Client encrypted message should be passed as is")
 	}
 }
+
+func TestEncryptDecryptMessageContent(t *testing.T) {
+	ctx := context.Background()
+	keys := generateMessageKeysTemplate()
+	message := "Hello World!!!"
+	result, err := EncryptMessageContent(ctx, message, keys)
+	if err != nil {
+		t.Fatalf("EncryptMessageContent failed: %v", err)
+	}
+	if !strings.HasPrefix(result.ContentEncrypted, "v2:gcm:dek:") ||
+		!strings.HasPrefix(result.WrappedDataKey, "v2:gcm:2026-10:") || result.KEKID != "2026-10" {
+		t.Fatalf("Message content should be sealed with a data key wrapped by the active key: %+v", result)
+	}
+	decrypted, err := DecryptMessageContent(ctx, result.ContentEncrypted, result.WrappedDataKey, keys)
+	if err != nil || decrypted != message {
+		t.Fatalf("DecryptMessageContent failed: %s %v", decrypted, err)
+	}
+	if isReencryptionNeeded(result.ContentEncrypted) {
+		t.Fatal("Message content sealed with a data key should not be re-encrypted")
+	}
+	// Crypto-shredding: without its data key the content is unreadable
+	_, err = DecryptMessageContent(ctx, result.ContentEncrypted, "", keys)
+	if !errors.Is(err, secure.ErrDataKeyNotFound) {
+		t.Fatalf("Message content without data key should fail with ErrDataKeyNotFound, got %v", err)
+	}
+	retired, err := secure.SealEnvelope(message, secure.LegacyKeyID, keys.Keyring.Keys[secure.LegacyKeyID])
+	if err != nil {
+		t.Fatalf("SealEnvelope failed: %v", err)
+	}
+	decrypted, err = DecryptMessageContent(ctx, retired, "", keys)
+	if err != nil || decrypted != message {
+		t.Fatalf("Message content sealed with a keyring key should still be decrypted: %s %v", decrypted, err)
+	}
+	if !isReencryptionNeeded(retired) {
+		t.Fatal("Message content sealed with a keyring key should be re-encrypted")
+	}
+}
+
+func TestDecryptLegacyMessageContent(t *testing.T) {
+	ctx := context.Background()
+	keys := generateMessageKeysTemplate()
+	message := "Hello World!!!"
+	encrypted, err := secure.Encrypt(message, keys.Keyring.Keys[secure.LegacyKeyID])
+	if err != nil {
+		t.Fatalf("Legacy encryption failed: %v", err)
+	}
+	legacy := encrypted.IV + "." + encrypted.Text
+	decrypted, err := DecryptMessageContent(ctx, legacy, "", keys)
+	if err != nil || decrypted != message {
+		t.Fatalf("Legacy AES-CFB message content should still be decrypted: %s %v", decrypted, err)
+	}
+	if !isReencryptionNeeded(legacy) {
+		t.Fatal("Legacy message content should be re-encrypted")
+	}
+}
+
+func TestDecryptInvalidMessageContent(t *testing.T) {
+	ctx := context.Background()
+	keys := generateMessageKeysTemplate()
+	cases := map[string]error{
+		"no separator":                         secure.ErrInvalidCiphertext,
+		"0123456789abcdef.not base64!!!":       secure.ErrInvalidCiphertext,
+		"v2:gcm:default:AAAA":                  secure.ErrInvalidCiphertext,
+		"v2:gcm:another-key:AAAA:AAAA":         secure.ErrUnknownKey,
+		"v2:gcm:default:AAAAAAAAAAAAAAAA:AAAA": secure.ErrDecryptionFailed,
+		"v2:gcm:dek:AAAAAAAAAAAAAAAA:AAAA":     secure.ErrDataKeyNotFound,
+	}
+	for str, expectedErr := range cases {
+		if _, err := DecryptMessageContent(ctx, str, "", keys); !errors.Is(err, expectedErr) {
+			t.Fatalf("Decrypting %s should fail with %v, got %v", str, expectedErr, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
+)
+
+// PostgresAttemptStore shares the rate limits between instances. It should not use the request transaction,
+// the failures of a rejected request have to be committed.
+type PostgresAttemptStore struct {
+	DB data.DBTX
+}
+
+func (s PostgresAttemptStore) Hit(ctx context.Context, key string, now time.Time, window time.Duration) (secure.AttemptState, error) {
+	row, err := data.New(s.DB).HitRateLimit(ctx, data.HitRateLimitParams{
+		Key:              key,
+		Now:              now,
+		WindowStartAfter: now.Add(-window),
+	})
+	return toAttemptState(row), err
+}
+
+func (s PostgresAttemptStore) Fail(ctx context.Context, key string, now time.Time, lockout func(failures int) time.Duration) (secure.AttemptState, error) {
+	queries := data.New(s.DB)
+	row, err := queries.FailRateLimit(ctx, data.FailRateLimitParams{Key: key, Now: now})
+	if err != nil {
+		return secure.AttemptState{}, err
+	}
+	state := toAttemptState(row)
+	if lockedUntil := now.Add(lockout(state.Failures)); lockedUntil.After(state.LockedUntil) {
+		err = queries.LockRateLimit(ctx, data.LockRateLimitParams{LockedUntil: lockedUntil, Key: key})
+		state.LockedUntil = lockedUntil
+	}
+	return state, err
+}
+
+func (s PostgresAttemptStore) Reset(ctx context.Context, key string) error {
+	return data.New(s.DB).ResetRateLimitFailures(ctx, key)
+}
+
+func toAttemptState(row data.RateLimit) secure.AttemptState {
+	return secure.AttemptState{
+		Hits:        int(row.Hits),
+		WindowStart: row.WindowStart,
+		Failures:    int(row.Failures),
+		LockedUntil: row.LockedUntil,
+	}
+}
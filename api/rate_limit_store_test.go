@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
+	"github.com/google/uuid"
+)
+
+func TestPostgresAttemptStore(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	now := time.Now().Truncate(time.Second)
+	l := secure.RateLimiter{
+		Store:  PostgresAttemptStore{DB: tx},
+		Policy: secure.RateLimitPolicy{Window: time.Minute, MaxHits: 2, MaxFailures: 1, BaseLockout: time.Minute, MaxLockout: time.Hour},
+		Now:    func() time.Time { return now },
+	}
+	key := "ip:" + uuid.NewString()
+	for i := 0; i < 2; i++ {
+		if retryAfter, err := l.Allow(ctx, key); err != nil || retryAfter != 0 {
+			t.Fatalf("Request %d should be allowed: %v %v", i, retryAfter, err)
+		}
+	}
+	if retryAfter, err := l.Allow(ctx, key); err != nil || retryAfter <= 0 {
+		t.Fatalf("Request over the limit should be rejected: %v %v", retryAfter, err)
+	}
+	now = now.Add(time.Minute)
+	if retryAfter, err := l.Allow(ctx, key); err != nil || retryAfter != 0 {
+		t.Fatalf("The limit should restart in the next window: %v %v", retryAfter, err)
+	}
+	if failures, err := l.Fail(ctx, key); err != nil || failures != 1 {
+		t.Fatalf("Expected 1 failure: %d %v", failures, err)
+	}
+	if retryAfter, err := l.Allow(ctx, key); err != nil || retryAfter != time.Minute {
+		t.Fatalf("The key should be locked out for a minute: %v %v", retryAfter, err)
+	}
+	l.Fail(ctx, key)
+	if retryAfter, _ := l.Allow(ctx, key); retryAfter != 2*time.Minute {
+		t.Fatalf("The lockout should be doubled, got: %v", retryAfter)
+	}
+	if err := l.Succeed(ctx, key); err != nil {
+		t.Fatalf("Succeed failed: %v", err)
+	}
+	if retryAfter, _ := l.Allow(ctx, key); retryAfter != 0 {
+		t.Fatalf("Success should clear the lockout, got: %v", retryAfter)
+	}
+}
+
+func TestSelectSecretAttemptFailures(t *testing.T) {
+	ctx := context.Background()
+	tx, err := pgxPoolConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	messageID := uuid.NullUUID{UUID: uuid.New(), Valid: true}
+	for i := 0; i < secretAttemptAlertThreshold; i++ {
+		if err := RecordSecretAttemptFailure(ctx, tx, messageID, "extend-message", "10.0.0.1"); err != nil {
+			t.Fatalf("RecordSecretAttemptFailure failed: %v", err)
+		}
+	}
+	aSch := APIForScheduler{Context: ctx, Tx: tx, DB: tx}
+	res, err := aSch.SelectSecretAttemptFailures()
+	if err != nil {
+		t.Fatalf("SelectSecretAttemptFailures failed: %v", err)
+	}
+	rows := res.Data.([]data.SelectSecretAttemptFailureCountsRow)
+	found := false
+	for _, row := range rows {
+		if row.MessageID == messageID {
+			found = true
+			if row.Failures != secretAttemptAlertThreshold || row.Ips != 1 {
+				t.Fatalf("Unexpected failure count: %+v", row)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Message %s should be reported", messageID.UUID)
+	}
+}
+
+func TestSecretRateLimitKeys(t *testing.T) {
+	l := secure.RateLimiter{Store: secure.NewMemoryAttemptStore(), Policy: secure.DefaultRateLimitPolicy}
+	ctx := context.Background()
+	messageID := uuid.NullUUID{UUID: uuid.New(), Valid: true}
+	attacker := SecretRateLimitKeys("203.0.113.1", messageID)
+	owner := SecretRateLimitKeys("198.51.100.1", messageID)
+	for i := 0; i < 10; i++ {
+		l.Fail(ctx, attacker.Fail...)
+	}
+	if retryAfter, err := l.Allow(ctx, attacker.Allow...); err != nil || retryAfter == 0 {
+		t.Fatalf("The attacker should be locked out: %v %v", retryAfter, err)
+	}
+	if retryAfter, err := l.Allow(ctx, owner.Allow...); err != nil || retryAfter != 0 {
+		t.Fatalf("The failures of another IP should not lock the owner out: %v %v", retryAfter, err)
+	}
+	// A valid secret of another message does not clear the failures of the IP
+	other := SecretRateLimitKeys("203.0.113.1", uuid.NullUUID{UUID: uuid.New(), Valid: true})
+	l.Succeed(ctx, other.Succeed...)
+	if retryAfter, _ := l.Allow(ctx, attacker.Allow...); retryAfter == 0 {
+		t.Fatalf("The IP should stay locked out")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/legacy-api-secret", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if ip := ClientIP(r); ip != "192.0.2.1" {
+		t.Fatalf("Without X-Forwarded-For the remote address is the client: %s", ip)
+	}
+	// The client forges the first entry, the load balancer appends the client IP & its own address
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 203.0.113.1, 130.211.0.1")
+	if ip := ClientIP(r); ip != "203.0.113.1" {
+		t.Fatalf("The entry before the load balancer is the client: %s", ip)
+	}
+	t.Setenv("TRUSTED_PROXY_HOPS", "0")
+	if ip := ClientIP(r); ip != "130.211.0.1" {
+		t.Fatalf("Without a trusted proxy the last entry is the client: %s", ip)
+	}
+	t.Setenv("TRUSTED_PROXY_HOPS", "5")
+	if ip := ClientIP(r); ip != "10.0.0.1" {
+		t.Fatalf("The first entry is the client when there are fewer entries: %s", ip)
+	}
+}
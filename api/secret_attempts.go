@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
+	"github.com/google/uuid"
+)
+
+const (
+	// Failed attempts against one message within secretAttemptAlertWindow which are worth an alert
+	secretAttemptAlertThreshold = 20
+	secretAttemptAlertWindow    = 24 * time.Hour
+	secretAttemptRetention      = 30 * 24 * time.Hour
+	rateLimitRetention          = 24 * time.Hour
+)
+
+// The memory store has to outlive the requests, it is shared by every request of this instance
+var memoryAttemptStore = secure.NewMemoryAttemptStore()
+
+// LoadAttemptStoreFromEnv uses RATE_LIMIT_STORE: memory (default) or postgres, which is shared by every Cloud Run instance
+func LoadAttemptStoreFromEnv(db data.DBTX) (secure.AttemptStore, error) {
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "memory":
+		return memoryAttemptStore, nil
+	case "postgres":
+		return PostgresAttemptStore{DB: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE: %s", store)
+	}
+}
+
+func LoadSecretRateLimiterFromEnv(db data.DBTX) (secure.RateLimiter, error) {
+	store, err := LoadAttemptStoreFromEnv(db)
+	return secure.RateLimiter{Store: store, Policy: secure.DefaultRateLimitPolicy}, err
+}
+
+// SecretAttemptKeys are the rate limiter keys of a request of /legacy-api-secret
+type SecretAttemptKeys struct {
+	// The requests are limited per IP, per message & per IP of a message
+	Allow []string
+	// The failures lock out the IP & the IP of the message. Never the message alone, anyone could lock its owner out.
+	Fail []string
+	// A valid secret only clears the failures of its message, the other failures of the IP stay
+	Succeed []string
+}
+
+// SecretRateLimitKeys returns the keys of a request, an invalid message id is only limited per IP
+func SecretRateLimitKeys(ip string, messageID uuid.NullUUID) (keys SecretAttemptKeys) {
+	ipKey := "ip:" + ip
+	if !messageID.Valid {
+		return SecretAttemptKeys{Allow: []string{ipKey}, Fail: []string{ipKey}}
+	}
+	ipMessageKey := "ip-message:" + ip + ":" + messageID.UUID.String()
+	return SecretAttemptKeys{
+		Allow:   []string{ipKey, "message:" + messageID.UUID.String(), ipMessageKey},
+		Fail:    []string{ipKey, ipMessageKey},
+		Succeed: []string{ipMessageKey},
+	}
+}
+
+// ClientIP is the X-Forwarded-For entry right before the ones of the trusted proxies, the earlier ones can be forged.
+// TRUSTED_PROXY_HOPS is the number of proxies appending their address after the client IP, 1 for the Google load balancer.
+func ClientIP(r *http.Request) string {
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		ips := strings.Split(forwardedFor, ",")
+		i := max(len(ips)-1-trustedProxyHops(), 0)
+		return strings.TrimSpace(ips[i])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func trustedProxyHops() int {
+	hops, err := strconv.Atoi(os.Getenv("TRUSTED_PROXY_HOPS"))
+	if err != nil || hops < 0 {
+		return 1
+	}
+	return hops
+}
+
+// RecordSecretAttemptFailure stores a failed attempt, db should not be the rolled back request transaction
+func RecordSecretAttemptFailure(ctx context.Context, db data.DBTX, messageID uuid.NullUUID, action string, ip string) error {
+	return data.New(db).InsertSecretAttemptFailure(ctx, data.InsertSecretAttemptFailureParams{
+		MessageID: messageID,
+		Action:    action,
+		IP:        ip,
+	})
+}
+
+// SelectSecretAttemptFailures lists the messages with many failed secret attempts in the last 24 hours, for alerting
+func (a *APIForScheduler) SelectSecretAttemptFailures() (res APIResponse, err error) {
+	rows, err := data.New(a.Tx).SelectSecretAttemptFailureCounts(a.Context, data.SelectSecretAttemptFailureCountsParams{
+		Since:       time.Now().Add(-secretAttemptAlertWindow),
+		MinFailures: secretAttemptAlertThreshold,
+	})
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	for _, row := range rows {
+		// A log based alert can match this line
+		fmt.Printf("Possible secret brute force, message: %s failures: %d ips: %d\n", row.MessageID.UUID, row.Failures, row.Ips)
+	}
+	res.StatusCode = http.StatusOK
+	res.Data = rows
+	return res, nil
+}
+
+// DeleteExpiredRateLimits removes the idle rate limits & the old failed secret attempts
+func (a *APIForScheduler) DeleteExpiredRateLimits() (res APIResponse, err error) {
+	queries := data.New(a.Tx)
+	rateLimits, err := queries.DeleteExpiredRateLimits(a.Context, time.Now().Add(-rateLimitRetention))
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	failures, err := queries.DeleteSecretAttemptFailures(a.Context, time.Now().Add(-secretAttemptRetention))
+	if err != nil {
+		res.StatusCode = http.StatusInternalServerError
+		return res, err
+	}
+	res.StatusCode = http.StatusOK
+	res.ResponseMsg = fmt.Sprintf("Deleted %d rate limits & %d failed secret attempts", rateLimits, failures)
+	return res, nil
+}
@@ -1,39 +1,71 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	p "github.com/asendia/legacy-api"
 	"github.com/asendia/legacy-api/simple"
 )
 
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	simple.MustLoadEnv("")
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	http.HandleFunc("/legacy-api", p.CloudFunctionForFrontendWithNetlifyJWT)
 	http.HandleFunc("/legacy-api-secret", p.CloudFunctionForFrontendWithUserSecret)
+	// Alternative of the Pub/Sub triggered cloud function, every request has to be signed
+	http.HandleFunc("/legacy-api-scheduler", p.CloudFunctionForSchedulerWithSignedRequest)
+	// Push subscription of the scheduler topic, authenticated by the OIDC token of Pub/Sub
+	http.HandleFunc("/legacy-api-scheduler-push", p.CloudFunctionForSchedulerWithPubSubPush)
+	// History of the scheduler runs, signed like /legacy-api-scheduler
+	http.HandleFunc("/legacy-api-scheduler-runs", p.CloudFunctionForSchedulerRuns)
+	// Emails written to MAIL_FILE_DIR by the file mail vendor, never in prod
 	if os.Getenv("ENVIRONMENT") != "prod" {
-		// Scheduler uses cloud function in production
-		http.HandleFunc("/legacy-api-scheduler", handleScheduler)
+		devMailbox := p.DevMailboxHandler()
+		http.Handle("/dev/mailbox", devMailbox)
+		http.Handle("/dev/mailbox/", devMailbox)
 	}
-	log.Printf("Server is running on localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
-}
-
-func handleScheduler(w http.ResponseWriter, r *http.Request) {
-	var psm p.PubSubMessage
-	json.NewDecoder(r.Body).Decode(&psm)
-	err := p.CloudFunctionForSchedulerWithStaticSecret(r.Context(), psm)
+	// Optional in-process scheduler of self-hosted servers, enabled by the CRON_<ACTION> envs
+	cronScheduler, err := p.LoadCronSchedulerFromEnv(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error: %+v\n", err), http.StatusInternalServerError)
-		return
+		log.Fatalf("Cannot load the cron scheduler: %v", err)
+	}
+	cronDone := make(chan struct{})
+	go func() {
+		defer close(cronDone)
+		if cronScheduler != nil {
+			log.Printf("Cron scheduler is running %d jobs", len(cronScheduler.Jobs))
+			cronScheduler.Start(ctx)
+			cronScheduler.DB.Close()
+		}
+	}()
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Cannot shut down the server: %v", err)
+		}
+	}()
+	log.Printf("Server is running on localhost:%s", port)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
 	}
-	fmt.Fprintf(w, "Success!")
+	// Waits for the running scheduler action
+	<-cronDone
+	log.Printf("Server is stopped")
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/simple"
+)
+
+// Usage: ENVIRONMENT=dev go run ./cmd/migrate [-dry-run] [-steps 1] up|down|status
+func main() {
+	dryRun := flag.Bool("dry-run", false, "Print the migrations & their SQL without applying them")
+	steps := flag.Int("steps", 1, "Number of migrations to revert with down")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-dry-run] [-steps N] up|down|status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	simple.MustLoadEnv("")
+	ctx := context.Background()
+	conn, err := data.ConnectDB(ctx, data.LoadDBURLConfig())
+	if err != nil {
+		log.Fatalf("Cannot connect to DB: %v", err)
+	}
+	defer conn.Close()
+	switch flag.Arg(0) {
+	case "up":
+		migrations, err := data.MigrateUp(ctx, conn, *dryRun)
+		printMigrations("up", migrations, *dryRun)
+		if err != nil {
+			log.Fatalf("Migrate up failed: %v", err)
+		}
+	case "down":
+		migrations, err := data.MigrateDown(ctx, conn, *steps, *dryRun)
+		printMigrations("down", migrations, *dryRun)
+		if err != nil {
+			log.Fatalf("Migrate down failed: %v", err)
+		}
+	case "status":
+		statuses, err := data.GetMigrationStatus(ctx, conn)
+		if err != nil {
+			log.Fatalf("Cannot get migration status: %v", err)
+		}
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.IsApplied {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func printMigrations(direction string, migrations []data.Migration, dryRun bool) {
+	if len(migrations) == 0 {
+		fmt.Printf("No migration to run %s\n", direction)
+		return
+	}
+	for _, m := range migrations {
+		if !dryRun {
+			fmt.Printf("Migrated %s: %04d_%s\n", direction, m.Version, m.Name)
+			continue
+		}
+		query := m.Up
+		if direction == "down" {
+			query = m.Down
+		}
+		fmt.Printf("-- %04d_%s.%s.sql (dry run)\n%s\n", m.Version, m.Name, direction, query)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/asendia/legacy-api/secure"
+	"github.com/asendia/legacy-api/simple"
+)
+
+// Usage: ENVIRONMENT=dev go run ./cmd/scheduler [-url http://localhost:8080/legacy-api-scheduler] [-params '{"dryRun":true}'] <action>
+//
+//	ENVIRONMENT=dev go run ./cmd/scheduler runs [-action send-testaments] [-status failed] [-limit 20] [run id]
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "runs" {
+		runs(os.Args[2:])
+		return
+	}
+	url := flag.String("url", "http://localhost:8080/legacy-api-scheduler", "Scheduler endpoint")
+	params := flag.String("params", "", "JSON params of the action, e.g. {\"batchSize\":10,\"dryRun\":true}")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-url URL] [-params JSON] <action>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s runs [-h] [run id]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	simple.MustLoadEnv("")
+	// The params are the data of the Pub/Sub message, base64 encoded by encoding/json
+	body, err := json.Marshal(map[string]any{
+		"attributes": map[string]string{"action": flag.Arg(0)},
+		"data":       []byte(*params),
+	})
+	if err != nil {
+		log.Fatalf("Cannot generate the request body: %v", err)
+	}
+	res, resBody := postSignedRequest(*url, body)
+	fmt.Printf("%s\n%s\n", res.Status, resBody)
+	if res.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
+
+// postSignedRequest signs the body with the first scheduler signing secret
+func postSignedRequest(url string, body []byte) (*http.Response, []byte) {
+	secrets, err := secure.LoadSchedulerSigningSecretsFromEnv()
+	if err != nil {
+		log.Fatalf("Cannot load the signing secrets: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("Cannot create the request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	secure.SignRequest(req.Header, secrets[0], time.Now(), body)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Request failed: %v", err)
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(res.Body)
+	return res, resBody
+}
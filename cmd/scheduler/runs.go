@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/asendia/legacy-api/api"
+	"github.com/asendia/legacy-api/simple"
+	"github.com/google/uuid"
+)
+
+// runs lists the latest scheduler runs, or shows one run with the result of every email it sent
+func runs(args []string) {
+	flags := flag.NewFlagSet("runs", flag.ExitOnError)
+	url := flags.String("url", "http://localhost:8080/legacy-api-scheduler-runs", "Scheduler runs endpoint")
+	action := flags.String("action", "", "Only the runs of this action")
+	status := flags.String("status", "", "Only the runs with this status: running, succeeded, failed, skipped or dry-run")
+	limit := flags.Int("limit", 20, "Number of runs")
+	isJSON := flags.Bool("json", false, "Print the JSON response")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s runs [-url URL] [-action ACTION] [-status STATUS] [-limit N] [-json] [run id]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	q := api.SchedulerRunsQuery{Action: *action, Status: *status, Limit: *limit}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if flags.NArg() == 1 {
+		id, err := uuid.Parse(flags.Arg(0))
+		if err != nil {
+			log.Fatalf("Invalid run id: %v", err)
+		}
+		q = api.SchedulerRunsQuery{ID: id}
+	}
+	simple.MustLoadEnv("")
+	body, err := json.Marshal(q)
+	if err != nil {
+		log.Fatalf("Cannot generate the request body: %v", err)
+	}
+	res, resBody := postSignedRequest(*url, body)
+	if res.StatusCode != http.StatusOK || *isJSON {
+		fmt.Printf("%s\n%s\n", res.Status, resBody)
+		if res.StatusCode != http.StatusOK {
+			os.Exit(1)
+		}
+		return
+	}
+	var apiRes struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err = json.Unmarshal(resBody, &apiRes); err != nil {
+		log.Fatalf("Invalid response: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	if q.ID == uuid.Nil {
+		var runs []api.SchedulerRunData
+		if err = json.Unmarshal(apiRes.Data, &runs); err != nil {
+			log.Fatalf("Invalid response: %v", err)
+		}
+		fmt.Fprintln(w, "STARTED\tACTION\tSTATUS\tSELECTED\tQUEUED\tSENT\tFAILED\tSKIPPED\tDEFERRED\tDURATION\tID")
+		for _, run := range runs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n", run.StartedAt.Local().Format(time.DateTime), run.Action,
+				run.Status, run.Selected, run.Queued, run.Sent, run.Failed, run.Skipped, run.Deferred, runDuration(run), run.ID)
+		}
+		return
+	}
+	var run api.SchedulerRunData
+	if err = json.Unmarshal(apiRes.Data, &run); err != nil {
+		log.Fatalf("Invalid response: %v", err)
+	}
+	fmt.Fprintf(w, "ID:\t%s\n", run.ID)
+	fmt.Fprintf(w, "Action:\t%s\n", run.Action)
+	fmt.Fprintf(w, "Params:\t%s\n", run.Params)
+	fmt.Fprintf(w, "Trigger:\t%s\n", run.TriggerID)
+	fmt.Fprintf(w, "Status:\t%s\n", run.Status)
+	fmt.Fprintf(w, "Started:\t%s\n", run.StartedAt.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "Duration:\t%s\n", runDuration(run))
+	fmt.Fprintf(w, "Counts:\tselected %d, queued %d, sent %d, failed %d, skipped %d, deferred %d\n",
+		run.Selected, run.Queued, run.Sent, run.Failed, run.Skipped, run.Deferred)
+	if run.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", run.Error)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "KIND\tRECEIVER\tSTATUS\tVENDOR\tMESSAGE\tERROR")
+	for _, email := range run.Emails {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", email.Kind, email.EmailReceiver, email.Status, email.VendorID,
+			email.MessageID, email.Error)
+	}
+}
+
+func runDuration(run api.SchedulerRunData) string {
+	if run.FinishedAt == nil {
+		return "-"
+	}
+	return run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond).String()
+}
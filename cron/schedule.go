@@ -0,0 +1,176 @@
+// Package cron parses the 5 field cron expressions of the in-process scheduler
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidExpression = errors.New("invalid cron expression")
+
+// Next gives up after this many years without a match, e.g. "0 0 30 2 *"
+const maxSearchYears = 5
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Schedule is a parsed "minute hour day-of-month month day-of-week" expression in a time zone
+type Schedule struct {
+	Expression string
+	Location   *time.Location
+	minutes    uint64
+	hours      uint64
+	days       uint64
+	months     uint64
+	weekdays   uint64
+	// Like the classic cron, a restricted day of month or day of week matches either of them when both are restricted
+	isDayStar     bool
+	isWeekdayStar bool
+}
+
+// Parse reads an expression like "30 9 * * 1-5", "*/15 * * * *" or "@daily", the times are in loc, UTC if nil
+func Parse(expression string, loc *time.Location) (s Schedule, err error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	s = Schedule{Expression: expression, Location: loc}
+	expr := strings.TrimSpace(expression)
+	if macro, ok := macros[expr]; ok {
+		expr = macro
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return s, fmt.Errorf("%w: %q should have %d fields", ErrInvalidExpression, expression, len(fields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		if bits[i], err = parseField(parts[i], f); err != nil {
+			return s, fmt.Errorf("%w: %q %v", ErrInvalidExpression, expression, err)
+		}
+	}
+	s.minutes, s.hours, s.days, s.months, s.weekdays = bits[0], bits[1], bits[2], bits[3], bits[4]
+	// 7 is Sunday too
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+	s.isDayStar = strings.HasPrefix(parts[2], "*")
+	s.isWeekdayStar = strings.HasPrefix(parts[4], "*")
+	return s, nil
+}
+
+// parseField reads a comma separated list of "*", "n", "n-m", each with an optional "/step"
+func parseField(value string, f field) (bits uint64, err error) {
+	for _, item := range strings.Split(value, ",") {
+		rangeStr, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step of %s: %q", f.name, item)
+			}
+		}
+		start, end := f.min, f.max
+		switch {
+		case rangeStr == "*":
+		case strings.Contains(rangeStr, "-"):
+			startStr, endStr, _ := strings.Cut(rangeStr, "-")
+			start, err = parseNumber(startStr, f)
+			if err == nil {
+				end, err = parseNumber(endStr, f)
+			}
+			if err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range of %s: %q", f.name, item)
+			}
+		default:
+			if start, err = parseNumber(rangeStr, f); err != nil {
+				return 0, err
+			}
+			end = start
+			// "n/step" runs from n to the max
+			if hasStep {
+				end = f.max
+			}
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << i
+		}
+	}
+	return bits, nil
+}
+
+func parseNumber(value string, f field) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("%s should be between %d and %d: %q", f.name, f.min, f.max, value)
+	}
+	return n, nil
+}
+
+// Next returns the first scheduled time after t, the zero time if there is none within maxSearchYears
+func (s Schedule) Next(t time.Time) time.Time {
+	t = t.In(s.Location).Truncate(time.Minute).Add(time.Minute)
+	yearLimit := t.Year() + maxSearchYears
+	for t.Year() <= yearLimit {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.Location)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.Location)
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			// Not time.Date, a skipped hour of a DST change would normalize back to the same hour
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s Schedule) matchesDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	if s.isDayStar || s.isWeekdayStar {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Last returns the last scheduled time after since & up to now, the zero time if there is none
+func (s Schedule) Last(since time.Time, now time.Time) (last time.Time) {
+	for next := s.Next(since); !next.IsZero() && !next.After(now); next = s.Next(next) {
+		last = next
+	}
+	return last
+}
@@ -0,0 +1,69 @@
+package cron
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	jakarta, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		t.Fatalf("Cannot load time zone: %v", err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("Cannot load time zone: %v", err)
+	}
+	cases := []struct {
+		expression string
+		loc        *time.Location
+		after      time.Time
+		expected   time.Time
+	}{
+		{"0 9 * * *", nil, time.Date(2026, 10, 18, 8, 59, 30, 0, time.UTC), time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * *", nil, time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", nil, time.Date(2026, 10, 18, 9, 7, 0, 0, time.UTC), time.Date(2026, 10, 18, 9, 15, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", nil, time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", nil, time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", nil, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", nil, time.Date(2026, 10, 18, 1, 0, 0, 0, time.UTC), time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)},
+		// Either the day of month or the day of week
+		{"0 0 1 * 1", nil, time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"@daily", nil, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		// 09:00 in Jakarta is 02:00 UTC
+		{"0 9 * * *", jakarta, time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 2, 0, 0, 0, time.UTC)},
+		// 02:30 does not exist on the day the clocks go forward
+		{"30 2 * * *", newYork, time.Date(2026, 3, 8, 0, 0, 0, 0, newYork), time.Date(2026, 3, 9, 2, 30, 0, 0, newYork)},
+		{"0 0 30 2 *", nil, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.expression, c.loc)
+		if err != nil {
+			t.Fatalf("Cannot parse %q: %v", c.expression, err)
+		}
+		if next := s.Next(c.after); !next.Equal(c.expected) {
+			t.Errorf("Next of %q after %v should be %v, got: %v", c.expression, c.after, c.expected, next)
+		}
+	}
+}
+
+func TestScheduleLast(t *testing.T) {
+	s, _ := Parse("0 9 * * *", nil)
+	since := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	if last := s.Last(since, time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)); !last.Equal(time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("The missed runs should collapse into the last one, got: %v", last)
+	}
+	if last := s.Last(since, time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)); !last.IsZero() {
+		t.Fatalf("Nothing should be due, got: %v", last)
+	}
+}
+
+func TestParseInvalidExpression(t *testing.T) {
+	for _, expression := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"5-1 * * * *", "*/0 * * * *", "a * * * *", "@reboot"} {
+		if _, err := Parse(expression, nil); !errors.Is(err, ErrInvalidExpression) {
+			t.Errorf("%q should be invalid, got: %v", expression, err)
+		}
+	}
+}
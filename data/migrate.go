@@ -0,0 +1,238 @@
+package data
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Migrations use the golang-migrate file naming, e.g. 0001_init.up.sql & 0001_init.down.sql,
+// sqlc reads the same directory and skips the .down.sql files
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// Serializes concurrent migrate runs, e.g. two deployments starting at once
+const migrationLockID = 7340137
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	IsApplied bool
+	AppliedAt time.Time
+}
+
+type MigrationDB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// LoadMigrations returns the embedded migrations sorted by version
+func LoadMigrations() ([]Migration, error) {
+	return loadMigrations(migrationsFS, "migrations")
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	migrationMap := map[int64]*Migration{}
+	for _, entry := range entries {
+		matches := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := migrationMap[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: matches[2]}
+			migrationMap[version] = m
+		} else if m.Name != matches[2] {
+			return nil, fmt.Errorf("migration version %d is used by %s & %s", version, m.Name, matches[2])
+		}
+		if matches[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+	migrations := []Migration{}
+	for _, m := range migrationMap {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// GetMigrationStatus lists every embedded migration and whether it has been applied
+func GetMigrationStatus(ctx context.Context, db MigrationDB) (statuses []MigrationStatus, err error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	applied, err := selectAppliedMigrations(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range migrations {
+		appliedAt, isApplied := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			IsApplied: isApplied,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// MigrateUp applies every pending migration, each one in its own transaction.
+// With dryRun the pending migrations are returned without being applied.
+func MigrateUp(ctx context.Context, db MigrationDB, dryRun bool) (pending []Migration, err error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := GetMigrationStatus(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for id, s := range statuses {
+		if !s.IsApplied {
+			pending = append(pending, migrations[id])
+		}
+	}
+	if dryRun {
+		return pending, nil
+	}
+	for id, m := range pending {
+		err = runMigration(ctx, db, m, m.Up, true)
+		if err != nil {
+			return pending[:id], fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateDown reverts the latest `steps` applied migrations, newest first.
+// With dryRun the migrations are returned without being reverted.
+func MigrateDown(ctx context.Context, db MigrationDB, steps int, dryRun bool) (reverted []Migration, err error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := GetMigrationStatus(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for id := len(statuses) - 1; id >= 0 && len(reverted) < steps; id-- {
+		if statuses[id].IsApplied {
+			reverted = append(reverted, migrations[id])
+		}
+	}
+	if dryRun {
+		return reverted, nil
+	}
+	for id, m := range reverted {
+		if m.Down == "" {
+			return reverted[:id], fmt.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+		}
+		err = runMigration(ctx, db, m, m.Down, false)
+		if err != nil {
+			return reverted[:id], fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+	}
+	return reverted, nil
+}
+
+func runMigration(ctx context.Context, db MigrationDB, m Migration, query string, isUp bool) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	// Another process might have applied it while this one was waiting for the lock
+	applied, err := selectAppliedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if _, isApplied := applied[m.Version]; isApplied == isUp {
+		return tx.Commit(ctx)
+	}
+	if _, err = tx.Exec(ctx, query); err != nil {
+		return err
+	}
+	if isUp {
+		_, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+	} else {
+		_, err = tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func selectAppliedMigrations(ctx context.Context, tx pgx.Tx) (map[int64]time.Time, error) {
+	_, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS public.schema_migrations (
+  version bigint NOT NULL,
+  name character varying(200) NOT NULL,
+  applied_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (version)
+)`)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
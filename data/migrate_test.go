@@ -0,0 +1,47 @@
+package data
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatalf("Cannot load embedded migrations: %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].Version != 1 {
+		t.Fatalf("The first migration should be version 1: %+v", migrations)
+	}
+	for id, m := range migrations {
+		if id > 0 && migrations[id-1].Version >= m.Version {
+			t.Fatalf("Migrations are not sorted by version: %d_%s", m.Version, m.Name)
+		}
+		if m.Up == "" || m.Down == "" {
+			t.Fatalf("Migration %d_%s should have both up & down files", m.Version, m.Name)
+		}
+	}
+}
+
+func TestLoadMigrationsInvalidFiles(t *testing.T) {
+	_, err := loadMigrations(fstest.MapFS{
+		"migrations/0001_init.up.sql":  {Data: []byte("SELECT 1;")},
+		"migrations/0001_other.up.sql": {Data: []byte("SELECT 1;")},
+	}, "migrations")
+	if err == nil || !strings.Contains(err.Error(), "is used by") {
+		t.Fatalf("Duplicate versions should be rejected, got: %v", err)
+	}
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/0001_init.down.sql": {Data: []byte("SELECT 1;")},
+	}, "migrations")
+	if err == nil {
+		t.Fatal("A migration without up file should be rejected")
+	}
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/init.sql": {Data: []byte("SELECT 1;")},
+	}, "migrations")
+	if err == nil {
+		t.Fatal("A file without version should be rejected")
+	}
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS public.messages_email_receivers;
+
+DROP TABLE IF EXISTS public.messages;
+
+DROP TABLE IF EXISTS public.emails;
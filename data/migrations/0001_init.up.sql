@@ -1,11 +1,13 @@
-CREATE TABLE public.emails (
+-- Tables & indexes created before versioned migrations existed,
+-- IF NOT EXISTS lets databases created from the old data/schema.sql adopt this migration
+CREATE TABLE IF NOT EXISTS public.emails (
   email character varying(70) NOT NULL,
   created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
   is_active boolean DEFAULT TRUE NOT NULL,
   PRIMARY KEY (email)
 );
 
-CREATE TABLE public.messages (
+CREATE TABLE IF NOT EXISTS public.messages (
   id uuid NOT NULL DEFAULT gen_random_uuid (),
   email_creator character varying(70) NOT NULL,
   created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
@@ -21,7 +23,7 @@ CREATE TABLE public.messages (
   FOREIGN KEY (email_creator) REFERENCES public.emails (email) ON DELETE CASCADE
 );
 
-CREATE TABLE public.messages_email_receivers (
+CREATE TABLE IF NOT EXISTS public.messages_email_receivers (
   message_id uuid NOT NULL,
   email_receiver character varying(70) NOT NULL,
   is_unsubscribed boolean DEFAULT FALSE NOT NULL,
@@ -32,22 +34,22 @@ CREATE TABLE public.messages_email_receivers (
 );
 
 -- For UpdateMessage & DeleteMessage
-CREATE INDEX messages_id_email_creator ON public.messages USING btree (id, email_creator);
+CREATE INDEX IF NOT EXISTS messages_id_email_creator ON public.messages USING btree (id, email_creator);
 
 -- For SelectMessagesNeedReminding
-CREATE INDEX messages_need_reminding ON public.messages USING btree (next_reminder_at, is_active);
+CREATE INDEX IF NOT EXISTS messages_need_reminding ON public.messages USING btree (next_reminder_at, is_active);
 
 -- For SelectInactiveMessages
-CREATE INDEX messages_select_inactive ON public.messages USING btree (inactive_at, is_active, sent_counter);
+CREATE INDEX IF NOT EXISTS messages_select_inactive ON public.messages USING btree (inactive_at, is_active, sent_counter);
 
 -- For SelectMessagesByEmailCreator
-CREATE INDEX emails_is_active ON public.emails USING HASH (is_active);
+CREATE INDEX IF NOT EXISTS emails_is_active ON public.emails USING HASH (is_active);
 
 -- For SelectMessagesByEmailCreator, SelectMessagesNeedReminding, SelectInactiveMessages
-CREATE INDEX receivers_is_unsubscribed ON public.messages_email_receivers USING HASH (is_unsubscribed);
+CREATE INDEX IF NOT EXISTS receivers_is_unsubscribed ON public.messages_email_receivers USING HASH (is_unsubscribed);
 
 -- For UpdateMessagesEmailReceiver
-CREATE INDEX receivers_id_is_unsubscribed ON public.messages_email_receivers USING btree (message_id,
+CREATE INDEX IF NOT EXISTS receivers_id_is_unsubscribed ON public.messages_email_receivers USING btree (message_id,
   unsubscribe_secret);
 
 GRANT INSERT, SELECT, UPDATE, DELETE ON public.emails TO project_legacy_admin;
@@ -0,0 +1,21 @@
+-- One row per (message, receiver, attempt)
+CREATE TABLE public.testament_deliveries (
+  id uuid NOT NULL DEFAULT gen_random_uuid (),
+  message_id uuid NOT NULL,
+  email_receiver character varying(70) NOT NULL,
+  attempt integer NOT NULL,
+  status character varying(10) NOT NULL,
+  vendor_id character varying(20) DEFAULT '' NOT NULL,
+  error_message character varying(500) DEFAULT '' NOT NULL,
+  created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  sent_at timestamp with time zone,
+  PRIMARY KEY (id),
+  UNIQUE (message_id, email_receiver, attempt),
+  FOREIGN KEY (message_id) REFERENCES public.messages (id) ON DELETE CASCADE
+);
+
+-- For SelectInactiveMessages & UpdateMessageAfterSendingTestament
+CREATE INDEX testament_deliveries_receiver_status ON public.testament_deliveries USING btree (message_id,
+  email_receiver, status);
+
+GRANT INSERT, SELECT, UPDATE, DELETE ON public.testament_deliveries TO project_legacy_admin;
@@ -0,0 +1,26 @@
+-- Emails written by the scheduler actions, sent by the dispatcher after commit
+CREATE TABLE public.email_outbox (
+  id uuid NOT NULL DEFAULT gen_random_uuid (),
+  idempotency_key character varying(200) NOT NULL,
+  kind character varying(20) NOT NULL,
+  message_id uuid NOT NULL,
+  email_receiver character varying(70) NOT NULL,
+  delivery_id uuid,
+  mail_item jsonb NOT NULL,
+  status character varying(10) DEFAULT 'pending' NOT NULL,
+  attempts integer DEFAULT 0 NOT NULL,
+  next_attempt_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  last_error character varying(500) DEFAULT '' NOT NULL,
+  vendor_id character varying(20) DEFAULT '' NOT NULL,
+  created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  sent_at timestamp with time zone,
+  PRIMARY KEY (id),
+  UNIQUE (idempotency_key),
+  FOREIGN KEY (message_id) REFERENCES public.messages (id) ON DELETE CASCADE,
+  FOREIGN KEY (delivery_id) REFERENCES public.testament_deliveries (id) ON DELETE CASCADE
+);
+
+-- For ClaimEmailOutbox
+CREATE INDEX email_outbox_status_next_attempt_at ON public.email_outbox USING btree (status, next_attempt_at);
+
+GRANT INSERT, SELECT, UPDATE, DELETE ON public.email_outbox TO project_legacy_admin;
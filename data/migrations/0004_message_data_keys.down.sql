@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.message_data_keys;
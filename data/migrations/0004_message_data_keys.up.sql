@@ -0,0 +1,16 @@
+-- Per-message data key, wrapped by a key-encryption key (KEK) of the KeyProvider.
+-- Deleting the row crypto-shreds the message content.
+CREATE TABLE public.message_data_keys (
+  message_id uuid NOT NULL,
+  kek_id character varying(200) NOT NULL,
+  wrapped_key text NOT NULL,
+  created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  updated_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (message_id),
+  FOREIGN KEY (message_id) REFERENCES public.messages (id) ON DELETE CASCADE
+);
+
+-- For SelectMessageDataKeysToRewrap
+CREATE INDEX message_data_keys_kek_id ON public.message_data_keys USING btree (kek_id);
+
+GRANT INSERT, SELECT, UPDATE, DELETE ON public.message_data_keys TO project_legacy_admin;
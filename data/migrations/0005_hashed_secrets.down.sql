@@ -0,0 +1,12 @@
+-- The secrets which only exist as hashes are lost, their email links stop working
+DROP INDEX IF EXISTS public.receivers_message_id_unsubscribe_secret_hash;
+
+ALTER TABLE public.messages_email_receivers
+  DROP COLUMN IF EXISTS unsubscribe_secret_hash,
+  ALTER COLUMN unsubscribe_secret DROP DEFAULT,
+  ALTER COLUMN unsubscribe_secret TYPE character(69);
+
+ALTER TABLE public.messages
+  DROP COLUMN IF EXISTS extension_secret_hash,
+  ALTER COLUMN extension_secret DROP DEFAULT,
+  ALTER COLUMN extension_secret TYPE character(69);
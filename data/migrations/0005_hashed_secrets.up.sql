@@ -0,0 +1,16 @@
+-- Hex HMAC-SHA256 of the secrets keyed with SECRET_PEPPER, only the hashes are stored from now on.
+-- The plaintext columns become varchar, a character(69) empty secret would be padded with spaces.
+-- They are emptied by the hash-secrets scheduler action, then they can be dropped.
+ALTER TABLE public.messages
+  ADD COLUMN extension_secret_hash character varying(64) DEFAULT '' NOT NULL,
+  ALTER COLUMN extension_secret TYPE character varying(69),
+  ALTER COLUMN extension_secret SET DEFAULT '';
+
+ALTER TABLE public.messages_email_receivers
+  ADD COLUMN unsubscribe_secret_hash character varying(64) DEFAULT '' NOT NULL,
+  ALTER COLUMN unsubscribe_secret TYPE character varying(69),
+  ALTER COLUMN unsubscribe_secret SET DEFAULT '';
+
+-- For UpdateReceiverUnsubscribe
+CREATE INDEX receivers_message_id_unsubscribe_secret_hash ON public.messages_email_receivers USING btree (message_id,
+  unsubscribe_secret_hash);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.secret_attempt_failures;
+
+DROP TABLE IF EXISTS public.rate_limits;
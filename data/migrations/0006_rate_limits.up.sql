@@ -0,0 +1,31 @@
+-- Request counts & failure lockouts of /legacy-api-secret, shared by every Cloud Run instance.
+-- The key is e.g. "ip:203.0.113.7" or "message:<uuid>".
+CREATE TABLE public.rate_limits (
+  key character varying(120) NOT NULL,
+  window_start timestamp with time zone NOT NULL,
+  hits integer DEFAULT 0 NOT NULL,
+  failures integer DEFAULT 0 NOT NULL,
+  locked_until timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  updated_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (key)
+);
+
+-- For DeleteExpiredRateLimits
+CREATE INDEX rate_limits_updated_at ON public.rate_limits USING btree (updated_at);
+
+-- Every failed extend-message & unsubscribe-message attempt, to alert on guesses against one message
+CREATE TABLE public.secret_attempt_failures (
+  id uuid NOT NULL DEFAULT gen_random_uuid (),
+  message_id uuid,
+  action character varying(40) NOT NULL,
+  ip character varying(45) NOT NULL,
+  created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id)
+);
+
+-- For SelectSecretAttemptFailureCounts
+CREATE INDEX secret_attempt_failures_created_at ON public.secret_attempt_failures USING btree (created_at, message_id);
+
+GRANT INSERT, SELECT, UPDATE, DELETE ON public.rate_limits TO project_legacy_admin;
+
+GRANT INSERT, SELECT, UPDATE, DELETE ON public.secret_attempt_failures TO project_legacy_admin;
@@ -0,0 +1,11 @@
+-- Last scheduled run of every job of the in-process cron scheduler, a missed run is caught up by the next leader
+CREATE TABLE public.cron_jobs (
+  action character varying(40) NOT NULL,
+  last_scheduled_at timestamp with time zone NOT NULL,
+  last_finished_at timestamp with time zone,
+  last_error text DEFAULT '' NOT NULL,
+  updated_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (action)
+);
+
+GRANT INSERT, SELECT, UPDATE, DELETE ON public.cron_jobs TO project_legacy_admin;
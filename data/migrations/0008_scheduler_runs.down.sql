@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.scheduler_run_emails;
+
+DROP TABLE IF EXISTS public.scheduler_runs;
@@ -0,0 +1,43 @@
+-- Every run of a scheduler action, written outside of its transaction so a failed or crashed run is kept too
+CREATE TABLE public.scheduler_runs (
+  id uuid NOT NULL DEFAULT gen_random_uuid (),
+  action character varying(40) NOT NULL,
+  params jsonb DEFAULT '{}' NOT NULL,
+  -- The Pub/Sub message id, or e.g. "cron:send-testaments:<scheduled time>"
+  trigger_id character varying(200) DEFAULT '' NOT NULL,
+  status character varying(20) DEFAULT 'running' NOT NULL,
+  selected integer DEFAULT 0 NOT NULL,
+  queued integer DEFAULT 0 NOT NULL,
+  sent integer DEFAULT 0 NOT NULL,
+  failed integer DEFAULT 0 NOT NULL,
+  skipped integer DEFAULT 0 NOT NULL,
+  error_message text DEFAULT '' NOT NULL,
+  started_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  finished_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+
+-- For SelectSchedulerRuns
+CREATE INDEX scheduler_runs_started_at ON public.scheduler_runs USING btree (started_at DESC, action);
+
+-- The result of every email a run sent through mail.SendEmails
+CREATE TABLE public.scheduler_run_emails (
+  id uuid NOT NULL DEFAULT gen_random_uuid (),
+  run_id uuid NOT NULL,
+  outbox_id uuid NOT NULL,
+  kind character varying(20) NOT NULL,
+  message_id uuid NOT NULL,
+  email_receiver character varying(70) NOT NULL,
+  status character varying(20) NOT NULL,
+  vendor_id character varying(20) DEFAULT '' NOT NULL,
+  error_message text DEFAULT '' NOT NULL,
+  created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (id),
+  FOREIGN KEY (run_id) REFERENCES public.scheduler_runs (id) ON DELETE CASCADE
+);
+
+CREATE INDEX scheduler_run_emails_run_id ON public.scheduler_run_emails USING btree (run_id);
+
+GRANT INSERT, SELECT, UPDATE, DELETE ON public.scheduler_runs TO project_legacy_admin;
+
+GRANT INSERT, SELECT, UPDATE, DELETE ON public.scheduler_run_emails TO project_legacy_admin;
@@ -0,0 +1,4 @@
+ALTER TABLE public.scheduler_runs
+  DROP COLUMN IF EXISTS deferred;
+
+DROP TABLE IF EXISTS public.mail_vendor_quotas;
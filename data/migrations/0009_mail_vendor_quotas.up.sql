@@ -0,0 +1,14 @@
+-- Emails reserved & sent by every mail vendor per UTC day, shared by every instance to stay under the daily limit
+CREATE TABLE public.mail_vendor_quotas (
+  vendor_id character varying(20) NOT NULL,
+  day date NOT NULL,
+  sent_count integer DEFAULT 0 NOT NULL,
+  updated_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  PRIMARY KEY (vendor_id, day)
+);
+
+-- Emails over the daily limit of every vendor, they are sent the next day
+ALTER TABLE public.scheduler_runs
+  ADD COLUMN deferred integer DEFAULT 0 NOT NULL;
+
+GRANT INSERT, SELECT, UPDATE, DELETE ON public.mail_vendor_quotas TO project_legacy_admin;
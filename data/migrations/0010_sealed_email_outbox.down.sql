@@ -0,0 +1,5 @@
+-- The sealed emails which are not sent yet are lost
+ALTER TABLE public.email_outbox
+  ALTER COLUMN mail_item DROP DEFAULT,
+  DROP COLUMN IF EXISTS wrapped_key,
+  DROP COLUMN IF EXISTS mail_item_sealed;
@@ -0,0 +1,6 @@
+-- The rendered email holds the testament & the secrets of its links, it is sealed with its own data key
+-- wrapped by the KeyProvider. mail_item only holds the emails queued before, it is cleared once they are sent.
+ALTER TABLE public.email_outbox
+  ADD COLUMN mail_item_sealed text DEFAULT '' NOT NULL,
+  ADD COLUMN wrapped_key text DEFAULT '' NOT NULL,
+  ALTER COLUMN mail_item SET DEFAULT '{}'::jsonb;
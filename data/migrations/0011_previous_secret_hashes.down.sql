@@ -0,0 +1,5 @@
+ALTER TABLE public.messages_email_receivers
+  DROP COLUMN IF EXISTS previous_unsubscribe_secret_hashes;
+
+ALTER TABLE public.messages
+  DROP COLUMN IF EXISTS previous_extension_secret_hashes;
@@ -0,0 +1,7 @@
+-- Every reminder & testament email brings a new secret, the hashes of the secrets of the earlier emails
+-- stay valid so their links keep working. Only the last 9 are kept, most recent first.
+ALTER TABLE public.messages
+  ADD COLUMN previous_extension_secret_hashes text[] DEFAULT '{}' NOT NULL;
+
+ALTER TABLE public.messages_email_receivers
+  ADD COLUMN previous_unsubscribe_secret_hashes text[] DEFAULT '{}' NOT NULL;
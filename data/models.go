@@ -5,34 +5,140 @@
 package data
 
 import (
+	"database/sql"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+type CronJob struct {
+	Action          string
+	LastScheduledAt time.Time
+	LastFinishedAt  sql.NullTime
+	LastError       string
+	UpdatedAt       time.Time
+}
+
+type EmailOutbox struct {
+	ID             uuid.UUID
+	IdempotencyKey string
+	Kind           string
+	MessageID      uuid.UUID
+	EmailReceiver  string
+	DeliveryID     uuid.NullUUID
+	MailItem       []byte
+	Status         string
+	Attempts       int32
+	NextAttemptAt  time.Time
+	LastError      string
+	VendorID       string
+	CreatedAt      time.Time
+	SentAt         sql.NullTime
+	MailItemSealed string
+	WrappedKey     string
+}
+
 type Email struct {
 	Email     string
 	CreatedAt time.Time
 	IsActive  bool
 }
 
+type MailVendorQuota struct {
+	VendorID  string
+	Day       time.Time
+	SentCount int32
+	UpdatedAt time.Time
+}
+
+type MessageDataKey struct {
+	MessageID  uuid.UUID
+	KekID      string
+	WrappedKey string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
 type Message struct {
-	ID                   uuid.UUID
-	EmailCreator         string
-	CreatedAt            time.Time
-	ContentEncrypted     string
-	InactivePeriodDays   int32
-	ReminderIntervalDays int32
-	IsActive             bool
-	ExtensionSecret      string
-	InactiveAt           time.Time
-	NextReminderAt       time.Time
-	SentCounter          int32
+	ID                            uuid.UUID
+	EmailCreator                  string
+	CreatedAt                     time.Time
+	ContentEncrypted              string
+	InactivePeriodDays            int32
+	ReminderIntervalDays          int32
+	IsActive                      bool
+	ExtensionSecret               string
+	InactiveAt                    time.Time
+	NextReminderAt                time.Time
+	SentCounter                   int32
+	ExtensionSecretHash           string
+	PreviousExtensionSecretHashes []string
 }
 
 type MessagesEmailReceiver struct {
-	MessageID         uuid.UUID
-	EmailReceiver     string
-	IsUnsubscribed    bool
-	UnsubscribeSecret string
+	MessageID                       uuid.UUID
+	EmailReceiver                   string
+	IsUnsubscribed                  bool
+	UnsubscribeSecret               string
+	UnsubscribeSecretHash           string
+	PreviousUnsubscribeSecretHashes []string
+}
+
+type RateLimit struct {
+	Key         string
+	WindowStart time.Time
+	Hits        int32
+	Failures    int32
+	LockedUntil time.Time
+	UpdatedAt   time.Time
+}
+
+type SchedulerRunEmail struct {
+	ID            uuid.UUID
+	RunID         uuid.UUID
+	OutboxID      uuid.UUID
+	Kind          string
+	MessageID     uuid.UUID
+	EmailReceiver string
+	Status        string
+	VendorID      string
+	ErrorMessage  string
+	CreatedAt     time.Time
+}
+
+type SchedulerRun struct {
+	ID           uuid.UUID
+	Action       string
+	Params       []byte
+	TriggerID    string
+	Status       string
+	Selected     int32
+	Queued       int32
+	Sent         int32
+	Failed       int32
+	Skipped      int32
+	ErrorMessage string
+	StartedAt    time.Time
+	FinishedAt   sql.NullTime
+	Deferred     int32
+}
+
+type SecretAttemptFailure struct {
+	ID        uuid.UUID
+	MessageID uuid.NullUUID
+	Action    string
+	IP        string
+	CreatedAt time.Time
+}
+
+type TestamentDelivery struct {
+	ID            uuid.UUID
+	MessageID     uuid.UUID
+	EmailReceiver string
+	Attempt       int32
+	Status        string
+	VendorID      string
+	ErrorMessage  string
+	CreatedAt     time.Time
+	SentAt        sql.NullTime
 }
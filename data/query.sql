@@ -7,7 +7,7 @@ INSERT INTO emails (email)
   RETURNING
     email)
   INSERT INTO messages (email_creator, content_encrypted, inactive_period_days,
-    reminder_interval_days, extension_secret, inactive_at, next_reminder_at)
+    reminder_interval_days, extension_secret_hash, inactive_at, next_reminder_at)
   SELECT
     $1,
     $2,
@@ -41,11 +41,11 @@ delete_receivers AS (
     AND messages_email_receivers.email_receiver NOT IN (
       SELECT
         unnest(@email_receivers::text[])))
-INSERT INTO messages_email_receivers (message_id, email_receiver, unsubscribe_secret)
+INSERT INTO messages_email_receivers (message_id, email_receiver, unsubscribe_secret_hash)
 SELECT
   $1 AS message_id,
   unnest(@email_receivers::text[]) AS email_receiver,
-  unnest(@unsubscribe_secrets::text[]) AS unsubscribe_secret
+  unnest(@unsubscribe_secret_hashes::text[]) AS unsubscribe_secret_hash
 ON CONFLICT
   DO NOTHING
 RETURNING
@@ -57,8 +57,11 @@ UPDATE
 SET
   is_unsubscribed = TRUE
 WHERE
-  message_id = $1
-  AND unsubscribe_secret = $2
+  message_id = @message_id
+  AND (unsubscribe_secret_hash = @unsubscribe_secret_hash
+    OR @unsubscribe_secret_hash = ANY (previous_unsubscribe_secret_hashes)
+    OR (unsubscribe_secret_hash = ''
+      AND unsubscribe_secret = @unsubscribe_secret))
 RETURNING
   *;
 
@@ -81,18 +84,18 @@ SELECT
   messages.inactive_period_days AS msg_inactive_period_days,
   messages.reminder_interval_days AS msg_reminder_interval_days,
   messages.is_active AS msg_is_active,
-  messages.extension_secret AS msg_extension_secret,
   messages.inactive_at AS msg_inactive_at,
   messages.next_reminder_at AS msg_next_reminder_at,
   messages.sent_counter AS msg_sent_counter,
   receivers.message_id AS rcv_message_id,
   receivers.email_receiver AS rcv_email_receiver,
   receivers.is_unsubscribed AS rcv_is_unsubscribed,
-  receivers.unsubscribe_secret AS rcv_unsubscribe_secret
+  data_keys.wrapped_key AS dk_wrapped_key
 FROM
   emails
   INNER JOIN messages ON messages.email_creator = emails.email
   LEFT JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  LEFT JOIN message_data_keys AS data_keys ON messages.id = data_keys.message_id
 WHERE
   messages.email_creator = $1
   AND emails.is_active
@@ -112,18 +115,18 @@ SELECT
   messages.inactive_period_days AS msg_inactive_period_days,
   messages.reminder_interval_days AS msg_reminder_interval_days,
   messages.is_active AS msg_is_active,
-  messages.extension_secret AS msg_extension_secret,
   messages.inactive_at AS msg_inactive_at,
   messages.next_reminder_at AS msg_next_reminder_at,
   messages.sent_counter AS msg_sent_counter,
   receivers.message_id AS rcv_message_id,
   receivers.email_receiver AS rcv_email_receiver,
   receivers.is_unsubscribed AS rcv_is_unsubscribed,
-  receivers.unsubscribe_secret AS rcv_unsubscribe_secret
+  data_keys.wrapped_key AS dk_wrapped_key
 FROM
   emails
   INNER JOIN messages ON messages.email_creator = emails.email
   LEFT JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  LEFT JOIN message_data_keys AS data_keys ON messages.id = data_keys.message_id
 WHERE
   messages.id = $1
   AND emails.is_active
@@ -135,12 +138,17 @@ LIMIT 10;
 UPDATE
   messages
 SET
-  extension_secret = $1,
+  extension_secret = '',
+  extension_secret_hash = @new_extension_secret_hash,
+  previous_extension_secret_hashes = '{}',
   inactive_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, inactive_period_days),
   next_reminder_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, reminder_interval_days)
 WHERE
-  id = $2
-  AND extension_secret = $3
+  id = @id
+  AND (extension_secret_hash = @extension_secret_hash
+    OR @extension_secret_hash = ANY (previous_extension_secret_hashes)
+    OR (extension_secret_hash = ''
+      AND extension_secret = @extension_secret))
   AND inactive_at >= CURRENT_DATE
   AND is_active
 RETURNING
@@ -162,7 +170,9 @@ SET
   inactive_period_days = $2,
   reminder_interval_days = $3,
   is_active = $4,
-  extension_secret = $5,
+  extension_secret = '',
+  extension_secret_hash = $5,
+  previous_extension_secret_hashes = '{}',
   inactive_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, $2),
   next_reminder_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, $3),
   sent_counter = 0
@@ -190,29 +200,139 @@ SELECT
   messages.sent_counter AS msg_sent_counter,
   message_id AS rcv_message_id,
   receivers.email_receiver AS rcv_email_receiver,
-  receivers.is_unsubscribed AS rcv_is_unsubscribed,
-  receivers.unsubscribe_secret AS rcv_unsubscribe_secret
+  receivers.is_unsubscribed AS rcv_is_unsubscribed
 FROM
   emails
   INNER JOIN messages ON emails.email = messages.email_creator
   INNER JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
 WHERE
-  messages.is_active
-  AND messages.content_encrypted <> ''
-  AND messages.next_reminder_at <= CURRENT_DATE
+  messages.id IN (
+    SELECT
+      due.id
+    FROM
+      messages AS due
+    WHERE
+      due.is_active
+      AND due.content_encrypted <> ''
+      AND due.next_reminder_at <= @today::date
+      AND (cardinality(@message_ids::uuid[]) = 0
+        OR due.id = ANY (@message_ids::uuid[]))
+      AND (due.created_at, due.id) > (@after_created_at::timestamptz, @after_id::uuid)
+      AND EXISTS (
+        SELECT
+          1
+        FROM
+          messages_email_receivers AS due_receivers
+        WHERE
+          due_receivers.message_id = due.id
+          AND due_receivers.is_unsubscribed = FALSE)
+    ORDER BY
+      due.created_at ASC,
+      due.id ASC
+    LIMIT @batch_size
+    FOR UPDATE
+      SKIP LOCKED)
+  AND receivers.is_unsubscribed = FALSE
+ORDER BY
+  messages.created_at ASC,
+  messages.id ASC;
+
+-- name: SelectMessagesNeedRemindingReadOnly :many
+SELECT
+  emails.email AS usr_email,
+  emails.created_at AS usr_created_at,
+  emails.is_active AS usr_is_active,
+  messages.id AS msg_id,
+  messages.email_creator AS msg_email_creator,
+  messages.created_at AS msg_created_at,
+  messages.content_encrypted AS msg_content_encrypted,
+  messages.inactive_period_days AS msg_inactive_period_days,
+  messages.reminder_interval_days AS msg_reminder_interval_days,
+  messages.is_active AS msg_is_active,
+  messages.extension_secret AS msg_extension_secret,
+  messages.inactive_at AS msg_inactive_at,
+  messages.next_reminder_at AS msg_next_reminder_at,
+  messages.sent_counter AS msg_sent_counter,
+  message_id AS rcv_message_id,
+  receivers.email_receiver AS rcv_email_receiver,
+  receivers.is_unsubscribed AS rcv_is_unsubscribed
+FROM
+  emails
+  INNER JOIN messages ON emails.email = messages.email_creator
+  INNER JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+WHERE
+  messages.id IN (
+    SELECT
+      due.id
+    FROM
+      messages AS due
+    WHERE
+      due.is_active
+      AND due.content_encrypted <> ''
+      AND due.next_reminder_at <= @today::date
+      AND (cardinality(@message_ids::uuid[]) = 0
+        OR due.id = ANY (@message_ids::uuid[]))
+      AND (due.created_at, due.id) > (@after_created_at::timestamptz, @after_id::uuid)
+      AND EXISTS (
+        SELECT
+          1
+        FROM
+          messages_email_receivers AS due_receivers
+        WHERE
+          due_receivers.message_id = due.id
+          AND due_receivers.is_unsubscribed = FALSE)
+    ORDER BY
+      due.created_at ASC,
+      due.id ASC
+    LIMIT @batch_size)
   AND receivers.is_unsubscribed = FALSE
 ORDER BY
   messages.created_at ASC,
-  messages.id ASC
-LIMIT 100;
+  messages.id ASC;
+
+-- name: CountMessagesNeedReminding :one
+SELECT
+  COUNT(*)
+FROM
+  messages
+WHERE
+  messages.is_active
+  AND messages.content_encrypted <> ''
+  AND messages.next_reminder_at <= @today::date
+  AND (cardinality(@message_ids::uuid[]) = 0
+    OR messages.id = ANY (@message_ids::uuid[]))
+  AND (messages.created_at, messages.id) > (@after_created_at::timestamptz, @after_id::uuid)
+  AND EXISTS (
+    SELECT
+      1
+    FROM
+      messages_email_receivers AS receivers
+    WHERE
+      receivers.message_id = messages.id
+      AND receivers.is_unsubscribed = FALSE);
 
 -- name: UpdateMessageAfterSendingReminder :one
 UPDATE
   messages
 SET
-  next_reminder_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, reminder_interval_days)
+  next_reminder_at = @today::date + MAKE_INTERVAL(0, 0, 0, reminder_interval_days),
+  extension_secret = CASE WHEN @extension_secret_hash::text = '' THEN
+    extension_secret
+  ELSE
+    ''
+  END,
+  extension_secret_hash = COALESCE(NULLIF(@extension_secret_hash::text, ''), extension_secret_hash),
+  previous_extension_secret_hashes = CASE WHEN @extension_secret_hash::text = '' THEN
+    previous_extension_secret_hashes
+  WHEN extension_secret_hash <> '' THEN
+    (array_prepend(extension_secret_hash::text, previous_extension_secret_hashes))[1:9]
+  WHEN @legacy_extension_secret_hash::text <> '' THEN
+    (array_prepend(@legacy_extension_secret_hash::text, previous_extension_secret_hashes))[1:9]
+  ELSE
+    previous_extension_secret_hashes
+  END
 WHERE
-  id = $1
+  id = @id
 RETURNING
   *;
 
@@ -228,44 +348,714 @@ SELECT
   messages.inactive_period_days AS msg_inactive_period_days,
   messages.reminder_interval_days AS msg_reminder_interval_days,
   messages.is_active AS msg_is_active,
-  messages.extension_secret AS msg_extension_secret,
   messages.inactive_at AS msg_inactive_at,
   messages.next_reminder_at AS msg_next_reminder_at,
   messages.sent_counter AS msg_sent_counter,
   receivers.message_id AS rcv_message_id,
   receivers.email_receiver AS rcv_email_receiver,
   receivers.is_unsubscribed AS rcv_is_unsubscribed,
-  receivers.unsubscribe_secret AS rcv_unsubscribe_secret
+  receivers.unsubscribe_secret AS rcv_unsubscribe_secret,
+  data_keys.wrapped_key AS dk_wrapped_key
 FROM
   emails
   INNER JOIN messages ON emails.email = messages.email_creator
   INNER JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  LEFT JOIN message_data_keys AS data_keys ON messages.id = data_keys.message_id
 WHERE
-  messages.inactive_at < CURRENT_DATE
-  AND messages.content_encrypted <> ''
-  AND messages.is_active
-  AND messages.sent_counter < 3
+  messages.id IN (
+    SELECT
+      due.id
+    FROM
+      messages AS due
+    WHERE
+      due.inactive_at < @today::date
+      AND due.content_encrypted <> ''
+      AND due.is_active
+      AND due.sent_counter < 3
+      AND (cardinality(@message_ids::uuid[]) = 0
+        OR due.id = ANY (@message_ids::uuid[]))
+      AND (due.created_at, due.id) > (@after_created_at::timestamptz, @after_id::uuid)
+      AND EXISTS (
+        SELECT
+          1
+        FROM
+          messages_email_receivers AS due_receivers
+        WHERE
+          due_receivers.message_id = due.id
+          AND due_receivers.is_unsubscribed = FALSE
+          AND NOT EXISTS (
+            SELECT
+              1
+            FROM
+              testament_deliveries AS deliveries
+            WHERE
+              deliveries.message_id = due_receivers.message_id
+              AND deliveries.email_receiver = due_receivers.email_receiver
+              AND deliveries.status IN ('queued', 'sent')))
+    ORDER BY
+      due.created_at ASC,
+      due.id ASC
+    LIMIT @batch_size
+    FOR UPDATE
+      SKIP LOCKED)
+  AND receivers.is_unsubscribed = FALSE
+  AND NOT EXISTS (
+    SELECT
+      1
+    FROM
+      testament_deliveries AS deliveries
+    WHERE
+      deliveries.message_id = receivers.message_id
+      AND deliveries.email_receiver = receivers.email_receiver
+      AND deliveries.status IN ('queued', 'sent'))
+ORDER BY
+  messages.created_at ASC,
+  messages.id ASC;
+
+-- name: SelectInactiveMessagesReadOnly :many
+SELECT
+  emails.email AS usr_email,
+  emails.created_at AS usr_created_at,
+  emails.is_active AS usr_is_active,
+  messages.id AS msg_id,
+  messages.email_creator AS msg_email_creator,
+  messages.created_at AS msg_created_at,
+  messages.content_encrypted AS msg_content_encrypted,
+  messages.inactive_period_days AS msg_inactive_period_days,
+  messages.reminder_interval_days AS msg_reminder_interval_days,
+  messages.is_active AS msg_is_active,
+  messages.inactive_at AS msg_inactive_at,
+  messages.next_reminder_at AS msg_next_reminder_at,
+  messages.sent_counter AS msg_sent_counter,
+  receivers.message_id AS rcv_message_id,
+  receivers.email_receiver AS rcv_email_receiver,
+  receivers.is_unsubscribed AS rcv_is_unsubscribed,
+  receivers.unsubscribe_secret AS rcv_unsubscribe_secret,
+  data_keys.wrapped_key AS dk_wrapped_key
+FROM
+  emails
+  INNER JOIN messages ON emails.email = messages.email_creator
+  INNER JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  LEFT JOIN message_data_keys AS data_keys ON messages.id = data_keys.message_id
+WHERE
+  messages.id IN (
+    SELECT
+      due.id
+    FROM
+      messages AS due
+    WHERE
+      due.inactive_at < @today::date
+      AND due.content_encrypted <> ''
+      AND due.is_active
+      AND due.sent_counter < 3
+      AND (cardinality(@message_ids::uuid[]) = 0
+        OR due.id = ANY (@message_ids::uuid[]))
+      AND (due.created_at, due.id) > (@after_created_at::timestamptz, @after_id::uuid)
+      AND EXISTS (
+        SELECT
+          1
+        FROM
+          messages_email_receivers AS due_receivers
+        WHERE
+          due_receivers.message_id = due.id
+          AND due_receivers.is_unsubscribed = FALSE
+          AND NOT EXISTS (
+            SELECT
+              1
+            FROM
+              testament_deliveries AS deliveries
+            WHERE
+              deliveries.message_id = due_receivers.message_id
+              AND deliveries.email_receiver = due_receivers.email_receiver
+              AND deliveries.status IN ('queued', 'sent')))
+    ORDER BY
+      due.created_at ASC,
+      due.id ASC
+    LIMIT @batch_size)
   AND receivers.is_unsubscribed = FALSE
+  AND NOT EXISTS (
+    SELECT
+      1
+    FROM
+      testament_deliveries AS deliveries
+    WHERE
+      deliveries.message_id = receivers.message_id
+      AND deliveries.email_receiver = receivers.email_receiver
+      AND deliveries.status IN ('queued', 'sent'))
 ORDER BY
   messages.created_at ASC,
-  messages.id ASC
-LIMIT 100;
+  messages.id ASC;
+
+-- name: CountInactiveMessages :one
+SELECT
+  COUNT(*)
+FROM
+  messages
+WHERE
+  messages.inactive_at < @today::date
+  AND messages.content_encrypted <> ''
+  AND messages.is_active
+  AND messages.sent_counter < 3
+  AND (cardinality(@message_ids::uuid[]) = 0
+    OR messages.id = ANY (@message_ids::uuid[]))
+  AND (messages.created_at, messages.id) > (@after_created_at::timestamptz, @after_id::uuid)
+  AND EXISTS (
+    SELECT
+      1
+    FROM
+      messages_email_receivers AS receivers
+    WHERE
+      receivers.message_id = messages.id
+      AND receivers.is_unsubscribed = FALSE
+      AND NOT EXISTS (
+        SELECT
+          1
+        FROM
+          testament_deliveries AS deliveries
+        WHERE
+          deliveries.message_id = receivers.message_id
+          AND deliveries.email_receiver = receivers.email_receiver
+          AND deliveries.status IN ('queued', 'sent')));
 
 -- name: UpdateMessageAfterSendingTestament :one
 UPDATE
   messages
 SET
-  is_active = CASE WHEN sent_counter < 2 THEN
+  is_active = CASE WHEN sent_counter < 2
+    AND EXISTS (
+      SELECT
+        1
+      FROM
+        messages_email_receivers AS receivers
+      WHERE
+        receivers.message_id = messages.id
+        AND receivers.is_unsubscribed = FALSE
+        AND NOT EXISTS (
+          SELECT
+            1
+          FROM
+            testament_deliveries AS deliveries
+          WHERE
+            deliveries.message_id = receivers.message_id
+            AND deliveries.email_receiver = receivers.email_receiver
+            AND deliveries.status = 'sent')) THEN
     is_active
   ELSE
     FALSE
   END,
   sent_counter = sent_counter + 1,
-  inactive_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, 15),
-  next_reminder_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, 30)
+  inactive_at = @today::date + MAKE_INTERVAL(0, 0, 0, 15),
+  next_reminder_at = @today::date + MAKE_INTERVAL(0, 0, 0, 30)
 WHERE
-  id = $1
+  id = @id
   AND sent_counter < 3
   AND is_active
 RETURNING
   *;
+
+-- name: InsertTestamentDelivery :one
+INSERT INTO testament_deliveries (message_id, email_receiver, attempt, status, vendor_id,
+  error_message, sent_at)
+SELECT
+  $1,
+  $2,
+  COALESCE(MAX(deliveries.attempt), 0) + 1,
+  $3,
+  $4,
+  $5,
+  $6
+FROM
+  testament_deliveries AS deliveries
+WHERE
+  deliveries.message_id = $1
+  AND deliveries.email_receiver = $2
+ON CONFLICT (message_id, email_receiver, attempt)
+  DO NOTHING
+RETURNING
+  *;
+
+-- name: SelectTestamentDeliveries :many
+SELECT
+  *
+FROM
+  testament_deliveries
+WHERE
+  message_id = $1
+ORDER BY
+  email_receiver ASC,
+  attempt ASC;
+
+-- name: UpdateTestamentDelivery :exec
+UPDATE
+  testament_deliveries
+SET
+  status = $2,
+  vendor_id = $3,
+  error_message = $4,
+  sent_at = $5
+WHERE
+  id = $1;
+
+-- name: DeactivateDeliveredMessage :exec
+UPDATE
+  messages
+SET
+  is_active = FALSE
+WHERE
+  id = $1
+  AND is_active
+  AND NOT EXISTS (
+    SELECT
+      1
+    FROM
+      messages_email_receivers AS receivers
+    WHERE
+      receivers.message_id = messages.id
+      AND receivers.is_unsubscribed = FALSE
+      AND NOT EXISTS (
+        SELECT
+          1
+        FROM
+          testament_deliveries AS deliveries
+        WHERE
+          deliveries.message_id = receivers.message_id
+          AND deliveries.email_receiver = receivers.email_receiver
+          AND deliveries.status = 'sent'));
+
+-- name: InsertEmailOutbox :one
+INSERT INTO email_outbox (idempotency_key, kind, message_id, email_receiver, delivery_id,
+  mail_item_sealed, wrapped_key)
+  VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (idempotency_key)
+  DO NOTHING
+RETURNING
+  *;
+
+-- name: ClaimEmailOutbox :many
+UPDATE
+  email_outbox
+SET
+  status = 'sending',
+  attempts = attempts + 1,
+  next_attempt_at = @lease_until
+WHERE
+  id IN (
+    SELECT
+      id
+    FROM
+      email_outbox
+    WHERE
+      email_outbox.status IN ('pending', 'sending')
+      AND email_outbox.next_attempt_at <= CURRENT_TIMESTAMP
+    ORDER BY
+      email_outbox.next_attempt_at ASC
+    LIMIT @batch_size
+    FOR UPDATE
+      SKIP LOCKED)
+RETURNING
+  *;
+
+-- name: UpdateEmailOutboxAfterSending :exec
+UPDATE
+  email_outbox
+SET
+  status = 'sent',
+  vendor_id = $2,
+  last_error = '',
+  mail_item = '{}'::jsonb,
+  mail_item_sealed = '',
+  wrapped_key = '',
+  sent_at = CURRENT_TIMESTAMP
+WHERE
+  id = $1;
+
+-- name: UpdateEmailOutboxAfterFailure :exec
+UPDATE
+  email_outbox
+SET
+  status = $2,
+  last_error = $3,
+  next_attempt_at = $4,
+  mail_item = CASE WHEN $2 = 'failed' THEN
+    '{}'::jsonb
+  ELSE
+    mail_item
+  END,
+  mail_item_sealed = CASE WHEN $2 = 'failed' THEN
+    ''
+  ELSE
+    mail_item_sealed
+  END,
+  wrapped_key = CASE WHEN $2 = 'failed' THEN
+    ''
+  ELSE
+    wrapped_key
+  END
+WHERE
+  id = $1;
+
+-- name: SelectEmailOutboxByMessage :many
+SELECT
+  *
+FROM
+  email_outbox
+WHERE
+  message_id = $1
+ORDER BY
+  created_at ASC;
+
+-- name: SelectMessagesToReencrypt :many
+SELECT
+  id,
+  content_encrypted
+FROM
+  messages
+WHERE
+  id > @after_id
+  AND NOT starts_with(content_encrypted, @envelope_prefix::text)
+  AND NOT starts_with(content_encrypted, 'aes.utf8:')
+ORDER BY
+  id ASC
+LIMIT @batch_size;
+
+-- name: UpdateMessageContentEncrypted :execrows
+UPDATE
+  messages
+SET
+  content_encrypted = @new_content_encrypted
+WHERE
+  id = @id
+  AND content_encrypted = @old_content_encrypted;
+
+-- name: UpsertMessageDataKey :exec
+INSERT INTO message_data_keys (message_id, kek_id, wrapped_key)
+  VALUES ($1, $2, $3)
+ON CONFLICT (message_id)
+  DO UPDATE SET
+    kek_id = EXCLUDED.kek_id,
+    wrapped_key = EXCLUDED.wrapped_key,
+    updated_at = CURRENT_TIMESTAMP;
+
+-- name: DeleteMessageDataKey :exec
+DELETE FROM message_data_keys
+WHERE message_id = $1;
+
+-- name: SelectMessageDataKeysToRewrap :many
+SELECT
+  *
+FROM
+  message_data_keys
+WHERE
+  message_id > @after_message_id
+  AND kek_id <> @active_kek_id
+ORDER BY
+  message_id ASC
+LIMIT @batch_size;
+
+-- name: UpdateMessageDataKeyWrapped :execrows
+UPDATE
+  message_data_keys
+SET
+  kek_id = @new_kek_id,
+  wrapped_key = @new_wrapped_key,
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  message_id = @message_id
+  AND wrapped_key = @old_wrapped_key;
+
+-- name: UpdateReceiverUnsubscribeSecretHash :exec
+UPDATE
+  messages_email_receivers
+SET
+  unsubscribe_secret = '',
+  unsubscribe_secret_hash = $3,
+  previous_unsubscribe_secret_hashes = CASE WHEN unsubscribe_secret_hash <> '' THEN
+    (array_prepend(unsubscribe_secret_hash::text, previous_unsubscribe_secret_hashes))[1:9]
+  WHEN $4::text <> '' THEN
+    (array_prepend($4::text, previous_unsubscribe_secret_hashes))[1:9]
+  ELSE
+    previous_unsubscribe_secret_hashes
+  END
+WHERE
+  message_id = $1
+  AND email_receiver = $2;
+
+-- name: SelectMessagesWithPlaintextSecret :many
+SELECT
+  id,
+  extension_secret
+FROM
+  messages
+WHERE
+  extension_secret_hash = ''
+  AND extension_secret <> ''
+LIMIT @batch_size;
+
+-- name: BackfillMessageExtensionSecretHash :exec
+UPDATE
+  messages
+SET
+  extension_secret = '',
+  extension_secret_hash = @extension_secret_hash
+WHERE
+  id = @id
+  AND extension_secret_hash = ''
+  AND extension_secret = @extension_secret;
+
+-- name: SelectReceiversWithPlaintextSecret :many
+SELECT
+  message_id,
+  email_receiver,
+  unsubscribe_secret
+FROM
+  messages_email_receivers
+WHERE
+  unsubscribe_secret_hash = ''
+  AND unsubscribe_secret <> ''
+LIMIT @batch_size;
+
+-- name: BackfillReceiverUnsubscribeSecretHash :exec
+UPDATE
+  messages_email_receivers
+SET
+  unsubscribe_secret = '',
+  unsubscribe_secret_hash = @unsubscribe_secret_hash
+WHERE
+  message_id = @message_id
+  AND email_receiver = @email_receiver
+  AND unsubscribe_secret_hash = ''
+  AND unsubscribe_secret = @unsubscribe_secret;
+
+-- name: HitRateLimit :one
+INSERT INTO rate_limits (key, window_start, hits, updated_at)
+  VALUES (@key, @now, 1, @now)
+ON CONFLICT (key)
+  DO UPDATE SET
+    hits = CASE WHEN rate_limits.window_start > @window_start_after THEN
+      rate_limits.hits + 1
+    ELSE
+      1
+    END,
+    window_start = CASE WHEN rate_limits.window_start > @window_start_after THEN
+      rate_limits.window_start
+    ELSE
+      @now
+    END,
+    updated_at = @now
+RETURNING
+  *;
+
+-- name: FailRateLimit :one
+INSERT INTO rate_limits (key, window_start, failures, updated_at)
+  VALUES (@key, @now, 1, @now)
+ON CONFLICT (key)
+  DO UPDATE SET
+    failures = rate_limits.failures + 1,
+    updated_at = @now
+RETURNING
+  *;
+
+-- name: LockRateLimit :exec
+UPDATE
+  rate_limits
+SET
+  locked_until = GREATEST (locked_until, @locked_until)
+WHERE
+  key = @key;
+
+-- name: ResetRateLimitFailures :exec
+UPDATE
+  rate_limits
+SET
+  failures = 0,
+  locked_until = updated_at
+WHERE
+  key = $1;
+
+-- name: DeleteExpiredRateLimits :execrows
+DELETE FROM rate_limits
+WHERE updated_at < @updated_before
+  AND locked_until < CURRENT_TIMESTAMP;
+
+-- name: InsertSecretAttemptFailure :exec
+INSERT INTO secret_attempt_failures (message_id, action, ip)
+  VALUES ($1, $2, $3);
+
+-- name: SelectSecretAttemptFailureCounts :many
+SELECT
+  message_id,
+  count(*) AS failures,
+  count(DISTINCT ip) AS ips,
+  max(created_at)::timestamptz AS last_failed_at
+FROM
+  secret_attempt_failures
+WHERE
+  created_at >= @since
+  AND message_id IS NOT NULL
+GROUP BY
+  message_id
+HAVING
+  count(*) >= @min_failures::bigint
+ORDER BY
+  failures DESC;
+
+-- name: DeleteSecretAttemptFailures :execrows
+DELETE FROM secret_attempt_failures
+WHERE created_at < $1;
+
+-- name: TryAdvisoryXactLock :one
+SELECT
+  pg_try_advisory_xact_lock(hashtext(@lock_name::text)) AS is_locked;
+
+-- name: TryAdvisoryXactLockShared :one
+SELECT
+  pg_try_advisory_xact_lock_shared(hashtext(@lock_name::text)) AS is_locked;
+
+-- name: TryAdvisoryLock :one
+SELECT
+  pg_try_advisory_lock(hashtext(@lock_name::text)) AS is_locked;
+
+-- name: AdvisoryUnlock :one
+SELECT
+  pg_advisory_unlock(hashtext(@lock_name::text)) AS is_unlocked;
+
+-- name: InsertCronJobIfNotExists :exec
+INSERT INTO cron_jobs (action, last_scheduled_at)
+  VALUES (@action, @last_scheduled_at)
+ON CONFLICT (action)
+  DO NOTHING;
+
+-- name: SelectCronJob :one
+SELECT
+  *
+FROM
+  cron_jobs
+WHERE
+  action = @action;
+
+-- name: UpdateCronJobAfterRun :exec
+UPDATE
+  cron_jobs
+SET
+  last_scheduled_at = @last_scheduled_at,
+  last_finished_at = CURRENT_TIMESTAMP,
+  last_error = @last_error,
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  action = @action;
+
+-- name: InsertSchedulerRun :one
+INSERT INTO scheduler_runs (action, params, trigger_id)
+  VALUES (@action, @params, @trigger_id)
+RETURNING
+  *;
+
+-- name: UpdateSchedulerRunAfterFinishing :exec
+UPDATE
+  scheduler_runs
+SET
+  status = @status,
+  selected = @selected,
+  queued = @queued,
+  sent = @sent,
+  failed = @failed,
+  skipped = @skipped,
+  deferred = @deferred,
+  error_message = @error_message,
+  finished_at = CURRENT_TIMESTAMP
+WHERE
+  id = @id;
+
+-- name: InsertSchedulerRunEmail :exec
+INSERT INTO scheduler_run_emails (run_id, outbox_id, kind, message_id, email_receiver, status, vendor_id, error_message)
+  VALUES (@run_id, @outbox_id, @kind, @message_id, @email_receiver, @status, @vendor_id, @error_message);
+
+-- name: SelectSchedulerRuns :many
+SELECT
+  *
+FROM
+  scheduler_runs
+WHERE (@action::text = ''
+  OR action = @action::text)
+  AND (@status::text = ''
+    OR status = @status::text)
+ORDER BY
+  started_at DESC
+LIMIT @row_limit;
+
+-- name: SelectSchedulerRun :one
+SELECT
+  *
+FROM
+  scheduler_runs
+WHERE
+  id = @id;
+
+-- name: SelectSchedulerRunEmails :many
+SELECT
+  *
+FROM
+  scheduler_run_emails
+WHERE
+  run_id = @run_id
+ORDER BY
+  created_at ASC,
+  email_receiver ASC;
+
+-- name: SelectMessagesByIDs :many
+SELECT
+  *
+FROM
+  messages
+WHERE
+  id = ANY (@ids::uuid[])
+ORDER BY
+  created_at ASC,
+  id ASC;
+
+-- name: InsertMailVendorQuotaIfNotExists :exec
+INSERT INTO mail_vendor_quotas (vendor_id, day)
+  VALUES (@vendor_id, @day)
+ON CONFLICT (vendor_id, day)
+  DO NOTHING;
+
+-- name: SelectMailVendorQuotaForUpdate :one
+SELECT
+  sent_count
+FROM
+  mail_vendor_quotas
+WHERE
+  vendor_id = @vendor_id
+  AND day = @day
+FOR UPDATE;
+
+-- name: UpdateMailVendorQuota :exec
+UPDATE
+  mail_vendor_quotas
+SET
+  sent_count = @sent_count,
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  vendor_id = @vendor_id
+  AND day = @day;
+
+-- name: ReleaseMailVendorQuota :exec
+UPDATE
+  mail_vendor_quotas
+SET
+  sent_count = GREATEST (sent_count - @count::integer, 0),
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  vendor_id = @vendor_id
+  AND day = @day;
+
+-- name: DeferEmailOutbox :exec
+UPDATE
+  email_outbox
+SET
+  status = 'pending',
+  attempts = GREATEST (attempts - 1, 0),
+  last_error = @last_error,
+  next_attempt_at = @next_attempt_at
+WHERE
+  id = @id;
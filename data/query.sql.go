@@ -11,12 +11,305 @@ import (
 	"github.com/google/uuid"
 )
 
+const advisoryUnlock = `-- name: AdvisoryUnlock :one
+SELECT
+  pg_advisory_unlock(hashtext($1::text)) AS is_unlocked
+`
+
+func (q *Queries) AdvisoryUnlock(ctx context.Context, lockName string) (bool, error) {
+	row := q.db.QueryRow(ctx, advisoryUnlock, lockName)
+	var is_unlocked bool
+	err := row.Scan(&is_unlocked)
+	return is_unlocked, err
+}
+
+const backfillMessageExtensionSecretHash = `-- name: BackfillMessageExtensionSecretHash :exec
+UPDATE
+  messages
+SET
+  extension_secret = '',
+  extension_secret_hash = $1
+WHERE
+  id = $2
+  AND extension_secret_hash = ''
+  AND extension_secret = $3
+`
+
+type BackfillMessageExtensionSecretHashParams struct {
+	ExtensionSecretHash string
+	ID                  uuid.UUID
+	ExtensionSecret     string
+}
+
+func (q *Queries) BackfillMessageExtensionSecretHash(ctx context.Context, arg BackfillMessageExtensionSecretHashParams) error {
+	_, err := q.db.Exec(ctx, backfillMessageExtensionSecretHash, arg.ExtensionSecretHash, arg.ID, arg.ExtensionSecret)
+	return err
+}
+
+const backfillReceiverUnsubscribeSecretHash = `-- name: BackfillReceiverUnsubscribeSecretHash :exec
+UPDATE
+  messages_email_receivers
+SET
+  unsubscribe_secret = '',
+  unsubscribe_secret_hash = $1
+WHERE
+  message_id = $2
+  AND email_receiver = $3
+  AND unsubscribe_secret_hash = ''
+  AND unsubscribe_secret = $4
+`
+
+type BackfillReceiverUnsubscribeSecretHashParams struct {
+	UnsubscribeSecretHash string
+	MessageID             uuid.UUID
+	EmailReceiver         string
+	UnsubscribeSecret     string
+}
+
+func (q *Queries) BackfillReceiverUnsubscribeSecretHash(ctx context.Context, arg BackfillReceiverUnsubscribeSecretHashParams) error {
+	_, err := q.db.Exec(ctx, backfillReceiverUnsubscribeSecretHash,
+		arg.UnsubscribeSecretHash,
+		arg.MessageID,
+		arg.EmailReceiver,
+		arg.UnsubscribeSecret,
+	)
+	return err
+}
+
+const claimEmailOutbox = `-- name: ClaimEmailOutbox :many
+UPDATE
+  email_outbox
+SET
+  status = 'sending',
+  attempts = attempts + 1,
+  next_attempt_at = $1
+WHERE
+  id IN (
+    SELECT
+      id
+    FROM
+      email_outbox
+    WHERE
+      email_outbox.status IN ('pending', 'sending')
+      AND email_outbox.next_attempt_at <= CURRENT_TIMESTAMP
+    ORDER BY
+      email_outbox.next_attempt_at ASC
+    LIMIT $2
+    FOR UPDATE
+      SKIP LOCKED)
+RETURNING
+  id, idempotency_key, kind, message_id, email_receiver, delivery_id, mail_item, status, attempts, next_attempt_at, last_error, vendor_id, created_at, sent_at, mail_item_sealed, wrapped_key
+`
+
+type ClaimEmailOutboxParams struct {
+	LeaseUntil time.Time
+	BatchSize  int32
+}
+
+func (q *Queries) ClaimEmailOutbox(ctx context.Context, arg ClaimEmailOutboxParams) ([]EmailOutbox, error) {
+	rows, err := q.db.Query(ctx, claimEmailOutbox, arg.LeaseUntil, arg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []EmailOutbox
+	for rows.Next() {
+		var i EmailOutbox
+		if err := rows.Scan(
+			&i.ID,
+			&i.IdempotencyKey,
+			&i.Kind,
+			&i.MessageID,
+			&i.EmailReceiver,
+			&i.DeliveryID,
+			&i.MailItem,
+			&i.Status,
+			&i.Attempts,
+			&i.NextAttemptAt,
+			&i.LastError,
+			&i.VendorID,
+			&i.CreatedAt,
+			&i.SentAt,
+			&i.MailItemSealed,
+			&i.WrappedKey,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const countInactiveMessages = `-- name: CountInactiveMessages :one
+SELECT
+  COUNT(*)
+FROM
+  messages
+WHERE
+  messages.inactive_at < $1::date
+  AND messages.content_encrypted <> ''
+  AND messages.is_active
+  AND messages.sent_counter < 3
+  AND (cardinality($2::uuid[]) = 0
+    OR messages.id = ANY ($2::uuid[]))
+  AND (messages.created_at, messages.id) > ($3::timestamptz, $4::uuid)
+  AND EXISTS (
+    SELECT
+      1
+    FROM
+      messages_email_receivers AS receivers
+    WHERE
+      receivers.message_id = messages.id
+      AND receivers.is_unsubscribed = FALSE
+      AND NOT EXISTS (
+        SELECT
+          1
+        FROM
+          testament_deliveries AS deliveries
+        WHERE
+          deliveries.message_id = receivers.message_id
+          AND deliveries.email_receiver = receivers.email_receiver
+          AND deliveries.status IN ('queued', 'sent')))
+`
+
+type CountInactiveMessagesParams struct {
+	Today          time.Time
+	MessageIds     []uuid.UUID
+	AfterCreatedAt time.Time
+	AfterID        uuid.UUID
+}
+
+func (q *Queries) CountInactiveMessages(ctx context.Context, arg CountInactiveMessagesParams) (int64, error) {
+	row := q.db.QueryRow(ctx, countInactiveMessages,
+		arg.Today,
+		arg.MessageIds,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+	)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countMessagesNeedReminding = `-- name: CountMessagesNeedReminding :one
+SELECT
+  COUNT(*)
+FROM
+  messages
+WHERE
+  messages.is_active
+  AND messages.content_encrypted <> ''
+  AND messages.next_reminder_at <= $1::date
+  AND (cardinality($2::uuid[]) = 0
+    OR messages.id = ANY ($2::uuid[]))
+  AND (messages.created_at, messages.id) > ($3::timestamptz, $4::uuid)
+  AND EXISTS (
+    SELECT
+      1
+    FROM
+      messages_email_receivers AS receivers
+    WHERE
+      receivers.message_id = messages.id
+      AND receivers.is_unsubscribed = FALSE)
+`
+
+type CountMessagesNeedRemindingParams struct {
+	Today          time.Time
+	MessageIds     []uuid.UUID
+	AfterCreatedAt time.Time
+	AfterID        uuid.UUID
+}
+
+func (q *Queries) CountMessagesNeedReminding(ctx context.Context, arg CountMessagesNeedRemindingParams) (int64, error) {
+	row := q.db.QueryRow(ctx, countMessagesNeedReminding,
+		arg.Today,
+		arg.MessageIds,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+	)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const deactivateDeliveredMessage = `-- name: DeactivateDeliveredMessage :exec
+UPDATE
+  messages
+SET
+  is_active = FALSE
+WHERE
+  id = $1
+  AND is_active
+  AND NOT EXISTS (
+    SELECT
+      1
+    FROM
+      messages_email_receivers AS receivers
+    WHERE
+      receivers.message_id = messages.id
+      AND receivers.is_unsubscribed = FALSE
+      AND NOT EXISTS (
+        SELECT
+          1
+        FROM
+          testament_deliveries AS deliveries
+        WHERE
+          deliveries.message_id = receivers.message_id
+          AND deliveries.email_receiver = receivers.email_receiver
+          AND deliveries.status = 'sent'))
+`
+
+func (q *Queries) DeactivateDeliveredMessage(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.Exec(ctx, deactivateDeliveredMessage, id)
+	return err
+}
+
+const deferEmailOutbox = `-- name: DeferEmailOutbox :exec
+UPDATE
+  email_outbox
+SET
+  status = 'pending',
+  attempts = GREATEST (attempts - 1, 0),
+  last_error = $1,
+  next_attempt_at = $2
+WHERE
+  id = $3
+`
+
+type DeferEmailOutboxParams struct {
+	LastError     string
+	NextAttemptAt time.Time
+	ID            uuid.UUID
+}
+
+func (q *Queries) DeferEmailOutbox(ctx context.Context, arg DeferEmailOutboxParams) error {
+	_, err := q.db.Exec(ctx, deferEmailOutbox, arg.LastError, arg.NextAttemptAt, arg.ID)
+	return err
+}
+
+const deleteExpiredRateLimits = `-- name: DeleteExpiredRateLimits :execrows
+DELETE FROM rate_limits
+WHERE updated_at < $1
+  AND locked_until < CURRENT_TIMESTAMP
+`
+
+func (q *Queries) DeleteExpiredRateLimits(ctx context.Context, updatedBefore time.Time) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteExpiredRateLimits, updatedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const deleteMessage = `-- name: DeleteMessage :one
 DELETE FROM messages
 WHERE id = $1
   AND email_creator = $2
 RETURNING
-  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter
+  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter, extension_secret_hash, previous_extension_secret_hashes
 `
 
 type DeleteMessageParams struct {
@@ -39,10 +332,191 @@ func (q *Queries) DeleteMessage(ctx context.Context, arg DeleteMessageParams) (M
 		&i.InactiveAt,
 		&i.NextReminderAt,
 		&i.SentCounter,
+		&i.ExtensionSecretHash,
+		&i.PreviousExtensionSecretHashes,
+	)
+	return i, err
+}
+
+const deleteMessageDataKey = `-- name: DeleteMessageDataKey :exec
+DELETE FROM message_data_keys
+WHERE message_id = $1
+`
+
+func (q *Queries) DeleteMessageDataKey(ctx context.Context, messageID uuid.UUID) error {
+	_, err := q.db.Exec(ctx, deleteMessageDataKey, messageID)
+	return err
+}
+
+const deleteSecretAttemptFailures = `-- name: DeleteSecretAttemptFailures :execrows
+DELETE FROM secret_attempt_failures
+WHERE created_at < $1
+`
+
+func (q *Queries) DeleteSecretAttemptFailures(ctx context.Context, createdAt time.Time) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteSecretAttemptFailures, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const failRateLimit = `-- name: FailRateLimit :one
+INSERT INTO rate_limits (key, window_start, failures, updated_at)
+  VALUES ($1, $2, 1, $2)
+ON CONFLICT (key)
+  DO UPDATE SET
+    failures = rate_limits.failures + 1,
+    updated_at = $2
+RETURNING
+  key, window_start, hits, failures, locked_until, updated_at
+`
+
+type FailRateLimitParams struct {
+	Key string
+	Now time.Time
+}
+
+func (q *Queries) FailRateLimit(ctx context.Context, arg FailRateLimitParams) (RateLimit, error) {
+	row := q.db.QueryRow(ctx, failRateLimit, arg.Key, arg.Now)
+	var i RateLimit
+	err := row.Scan(
+		&i.Key,
+		&i.WindowStart,
+		&i.Hits,
+		&i.Failures,
+		&i.LockedUntil,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const hitRateLimit = `-- name: HitRateLimit :one
+INSERT INTO rate_limits (key, window_start, hits, updated_at)
+  VALUES ($1, $2, 1, $2)
+ON CONFLICT (key)
+  DO UPDATE SET
+    hits = CASE WHEN rate_limits.window_start > $3 THEN
+      rate_limits.hits + 1
+    ELSE
+      1
+    END,
+    window_start = CASE WHEN rate_limits.window_start > $3 THEN
+      rate_limits.window_start
+    ELSE
+      $2
+    END,
+    updated_at = $2
+RETURNING
+  key, window_start, hits, failures, locked_until, updated_at
+`
+
+type HitRateLimitParams struct {
+	Key              string
+	Now              time.Time
+	WindowStartAfter time.Time
+}
+
+func (q *Queries) HitRateLimit(ctx context.Context, arg HitRateLimitParams) (RateLimit, error) {
+	row := q.db.QueryRow(ctx, hitRateLimit, arg.Key, arg.Now, arg.WindowStartAfter)
+	var i RateLimit
+	err := row.Scan(
+		&i.Key,
+		&i.WindowStart,
+		&i.Hits,
+		&i.Failures,
+		&i.LockedUntil,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const insertCronJobIfNotExists = `-- name: InsertCronJobIfNotExists :exec
+INSERT INTO cron_jobs (action, last_scheduled_at)
+  VALUES ($1, $2)
+ON CONFLICT (action)
+  DO NOTHING
+`
+
+type InsertCronJobIfNotExistsParams struct {
+	Action          string
+	LastScheduledAt time.Time
+}
+
+func (q *Queries) InsertCronJobIfNotExists(ctx context.Context, arg InsertCronJobIfNotExistsParams) error {
+	_, err := q.db.Exec(ctx, insertCronJobIfNotExists, arg.Action, arg.LastScheduledAt)
+	return err
+}
+
+const insertEmailOutbox = `-- name: InsertEmailOutbox :one
+INSERT INTO email_outbox (idempotency_key, kind, message_id, email_receiver, delivery_id,
+  mail_item_sealed, wrapped_key)
+  VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (idempotency_key)
+  DO NOTHING
+RETURNING
+  id, idempotency_key, kind, message_id, email_receiver, delivery_id, mail_item, status, attempts, next_attempt_at, last_error, vendor_id, created_at, sent_at, mail_item_sealed, wrapped_key
+`
+
+type InsertEmailOutboxParams struct {
+	IdempotencyKey string
+	Kind           string
+	MessageID      uuid.UUID
+	EmailReceiver  string
+	DeliveryID     uuid.NullUUID
+	MailItemSealed string
+	WrappedKey     string
+}
+
+func (q *Queries) InsertEmailOutbox(ctx context.Context, arg InsertEmailOutboxParams) (EmailOutbox, error) {
+	row := q.db.QueryRow(ctx, insertEmailOutbox,
+		arg.IdempotencyKey,
+		arg.Kind,
+		arg.MessageID,
+		arg.EmailReceiver,
+		arg.DeliveryID,
+		arg.MailItemSealed,
+		arg.WrappedKey,
+	)
+	var i EmailOutbox
+	err := row.Scan(
+		&i.ID,
+		&i.IdempotencyKey,
+		&i.Kind,
+		&i.MessageID,
+		&i.EmailReceiver,
+		&i.DeliveryID,
+		&i.MailItem,
+		&i.Status,
+		&i.Attempts,
+		&i.NextAttemptAt,
+		&i.LastError,
+		&i.VendorID,
+		&i.CreatedAt,
+		&i.SentAt,
+		&i.MailItemSealed,
+		&i.WrappedKey,
 	)
 	return i, err
 }
 
+const insertMailVendorQuotaIfNotExists = `-- name: InsertMailVendorQuotaIfNotExists :exec
+INSERT INTO mail_vendor_quotas (vendor_id, day)
+  VALUES ($1, $2)
+ON CONFLICT (vendor_id, day)
+  DO NOTHING
+`
+
+type InsertMailVendorQuotaIfNotExistsParams struct {
+	VendorID string
+	Day      time.Time
+}
+
+func (q *Queries) InsertMailVendorQuotaIfNotExists(ctx context.Context, arg InsertMailVendorQuotaIfNotExistsParams) error {
+	_, err := q.db.Exec(ctx, insertMailVendorQuotaIfNotExists, arg.VendorID, arg.Day)
+	return err
+}
+
 const insertMessage = `-- name: InsertMessage :one
 WITH insert_email AS (
 INSERT INTO emails (email)
@@ -52,7 +526,7 @@ INSERT INTO emails (email)
   RETURNING
     email)
   INSERT INTO messages (email_creator, content_encrypted, inactive_period_days,
-    reminder_interval_days, extension_secret, inactive_at, next_reminder_at)
+    reminder_interval_days, extension_secret_hash, inactive_at, next_reminder_at)
   SELECT
     $1,
     $2,
@@ -69,7 +543,7 @@ INSERT INTO emails (email)
     WHERE
       messages.email_creator = $1) < 3
 RETURNING
-  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter
+  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter, extension_secret_hash, previous_extension_secret_hashes
 `
 
 type InsertMessageParams struct {
@@ -77,7 +551,7 @@ type InsertMessageParams struct {
 	ContentEncrypted     string
 	InactivePeriodDays   int32
 	ReminderIntervalDays int32
-	ExtensionSecret      string
+	ExtensionSecretHash  string
 }
 
 func (q *Queries) InsertMessage(ctx context.Context, arg InsertMessageParams) (Message, error) {
@@ -86,7 +560,7 @@ func (q *Queries) InsertMessage(ctx context.Context, arg InsertMessageParams) (M
 		arg.ContentEncrypted,
 		arg.InactivePeriodDays,
 		arg.ReminderIntervalDays,
-		arg.ExtensionSecret,
+		arg.ExtensionSecretHash,
 	)
 	var i Message
 	err := row.Scan(
@@ -101,11 +575,869 @@ func (q *Queries) InsertMessage(ctx context.Context, arg InsertMessageParams) (M
 		&i.InactiveAt,
 		&i.NextReminderAt,
 		&i.SentCounter,
+		&i.ExtensionSecretHash,
+		&i.PreviousExtensionSecretHashes,
+	)
+	return i, err
+}
+
+const insertSchedulerRun = `-- name: InsertSchedulerRun :one
+INSERT INTO scheduler_runs (action, params, trigger_id)
+  VALUES ($1, $2, $3)
+RETURNING
+  id, action, params, trigger_id, status, selected, queued, sent, failed, skipped, error_message, started_at, finished_at, deferred
+`
+
+type InsertSchedulerRunParams struct {
+	Action    string
+	Params    []byte
+	TriggerID string
+}
+
+func (q *Queries) InsertSchedulerRun(ctx context.Context, arg InsertSchedulerRunParams) (SchedulerRun, error) {
+	row := q.db.QueryRow(ctx, insertSchedulerRun, arg.Action, arg.Params, arg.TriggerID)
+	var i SchedulerRun
+	err := row.Scan(
+		&i.ID,
+		&i.Action,
+		&i.Params,
+		&i.TriggerID,
+		&i.Status,
+		&i.Selected,
+		&i.Queued,
+		&i.Sent,
+		&i.Failed,
+		&i.Skipped,
+		&i.ErrorMessage,
+		&i.StartedAt,
+		&i.FinishedAt,
+		&i.Deferred,
+	)
+	return i, err
+}
+
+const insertSchedulerRunEmail = `-- name: InsertSchedulerRunEmail :exec
+INSERT INTO scheduler_run_emails (run_id, outbox_id, kind, message_id, email_receiver, status, vendor_id, error_message)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+`
+
+type InsertSchedulerRunEmailParams struct {
+	RunID         uuid.UUID
+	OutboxID      uuid.UUID
+	Kind          string
+	MessageID     uuid.UUID
+	EmailReceiver string
+	Status        string
+	VendorID      string
+	ErrorMessage  string
+}
+
+func (q *Queries) InsertSchedulerRunEmail(ctx context.Context, arg InsertSchedulerRunEmailParams) error {
+	_, err := q.db.Exec(ctx, insertSchedulerRunEmail,
+		arg.RunID,
+		arg.OutboxID,
+		arg.Kind,
+		arg.MessageID,
+		arg.EmailReceiver,
+		arg.Status,
+		arg.VendorID,
+		arg.ErrorMessage,
+	)
+	return err
+}
+
+const insertSecretAttemptFailure = `-- name: InsertSecretAttemptFailure :exec
+INSERT INTO secret_attempt_failures (message_id, action, ip)
+  VALUES ($1, $2, $3)
+`
+
+type InsertSecretAttemptFailureParams struct {
+	MessageID uuid.NullUUID
+	Action    string
+	IP        string
+}
+
+func (q *Queries) InsertSecretAttemptFailure(ctx context.Context, arg InsertSecretAttemptFailureParams) error {
+	_, err := q.db.Exec(ctx, insertSecretAttemptFailure, arg.MessageID, arg.Action, arg.IP)
+	return err
+}
+
+const insertTestamentDelivery = `-- name: InsertTestamentDelivery :one
+INSERT INTO testament_deliveries (message_id, email_receiver, attempt, status, vendor_id,
+  error_message, sent_at)
+SELECT
+  $1,
+  $2,
+  COALESCE(MAX(deliveries.attempt), 0) + 1,
+  $3,
+  $4,
+  $5,
+  $6
+FROM
+  testament_deliveries AS deliveries
+WHERE
+  deliveries.message_id = $1
+  AND deliveries.email_receiver = $2
+ON CONFLICT (message_id, email_receiver, attempt)
+  DO NOTHING
+RETURNING
+  id, message_id, email_receiver, attempt, status, vendor_id, error_message, created_at, sent_at
+`
+
+type InsertTestamentDeliveryParams struct {
+	MessageID     uuid.UUID
+	EmailReceiver string
+	Status        string
+	VendorID      string
+	ErrorMessage  string
+	SentAt        sql.NullTime
+}
+
+func (q *Queries) InsertTestamentDelivery(ctx context.Context, arg InsertTestamentDeliveryParams) (TestamentDelivery, error) {
+	row := q.db.QueryRow(ctx, insertTestamentDelivery,
+		arg.MessageID,
+		arg.EmailReceiver,
+		arg.Status,
+		arg.VendorID,
+		arg.ErrorMessage,
+		arg.SentAt,
+	)
+	var i TestamentDelivery
+	err := row.Scan(
+		&i.ID,
+		&i.MessageID,
+		&i.EmailReceiver,
+		&i.Attempt,
+		&i.Status,
+		&i.VendorID,
+		&i.ErrorMessage,
+		&i.CreatedAt,
+		&i.SentAt,
 	)
 	return i, err
 }
 
-const selectInactiveMessages = `-- name: SelectInactiveMessages :many
+const lockRateLimit = `-- name: LockRateLimit :exec
+UPDATE
+  rate_limits
+SET
+  locked_until = GREATEST (locked_until, $1)
+WHERE
+  key = $2
+`
+
+type LockRateLimitParams struct {
+	LockedUntil time.Time
+	Key         string
+}
+
+func (q *Queries) LockRateLimit(ctx context.Context, arg LockRateLimitParams) error {
+	_, err := q.db.Exec(ctx, lockRateLimit, arg.LockedUntil, arg.Key)
+	return err
+}
+
+const releaseMailVendorQuota = `-- name: ReleaseMailVendorQuota :exec
+UPDATE
+  mail_vendor_quotas
+SET
+  sent_count = GREATEST (sent_count - $1::integer, 0),
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  vendor_id = $2
+  AND day = $3
+`
+
+type ReleaseMailVendorQuotaParams struct {
+	Count    int32
+	VendorID string
+	Day      time.Time
+}
+
+func (q *Queries) ReleaseMailVendorQuota(ctx context.Context, arg ReleaseMailVendorQuotaParams) error {
+	_, err := q.db.Exec(ctx, releaseMailVendorQuota, arg.Count, arg.VendorID, arg.Day)
+	return err
+}
+
+const resetRateLimitFailures = `-- name: ResetRateLimitFailures :exec
+UPDATE
+  rate_limits
+SET
+  failures = 0,
+  locked_until = updated_at
+WHERE
+  key = $1
+`
+
+func (q *Queries) ResetRateLimitFailures(ctx context.Context, key string) error {
+	_, err := q.db.Exec(ctx, resetRateLimitFailures, key)
+	return err
+}
+
+const selectCronJob = `-- name: SelectCronJob :one
+SELECT
+  action, last_scheduled_at, last_finished_at, last_error, updated_at
+FROM
+  cron_jobs
+WHERE
+  action = $1
+`
+
+func (q *Queries) SelectCronJob(ctx context.Context, action string) (CronJob, error) {
+	row := q.db.QueryRow(ctx, selectCronJob, action)
+	var i CronJob
+	err := row.Scan(
+		&i.Action,
+		&i.LastScheduledAt,
+		&i.LastFinishedAt,
+		&i.LastError,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const selectEmailOutboxByMessage = `-- name: SelectEmailOutboxByMessage :many
+SELECT
+  id, idempotency_key, kind, message_id, email_receiver, delivery_id, mail_item, status, attempts, next_attempt_at, last_error, vendor_id, created_at, sent_at, mail_item_sealed, wrapped_key
+FROM
+  email_outbox
+WHERE
+  message_id = $1
+ORDER BY
+  created_at ASC
+`
+
+func (q *Queries) SelectEmailOutboxByMessage(ctx context.Context, messageID uuid.UUID) ([]EmailOutbox, error) {
+	rows, err := q.db.Query(ctx, selectEmailOutboxByMessage, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []EmailOutbox
+	for rows.Next() {
+		var i EmailOutbox
+		if err := rows.Scan(
+			&i.ID,
+			&i.IdempotencyKey,
+			&i.Kind,
+			&i.MessageID,
+			&i.EmailReceiver,
+			&i.DeliveryID,
+			&i.MailItem,
+			&i.Status,
+			&i.Attempts,
+			&i.NextAttemptAt,
+			&i.LastError,
+			&i.VendorID,
+			&i.CreatedAt,
+			&i.SentAt,
+			&i.MailItemSealed,
+			&i.WrappedKey,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectInactiveMessages = `-- name: SelectInactiveMessages :many
+SELECT
+  emails.email AS usr_email,
+  emails.created_at AS usr_created_at,
+  emails.is_active AS usr_is_active,
+  messages.id AS msg_id,
+  messages.email_creator AS msg_email_creator,
+  messages.created_at AS msg_created_at,
+  messages.content_encrypted AS msg_content_encrypted,
+  messages.inactive_period_days AS msg_inactive_period_days,
+  messages.reminder_interval_days AS msg_reminder_interval_days,
+  messages.is_active AS msg_is_active,
+  messages.inactive_at AS msg_inactive_at,
+  messages.next_reminder_at AS msg_next_reminder_at,
+  messages.sent_counter AS msg_sent_counter,
+  receivers.message_id AS rcv_message_id,
+  receivers.email_receiver AS rcv_email_receiver,
+  receivers.is_unsubscribed AS rcv_is_unsubscribed,
+  receivers.unsubscribe_secret AS rcv_unsubscribe_secret,
+  data_keys.wrapped_key AS dk_wrapped_key
+FROM
+  emails
+  INNER JOIN messages ON emails.email = messages.email_creator
+  INNER JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  LEFT JOIN message_data_keys AS data_keys ON messages.id = data_keys.message_id
+WHERE
+  messages.id IN (
+    SELECT
+      due.id
+    FROM
+      messages AS due
+    WHERE
+      due.inactive_at < $1::date
+      AND due.content_encrypted <> ''
+      AND due.is_active
+      AND due.sent_counter < 3
+      AND (cardinality($2::uuid[]) = 0
+        OR due.id = ANY ($2::uuid[]))
+      AND (due.created_at, due.id) > ($3::timestamptz, $4::uuid)
+      AND EXISTS (
+        SELECT
+          1
+        FROM
+          messages_email_receivers AS due_receivers
+        WHERE
+          due_receivers.message_id = due.id
+          AND due_receivers.is_unsubscribed = FALSE
+          AND NOT EXISTS (
+            SELECT
+              1
+            FROM
+              testament_deliveries AS deliveries
+            WHERE
+              deliveries.message_id = due_receivers.message_id
+              AND deliveries.email_receiver = due_receivers.email_receiver
+              AND deliveries.status IN ('queued', 'sent')))
+    ORDER BY
+      due.created_at ASC,
+      due.id ASC
+    LIMIT $5
+    FOR UPDATE
+      SKIP LOCKED)
+  AND receivers.is_unsubscribed = FALSE
+  AND NOT EXISTS (
+    SELECT
+      1
+    FROM
+      testament_deliveries AS deliveries
+    WHERE
+      deliveries.message_id = receivers.message_id
+      AND deliveries.email_receiver = receivers.email_receiver
+      AND deliveries.status IN ('queued', 'sent'))
+ORDER BY
+  messages.created_at ASC,
+  messages.id ASC
+`
+
+type SelectInactiveMessagesParams struct {
+	Today          time.Time
+	MessageIds     []uuid.UUID
+	AfterCreatedAt time.Time
+	AfterID        uuid.UUID
+	BatchSize      int32
+}
+
+type SelectInactiveMessagesRow struct {
+	UsrEmail                string
+	UsrCreatedAt            time.Time
+	UsrIsActive             bool
+	MsgID                   uuid.UUID
+	MsgEmailCreator         string
+	MsgCreatedAt            time.Time
+	MsgContentEncrypted     string
+	MsgInactivePeriodDays   int32
+	MsgReminderIntervalDays int32
+	MsgIsActive             bool
+	MsgInactiveAt           time.Time
+	MsgNextReminderAt       time.Time
+	MsgSentCounter          int32
+	RcvMessageID            uuid.UUID
+	RcvEmailReceiver        string
+	RcvIsUnsubscribed       bool
+	RcvUnsubscribeSecret    string
+	DkWrappedKey            sql.NullString
+}
+
+func (q *Queries) SelectInactiveMessages(ctx context.Context, arg SelectInactiveMessagesParams) ([]SelectInactiveMessagesRow, error) {
+	rows, err := q.db.Query(ctx, selectInactiveMessages,
+		arg.Today,
+		arg.MessageIds,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+		arg.BatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SelectInactiveMessagesRow
+	for rows.Next() {
+		var i SelectInactiveMessagesRow
+		if err := rows.Scan(
+			&i.UsrEmail,
+			&i.UsrCreatedAt,
+			&i.UsrIsActive,
+			&i.MsgID,
+			&i.MsgEmailCreator,
+			&i.MsgCreatedAt,
+			&i.MsgContentEncrypted,
+			&i.MsgInactivePeriodDays,
+			&i.MsgReminderIntervalDays,
+			&i.MsgIsActive,
+			&i.MsgInactiveAt,
+			&i.MsgNextReminderAt,
+			&i.MsgSentCounter,
+			&i.RcvMessageID,
+			&i.RcvEmailReceiver,
+			&i.RcvIsUnsubscribed,
+			&i.RcvUnsubscribeSecret,
+			&i.DkWrappedKey,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectInactiveMessagesReadOnly = `-- name: SelectInactiveMessagesReadOnly :many
+SELECT
+  emails.email AS usr_email,
+  emails.created_at AS usr_created_at,
+  emails.is_active AS usr_is_active,
+  messages.id AS msg_id,
+  messages.email_creator AS msg_email_creator,
+  messages.created_at AS msg_created_at,
+  messages.content_encrypted AS msg_content_encrypted,
+  messages.inactive_period_days AS msg_inactive_period_days,
+  messages.reminder_interval_days AS msg_reminder_interval_days,
+  messages.is_active AS msg_is_active,
+  messages.inactive_at AS msg_inactive_at,
+  messages.next_reminder_at AS msg_next_reminder_at,
+  messages.sent_counter AS msg_sent_counter,
+  receivers.message_id AS rcv_message_id,
+  receivers.email_receiver AS rcv_email_receiver,
+  receivers.is_unsubscribed AS rcv_is_unsubscribed,
+  receivers.unsubscribe_secret AS rcv_unsubscribe_secret,
+  data_keys.wrapped_key AS dk_wrapped_key
+FROM
+  emails
+  INNER JOIN messages ON emails.email = messages.email_creator
+  INNER JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  LEFT JOIN message_data_keys AS data_keys ON messages.id = data_keys.message_id
+WHERE
+  messages.id IN (
+    SELECT
+      due.id
+    FROM
+      messages AS due
+    WHERE
+      due.inactive_at < $1::date
+      AND due.content_encrypted <> ''
+      AND due.is_active
+      AND due.sent_counter < 3
+      AND (cardinality($2::uuid[]) = 0
+        OR due.id = ANY ($2::uuid[]))
+      AND (due.created_at, due.id) > ($3::timestamptz, $4::uuid)
+      AND EXISTS (
+        SELECT
+          1
+        FROM
+          messages_email_receivers AS due_receivers
+        WHERE
+          due_receivers.message_id = due.id
+          AND due_receivers.is_unsubscribed = FALSE
+          AND NOT EXISTS (
+            SELECT
+              1
+            FROM
+              testament_deliveries AS deliveries
+            WHERE
+              deliveries.message_id = due_receivers.message_id
+              AND deliveries.email_receiver = due_receivers.email_receiver
+              AND deliveries.status IN ('queued', 'sent')))
+    ORDER BY
+      due.created_at ASC,
+      due.id ASC
+    LIMIT $5)
+  AND receivers.is_unsubscribed = FALSE
+  AND NOT EXISTS (
+    SELECT
+      1
+    FROM
+      testament_deliveries AS deliveries
+    WHERE
+      deliveries.message_id = receivers.message_id
+      AND deliveries.email_receiver = receivers.email_receiver
+      AND deliveries.status IN ('queued', 'sent'))
+ORDER BY
+  messages.created_at ASC,
+  messages.id ASC
+`
+
+type SelectInactiveMessagesReadOnlyParams struct {
+	Today          time.Time
+	MessageIds     []uuid.UUID
+	AfterCreatedAt time.Time
+	AfterID        uuid.UUID
+	BatchSize      int32
+}
+
+type SelectInactiveMessagesReadOnlyRow struct {
+	UsrEmail                string
+	UsrCreatedAt            time.Time
+	UsrIsActive             bool
+	MsgID                   uuid.UUID
+	MsgEmailCreator         string
+	MsgCreatedAt            time.Time
+	MsgContentEncrypted     string
+	MsgInactivePeriodDays   int32
+	MsgReminderIntervalDays int32
+	MsgIsActive             bool
+	MsgInactiveAt           time.Time
+	MsgNextReminderAt       time.Time
+	MsgSentCounter          int32
+	RcvMessageID            uuid.UUID
+	RcvEmailReceiver        string
+	RcvIsUnsubscribed       bool
+	RcvUnsubscribeSecret    string
+	DkWrappedKey            sql.NullString
+}
+
+func (q *Queries) SelectInactiveMessagesReadOnly(ctx context.Context, arg SelectInactiveMessagesReadOnlyParams) ([]SelectInactiveMessagesReadOnlyRow, error) {
+	rows, err := q.db.Query(ctx, selectInactiveMessagesReadOnly,
+		arg.Today,
+		arg.MessageIds,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+		arg.BatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SelectInactiveMessagesReadOnlyRow
+	for rows.Next() {
+		var i SelectInactiveMessagesReadOnlyRow
+		if err := rows.Scan(
+			&i.UsrEmail,
+			&i.UsrCreatedAt,
+			&i.UsrIsActive,
+			&i.MsgID,
+			&i.MsgEmailCreator,
+			&i.MsgCreatedAt,
+			&i.MsgContentEncrypted,
+			&i.MsgInactivePeriodDays,
+			&i.MsgReminderIntervalDays,
+			&i.MsgIsActive,
+			&i.MsgInactiveAt,
+			&i.MsgNextReminderAt,
+			&i.MsgSentCounter,
+			&i.RcvMessageID,
+			&i.RcvEmailReceiver,
+			&i.RcvIsUnsubscribed,
+			&i.RcvUnsubscribeSecret,
+			&i.DkWrappedKey,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectMailVendorQuotaForUpdate = `-- name: SelectMailVendorQuotaForUpdate :one
+SELECT
+  sent_count
+FROM
+  mail_vendor_quotas
+WHERE
+  vendor_id = $1
+  AND day = $2
+FOR UPDATE
+`
+
+type SelectMailVendorQuotaForUpdateParams struct {
+	VendorID string
+	Day      time.Time
+}
+
+func (q *Queries) SelectMailVendorQuotaForUpdate(ctx context.Context, arg SelectMailVendorQuotaForUpdateParams) (int32, error) {
+	row := q.db.QueryRow(ctx, selectMailVendorQuotaForUpdate, arg.VendorID, arg.Day)
+	var sent_count int32
+	err := row.Scan(&sent_count)
+	return sent_count, err
+}
+
+const selectMessage = `-- name: SelectMessage :many
+SELECT
+  emails.email AS usr_email,
+  emails.created_at AS usr_created_at,
+  emails.is_active AS usr_is_active,
+  messages.id AS msg_id,
+  messages.email_creator AS msg_email_creator,
+  messages.created_at AS msg_created_at,
+  messages.content_encrypted AS msg_content_encrypted,
+  messages.inactive_period_days AS msg_inactive_period_days,
+  messages.reminder_interval_days AS msg_reminder_interval_days,
+  messages.is_active AS msg_is_active,
+  messages.inactive_at AS msg_inactive_at,
+  messages.next_reminder_at AS msg_next_reminder_at,
+  messages.sent_counter AS msg_sent_counter,
+  receivers.message_id AS rcv_message_id,
+  receivers.email_receiver AS rcv_email_receiver,
+  receivers.is_unsubscribed AS rcv_is_unsubscribed,
+  data_keys.wrapped_key AS dk_wrapped_key
+FROM
+  emails
+  INNER JOIN messages ON messages.email_creator = emails.email
+  LEFT JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  LEFT JOIN message_data_keys AS data_keys ON messages.id = data_keys.message_id
+WHERE
+  messages.id = $1
+  AND emails.is_active
+ORDER BY
+  messages.created_at ASC
+LIMIT 10
+`
+
+type SelectMessageRow struct {
+	UsrEmail                string
+	UsrCreatedAt            time.Time
+	UsrIsActive             bool
+	MsgID                   uuid.UUID
+	MsgEmailCreator         string
+	MsgCreatedAt            time.Time
+	MsgContentEncrypted     string
+	MsgInactivePeriodDays   int32
+	MsgReminderIntervalDays int32
+	MsgIsActive             bool
+	MsgInactiveAt           time.Time
+	MsgNextReminderAt       time.Time
+	MsgSentCounter          int32
+	RcvMessageID            uuid.NullUUID
+	RcvEmailReceiver        sql.NullString
+	RcvIsUnsubscribed       sql.NullBool
+	DkWrappedKey            sql.NullString
+}
+
+func (q *Queries) SelectMessage(ctx context.Context, id uuid.UUID) ([]SelectMessageRow, error) {
+	rows, err := q.db.Query(ctx, selectMessage, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SelectMessageRow
+	for rows.Next() {
+		var i SelectMessageRow
+		if err := rows.Scan(
+			&i.UsrEmail,
+			&i.UsrCreatedAt,
+			&i.UsrIsActive,
+			&i.MsgID,
+			&i.MsgEmailCreator,
+			&i.MsgCreatedAt,
+			&i.MsgContentEncrypted,
+			&i.MsgInactivePeriodDays,
+			&i.MsgReminderIntervalDays,
+			&i.MsgIsActive,
+			&i.MsgInactiveAt,
+			&i.MsgNextReminderAt,
+			&i.MsgSentCounter,
+			&i.RcvMessageID,
+			&i.RcvEmailReceiver,
+			&i.RcvIsUnsubscribed,
+			&i.DkWrappedKey,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectMessageDataKeysToRewrap = `-- name: SelectMessageDataKeysToRewrap :many
+SELECT
+  message_id, kek_id, wrapped_key, created_at, updated_at
+FROM
+  message_data_keys
+WHERE
+  message_id > $1
+  AND kek_id <> $2
+ORDER BY
+  message_id ASC
+LIMIT $3
+`
+
+type SelectMessageDataKeysToRewrapParams struct {
+	AfterMessageID uuid.UUID
+	ActiveKekID    string
+	BatchSize      int32
+}
+
+func (q *Queries) SelectMessageDataKeysToRewrap(ctx context.Context, arg SelectMessageDataKeysToRewrapParams) ([]MessageDataKey, error) {
+	rows, err := q.db.Query(ctx, selectMessageDataKeysToRewrap, arg.AfterMessageID, arg.ActiveKekID, arg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []MessageDataKey
+	for rows.Next() {
+		var i MessageDataKey
+		if err := rows.Scan(
+			&i.MessageID,
+			&i.KekID,
+			&i.WrappedKey,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectMessagesByEmailCreator = `-- name: SelectMessagesByEmailCreator :many
+SELECT
+  emails.email AS usr_email,
+  emails.created_at AS usr_created_at,
+  emails.is_active AS usr_is_active,
+  messages.id AS msg_id,
+  messages.email_creator AS msg_email_creator,
+  messages.created_at AS msg_created_at,
+  messages.content_encrypted AS msg_content_encrypted,
+  messages.inactive_period_days AS msg_inactive_period_days,
+  messages.reminder_interval_days AS msg_reminder_interval_days,
+  messages.is_active AS msg_is_active,
+  messages.inactive_at AS msg_inactive_at,
+  messages.next_reminder_at AS msg_next_reminder_at,
+  messages.sent_counter AS msg_sent_counter,
+  receivers.message_id AS rcv_message_id,
+  receivers.email_receiver AS rcv_email_receiver,
+  receivers.is_unsubscribed AS rcv_is_unsubscribed,
+  data_keys.wrapped_key AS dk_wrapped_key
+FROM
+  emails
+  INNER JOIN messages ON messages.email_creator = emails.email
+  LEFT JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  LEFT JOIN message_data_keys AS data_keys ON messages.id = data_keys.message_id
+WHERE
+  messages.email_creator = $1
+  AND emails.is_active
+ORDER BY
+  messages.created_at ASC
+LIMIT 30
+`
+
+type SelectMessagesByEmailCreatorRow struct {
+	UsrEmail                string
+	UsrCreatedAt            time.Time
+	UsrIsActive             bool
+	MsgID                   uuid.UUID
+	MsgEmailCreator         string
+	MsgCreatedAt            time.Time
+	MsgContentEncrypted     string
+	MsgInactivePeriodDays   int32
+	MsgReminderIntervalDays int32
+	MsgIsActive             bool
+	MsgInactiveAt           time.Time
+	MsgNextReminderAt       time.Time
+	MsgSentCounter          int32
+	RcvMessageID            uuid.NullUUID
+	RcvEmailReceiver        sql.NullString
+	RcvIsUnsubscribed       sql.NullBool
+	DkWrappedKey            sql.NullString
+}
+
+func (q *Queries) SelectMessagesByEmailCreator(ctx context.Context, emailCreator string) ([]SelectMessagesByEmailCreatorRow, error) {
+	rows, err := q.db.Query(ctx, selectMessagesByEmailCreator, emailCreator)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SelectMessagesByEmailCreatorRow
+	for rows.Next() {
+		var i SelectMessagesByEmailCreatorRow
+		if err := rows.Scan(
+			&i.UsrEmail,
+			&i.UsrCreatedAt,
+			&i.UsrIsActive,
+			&i.MsgID,
+			&i.MsgEmailCreator,
+			&i.MsgCreatedAt,
+			&i.MsgContentEncrypted,
+			&i.MsgInactivePeriodDays,
+			&i.MsgReminderIntervalDays,
+			&i.MsgIsActive,
+			&i.MsgInactiveAt,
+			&i.MsgNextReminderAt,
+			&i.MsgSentCounter,
+			&i.RcvMessageID,
+			&i.RcvEmailReceiver,
+			&i.RcvIsUnsubscribed,
+			&i.DkWrappedKey,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectMessagesByIDs = `-- name: SelectMessagesByIDs :many
+SELECT
+  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter, extension_secret_hash, previous_extension_secret_hashes
+FROM
+  messages
+WHERE
+  id = ANY ($1::uuid[])
+ORDER BY
+  created_at ASC,
+  id ASC
+`
+
+func (q *Queries) SelectMessagesByIDs(ctx context.Context, ids []uuid.UUID) ([]Message, error) {
+	rows, err := q.db.Query(ctx, selectMessagesByIDs, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Message
+	for rows.Next() {
+		var i Message
+		if err := rows.Scan(
+			&i.ID,
+			&i.EmailCreator,
+			&i.CreatedAt,
+			&i.ContentEncrypted,
+			&i.InactivePeriodDays,
+			&i.ReminderIntervalDays,
+			&i.IsActive,
+			&i.ExtensionSecret,
+			&i.InactiveAt,
+			&i.NextReminderAt,
+			&i.SentCounter,
+			&i.ExtensionSecretHash,
+			&i.PreviousExtensionSecretHashes,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectMessagesNeedReminding = `-- name: SelectMessagesNeedReminding :many
 SELECT
   emails.email AS usr_email,
   emails.created_at AS usr_created_at,
@@ -121,27 +1453,55 @@ SELECT
   messages.inactive_at AS msg_inactive_at,
   messages.next_reminder_at AS msg_next_reminder_at,
   messages.sent_counter AS msg_sent_counter,
-  receivers.message_id AS rcv_message_id,
+  message_id AS rcv_message_id,
   receivers.email_receiver AS rcv_email_receiver,
-  receivers.is_unsubscribed AS rcv_is_unsubscribed,
-  receivers.unsubscribe_secret AS rcv_unsubscribe_secret
+  receivers.is_unsubscribed AS rcv_is_unsubscribed
 FROM
   emails
   INNER JOIN messages ON emails.email = messages.email_creator
   INNER JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
 WHERE
-  messages.inactive_at < CURRENT_DATE
-  AND messages.content_encrypted <> ''
-  AND messages.is_active
-  AND messages.sent_counter < 3
+  messages.id IN (
+    SELECT
+      due.id
+    FROM
+      messages AS due
+    WHERE
+      due.is_active
+      AND due.content_encrypted <> ''
+      AND due.next_reminder_at <= $1::date
+      AND (cardinality($2::uuid[]) = 0
+        OR due.id = ANY ($2::uuid[]))
+      AND (due.created_at, due.id) > ($3::timestamptz, $4::uuid)
+      AND EXISTS (
+        SELECT
+          1
+        FROM
+          messages_email_receivers AS due_receivers
+        WHERE
+          due_receivers.message_id = due.id
+          AND due_receivers.is_unsubscribed = FALSE)
+    ORDER BY
+      due.created_at ASC,
+      due.id ASC
+    LIMIT $5
+    FOR UPDATE
+      SKIP LOCKED)
   AND receivers.is_unsubscribed = FALSE
 ORDER BY
   messages.created_at ASC,
   messages.id ASC
-LIMIT 100
 `
 
-type SelectInactiveMessagesRow struct {
+type SelectMessagesNeedRemindingParams struct {
+	Today          time.Time
+	MessageIds     []uuid.UUID
+	AfterCreatedAt time.Time
+	AfterID        uuid.UUID
+	BatchSize      int32
+}
+
+type SelectMessagesNeedRemindingRow struct {
 	UsrEmail                string
 	UsrCreatedAt            time.Time
 	UsrIsActive             bool
@@ -159,18 +1519,23 @@ type SelectInactiveMessagesRow struct {
 	RcvMessageID            uuid.UUID
 	RcvEmailReceiver        string
 	RcvIsUnsubscribed       bool
-	RcvUnsubscribeSecret    string
 }
 
-func (q *Queries) SelectInactiveMessages(ctx context.Context) ([]SelectInactiveMessagesRow, error) {
-	rows, err := q.db.Query(ctx, selectInactiveMessages)
+func (q *Queries) SelectMessagesNeedReminding(ctx context.Context, arg SelectMessagesNeedRemindingParams) ([]SelectMessagesNeedRemindingRow, error) {
+	rows, err := q.db.Query(ctx, selectMessagesNeedReminding,
+		arg.Today,
+		arg.MessageIds,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+		arg.BatchSize,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []SelectInactiveMessagesRow
+	var items []SelectMessagesNeedRemindingRow
 	for rows.Next() {
-		var i SelectInactiveMessagesRow
+		var i SelectMessagesNeedRemindingRow
 		if err := rows.Scan(
 			&i.UsrEmail,
 			&i.UsrCreatedAt,
@@ -189,7 +1554,6 @@ func (q *Queries) SelectInactiveMessages(ctx context.Context) ([]SelectInactiveM
 			&i.RcvMessageID,
 			&i.RcvEmailReceiver,
 			&i.RcvIsUnsubscribed,
-			&i.RcvUnsubscribeSecret,
 		); err != nil {
 			return nil, err
 		}
@@ -201,7 +1565,7 @@ func (q *Queries) SelectInactiveMessages(ctx context.Context) ([]SelectInactiveM
 	return items, nil
 }
 
-const selectMessage = `-- name: SelectMessage :many
+const selectMessagesNeedRemindingReadOnly = `-- name: SelectMessagesNeedRemindingReadOnly :many
 SELECT
   emails.email AS usr_email,
   emails.created_at AS usr_created_at,
@@ -217,23 +1581,53 @@ SELECT
   messages.inactive_at AS msg_inactive_at,
   messages.next_reminder_at AS msg_next_reminder_at,
   messages.sent_counter AS msg_sent_counter,
-  receivers.message_id AS rcv_message_id,
+  message_id AS rcv_message_id,
   receivers.email_receiver AS rcv_email_receiver,
-  receivers.is_unsubscribed AS rcv_is_unsubscribed,
-  receivers.unsubscribe_secret AS rcv_unsubscribe_secret
+  receivers.is_unsubscribed AS rcv_is_unsubscribed
 FROM
   emails
-  INNER JOIN messages ON messages.email_creator = emails.email
-  LEFT JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  INNER JOIN messages ON emails.email = messages.email_creator
+  INNER JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
 WHERE
-  messages.id = $1
-  AND emails.is_active
+  messages.id IN (
+    SELECT
+      due.id
+    FROM
+      messages AS due
+    WHERE
+      due.is_active
+      AND due.content_encrypted <> ''
+      AND due.next_reminder_at <= $1::date
+      AND (cardinality($2::uuid[]) = 0
+        OR due.id = ANY ($2::uuid[]))
+      AND (due.created_at, due.id) > ($3::timestamptz, $4::uuid)
+      AND EXISTS (
+        SELECT
+          1
+        FROM
+          messages_email_receivers AS due_receivers
+        WHERE
+          due_receivers.message_id = due.id
+          AND due_receivers.is_unsubscribed = FALSE)
+    ORDER BY
+      due.created_at ASC,
+      due.id ASC
+    LIMIT $5)
+  AND receivers.is_unsubscribed = FALSE
 ORDER BY
-  messages.created_at ASC
-LIMIT 10
+  messages.created_at ASC,
+  messages.id ASC
 `
 
-type SelectMessageRow struct {
+type SelectMessagesNeedRemindingReadOnlyParams struct {
+	Today          time.Time
+	MessageIds     []uuid.UUID
+	AfterCreatedAt time.Time
+	AfterID        uuid.UUID
+	BatchSize      int32
+}
+
+type SelectMessagesNeedRemindingReadOnlyRow struct {
 	UsrEmail                string
 	UsrCreatedAt            time.Time
 	UsrIsActive             bool
@@ -248,21 +1642,26 @@ type SelectMessageRow struct {
 	MsgInactiveAt           time.Time
 	MsgNextReminderAt       time.Time
 	MsgSentCounter          int32
-	RcvMessageID            uuid.NullUUID
-	RcvEmailReceiver        sql.NullString
-	RcvIsUnsubscribed       sql.NullBool
-	RcvUnsubscribeSecret    sql.NullString
+	RcvMessageID            uuid.UUID
+	RcvEmailReceiver        string
+	RcvIsUnsubscribed       bool
 }
 
-func (q *Queries) SelectMessage(ctx context.Context, id uuid.UUID) ([]SelectMessageRow, error) {
-	rows, err := q.db.Query(ctx, selectMessage, id)
+func (q *Queries) SelectMessagesNeedRemindingReadOnly(ctx context.Context, arg SelectMessagesNeedRemindingReadOnlyParams) ([]SelectMessagesNeedRemindingReadOnlyRow, error) {
+	rows, err := q.db.Query(ctx, selectMessagesNeedRemindingReadOnly,
+		arg.Today,
+		arg.MessageIds,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+		arg.BatchSize,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []SelectMessageRow
+	var items []SelectMessagesNeedRemindingReadOnlyRow
 	for rows.Next() {
-		var i SelectMessageRow
+		var i SelectMessagesNeedRemindingReadOnlyRow
 		if err := rows.Scan(
 			&i.UsrEmail,
 			&i.UsrCreatedAt,
@@ -281,7 +1680,6 @@ func (q *Queries) SelectMessage(ctx context.Context, id uuid.UUID) ([]SelectMess
 			&i.RcvMessageID,
 			&i.RcvEmailReceiver,
 			&i.RcvIsUnsubscribed,
-			&i.RcvUnsubscribeSecret,
 		); err != nil {
 			return nil, err
 		}
@@ -293,87 +1691,312 @@ func (q *Queries) SelectMessage(ctx context.Context, id uuid.UUID) ([]SelectMess
 	return items, nil
 }
 
-const selectMessagesByEmailCreator = `-- name: SelectMessagesByEmailCreator :many
+const selectMessagesToReencrypt = `-- name: SelectMessagesToReencrypt :many
 SELECT
-  emails.email AS usr_email,
-  emails.created_at AS usr_created_at,
-  emails.is_active AS usr_is_active,
-  messages.id AS msg_id,
-  messages.email_creator AS msg_email_creator,
-  messages.created_at AS msg_created_at,
-  messages.content_encrypted AS msg_content_encrypted,
-  messages.inactive_period_days AS msg_inactive_period_days,
-  messages.reminder_interval_days AS msg_reminder_interval_days,
-  messages.is_active AS msg_is_active,
-  messages.extension_secret AS msg_extension_secret,
-  messages.inactive_at AS msg_inactive_at,
-  messages.next_reminder_at AS msg_next_reminder_at,
-  messages.sent_counter AS msg_sent_counter,
-  receivers.message_id AS rcv_message_id,
-  receivers.email_receiver AS rcv_email_receiver,
-  receivers.is_unsubscribed AS rcv_is_unsubscribed,
-  receivers.unsubscribe_secret AS rcv_unsubscribe_secret
+  id,
+  content_encrypted
 FROM
-  emails
-  INNER JOIN messages ON messages.email_creator = emails.email
-  LEFT JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  messages
 WHERE
-  messages.email_creator = $1
-  AND emails.is_active
+  id > $1
+  AND NOT starts_with(content_encrypted, $2::text)
+  AND NOT starts_with(content_encrypted, 'aes.utf8:')
 ORDER BY
-  messages.created_at ASC
-LIMIT 30
+  id ASC
+LIMIT $3
 `
 
-type SelectMessagesByEmailCreatorRow struct {
-	UsrEmail                string
-	UsrCreatedAt            time.Time
-	UsrIsActive             bool
-	MsgID                   uuid.UUID
-	MsgEmailCreator         string
-	MsgCreatedAt            time.Time
-	MsgContentEncrypted     string
-	MsgInactivePeriodDays   int32
-	MsgReminderIntervalDays int32
-	MsgIsActive             bool
-	MsgExtensionSecret      string
-	MsgInactiveAt           time.Time
-	MsgNextReminderAt       time.Time
-	MsgSentCounter          int32
-	RcvMessageID            uuid.NullUUID
-	RcvEmailReceiver        sql.NullString
-	RcvIsUnsubscribed       sql.NullBool
-	RcvUnsubscribeSecret    sql.NullString
+type SelectMessagesToReencryptParams struct {
+	AfterID        uuid.UUID
+	EnvelopePrefix string
+	BatchSize      int32
+}
+
+type SelectMessagesToReencryptRow struct {
+	ID               uuid.UUID
+	ContentEncrypted string
+}
+
+func (q *Queries) SelectMessagesToReencrypt(ctx context.Context, arg SelectMessagesToReencryptParams) ([]SelectMessagesToReencryptRow, error) {
+	rows, err := q.db.Query(ctx, selectMessagesToReencrypt, arg.AfterID, arg.EnvelopePrefix, arg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SelectMessagesToReencryptRow
+	for rows.Next() {
+		var i SelectMessagesToReencryptRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.ContentEncrypted,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectMessagesWithPlaintextSecret = `-- name: SelectMessagesWithPlaintextSecret :many
+SELECT
+  id,
+  extension_secret
+FROM
+  messages
+WHERE
+  extension_secret_hash = ''
+  AND extension_secret <> ''
+LIMIT $1
+`
+
+type SelectMessagesWithPlaintextSecretRow struct {
+	ID              uuid.UUID
+	ExtensionSecret string
+}
+
+func (q *Queries) SelectMessagesWithPlaintextSecret(ctx context.Context, batchSize int32) ([]SelectMessagesWithPlaintextSecretRow, error) {
+	rows, err := q.db.Query(ctx, selectMessagesWithPlaintextSecret, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SelectMessagesWithPlaintextSecretRow
+	for rows.Next() {
+		var i SelectMessagesWithPlaintextSecretRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.ExtensionSecret,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectReceiversWithPlaintextSecret = `-- name: SelectReceiversWithPlaintextSecret :many
+SELECT
+  message_id,
+  email_receiver,
+  unsubscribe_secret
+FROM
+  messages_email_receivers
+WHERE
+  unsubscribe_secret_hash = ''
+  AND unsubscribe_secret <> ''
+LIMIT $1
+`
+
+type SelectReceiversWithPlaintextSecretRow struct {
+	MessageID         uuid.UUID
+	EmailReceiver     string
+	UnsubscribeSecret string
+}
+
+func (q *Queries) SelectReceiversWithPlaintextSecret(ctx context.Context, batchSize int32) ([]SelectReceiversWithPlaintextSecretRow, error) {
+	rows, err := q.db.Query(ctx, selectReceiversWithPlaintextSecret, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SelectReceiversWithPlaintextSecretRow
+	for rows.Next() {
+		var i SelectReceiversWithPlaintextSecretRow
+		if err := rows.Scan(
+			&i.MessageID,
+			&i.EmailReceiver,
+			&i.UnsubscribeSecret,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectSchedulerRun = `-- name: SelectSchedulerRun :one
+SELECT
+  id, action, params, trigger_id, status, selected, queued, sent, failed, skipped, error_message, started_at, finished_at, deferred
+FROM
+  scheduler_runs
+WHERE
+  id = $1
+`
+
+func (q *Queries) SelectSchedulerRun(ctx context.Context, id uuid.UUID) (SchedulerRun, error) {
+	row := q.db.QueryRow(ctx, selectSchedulerRun, id)
+	var i SchedulerRun
+	err := row.Scan(
+		&i.ID,
+		&i.Action,
+		&i.Params,
+		&i.TriggerID,
+		&i.Status,
+		&i.Selected,
+		&i.Queued,
+		&i.Sent,
+		&i.Failed,
+		&i.Skipped,
+		&i.ErrorMessage,
+		&i.StartedAt,
+		&i.FinishedAt,
+		&i.Deferred,
+	)
+	return i, err
+}
+
+const selectSchedulerRunEmails = `-- name: SelectSchedulerRunEmails :many
+SELECT
+  id, run_id, outbox_id, kind, message_id, email_receiver, status, vendor_id, error_message, created_at
+FROM
+  scheduler_run_emails
+WHERE
+  run_id = $1
+ORDER BY
+  created_at ASC,
+  email_receiver ASC
+`
+
+func (q *Queries) SelectSchedulerRunEmails(ctx context.Context, runID uuid.UUID) ([]SchedulerRunEmail, error) {
+	rows, err := q.db.Query(ctx, selectSchedulerRunEmails, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SchedulerRunEmail
+	for rows.Next() {
+		var i SchedulerRunEmail
+		if err := rows.Scan(
+			&i.ID,
+			&i.RunID,
+			&i.OutboxID,
+			&i.Kind,
+			&i.MessageID,
+			&i.EmailReceiver,
+			&i.Status,
+			&i.VendorID,
+			&i.ErrorMessage,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectSchedulerRuns = `-- name: SelectSchedulerRuns :many
+SELECT
+  id, action, params, trigger_id, status, selected, queued, sent, failed, skipped, error_message, started_at, finished_at, deferred
+FROM
+  scheduler_runs
+WHERE ($1::text = ''
+  OR action = $1::text)
+  AND ($2::text = ''
+    OR status = $2::text)
+ORDER BY
+  started_at DESC
+LIMIT $3
+`
+
+type SelectSchedulerRunsParams struct {
+	Action   string
+	Status   string
+	RowLimit int32
+}
+
+func (q *Queries) SelectSchedulerRuns(ctx context.Context, arg SelectSchedulerRunsParams) ([]SchedulerRun, error) {
+	rows, err := q.db.Query(ctx, selectSchedulerRuns, arg.Action, arg.Status, arg.RowLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SchedulerRun
+	for rows.Next() {
+		var i SchedulerRun
+		if err := rows.Scan(
+			&i.ID,
+			&i.Action,
+			&i.Params,
+			&i.TriggerID,
+			&i.Status,
+			&i.Selected,
+			&i.Queued,
+			&i.Sent,
+			&i.Failed,
+			&i.Skipped,
+			&i.ErrorMessage,
+			&i.StartedAt,
+			&i.FinishedAt,
+			&i.Deferred,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const selectSecretAttemptFailureCounts = `-- name: SelectSecretAttemptFailureCounts :many
+SELECT
+  message_id,
+  count(*) AS failures,
+  count(DISTINCT ip) AS ips,
+  max(created_at)::timestamptz AS last_failed_at
+FROM
+  secret_attempt_failures
+WHERE
+  created_at >= $1
+  AND message_id IS NOT NULL
+GROUP BY
+  message_id
+HAVING
+  count(*) >= $2::bigint
+ORDER BY
+  failures DESC
+`
+
+type SelectSecretAttemptFailureCountsParams struct {
+	Since       time.Time
+	MinFailures int64
 }
 
-func (q *Queries) SelectMessagesByEmailCreator(ctx context.Context, emailCreator string) ([]SelectMessagesByEmailCreatorRow, error) {
-	rows, err := q.db.Query(ctx, selectMessagesByEmailCreator, emailCreator)
+type SelectSecretAttemptFailureCountsRow struct {
+	MessageID    uuid.NullUUID
+	Failures     int64
+	Ips          int64
+	LastFailedAt time.Time
+}
+
+func (q *Queries) SelectSecretAttemptFailureCounts(ctx context.Context, arg SelectSecretAttemptFailureCountsParams) ([]SelectSecretAttemptFailureCountsRow, error) {
+	rows, err := q.db.Query(ctx, selectSecretAttemptFailureCounts, arg.Since, arg.MinFailures)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []SelectMessagesByEmailCreatorRow
+	var items []SelectSecretAttemptFailureCountsRow
 	for rows.Next() {
-		var i SelectMessagesByEmailCreatorRow
+		var i SelectSecretAttemptFailureCountsRow
 		if err := rows.Scan(
-			&i.UsrEmail,
-			&i.UsrCreatedAt,
-			&i.UsrIsActive,
-			&i.MsgID,
-			&i.MsgEmailCreator,
-			&i.MsgCreatedAt,
-			&i.MsgContentEncrypted,
-			&i.MsgInactivePeriodDays,
-			&i.MsgReminderIntervalDays,
-			&i.MsgIsActive,
-			&i.MsgExtensionSecret,
-			&i.MsgInactiveAt,
-			&i.MsgNextReminderAt,
-			&i.MsgSentCounter,
-			&i.RcvMessageID,
-			&i.RcvEmailReceiver,
-			&i.RcvIsUnsubscribed,
-			&i.RcvUnsubscribeSecret,
+			&i.MessageID,
+			&i.Failures,
+			&i.Ips,
+			&i.LastFailedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -385,90 +2008,37 @@ func (q *Queries) SelectMessagesByEmailCreator(ctx context.Context, emailCreator
 	return items, nil
 }
 
-const selectMessagesNeedReminding = `-- name: SelectMessagesNeedReminding :many
+const selectTestamentDeliveries = `-- name: SelectTestamentDeliveries :many
 SELECT
-  emails.email AS usr_email,
-  emails.created_at AS usr_created_at,
-  emails.is_active AS usr_is_active,
-  messages.id AS msg_id,
-  messages.email_creator AS msg_email_creator,
-  messages.created_at AS msg_created_at,
-  messages.content_encrypted AS msg_content_encrypted,
-  messages.inactive_period_days AS msg_inactive_period_days,
-  messages.reminder_interval_days AS msg_reminder_interval_days,
-  messages.is_active AS msg_is_active,
-  messages.extension_secret AS msg_extension_secret,
-  messages.inactive_at AS msg_inactive_at,
-  messages.next_reminder_at AS msg_next_reminder_at,
-  messages.sent_counter AS msg_sent_counter,
-  message_id AS rcv_message_id,
-  receivers.email_receiver AS rcv_email_receiver,
-  receivers.is_unsubscribed AS rcv_is_unsubscribed,
-  receivers.unsubscribe_secret AS rcv_unsubscribe_secret
+  id, message_id, email_receiver, attempt, status, vendor_id, error_message, created_at, sent_at
 FROM
-  emails
-  INNER JOIN messages ON emails.email = messages.email_creator
-  INNER JOIN messages_email_receivers AS receivers ON messages.id = receivers.message_id
+  testament_deliveries
 WHERE
-  messages.is_active
-  AND messages.content_encrypted <> ''
-  AND messages.next_reminder_at <= CURRENT_DATE
-  AND receivers.is_unsubscribed = FALSE
+  message_id = $1
 ORDER BY
-  messages.created_at ASC,
-  messages.id ASC
-LIMIT 100
+  email_receiver ASC,
+  attempt ASC
 `
 
-type SelectMessagesNeedRemindingRow struct {
-	UsrEmail                string
-	UsrCreatedAt            time.Time
-	UsrIsActive             bool
-	MsgID                   uuid.UUID
-	MsgEmailCreator         string
-	MsgCreatedAt            time.Time
-	MsgContentEncrypted     string
-	MsgInactivePeriodDays   int32
-	MsgReminderIntervalDays int32
-	MsgIsActive             bool
-	MsgExtensionSecret      string
-	MsgInactiveAt           time.Time
-	MsgNextReminderAt       time.Time
-	MsgSentCounter          int32
-	RcvMessageID            uuid.UUID
-	RcvEmailReceiver        string
-	RcvIsUnsubscribed       bool
-	RcvUnsubscribeSecret    string
-}
-
-func (q *Queries) SelectMessagesNeedReminding(ctx context.Context) ([]SelectMessagesNeedRemindingRow, error) {
-	rows, err := q.db.Query(ctx, selectMessagesNeedReminding)
+func (q *Queries) SelectTestamentDeliveries(ctx context.Context, messageID uuid.UUID) ([]TestamentDelivery, error) {
+	rows, err := q.db.Query(ctx, selectTestamentDeliveries, messageID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []SelectMessagesNeedRemindingRow
+	var items []TestamentDelivery
 	for rows.Next() {
-		var i SelectMessagesNeedRemindingRow
+		var i TestamentDelivery
 		if err := rows.Scan(
-			&i.UsrEmail,
-			&i.UsrCreatedAt,
-			&i.UsrIsActive,
-			&i.MsgID,
-			&i.MsgEmailCreator,
-			&i.MsgCreatedAt,
-			&i.MsgContentEncrypted,
-			&i.MsgInactivePeriodDays,
-			&i.MsgReminderIntervalDays,
-			&i.MsgIsActive,
-			&i.MsgExtensionSecret,
-			&i.MsgInactiveAt,
-			&i.MsgNextReminderAt,
-			&i.MsgSentCounter,
-			&i.RcvMessageID,
-			&i.RcvEmailReceiver,
-			&i.RcvIsUnsubscribed,
-			&i.RcvUnsubscribeSecret,
+			&i.ID,
+			&i.MessageID,
+			&i.EmailReceiver,
+			&i.Attempt,
+			&i.Status,
+			&i.VendorID,
+			&i.ErrorMessage,
+			&i.CreatedAt,
+			&i.SentAt,
 		); err != nil {
 			return nil, err
 		}
@@ -480,6 +2050,65 @@ func (q *Queries) SelectMessagesNeedReminding(ctx context.Context) ([]SelectMess
 	return items, nil
 }
 
+const tryAdvisoryLock = `-- name: TryAdvisoryLock :one
+SELECT
+  pg_try_advisory_lock(hashtext($1::text)) AS is_locked
+`
+
+func (q *Queries) TryAdvisoryLock(ctx context.Context, lockName string) (bool, error) {
+	row := q.db.QueryRow(ctx, tryAdvisoryLock, lockName)
+	var is_locked bool
+	err := row.Scan(&is_locked)
+	return is_locked, err
+}
+
+const tryAdvisoryXactLock = `-- name: TryAdvisoryXactLock :one
+SELECT
+  pg_try_advisory_xact_lock(hashtext($1::text)) AS is_locked
+`
+
+func (q *Queries) TryAdvisoryXactLock(ctx context.Context, lockName string) (bool, error) {
+	row := q.db.QueryRow(ctx, tryAdvisoryXactLock, lockName)
+	var is_locked bool
+	err := row.Scan(&is_locked)
+	return is_locked, err
+}
+
+const tryAdvisoryXactLockShared = `-- name: TryAdvisoryXactLockShared :one
+SELECT
+  pg_try_advisory_xact_lock_shared(hashtext($1::text)) AS is_locked
+`
+
+func (q *Queries) TryAdvisoryXactLockShared(ctx context.Context, lockName string) (bool, error) {
+	row := q.db.QueryRow(ctx, tryAdvisoryXactLockShared, lockName)
+	var is_locked bool
+	err := row.Scan(&is_locked)
+	return is_locked, err
+}
+
+const updateCronJobAfterRun = `-- name: UpdateCronJobAfterRun :exec
+UPDATE
+  cron_jobs
+SET
+  last_scheduled_at = $1,
+  last_finished_at = CURRENT_TIMESTAMP,
+  last_error = $2,
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  action = $3
+`
+
+type UpdateCronJobAfterRunParams struct {
+	LastScheduledAt time.Time
+	LastError       string
+	Action          string
+}
+
+func (q *Queries) UpdateCronJobAfterRun(ctx context.Context, arg UpdateCronJobAfterRunParams) error {
+	_, err := q.db.Exec(ctx, updateCronJobAfterRun, arg.LastScheduledAt, arg.LastError, arg.Action)
+	return err
+}
+
 const updateEmail = `-- name: UpdateEmail :exec
 UPDATE
   emails
@@ -499,6 +2128,96 @@ func (q *Queries) UpdateEmail(ctx context.Context, arg UpdateEmailParams) error
 	return err
 }
 
+const updateEmailOutboxAfterFailure = `-- name: UpdateEmailOutboxAfterFailure :exec
+UPDATE
+  email_outbox
+SET
+  status = $2,
+  last_error = $3,
+  next_attempt_at = $4,
+  mail_item = CASE WHEN $2 = 'failed' THEN
+    '{}'::jsonb
+  ELSE
+    mail_item
+  END,
+  mail_item_sealed = CASE WHEN $2 = 'failed' THEN
+    ''
+  ELSE
+    mail_item_sealed
+  END,
+  wrapped_key = CASE WHEN $2 = 'failed' THEN
+    ''
+  ELSE
+    wrapped_key
+  END
+WHERE
+  id = $1
+`
+
+type UpdateEmailOutboxAfterFailureParams struct {
+	ID            uuid.UUID
+	Status        string
+	LastError     string
+	NextAttemptAt time.Time
+}
+
+func (q *Queries) UpdateEmailOutboxAfterFailure(ctx context.Context, arg UpdateEmailOutboxAfterFailureParams) error {
+	_, err := q.db.Exec(ctx, updateEmailOutboxAfterFailure,
+		arg.ID,
+		arg.Status,
+		arg.LastError,
+		arg.NextAttemptAt,
+	)
+	return err
+}
+
+const updateEmailOutboxAfterSending = `-- name: UpdateEmailOutboxAfterSending :exec
+UPDATE
+  email_outbox
+SET
+  status = 'sent',
+  vendor_id = $2,
+  last_error = '',
+  mail_item = '{}'::jsonb,
+  mail_item_sealed = '',
+  wrapped_key = '',
+  sent_at = CURRENT_TIMESTAMP
+WHERE
+  id = $1
+`
+
+type UpdateEmailOutboxAfterSendingParams struct {
+	ID       uuid.UUID
+	VendorID string
+}
+
+func (q *Queries) UpdateEmailOutboxAfterSending(ctx context.Context, arg UpdateEmailOutboxAfterSendingParams) error {
+	_, err := q.db.Exec(ctx, updateEmailOutboxAfterSending, arg.ID, arg.VendorID)
+	return err
+}
+
+const updateMailVendorQuota = `-- name: UpdateMailVendorQuota :exec
+UPDATE
+  mail_vendor_quotas
+SET
+  sent_count = $1,
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  vendor_id = $2
+  AND day = $3
+`
+
+type UpdateMailVendorQuotaParams struct {
+	SentCount int32
+	VendorID  string
+	Day       time.Time
+}
+
+func (q *Queries) UpdateMailVendorQuota(ctx context.Context, arg UpdateMailVendorQuotaParams) error {
+	_, err := q.db.Exec(ctx, updateMailVendorQuota, arg.SentCount, arg.VendorID, arg.Day)
+	return err
+}
+
 const updateMessage = `-- name: UpdateMessage :one
 UPDATE
   messages
@@ -507,7 +2226,9 @@ SET
   inactive_period_days = $2,
   reminder_interval_days = $3,
   is_active = $4,
-  extension_secret = $5,
+  extension_secret = '',
+  extension_secret_hash = $5,
+  previous_extension_secret_hashes = '{}',
   inactive_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, $2),
   next_reminder_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, $3),
   sent_counter = 0
@@ -515,7 +2236,7 @@ WHERE
   id = $6
   AND email_creator = $7
 RETURNING
-  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter
+  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter, extension_secret_hash, previous_extension_secret_hashes
 `
 
 type UpdateMessageParams struct {
@@ -523,7 +2244,7 @@ type UpdateMessageParams struct {
 	InactivePeriodDays   int32
 	ReminderIntervalDays int32
 	IsActive             bool
-	ExtensionSecret      string
+	ExtensionSecretHash  string
 	ID                   uuid.UUID
 	EmailCreator         string
 }
@@ -534,7 +2255,7 @@ func (q *Queries) UpdateMessage(ctx context.Context, arg UpdateMessageParams) (M
 		arg.InactivePeriodDays,
 		arg.ReminderIntervalDays,
 		arg.IsActive,
-		arg.ExtensionSecret,
+		arg.ExtensionSecretHash,
 		arg.ID,
 		arg.EmailCreator,
 	)
@@ -551,6 +2272,8 @@ func (q *Queries) UpdateMessage(ctx context.Context, arg UpdateMessageParams) (M
 		&i.InactiveAt,
 		&i.NextReminderAt,
 		&i.SentCounter,
+		&i.ExtensionSecretHash,
+		&i.PreviousExtensionSecretHashes,
 	)
 	return i, err
 }
@@ -559,15 +2282,42 @@ const updateMessageAfterSendingReminder = `-- name: UpdateMessageAfterSendingRem
 UPDATE
   messages
 SET
-  next_reminder_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, reminder_interval_days)
+  next_reminder_at = $1::date + MAKE_INTERVAL(0, 0, 0, reminder_interval_days),
+  extension_secret = CASE WHEN $2::text = '' THEN
+    extension_secret
+  ELSE
+    ''
+  END,
+  extension_secret_hash = COALESCE(NULLIF($2::text, ''), extension_secret_hash),
+  previous_extension_secret_hashes = CASE WHEN $2::text = '' THEN
+    previous_extension_secret_hashes
+  WHEN extension_secret_hash <> '' THEN
+    (array_prepend(extension_secret_hash::text, previous_extension_secret_hashes))[1:9]
+  WHEN $3::text <> '' THEN
+    (array_prepend($3::text, previous_extension_secret_hashes))[1:9]
+  ELSE
+    previous_extension_secret_hashes
+  END
 WHERE
-  id = $1
+  id = $4
 RETURNING
-  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter
+  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter, extension_secret_hash, previous_extension_secret_hashes
 `
 
-func (q *Queries) UpdateMessageAfterSendingReminder(ctx context.Context, id uuid.UUID) (Message, error) {
-	row := q.db.QueryRow(ctx, updateMessageAfterSendingReminder, id)
+type UpdateMessageAfterSendingReminderParams struct {
+	Today                     time.Time
+	ExtensionSecretHash       string
+	LegacyExtensionSecretHash string
+	ID                        uuid.UUID
+}
+
+func (q *Queries) UpdateMessageAfterSendingReminder(ctx context.Context, arg UpdateMessageAfterSendingReminderParams) (Message, error) {
+	row := q.db.QueryRow(ctx, updateMessageAfterSendingReminder,
+		arg.Today,
+		arg.ExtensionSecretHash,
+		arg.LegacyExtensionSecretHash,
+		arg.ID,
+	)
 	var i Message
 	err := row.Scan(
 		&i.ID,
@@ -581,6 +2331,8 @@ func (q *Queries) UpdateMessageAfterSendingReminder(ctx context.Context, id uuid
 		&i.InactiveAt,
 		&i.NextReminderAt,
 		&i.SentCounter,
+		&i.ExtensionSecretHash,
+		&i.PreviousExtensionSecretHashes,
 	)
 	return i, err
 }
@@ -589,24 +2341,46 @@ const updateMessageAfterSendingTestament = `-- name: UpdateMessageAfterSendingTe
 UPDATE
   messages
 SET
-  is_active = CASE WHEN sent_counter < 2 THEN
+  is_active = CASE WHEN sent_counter < 2
+    AND EXISTS (
+      SELECT
+        1
+      FROM
+        messages_email_receivers AS receivers
+      WHERE
+        receivers.message_id = messages.id
+        AND receivers.is_unsubscribed = FALSE
+        AND NOT EXISTS (
+          SELECT
+            1
+          FROM
+            testament_deliveries AS deliveries
+          WHERE
+            deliveries.message_id = receivers.message_id
+            AND deliveries.email_receiver = receivers.email_receiver
+            AND deliveries.status = 'sent')) THEN
     is_active
   ELSE
     FALSE
   END,
   sent_counter = sent_counter + 1,
-  inactive_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, 15),
-  next_reminder_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, 30)
+  inactive_at = $1::date + MAKE_INTERVAL(0, 0, 0, 15),
+  next_reminder_at = $1::date + MAKE_INTERVAL(0, 0, 0, 30)
 WHERE
-  id = $1
+  id = $2
   AND sent_counter < 3
   AND is_active
 RETURNING
-  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter
+  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter, extension_secret_hash, previous_extension_secret_hashes
 `
 
-func (q *Queries) UpdateMessageAfterSendingTestament(ctx context.Context, id uuid.UUID) (Message, error) {
-	row := q.db.QueryRow(ctx, updateMessageAfterSendingTestament, id)
+type UpdateMessageAfterSendingTestamentParams struct {
+	Today time.Time
+	ID    uuid.UUID
+}
+
+func (q *Queries) UpdateMessageAfterSendingTestament(ctx context.Context, arg UpdateMessageAfterSendingTestamentParams) (Message, error) {
+	row := q.db.QueryRow(ctx, updateMessageAfterSendingTestament, arg.Today, arg.ID)
 	var i Message
 	err := row.Scan(
 		&i.ID,
@@ -620,34 +2394,103 @@ func (q *Queries) UpdateMessageAfterSendingTestament(ctx context.Context, id uui
 		&i.InactiveAt,
 		&i.NextReminderAt,
 		&i.SentCounter,
+		&i.ExtensionSecretHash,
+		&i.PreviousExtensionSecretHashes,
 	)
 	return i, err
 }
 
+const updateMessageContentEncrypted = `-- name: UpdateMessageContentEncrypted :execrows
+UPDATE
+  messages
+SET
+  content_encrypted = $1
+WHERE
+  id = $2
+  AND content_encrypted = $3
+`
+
+type UpdateMessageContentEncryptedParams struct {
+	NewContentEncrypted string
+	ID                  uuid.UUID
+	OldContentEncrypted string
+}
+
+func (q *Queries) UpdateMessageContentEncrypted(ctx context.Context, arg UpdateMessageContentEncryptedParams) (int64, error) {
+	result, err := q.db.Exec(ctx, updateMessageContentEncrypted, arg.NewContentEncrypted, arg.ID, arg.OldContentEncrypted)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const updateMessageDataKeyWrapped = `-- name: UpdateMessageDataKeyWrapped :execrows
+UPDATE
+  message_data_keys
+SET
+  kek_id = $1,
+  wrapped_key = $2,
+  updated_at = CURRENT_TIMESTAMP
+WHERE
+  message_id = $3
+  AND wrapped_key = $4
+`
+
+type UpdateMessageDataKeyWrappedParams struct {
+	NewKekID      string
+	NewWrappedKey string
+	MessageID     uuid.UUID
+	OldWrappedKey string
+}
+
+func (q *Queries) UpdateMessageDataKeyWrapped(ctx context.Context, arg UpdateMessageDataKeyWrappedParams) (int64, error) {
+	result, err := q.db.Exec(ctx, updateMessageDataKeyWrapped,
+		arg.NewKekID,
+		arg.NewWrappedKey,
+		arg.MessageID,
+		arg.OldWrappedKey,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const updateMessageExtendsInactiveAt = `-- name: UpdateMessageExtendsInactiveAt :one
 UPDATE
   messages
 SET
-  extension_secret = $1,
+  extension_secret = '',
+  extension_secret_hash = $1,
+  previous_extension_secret_hashes = '{}',
   inactive_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, inactive_period_days),
   next_reminder_at = CURRENT_DATE + MAKE_INTERVAL(0, 0, 0, reminder_interval_days)
 WHERE
   id = $2
-  AND extension_secret = $3
+  AND (extension_secret_hash = $3
+    OR $3 = ANY (previous_extension_secret_hashes)
+    OR (extension_secret_hash = ''
+      AND extension_secret = $4))
   AND inactive_at >= CURRENT_DATE
   AND is_active
 RETURNING
-  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter
+  id, email_creator, created_at, content_encrypted, inactive_period_days, reminder_interval_days, is_active, extension_secret, inactive_at, next_reminder_at, sent_counter, extension_secret_hash, previous_extension_secret_hashes
 `
 
 type UpdateMessageExtendsInactiveAtParams struct {
-	ExtensionSecret   string
-	ID                uuid.UUID
-	ExtensionSecret_2 string
+	NewExtensionSecretHash string
+	ID                     uuid.UUID
+	ExtensionSecretHash    string
+	ExtensionSecret        string
 }
 
 func (q *Queries) UpdateMessageExtendsInactiveAt(ctx context.Context, arg UpdateMessageExtendsInactiveAtParams) (Message, error) {
-	row := q.db.QueryRow(ctx, updateMessageExtendsInactiveAt, arg.ExtensionSecret, arg.ID, arg.ExtensionSecret_2)
+	row := q.db.QueryRow(ctx, updateMessageExtendsInactiveAt,
+		arg.NewExtensionSecretHash,
+		arg.ID,
+		arg.ExtensionSecretHash,
+		arg.ExtensionSecret,
+	)
 	var i Message
 	err := row.Scan(
 		&i.ID,
@@ -661,6 +2504,8 @@ func (q *Queries) UpdateMessageExtendsInactiveAt(ctx context.Context, arg Update
 		&i.InactiveAt,
 		&i.NextReminderAt,
 		&i.SentCounter,
+		&i.ExtensionSecretHash,
+		&i.PreviousExtensionSecretHashes,
 	)
 	return i, err
 }
@@ -672,28 +2517,165 @@ SET
   is_unsubscribed = TRUE
 WHERE
   message_id = $1
-  AND unsubscribe_secret = $2
+  AND (unsubscribe_secret_hash = $2
+    OR $2 = ANY (previous_unsubscribe_secret_hashes)
+    OR (unsubscribe_secret_hash = ''
+      AND unsubscribe_secret = $3))
 RETURNING
-  message_id, email_receiver, is_unsubscribed, unsubscribe_secret
+  message_id, email_receiver, is_unsubscribed, unsubscribe_secret, unsubscribe_secret_hash, previous_unsubscribe_secret_hashes
 `
 
 type UpdateReceiverUnsubscribeParams struct {
-	MessageID         uuid.UUID
-	UnsubscribeSecret string
+	MessageID             uuid.UUID
+	UnsubscribeSecretHash string
+	UnsubscribeSecret     string
 }
 
 func (q *Queries) UpdateReceiverUnsubscribe(ctx context.Context, arg UpdateReceiverUnsubscribeParams) (MessagesEmailReceiver, error) {
-	row := q.db.QueryRow(ctx, updateReceiverUnsubscribe, arg.MessageID, arg.UnsubscribeSecret)
+	row := q.db.QueryRow(ctx, updateReceiverUnsubscribe, arg.MessageID, arg.UnsubscribeSecretHash, arg.UnsubscribeSecret)
 	var i MessagesEmailReceiver
 	err := row.Scan(
 		&i.MessageID,
 		&i.EmailReceiver,
 		&i.IsUnsubscribed,
 		&i.UnsubscribeSecret,
+		&i.UnsubscribeSecretHash,
+		&i.PreviousUnsubscribeSecretHashes,
 	)
 	return i, err
 }
 
+const updateReceiverUnsubscribeSecretHash = `-- name: UpdateReceiverUnsubscribeSecretHash :exec
+UPDATE
+  messages_email_receivers
+SET
+  unsubscribe_secret = '',
+  unsubscribe_secret_hash = $3,
+  previous_unsubscribe_secret_hashes = CASE WHEN unsubscribe_secret_hash <> '' THEN
+    (array_prepend(unsubscribe_secret_hash::text, previous_unsubscribe_secret_hashes))[1:9]
+  WHEN $4::text <> '' THEN
+    (array_prepend($4::text, previous_unsubscribe_secret_hashes))[1:9]
+  ELSE
+    previous_unsubscribe_secret_hashes
+  END
+WHERE
+  message_id = $1
+  AND email_receiver = $2
+`
+
+type UpdateReceiverUnsubscribeSecretHashParams struct {
+	MessageID                   uuid.UUID
+	EmailReceiver               string
+	UnsubscribeSecretHash       string
+	LegacyUnsubscribeSecretHash string
+}
+
+func (q *Queries) UpdateReceiverUnsubscribeSecretHash(ctx context.Context, arg UpdateReceiverUnsubscribeSecretHashParams) error {
+	_, err := q.db.Exec(ctx, updateReceiverUnsubscribeSecretHash,
+		arg.MessageID,
+		arg.EmailReceiver,
+		arg.UnsubscribeSecretHash,
+		arg.LegacyUnsubscribeSecretHash,
+	)
+	return err
+}
+
+const updateSchedulerRunAfterFinishing = `-- name: UpdateSchedulerRunAfterFinishing :exec
+UPDATE
+  scheduler_runs
+SET
+  status = $1,
+  selected = $2,
+  queued = $3,
+  sent = $4,
+  failed = $5,
+  skipped = $6,
+  deferred = $7,
+  error_message = $8,
+  finished_at = CURRENT_TIMESTAMP
+WHERE
+  id = $9
+`
+
+type UpdateSchedulerRunAfterFinishingParams struct {
+	Status       string
+	Selected     int32
+	Queued       int32
+	Sent         int32
+	Failed       int32
+	Skipped      int32
+	Deferred     int32
+	ErrorMessage string
+	ID           uuid.UUID
+}
+
+func (q *Queries) UpdateSchedulerRunAfterFinishing(ctx context.Context, arg UpdateSchedulerRunAfterFinishingParams) error {
+	_, err := q.db.Exec(ctx, updateSchedulerRunAfterFinishing,
+		arg.Status,
+		arg.Selected,
+		arg.Queued,
+		arg.Sent,
+		arg.Failed,
+		arg.Skipped,
+		arg.Deferred,
+		arg.ErrorMessage,
+		arg.ID,
+	)
+	return err
+}
+
+const updateTestamentDelivery = `-- name: UpdateTestamentDelivery :exec
+UPDATE
+  testament_deliveries
+SET
+  status = $2,
+  vendor_id = $3,
+  error_message = $4,
+  sent_at = $5
+WHERE
+  id = $1
+`
+
+type UpdateTestamentDeliveryParams struct {
+	ID           uuid.UUID
+	Status       string
+	VendorID     string
+	ErrorMessage string
+	SentAt       sql.NullTime
+}
+
+func (q *Queries) UpdateTestamentDelivery(ctx context.Context, arg UpdateTestamentDeliveryParams) error {
+	_, err := q.db.Exec(ctx, updateTestamentDelivery,
+		arg.ID,
+		arg.Status,
+		arg.VendorID,
+		arg.ErrorMessage,
+		arg.SentAt,
+	)
+	return err
+}
+
+const upsertMessageDataKey = `-- name: UpsertMessageDataKey :exec
+INSERT INTO message_data_keys (message_id, kek_id, wrapped_key)
+  VALUES ($1, $2, $3)
+ON CONFLICT (message_id)
+  DO UPDATE SET
+    kek_id = EXCLUDED.kek_id,
+    wrapped_key = EXCLUDED.wrapped_key,
+    updated_at = CURRENT_TIMESTAMP
+`
+
+type UpsertMessageDataKeyParams struct {
+	MessageID  uuid.UUID
+	KekID      string
+	WrappedKey string
+}
+
+func (q *Queries) UpsertMessageDataKey(ctx context.Context, arg UpsertMessageDataKeyParams) error {
+	_, err := q.db.Exec(ctx, upsertMessageDataKey, arg.MessageID, arg.KekID, arg.WrappedKey)
+	return err
+}
+
 const upsertReceivers = `-- name: UpsertReceivers :many
 WITH insert_email AS (
 INSERT INTO emails
@@ -709,25 +2691,25 @@ delete_receivers AS (
     AND messages_email_receivers.email_receiver NOT IN (
       SELECT
         unnest($2::text[])))
-INSERT INTO messages_email_receivers (message_id, email_receiver, unsubscribe_secret)
+INSERT INTO messages_email_receivers (message_id, email_receiver, unsubscribe_secret_hash)
 SELECT
   $1 AS message_id,
   unnest($2::text[]) AS email_receiver,
-  unnest($3::text[]) AS unsubscribe_secret
+  unnest($3::text[]) AS unsubscribe_secret_hash
 ON CONFLICT
   DO NOTHING
 RETURNING
-  message_id, email_receiver, is_unsubscribed, unsubscribe_secret
+  message_id, email_receiver, is_unsubscribed, unsubscribe_secret, unsubscribe_secret_hash, previous_unsubscribe_secret_hashes
 `
 
 type UpsertReceiversParams struct {
-	MessageID          uuid.UUID
-	EmailReceivers     []string
-	UnsubscribeSecrets []string
+	MessageID               uuid.UUID
+	EmailReceivers          []string
+	UnsubscribeSecretHashes []string
 }
 
 func (q *Queries) UpsertReceivers(ctx context.Context, arg UpsertReceiversParams) ([]MessagesEmailReceiver, error) {
-	rows, err := q.db.Query(ctx, upsertReceivers, arg.MessageID, arg.EmailReceivers, arg.UnsubscribeSecrets)
+	rows, err := q.db.Query(ctx, upsertReceivers, arg.MessageID, arg.EmailReceivers, arg.UnsubscribeSecretHashes)
 	if err != nil {
 		return nil, err
 	}
@@ -740,6 +2722,8 @@ func (q *Queries) UpsertReceivers(ctx context.Context, arg UpsertReceiversParams
 			&i.EmailReceiver,
 			&i.IsUnsubscribed,
 			&i.UnsubscribeSecret,
+			&i.UnsubscribeSecretHash,
+			&i.PreviousUnsubscribeSecretHashes,
 		); err != nil {
 			return nil, err
 		}
@@ -3,3 +3,23 @@ ALTER TABLE public.emails OWNER TO project_legacy_tester;
 ALTER TABLE public.messages OWNER TO project_legacy_tester;
 
 ALTER TABLE public.messages_email_receivers OWNER TO project_legacy_tester;
+
+ALTER TABLE public.testament_deliveries OWNER TO project_legacy_tester;
+
+ALTER TABLE public.email_outbox OWNER TO project_legacy_tester;
+
+ALTER TABLE public.schema_migrations OWNER TO project_legacy_tester;
+
+ALTER TABLE public.message_data_keys OWNER TO project_legacy_tester;
+
+ALTER TABLE public.rate_limits OWNER TO project_legacy_tester;
+
+ALTER TABLE public.secret_attempt_failures OWNER TO project_legacy_tester;
+
+ALTER TABLE public.cron_jobs OWNER TO project_legacy_tester;
+
+ALTER TABLE public.scheduler_runs OWNER TO project_legacy_tester;
+
+ALTER TABLE public.scheduler_run_emails OWNER TO project_legacy_tester;
+
+ALTER TABLE public.mail_vendor_quotas OWNER TO project_legacy_tester;
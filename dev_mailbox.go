@@ -0,0 +1,132 @@
+package p
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/asendia/legacy-api/mail"
+)
+
+// The links of the emails are opened on this server instead of sejiwo.com
+var devMailboxLinks = strings.NewReplacer(
+	"https://sejiwo.com/extend?", "/dev/mailbox/extend?",
+	"https://sejiwo.com/unsubscribe?", "/dev/mailbox/unsubscribe?",
+)
+
+var devMailboxTemplate = template.Must(template.New("mailbox").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Mailbox</title></head>
+<body>
+<h1>Mailbox</h1>
+<p>{{len .}} emails written to MAIL_FILE_DIR, the newest first</p>
+<table border="1" cellpadding="4">
+<tr><th>Date</th><th>From</th><th>To</th><th>Subject</th><th></th></tr>
+{{range .}}<tr>
+<td>{{.Date.Format "2006-01-02 15:04:05 MST"}}</td>
+<td>{{.From}}</td>
+<td>{{range $id, $to := .To}}{{if $id}}, {{end}}{{$to}}{{end}}</td>
+<td><a href="/dev/mailbox/{{.ID}}">{{.Subject}}</a></td>
+<td><a href="/dev/mailbox/{{.ID}}/eml">.eml</a></td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// DevMailboxHandler lists & renders the emails written by mail.FileMailVendor to MAIL_FILE_DIR, never in prod.
+// The extension & unsubscribe links of the emails call /legacy-api-secret of this server.
+func DevMailboxHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dev/mailbox", devMailboxList)
+	mux.HandleFunc("GET /dev/mailbox/{id}", devMailboxEmail)
+	mux.HandleFunc("GET /dev/mailbox/{id}/eml", devMailboxEML)
+	mux.HandleFunc("GET /dev/mailbox/extend", devMailboxSecretAction("extend-message"))
+	mux.HandleFunc("GET /dev/mailbox/unsubscribe", devMailboxSecretAction("unsubscribe-message"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("ENVIRONMENT") == "prod" {
+			http.NotFound(w, r)
+			return
+		}
+		if os.Getenv("MAIL_FILE_DIR") == "" {
+			http.Error(w, "Set MAIL_FILE_DIR to write the emails to the mailbox", http.StatusNotFound)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func devMailboxVendor() *mail.FileMailVendor {
+	return &mail.FileMailVendor{Dir: os.Getenv("MAIL_FILE_DIR")}
+}
+
+func devMailboxList(w http.ResponseWriter, r *http.Request) {
+	index, err := devMailboxVendor().Index()
+	if err != nil {
+		log.Printf("Cannot read the mailbox: %v\n", err)
+		http.Error(w, "Cannot read the mailbox", http.StatusInternalServerError)
+		return
+	}
+	slices.Reverse(index)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = devMailboxTemplate.Execute(w, index); err != nil {
+		log.Printf("Cannot render the mailbox: %v\n", err)
+	}
+}
+
+// devMailboxRead writes the error response when the email cannot be read
+func devMailboxRead(w http.ResponseWriter, r *http.Request) (message []byte, ok bool) {
+	_, message, err := devMailboxVendor().Read(r.PathValue("id"))
+	if errors.Is(err, mail.ErrFileMailNotFound) {
+		http.NotFound(w, r)
+		return nil, false
+	} else if err != nil {
+		log.Printf("Cannot read the email: %v\n", err)
+		http.Error(w, "Cannot read the email", http.StatusInternalServerError)
+		return nil, false
+	}
+	return message, true
+}
+
+func devMailboxEmail(w http.ResponseWriter, r *http.Request) {
+	message, ok := devMailboxRead(w, r)
+	if !ok {
+		return
+	}
+	html, err := mail.MIMEMessageHTML(message)
+	if err != nil {
+		log.Printf("Cannot read the HTML of the email: %v\n", err)
+		http.Error(w, "Cannot read the HTML of the email", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	devMailboxLinks.WriteString(w, html)
+}
+
+func devMailboxEML(w http.ResponseWriter, r *http.Request) {
+	message, ok := devMailboxRead(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+r.PathValue("id")+`.eml"`)
+	w.Write(message)
+}
+
+// devMailboxSecretAction calls /legacy-api-secret like the extend & unsubscribe pages of the frontend
+func devMailboxSecretAction(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		query.Set("action", action)
+		req := r.Clone(r.Context())
+		req.URL.Path = "/legacy-api-secret"
+		req.URL.RawQuery = query.Encode()
+		// A clicked link has no Origin, this one is allowed by VerifyCORS
+		req.Header.Set("Origin", "http://localhost:5173")
+		CloudFunctionForFrontendWithUserSecret(w, req)
+	}
+}
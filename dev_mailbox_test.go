@@ -0,0 +1,50 @@
+package p
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/asendia/legacy-api/mail"
+)
+
+func getDevMailbox(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	DevMailboxHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestDevMailbox(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "dev")
+	t.Setenv("MAIL_FILE_DIR", t.TempDir())
+	vendor := mail.LoadSendMailConfigFromEnv().Vendors[0].Vendor
+	res, err := vendor.SendEmails([]mail.MailItem{{
+		From:        mail.MailAddress{Email: "noreply@sejiwo.com", Name: "Sejiwo Team"},
+		To:          []mail.MailAddress{{Email: "test@sejiwo.com"}},
+		Subject:     "Reminder to extend the delivery schedule of sejiwo.com testament",
+		HtmlContent: `<a href="https://sejiwo.com/extend?id=some-id&amp;secret=some-secret">Extend</a>`,
+	}})
+	if err != nil || res[0].Err != nil || vendor.GetVendorID() != mail.FileMailVendorID {
+		t.Fatalf("The email should be written to the mailbox: %+v %v", res, err)
+	}
+	list := getDevMailbox("/dev/mailbox")
+	if list.Code != http.StatusOK || !strings.Contains(list.Body.String(), "Reminder to extend the delivery schedule") {
+		t.Fatalf("The email should be listed: %d %s", list.Code, list.Body.String())
+	}
+	id := strings.Split(strings.Split(list.Body.String(), `<a href="/dev/mailbox/`)[1], `"`)[0]
+	email := getDevMailbox("/dev/mailbox/" + id)
+	if email.Code != http.StatusOK || email.Body.String() != `<a href="/dev/mailbox/extend?id=some-id&amp;secret=some-secret">Extend</a>` {
+		t.Fatalf("The link should be opened on this server: %d %s", email.Code, email.Body.String())
+	}
+	if eml := getDevMailbox("/dev/mailbox/" + id + "/eml"); eml.Code != http.StatusOK || !strings.Contains(eml.Body.String(), "MIME-Version: 1.0") {
+		t.Fatalf("Unexpected .eml: %d %s", eml.Code, eml.Body.String())
+	}
+	if notFound := getDevMailbox("/dev/mailbox/unknown"); notFound.Code != http.StatusNotFound {
+		t.Fatalf("An unknown email should not be found: %d", notFound.Code)
+	}
+	t.Setenv("ENVIRONMENT", "prod")
+	if prod := getDevMailbox("/dev/mailbox"); prod.Code != http.StatusNotFound {
+		t.Fatalf("The mailbox should not exist in prod: %d", prod.Code)
+	}
+}
@@ -1,11 +1,12 @@
 package p
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/asendia/legacy-api/api"
@@ -20,7 +21,7 @@ func CloudFunctionForFrontendWithNetlifyJWT(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	// Verifying auth
-	jwtRes, err := VerifyNetlifyJWT(r)
+	jwtRes, err := AuthenticateRequest(r)
 	if err != nil {
 		log.Println(err.Error())
 		w.Header().Set("Content-Type", "application/json")
@@ -98,16 +99,34 @@ func CloudFunctionForFrontendWithNetlifyJWT(w http.ResponseWriter, r *http.Reque
 	fmt.Fprint(w, resStr)
 }
 
-func VerifyNetlifyJWT(r *http.Request) (jwtRes secure.JWTResponse, err error) {
-	// Always login with this email during test or cmd
-	jwtRes = secure.JWTResponse{Email: "test@sejiwo.com"}
-	// Verify JWT token on prod env only
-	if os.Getenv("ENVIRONMENT") == "prod" {
+var (
+	authenticatorOnce sync.Once
+	authenticator     secure.Authenticator
+	authenticatorErr  error
+)
+
+// loadAuthenticator is shared by the requests of an instance, so the JWKS keys are fetched once & refreshed on a timer
+func loadAuthenticator() (secure.Authenticator, error) {
+	authenticatorOnce.Do(func() {
 		client := &http.Client{Timeout: time.Second * 10}
-		jwtRes, err = secure.VerifyNetlifyJWT(client, r.Header.Get("authorization"))
-		if err != nil {
-			return
-		}
+		authenticator, authenticatorErr = secure.LoadAuthenticatorFromEnv(context.Background(), client)
+	})
+	return authenticator, authenticatorErr
+}
+
+// AuthenticateRequest uses the AUTH_PROVIDER authenticator, outside prod every request is test@sejiwo.com by default
+func AuthenticateRequest(r *http.Request) (jwtRes secure.JWTResponse, err error) {
+	a, err := loadAuthenticator()
+	if err != nil {
+		return jwtRes, err
+	}
+	identity, err := a.Authenticate(r.Context(), r.Header.Get("authorization"))
+	if err != nil {
+		return jwtRes, err
+	}
+	// Messages are owned by their email, it should belong to the user
+	if !identity.EmailVerified {
+		return jwtRes, errors.New("email is not verified")
 	}
-	return
+	return identity.ToJWTResponse(), nil
 }
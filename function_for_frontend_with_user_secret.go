@@ -1,13 +1,17 @@
 package p
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/asendia/legacy-api/api"
 	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
@@ -19,12 +23,10 @@ func CloudFunctionForFrontendWithUserSecret(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	godotenv.Load()
-	secret, messageID, err := VerifyQueryString(r)
-	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, "Invalid query string", http.StatusForbidden)
-		return
-	}
+	ip := api.ClientIP(r)
+	action := r.URL.Query().Get("action")
+	secret, messageID, errQuery := VerifyQueryString(r)
+	nullMessageID := uuid.NullUUID{UUID: messageID, Valid: messageID != uuid.Nil}
 
 	// Establishing connection to database
 	ctx := r.Context()
@@ -35,6 +37,33 @@ func CloudFunctionForFrontendWithUserSecret(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	defer conn.Close()
+
+	// Rate limiting per IP & per message, repeated failures lock out the IP
+	limiter, err := api.LoadSecretRateLimiterFromEnv(conn)
+	if err != nil {
+		log.Printf("Cannot load the rate limiter: %v\n", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rateLimitKeys := api.SecretRateLimitKeys(ip, nullMessageID)
+	retryAfter, err := limiter.Allow(ctx, rateLimitKeys.Allow...)
+	if err != nil {
+		log.Printf("Cannot check the rate limit: %v\n", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, `{"err":"Too many attempts"}`, http.StatusTooManyRequests)
+		return
+	}
+	if errQuery != nil {
+		log.Println(errQuery.Error())
+		recordSecretAttemptFailure(ctx, conn, limiter, rateLimitKeys.Fail, nullMessageID, action, ip)
+		http.Error(w, "Invalid query string", http.StatusForbidden)
+		return
+	}
+
 	tx, err := conn.Begin(ctx)
 	if err != nil {
 		log.Printf("Cannot begin database transaction: %v\n", err.Error())
@@ -47,7 +76,6 @@ func CloudFunctionForFrontendWithUserSecret(w http.ResponseWriter, r *http.Reque
 		Tx:      tx,
 	}
 	var res api.APIResponse
-	action := r.URL.Query().Get("action")
 	switch action {
 	case "extend-message":
 		res, err = a.ExtendMessageInactiveAt(secret, messageID)
@@ -63,7 +91,11 @@ func CloudFunctionForFrontendWithUserSecret(w http.ResponseWriter, r *http.Reque
 	// Handle controller error
 	if err != nil {
 		log.Println(err.Error())
-		http.Error(w, `{"err":"`+err.Error()+`"}`, res.GetValidStatusCode())
+		statusCode := res.GetValidStatusCode()
+		if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+			recordSecretAttemptFailure(ctx, conn, limiter, rateLimitKeys.Fail, nullMessageID, action, ip)
+		}
+		http.Error(w, `{"err":"`+err.Error()+`"}`, statusCode)
 		return
 	}
 	// Generate response
@@ -74,9 +106,27 @@ func CloudFunctionForFrontendWithUserSecret(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	tx.Commit(ctx)
+	if err = limiter.Succeed(ctx, rateLimitKeys.Succeed...); err != nil {
+		log.Printf("Cannot reset the rate limit failures: %v\n", err)
+	}
 	fmt.Fprint(w, resStr)
 }
 
+// recordSecretAttemptFailure counts the failure towards the lockouts & keeps it for alerting,
+// both are written outside of the request transaction which is rolled back
+func recordSecretAttemptFailure(ctx context.Context, db data.DBTX, limiter secure.RateLimiter, keys []string,
+	messageID uuid.NullUUID, action string, ip string) {
+	failures, err := limiter.Fail(ctx, keys...)
+	if err != nil {
+		log.Printf("Cannot count the failed secret attempt: %v\n", err)
+	}
+	if err = api.RecordSecretAttemptFailure(ctx, db, messageID, action, ip); err != nil {
+		log.Printf("Cannot record the failed secret attempt: %v\n", err)
+	}
+	log.Printf("Failed secret attempt, action: %s message: %s ip: %s consecutive failures: %d\n",
+		action, messageID.UUID, ip, failures)
+}
+
 func VerifyQueryString(r *http.Request) (secret string, id uuid.UUID, err error) {
 	q := r.URL.Query()
 	id, err = uuid.Parse(q.Get("id"))
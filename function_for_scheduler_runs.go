@@ -0,0 +1,75 @@
+package p
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/asendia/legacy-api/api"
+	"github.com/asendia/legacy-api/data"
+	"github.com/joho/godotenv"
+)
+
+// Read only history of the scheduler runs, the body is an api.SchedulerRunsQuery signed like the scheduler requests
+func CloudFunctionForSchedulerRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	godotenv.Load()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSchedulerRequestBytes))
+	if err != nil {
+		http.Error(w, "Cannot read the request body", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Establishing connection to database
+	ctx := r.Context()
+	conn, err := data.ConnectDB(ctx, data.LoadDBURLConfig())
+	if err != nil {
+		log.Printf("Cannot connect to the database: %v\n", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	statusCode, err := VerifySignedRequest(r, body, conn)
+	if err != nil {
+		log.Printf("Rejected scheduler runs request: %v\n", err)
+		http.Error(w, http.StatusText(statusCode), statusCode)
+		return
+	}
+	var q api.SchedulerRunsQuery
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &q); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		log.Printf("Cannot begin database transaction: %v\n", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+	a := api.APIForScheduler{Context: ctx, Tx: tx}
+	res, err := a.SelectSchedulerRuns(q)
+	if err != nil {
+		log.Printf("Controller error: %+v\n", err)
+		if res.StatusCode == http.StatusBadRequest {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	resStr, err := res.ToString()
+	if err != nil {
+		log.Printf("Cannot generate a response: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.GetValidStatusCode())
+	io.WriteString(w, resStr)
+}
@@ -0,0 +1,104 @@
+package p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/asendia/legacy-api/api"
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
+	"github.com/joho/godotenv"
+)
+
+// Cloud Run endpoint of a Pub/Sub push subscription of the scheduler topic
+func CloudFunctionForSchedulerWithPubSubPush(w http.ResponseWriter, r *http.Request) {
+	godotenv.Load()
+	h, err := loadPubSubPushHandler()
+	if err != nil {
+		log.Printf("Cannot load the pubsub push handler: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+var (
+	pubSubPushHandlerOnce sync.Once
+	pubSubPushHandler     PubSubPushHandler
+	pubSubPushHandlerErr  error
+)
+
+// loadPubSubPushHandler is shared by the requests of an instance, so the Google keys are fetched once & refreshed on a timer
+func loadPubSubPushHandler() (PubSubPushHandler, error) {
+	pubSubPushHandlerOnce.Do(func() {
+		client := &http.Client{Timeout: time.Second * 10}
+		verifier, err := secure.LoadPubSubPushVerifierFromEnv(client)
+		if err != nil {
+			pubSubPushHandlerErr = err
+			return
+		}
+		verifier.Keys.(*secure.JWKSCache).Start(context.Background())
+		pubSubPushHandler = PubSubPushHandler{Verifier: verifier, Run: runSchedulerActionWithNewConn}
+	})
+	return pubSubPushHandler, pubSubPushHandlerErr
+}
+
+func runSchedulerActionWithNewConn(ctx context.Context, m PubSubMessage) error {
+	conn, err := data.ConnectDB(ctx, data.LoadDBURLConfig())
+	if err != nil {
+		log.Printf("Cannot connect to the database: %v\n", err.Error())
+		return err
+	}
+	defer conn.Close()
+	_, err = runSchedulerAction(ctx, conn, m)
+	return err
+}
+
+// PubSubPushHandler unwraps the push requests of Pub/Sub. A 2xx status acks the message, any other status makes
+// Pub/Sub redeliver it with backoff, so the messages which can never succeed are acked as well.
+type PubSubPushHandler struct {
+	Verifier secure.PubSubPushVerifier
+	Run      func(ctx context.Context, m PubSubMessage) error
+}
+
+func (h PubSubPushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	if _, err := h.Verifier.Verify(ctx, r.Header.Get("authorization")); err != nil {
+		log.Printf("Rejected pubsub push request: %v\n", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// The data of the message is base64 in the envelope, decoded into PubSubMessage.Data by encoding/json
+	var req PubSubRequest
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSchedulerRequestBytes))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		log.Printf("Dropped invalid pubsub push request: %v\n", err)
+		http.Error(w, "Invalid pubsub push request, dropped", http.StatusOK)
+		return
+	}
+	err = h.Run(ctx, req.Message)
+	if errors.Is(err, ErrInvalidAction) || errors.Is(err, api.ErrInvalidSchedulerParams) {
+		log.Printf("Dropped pubsub message: %s, action: %q, %v\n", req.Message.MessageID, req.Message.Attributes["action"], err)
+		http.Error(w, "Invalid action or params, dropped", http.StatusOK)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed pubsub message: %s, it will be redelivered: %v\n", req.Message.MessageID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
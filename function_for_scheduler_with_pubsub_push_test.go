@@ -0,0 +1,99 @@
+package p
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asendia/legacy-api/secure"
+)
+
+const (
+	testPushKey            = "key of the google signed push tokens in the tests"
+	testPushAudience       = "https://legacy-api.example.com/legacy-api-scheduler-push"
+	testPushServiceAccount = "scheduler-push@monarch-public.iam.gserviceaccount.com"
+)
+
+func TestPubSubPushHandler(t *testing.T) {
+	var received []PubSubMessage
+	var runErr error
+	h := PubSubPushHandler{
+		Verifier: secure.PubSubPushVerifier{
+			Keys:                secure.StaticJWTKeys{"": []byte(testPushKey)},
+			Audiences:           []string{testPushAudience},
+			ServiceAccountEmail: testPushServiceAccount,
+		},
+		Run: func(ctx context.Context, m PubSubMessage) error {
+			received = append(received, m)
+			return runErr
+		},
+	}
+	envelope := `{"message":{"attributes":{"action":"dispatch-emails"},"data":"` +
+		base64.StdEncoding.EncodeToString([]byte(`{"batchSize":10}`)) +
+		`","messageId":"2070443601311540"},"subscription":"projects/monarch-public/subscriptions/legacy-push"}`
+	validToken := mintPushToken(t, testPushAudience)
+
+	if status := servePushRequest(h, validToken, envelope); status != http.StatusNoContent {
+		t.Fatalf("Valid push request should be acked with 204, got: %d", status)
+	}
+	if len(received) != 1 || received[0].Attributes["action"] != "dispatch-emails" ||
+		string(received[0].Data) != `{"batchSize":10}` || received[0].MessageID != "2070443601311540" {
+		t.Fatalf("Envelope should be unwrapped, got: %+v", received)
+	}
+	for _, token := range []string{"", mintPushToken(t, "https://example.com")} {
+		if status := servePushRequest(h, token, envelope); status != http.StatusUnauthorized {
+			t.Fatalf("Push request without a valid token should be rejected, got: %d", status)
+		}
+	}
+	if len(received) != 1 {
+		t.Fatalf("Rejected requests should not run the action")
+	}
+	// Messages which can never succeed are acked, the failed ones are redelivered
+	if status := servePushRequest(h, validToken, `{"message":`); status != http.StatusOK {
+		t.Fatalf("Malformed envelope should be acked, got: %d", status)
+	}
+	runErr = ErrInvalidAction
+	if status := servePushRequest(h, validToken, envelope); status != http.StatusOK {
+		t.Fatalf("Invalid action should be acked, got: %d", status)
+	}
+	runErr = errors.New("cannot connect to the database")
+	if status := servePushRequest(h, validToken, envelope); status != http.StatusInternalServerError {
+		t.Fatalf("Failed action should be nacked with 500, got: %d", status)
+	}
+}
+
+func servePushRequest(h PubSubPushHandler, token string, body string) int {
+	r := httptest.NewRequest(http.MethodPost, "/legacy-api-scheduler-push", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func mintPushToken(t *testing.T, audience string) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	claims, err := json.Marshal(map[string]any{
+		"iss":            "https://accounts.google.com",
+		"aud":            audience,
+		"email":          testPushServiceAccount,
+		"email_verified": true,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal the claims: %v", err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, []byte(testPushKey))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
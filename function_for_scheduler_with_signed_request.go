@@ -0,0 +1,90 @@
+package p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/asendia/legacy-api/api"
+	"github.com/asendia/legacy-api/data"
+	"github.com/asendia/legacy-api/secure"
+	"github.com/joho/godotenv"
+)
+
+// Scheduler messages are tiny, larger bodies are rejected before verifying them
+const maxSchedulerRequestBytes = 64 << 10
+
+// HTTP alternative of CloudFunctionForSchedulerWithStaticSecret, the body is a PubSubMessage
+// signed with one of the scheduler signing secrets, see secure.SignRequest
+func CloudFunctionForSchedulerWithSignedRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	godotenv.Load()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSchedulerRequestBytes))
+	if err != nil {
+		http.Error(w, "Cannot read the request body", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Establishing connection to database
+	ctx := r.Context()
+	conn, err := data.ConnectDB(ctx, data.LoadDBURLConfig())
+	if err != nil {
+		log.Printf("Cannot connect to the database: %v\n", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	statusCode, err := VerifySignedRequest(r, body, conn)
+	if err != nil {
+		log.Printf("Rejected scheduler request: %v\n", err)
+		http.Error(w, http.StatusText(statusCode), statusCode)
+		return
+	}
+	var m PubSubMessage
+	if err = json.Unmarshal(body, &m); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	res, err := runSchedulerAction(ctx, conn, m)
+	if errors.Is(err, ErrInvalidAction) || errors.Is(err, api.ErrInvalidSchedulerParams) {
+		http.Error(w, fmt.Sprintf("Error: %+v\n", err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: %+v\n", err), http.StatusInternalServerError)
+		return
+	}
+	// The response of the action, e.g. the run summary or the dry run report
+	resStr, err := res.ToString()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, resStr)
+}
+
+// VerifySignedRequest checks the signature & the timestamp of the body, the signed requests are remembered
+// in Postgres until they expire so that they cannot be replayed on any instance, whatever the RATE_LIMIT_STORE is
+func VerifySignedRequest(r *http.Request, body []byte, db data.DBTX) (statusCode int, err error) {
+	secrets, err := secure.LoadSchedulerSigningSecretsFromEnv()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	verifier := secure.RequestVerifier{Secrets: secrets, Signatures: api.PostgresAttemptStore{DB: db}}
+	err = verifier.Verify(r.Context(), r.Header, body)
+	switch {
+	case err == nil:
+		return http.StatusOK, nil
+	case errors.Is(err, secure.ErrRequestSignatureMissing), errors.Is(err, secure.ErrRequestSignatureInvalid),
+		errors.Is(err, secure.ErrRequestSignatureExpired), errors.Is(err, secure.ErrRequestSignatureReplayed):
+		return http.StatusUnauthorized, err
+	default:
+		return http.StatusInternalServerError, err
+	}
+}
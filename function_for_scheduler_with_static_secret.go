@@ -3,15 +3,21 @@ package p
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/asendia/legacy-api/api"
 	"github.com/asendia/legacy-api/data"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 )
 
+var ErrInvalidAction = errors.New("invalid Action")
+
 // Google Cloud Function
 func CloudFunctionForSchedulerWithStaticSecret(ctx context.Context, m PubSubMessage) error {
 	godotenv.Load()
@@ -22,18 +28,114 @@ func CloudFunctionForSchedulerWithStaticSecret(ctx context.Context, m PubSubMess
 		return err
 	}
 	defer conn.Close()
+	_, err = runSchedulerAction(ctx, conn, m)
+	return err
+}
+
+// runSchedulerAction runs the action of the message in a transaction & dispatches the emails it queued,
+// every run is kept in scheduler_runs. res is the response of the action, the report of a dry run.
+func runSchedulerAction(ctx context.Context, conn *pgxpool.Pool, m PubSubMessage) (res api.APIResponse, err error) {
+	action := m.Attributes["action"]
+	params, err := parseSchedulerParams(action, m.Data)
+	if err != nil {
+		log.Printf("Invalid params of action: %s, %v\n", action, err)
+		return res, err
+	}
+	log.Printf("Running action: %s, params: %s", action, params)
+	run, err := api.StartSchedulerRun(ctx, conn, action, params, m.MessageID)
+	if err != nil {
+		log.Printf("Cannot record the scheduler run: %v\n", err)
+		return res, err
+	}
+	res, status, err := runSchedulerActionInTx(ctx, conn, action, params, run)
+	// Recorded even when the run was canceled
+	if errRecord := run.Finish(context.WithoutCancel(ctx), status, err); errRecord != nil {
+		log.Printf("Cannot record the result of scheduler run: %s, %v\n", run.Run.ID, errRecord)
+	}
+	return res, err
+}
+
+func runSchedulerActionInTx(ctx context.Context, conn *pgxpool.Pool, action string, params api.SchedulerParams,
+	run *api.SchedulerRunRecorder) (res api.APIResponse, status string, err error) {
 	tx, err := conn.Begin(ctx)
 	if err != nil {
 		log.Printf("Cannot begin database transaction: %v\n", err.Error())
-		return err
+		return res, api.SchedulerRunStatusFailed, err
 	}
 	defer tx.Rollback(ctx)
 	a := api.APIForScheduler{
-		Context: ctx,
-		Tx:      tx,
+		Context:  ctx,
+		Tx:       tx,
+		DB:       conn,
+		Params:   params,
+		Deadline: schedulerDeadline(ctx),
 	}
-	var res api.APIResponse
-	action := m.Attributes["action"]
+	if params.DryRun {
+		// The chunks become savepoints of the run transaction, which is rolled back
+		a.DB = tx
+	}
+	isLocked, err := a.LockAction(action)
+	if err != nil {
+		log.Printf("Cannot lock action: %s, %v\n", action, err)
+		return res, api.SchedulerRunStatusFailed, err
+	}
+	if !isLocked {
+		// Acknowledged, the run holding the lock or the next scheduled run takes over the due messages
+		log.Printf("Skipped action: %s, params: %s, a conflicting run holds its lock", action, params)
+		res.StatusCode = http.StatusOK
+		res.ResponseMsg = "Skipped, a conflicting run holds the lock of the action"
+		return res, api.SchedulerRunStatusSkipped, nil
+	}
+	if params.DryRun && dryRunReportActions[action] {
+		// The emails are rendered & captured instead of sent, see api.DryRunReport
+		res, err = a.DryRun(action)
+	} else {
+		res, err = runSchedulerController(&a, action)
+	}
+	// The chunks committed before an error count as well
+	run.Add(res)
+	// Handle controller error
+	if err != nil {
+		log.Printf("Controller error: %+v\n", err)
+		return res, api.SchedulerRunStatusFailed, err
+	}
+	// Generate response
+	resStr, err := res.ToString()
+	if err != nil {
+		log.Printf("Cannot generate a response: %v\n", err)
+		return res, api.SchedulerRunStatusFailed, err
+	}
+	if params.DryRun {
+		log.Printf("Dry run action: %s, params: %s, rolled back response: %s", action, params, resStr)
+		return res, api.SchedulerRunStatusDryRun, nil
+	}
+	if err = tx.Commit(ctx); err != nil {
+		log.Printf("Cannot commit database transaction: %v\n", err)
+		return res, api.SchedulerRunStatusFailed, err
+	}
+	log.Printf("Success action: %s, params: %s, response: %s", action, params, resStr)
+	// Emails queued by the action are only sent once its transaction is committed
+	if action == "send-reminder-messages" || action == "send-testaments" {
+		// The action itself succeeded, a failed dispatch is retried by the dispatch-emails action
+		dispatchRes, err := a.DispatchEmailOutbox()
+		run.Add(dispatchRes)
+		if err != nil {
+			log.Printf("Dispatcher error: %+v\n", err)
+			return res, api.SchedulerRunStatusSucceeded, nil
+		}
+		resStr, _ = dispatchRes.ToString()
+		log.Printf("Success action: dispatch-emails, response: %s", resStr)
+	}
+	return res, api.SchedulerRunStatusSucceeded, nil
+}
+
+// The actions whose dry run reports the emails it would send
+var dryRunReportActions = map[string]bool{
+	"send-reminder-messages": true,
+	"send-testaments":        true,
+}
+
+func runSchedulerController(a *api.APIForScheduler, action string) (res api.APIResponse, err error) {
 	switch action {
 	case "send-reminder-messages":
 		res, err = a.SendReminderMessages()
@@ -43,24 +145,64 @@ func CloudFunctionForSchedulerWithStaticSecret(ctx context.Context, m PubSubMess
 		res, err = a.SelectMessagesNeedReminding()
 	case "select-inactive-messages":
 		res, err = a.SelectInactiveMessages()
+	case "dispatch-emails":
+		res, err = a.DispatchEmailOutbox()
+	case "reencrypt-messages":
+		res, err = a.ReencryptMessages()
+	case "rewrap-data-keys":
+		res, err = a.RewrapDataKeys()
+	case "hash-secrets":
+		res, err = a.HashStoredSecrets()
+	case "select-secret-attempt-failures":
+		res, err = a.SelectSecretAttemptFailures()
+	case "delete-expired-rate-limits":
+		res, err = a.DeleteExpiredRateLimits()
 	default:
-		err = errors.New("invalid Action")
+		err = ErrInvalidAction
 		res.StatusCode = http.StatusNotFound
 	}
-	// Handle controller error
-	if err != nil {
-		log.Printf("Controller error: %+v\n", err)
-		return err
+	return res, err
+}
+
+// Default run time of a scheduler action, the --timeout of the cloud function & the Cloud Run service
+const defaultSchedulerTimeout = 15 * time.Second
+
+// schedulerDeadline keeps a third of the run time, up to the context deadline or SCHEDULER_TIMEOUT_SEC,
+// for dispatching the emails queued by the action
+func schedulerDeadline(ctx context.Context) time.Time {
+	startedAt := time.Now()
+	timeout := schedulerTimeout()
+	if deadline, ok := ctx.Deadline(); ok && deadline.Sub(startedAt) < timeout {
+		timeout = deadline.Sub(startedAt)
 	}
-	// Generate response
-	resStr, err := res.ToString()
+	return startedAt.Add(timeout * 2 / 3)
+}
+
+func schedulerTimeout() time.Duration {
+	if sec, err := strconv.Atoi(os.Getenv("SCHEDULER_TIMEOUT_SEC")); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	return defaultSchedulerTimeout
+}
+
+// Actions which select messages & only write into the run transaction, every param applies to them
+var messageSchedulerActions = map[string]bool{
+	"send-reminder-messages":         true,
+	"send-testaments":                true,
+	"select-messages-need-reminding": true,
+	"select-inactive-messages":       true,
+}
+
+// parseSchedulerParams reads the JSON params of the message data, the other actions only take batchSize & exclusive
+func parseSchedulerParams(action string, data []byte) (params api.SchedulerParams, err error) {
+	params, err = api.ParseSchedulerParams(data)
 	if err != nil {
-		log.Printf("Cannot generate a response: %v\n", err)
-		return err
+		return params, err
 	}
-	tx.Commit(ctx)
-	log.Printf("Success action: %s, response: %s", action, resStr)
-	return nil
+	if !messageSchedulerActions[action] && (params.DryRun || params.Today != "" || len(params.MessageIDs) > 0) {
+		return params, fmt.Errorf("%w: %s only takes batchSize & exclusive", api.ErrInvalidSchedulerParams, action)
+	}
+	return params, nil
 }
 
 type PubSubRequest struct {
@@ -71,16 +213,5 @@ type PubSubRequest struct {
 type PubSubMessage struct {
 	Data       []byte            `json:"data"`
 	Attributes map[string]string `json:"attributes"`
-}
-
-func VerifySecretHeader(r *http.Request) (statusCode int, err error) {
-	serverSecret := os.Getenv("STATIC_SECRET")
-	if len(serverSecret) != api.ExtensionSecretLength {
-		return http.StatusInternalServerError, errors.New("env STATIC_SECRET is invalid: " + serverSecret)
-	}
-	clientSecret := r.Header.Get("x-static-secret")
-	if serverSecret != clientSecret {
-		return http.StatusUnauthorized, errors.New("Invalid secret header: " + clientSecret)
-	}
-	return http.StatusOK, nil
+	MessageID  string            `json:"messageId"`
 }
@@ -0,0 +1,48 @@
+package p
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/asendia/legacy-api/api"
+)
+
+func TestParseSchedulerParams(t *testing.T) {
+	params, err := parseSchedulerParams("send-testaments",
+		[]byte(`{"batchSize":10,"dryRun":true,"messageIds":["9b1deb4d-3b7d-4bad-9bdd-2b0d7b3dcb6d"],"today":"2026-01-02"}`))
+	if err != nil {
+		t.Fatalf("Params should be valid: %v", err)
+	}
+	if params.BatchSize != 10 || !params.DryRun || len(params.MessageIDs) != 1 || params.Today != "2026-01-02" {
+		t.Fatalf("Unexpected params: %+v", params)
+	}
+	if params, err = parseSchedulerParams("dispatch-emails", nil); err != nil || params.BatchSize != 0 {
+		t.Fatalf("Empty data should be the default params: %+v %v", params, err)
+	}
+	if _, err = parseSchedulerParams("dispatch-emails", []byte(`{"batchSize":50}`)); err != nil {
+		t.Fatalf("Every action should take batchSize: %v", err)
+	}
+	if params, err = parseSchedulerParams("dispatch-emails", []byte(`{"exclusive":true}`)); err != nil || !params.Exclusive {
+		t.Fatalf("Every action should take exclusive: %+v %v", params, err)
+	}
+	invalidCases := []struct {
+		name   string
+		action string
+		data   string
+	}{
+		{"unknown field", "send-testaments", `{"batch_size":10}`},
+		{"negative batch size", "send-testaments", `{"batchSize":-1}`},
+		{"too large batch size", "send-testaments", `{"batchSize":100000}`},
+		{"nil message id", "send-testaments", `{"messageIds":["00000000-0000-0000-0000-000000000000"]}`},
+		{"invalid today", "send-testaments", `{"today":"02/01/2026"}`},
+		{"today in the future", "send-testaments", `{"today":"2999-01-01"}`},
+		{"not a json object", "send-testaments", `send-testaments`},
+		{"dry run of dispatch-emails", "dispatch-emails", `{"dryRun":true}`},
+		{"message ids of dispatch-emails", "dispatch-emails", `{"messageIds":["9b1deb4d-3b7d-4bad-9bdd-2b0d7b3dcb6d"]}`},
+	}
+	for _, c := range invalidCases {
+		if _, err = parseSchedulerParams(c.action, []byte(c.data)); !errors.Is(err, api.ErrInvalidSchedulerParams) {
+			t.Fatalf("Params with %s should be invalid, got: %v", c.name, err)
+		}
+	}
+}
@@ -2,8 +2,8 @@
 psql -d postgres -f data/cleanup.sql
 # ENV: dev
 psql -d postgres -f data/seed.sql # Set a proper db password for production
-psql -d project_legacy -f data/schema.sql
+DB_USER=$USER ENVIRONMENT=dev go run ./cmd/migrate up # Reads .env-dev.yaml, see .env-dev-template.yaml
 # ENV: test
 psql -d postgres -f data/seed_test.sql
-psql -d project_legacy_test -f data/schema.sql
+DB_USER=$USER DB_NAME=project_legacy_test ENVIRONMENT=dev go run ./cmd/migrate up
 psql -d project_legacy_test -f data/schema_test.sql
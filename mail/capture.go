@@ -0,0 +1,42 @@
+package mail
+
+import "sync"
+
+const CapturingMailVendorID = "CAPTURE"
+
+// CapturingMail is a vendor which keeps the emails instead of sending them, e.g. for the scheduler dry runs
+type CapturingMail struct {
+	mu    sync.Mutex
+	mails []MailItem
+}
+
+// NewCapturingSender sends every email to the returned CapturingMail
+func NewCapturingSender() (SendMailConfig, *CapturingMail) {
+	capture := &CapturingMail{}
+	return SendMailConfig{Vendors: []SendMailVendorConfig{{Vendor: capture}}}, capture
+}
+
+func (m *CapturingMail) GetVendorID() string {
+	return CapturingMailVendorID
+}
+
+func (m *CapturingMail) HasAPIKey() bool {
+	return true
+}
+
+func (m *CapturingMail) SendEmails(mails []MailItem) (res []SendEmailsResponse, criticalError error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mail := range mails {
+		m.mails = append(m.mails, mail)
+		res = append(res, NewSendEmailsResponse(mail, m.GetVendorID(), nil))
+	}
+	return res, nil
+}
+
+// Mails returns the captured emails in the order they were sent
+func (m *CapturingMail) Mails() []MailItem {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MailItem{}, m.mails...)
+}
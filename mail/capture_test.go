@@ -0,0 +1,19 @@
+package mail
+
+import "testing"
+
+func TestCapturingSender(t *testing.T) {
+	sender, capture := NewCapturingSender()
+	mails := []MailItem{
+		{To: []MailAddress{{Email: "receiver-1@sejiwo.com"}}, Subject: "First"},
+		{To: []MailAddress{{Email: "receiver-2@sejiwo.com"}}, Subject: "Second"},
+	}
+	res := sender.SendEmails(mails)
+	if len(res) != 2 || res[0].Err != nil || res[1].VendorID != CapturingMailVendorID || res[1].Emails[0] != "receiver-2@sejiwo.com" {
+		t.Fatalf("Every email should be captured successfully: %+v", res)
+	}
+	captured := capture.Mails()
+	if len(captured) != 2 || captured[0].Subject != "First" || captured[1].Subject != "Second" {
+		t.Fatalf("The emails should be captured in order: %+v", captured)
+	}
+}
@@ -0,0 +1,92 @@
+package mail
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+
+	defaultBreakerFailureThreshold = 3
+	defaultBreakerCooldown         = 10 * time.Minute
+)
+
+// CircuitBreaker stops routing emails to a vendor after FailureThreshold critical errors in a row.
+// Once Cooldown has passed the vendor is tried again, one more critical error opens the circuit again.
+type CircuitBreaker struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+	Now              func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func NewCircuitBreaker(failureThreshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{FailureThreshold: failureThreshold, Cooldown: cooldown, state: CircuitClosed}
+}
+
+var vendorBreakers = struct {
+	sync.Mutex
+	breakers map[string]*CircuitBreaker
+}{breakers: map[string]*CircuitBreaker{}}
+
+// VendorCircuitBreaker is the breaker shared by every SendMailConfig of the process for this vendor
+func VendorCircuitBreaker(vendorID string) *CircuitBreaker {
+	vendorBreakers.Lock()
+	defer vendorBreakers.Unlock()
+	b, ok := vendorBreakers.breakers[vendorID]
+	if !ok {
+		b = NewCircuitBreaker(defaultBreakerFailureThreshold, defaultBreakerCooldown)
+		vendorBreakers.breakers[vendorID] = b
+	}
+	return b
+}
+
+func (b *CircuitBreaker) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+// Allow reports whether the vendor can be used, an open circuit becomes half-open after the cooldown
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && b.now().Sub(b.openedAt) >= b.Cooldown {
+		b.state = CircuitHalfOpen
+	}
+	return b.state != CircuitOpen
+}
+
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = CircuitClosed
+	b.failures = 0
+}
+
+func (b *CircuitBreaker) RecordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.FailureThreshold {
+		b.state = CircuitOpen
+		b.openedAt = b.now()
+	}
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == "" {
+		return CircuitClosed
+	}
+	return b.state
+}
@@ -0,0 +1,39 @@
+package mail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker(2, time.Minute)
+	b.Now = func() time.Time { return now }
+	b.RecordFailure()
+	if !b.Allow() {
+		t.Fatalf("The circuit should be closed before reaching the threshold")
+	}
+	b.RecordSuccess()
+	b.RecordFailure()
+	b.RecordFailure()
+	if b.Allow() || b.State() != CircuitOpen {
+		t.Fatalf("The circuit should be open after 2 failures in a row: %s", b.State())
+	}
+	now = now.Add(time.Minute)
+	if !b.Allow() || b.State() != CircuitHalfOpen {
+		t.Fatalf("The circuit should be half-open after the cooldown: %s", b.State())
+	}
+	b.RecordFailure()
+	if b.Allow() {
+		t.Fatalf("A failure of a half-open circuit should open it again")
+	}
+	now = now.Add(time.Minute)
+	b.Allow()
+	b.RecordSuccess()
+	if b.State() != CircuitClosed {
+		t.Fatalf("A success of a half-open circuit should close it: %s", b.State())
+	}
+	if VendorCircuitBreaker("MAILJET") != VendorCircuitBreaker("MAILJET") {
+		t.Fatalf("The breaker of a vendor should be shared")
+	}
+}
@@ -0,0 +1,142 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Signed headers of the messages built by BuildMIMEMessage
+var dkimDefaultHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"}
+
+// DKIMSigner signs the messages with relaxed/relaxed canonicalization, RFC 6376
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	// *rsa.PrivateKey (rsa-sha256) or ed25519.PrivateKey (ed25519-sha256)
+	Key crypto.Signer
+	// dkimDefaultHeaders if empty
+	Headers []string
+	Now     func() time.Time
+}
+
+// ParseDKIMPrivateKey reads a PEM encoded PKCS #1 RSA key or a PKCS #8 RSA or Ed25519 key
+func ParseDKIMPrivateKey(pemKey string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("dkim private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dkim private key: %w", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported dkim private key: %T", key)
+}
+
+// Sign returns the message with a DKIM-Signature header on top
+func (d *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	headerEnd := bytes.Index(message, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, errors.New("dkim: message without a body")
+	}
+	fields := splitHeaderFields(string(message[:headerEnd+2]))
+	bodyHash := sha256.Sum256(dkimRelaxedBody(message[headerEnd+4:]))
+	algorithm, hash := "rsa-sha256", crypto.SHA256
+	if _, ok := d.Key.(ed25519.PrivateKey); ok {
+		algorithm, hash = "ed25519-sha256", crypto.Hash(0)
+	}
+	now := time.Now
+	if d.Now != nil {
+		now = d.Now
+	}
+	headers := d.Headers
+	if len(headers) == 0 {
+		headers = dkimDefaultHeaders
+	}
+	signed := []string{}
+	var data bytes.Buffer
+	for _, name := range headers {
+		for _, field := range fields {
+			if strings.EqualFold(fieldName(field), name) {
+				data.WriteString(dkimRelaxedHeader(field))
+				signed = append(signed, strings.ToLower(name))
+				break
+			}
+		}
+	}
+	signature := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm, d.Domain, d.Selector, now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	data.WriteString(strings.TrimSuffix(dkimRelaxedHeader(signature+"\r\n"), "\r\n"))
+	digest := sha256.Sum256(data.Bytes())
+	b, err := d.Key.Sign(rand.Reader, digest[:], hash)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signature+base64.StdEncoding.EncodeToString(b)+"\r\n"), message...), nil
+}
+
+// splitHeaderFields keeps the folded lines with their field, every field ends with CRLF
+func splitHeaderFields(header string) (fields []string) {
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+var dkimWSPRegexp = regexp.MustCompile(`[ \t]+`)
+
+// dkimRelaxedHeader is the relaxed canonicalization of a header field, RFC 6376 3.4.2
+func dkimRelaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimSpace(dkimWSPRegexp.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// dkimRelaxedBody is the relaxed canonicalization of a body, RFC 6376 3.4.4
+func dkimRelaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for id, line := range lines {
+		lines[id] = strings.TrimRight(dkimWSPRegexp.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
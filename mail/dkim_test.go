@@ -0,0 +1,120 @@
+package mail
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Cannot generate a key: %v", err)
+	}
+	return key
+}
+
+// verifyTestDKIMSignature checks the body hash & the signature of the DKIM-Signature header on top of data
+func verifyTestDKIMSignature(t *testing.T, data []byte, signer *DKIMSigner) {
+	t.Helper()
+	signature, message, _ := strings.Cut(string(data), "\r\n")
+	if !strings.HasPrefix(signature, "DKIM-Signature: ") {
+		t.Fatalf("The message should be signed: %s", signature)
+	}
+	tags := map[string]string{}
+	for _, tag := range strings.Split(strings.TrimPrefix(signature, "DKIM-Signature: "), "; ") {
+		name, value, _ := strings.Cut(tag, "=")
+		tags[name] = value
+	}
+	if tags["d"] != signer.Domain || tags["s"] != signer.Selector ||
+		tags["h"] != "from:to:subject:date:message-id:mime-version:content-type" {
+		t.Fatalf("Unexpected tags: %+v", tags)
+	}
+	header, body, _ := strings.Cut(message, "\r\n\r\n")
+	bodyHash := sha256.Sum256(dkimRelaxedBody([]byte(body)))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Fatalf("Invalid body hash: %s", tags["bh"])
+	}
+	fields := splitHeaderFields(header + "\r\n")
+	signed := ""
+	for _, name := range strings.Split(tags["h"], ":") {
+		for _, field := range fields {
+			if strings.EqualFold(fieldName(field), name) {
+				signed += dkimRelaxedHeader(field)
+				break
+			}
+		}
+	}
+	signed += strings.TrimSuffix(dkimRelaxedHeader(strings.TrimSuffix(signature, tags["b"])+"\r\n"), "\r\n")
+	digest := sha256.Sum256([]byte(signed))
+	b, _ := base64.StdEncoding.DecodeString(tags["b"])
+	switch public := signer.Key.Public().(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], b); err != nil || tags["a"] != "rsa-sha256" {
+			t.Fatalf("Invalid rsa-sha256 signature: %v", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(public, digest[:], b) || tags["a"] != "ed25519-sha256" {
+			t.Fatalf("Invalid ed25519-sha256 signature")
+		}
+	}
+}
+
+// The examples of RFC 6376 3.4.5
+func TestDKIMRelaxedCanonicalization(t *testing.T) {
+	header := ""
+	for _, field := range splitHeaderFields("A: X\r\nB : Y\t\r\n\tZ  \r\n") {
+		header += dkimRelaxedHeader(field)
+	}
+	if header != "a:X\r\nb:Y Z\r\n" {
+		t.Fatalf("Unexpected header: %q", header)
+	}
+	if body := string(dkimRelaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))); body != " C\r\nD E\r\n" {
+		t.Fatalf("Unexpected body: %q", body)
+	}
+	if body := dkimRelaxedBody([]byte("\r\n\r\n")); len(body) != 0 {
+		t.Fatalf("An empty body should be empty: %q", body)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	message, err := BuildMIMEMessage(newTestSMTPMail("first@sejiwo.com", "second@sejiwo.com"), time.Now())
+	if err != nil {
+		t.Fatalf("Cannot build the message: %v", err)
+	}
+	rsaKey := newTestRSAKey(t)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	for _, key := range []crypto.Signer{rsaKey, ed25519Key} {
+		signer := &DKIMSigner{Domain: "sejiwo.com", Selector: "legacy", Key: key}
+		signed, err := signer.Sign(message)
+		if err != nil {
+			t.Fatalf("Cannot sign: %v", err)
+		}
+		verifyTestDKIMSignature(t, signed, signer)
+	}
+}
+
+func TestParseDKIMPrivateKey(t *testing.T) {
+	rsaKey := newTestRSAKey(t)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	for name, block := range map[string]*pem.Block{
+		"pkcs1 rsa":     {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		"pkcs8 ed25519": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		if _, err := ParseDKIMPrivateKey(string(pem.EncodeToMemory(block))); err != nil {
+			t.Fatalf("Cannot parse the %s key: %v", name, err)
+		}
+	}
+	if _, err := ParseDKIMPrivateKey("not a key"); err == nil {
+		t.Fatalf("Expected an error")
+	}
+}
@@ -0,0 +1,162 @@
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FileMailVendorID = "FILE"
+	fileMailIndex    = "index.json"
+)
+
+var ErrFileMailNotFound = errors.New("email not found")
+
+// The index of every directory is rewritten by one SendEmails call at a time
+var fileMailMu sync.Mutex
+
+// FileMailVendor writes every email as an .eml file of Dir instead of sending it, for the development.
+// The emails are listed in Dir/index.json, the oldest first.
+type FileMailVendor struct {
+	Dir string
+	Now func() time.Time
+}
+
+// FileMailEntry is an email of the index.json of a FileMailVendor
+type FileMailEntry struct {
+	ID             string    `json:"id"`
+	File           string    `json:"file"`
+	Date           time.Time `json:"date"`
+	From           string    `json:"from"`
+	To             []string  `json:"to"`
+	Subject        string    `json:"subject"`
+	IdempotencyKey string    `json:"idempotencyKey,omitempty"`
+}
+
+func (m *FileMailVendor) GetVendorID() string {
+	return FileMailVendorID
+}
+
+func (m *FileMailVendor) HasAPIKey() bool {
+	return m.Dir != ""
+}
+
+func (m *FileMailVendor) SendEmails(mails []MailItem) (res []SendEmailsResponse, criticalError error) {
+	if !m.HasAPIKey() {
+		return res, ErrMailNoAPIKey
+	}
+	fileMailMu.Lock()
+	defer fileMailMu.Unlock()
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return res, err
+	}
+	index, err := m.Index()
+	if err != nil {
+		return res, err
+	}
+	now := time.Now
+	if m.Now != nil {
+		now = m.Now
+	}
+	for _, item := range mails {
+		date := now()
+		entry := FileMailEntry{
+			ID:             fmt.Sprintf("%s-%d", date.UTC().Format("20060102T150405"), len(index)+1),
+			Date:           date,
+			From:           item.From.Email,
+			Subject:        item.Subject,
+			IdempotencyKey: item.IdempotencyKey,
+		}
+		entry.File = entry.ID + ".eml"
+		for _, to := range item.To {
+			entry.To = append(entry.To, to.Email)
+		}
+		message, err := BuildMIMEMessage(item, date)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(m.Dir, entry.File), message, 0o644)
+		}
+		if err == nil {
+			index = append(index, entry)
+		}
+		res = append(res, NewSendEmailsResponse(item, m.GetVendorID(), err))
+	}
+	return res, m.writeIndex(index)
+}
+
+// Index returns the written emails, the oldest first
+func (m *FileMailVendor) Index() (index []FileMailEntry, err error) {
+	data, err := os.ReadFile(filepath.Join(m.Dir, fileMailIndex))
+	if errors.Is(err, os.ErrNotExist) {
+		return []FileMailEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return index, json.Unmarshal(data, &index)
+}
+
+// writeIndex replaces the index in one rename, a reader never sees a partial index
+func (m *FileMailVendor) writeIndex(index []FileMailEntry) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(m.Dir, fileMailIndex+".tmp")
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.Dir, fileMailIndex))
+}
+
+// Read returns the email of the index with its .eml file, only the files of the index can be read
+func (m *FileMailVendor) Read(id string) (entry FileMailEntry, message []byte, err error) {
+	index, err := m.Index()
+	if err != nil {
+		return entry, nil, err
+	}
+	for _, e := range index {
+		if e.ID == id {
+			message, err = os.ReadFile(filepath.Join(m.Dir, filepath.Base(e.File)))
+			return e, message, err
+		}
+	}
+	return entry, nil, ErrFileMailNotFound
+}
+
+// MIMEMessageHTML returns the HTML part of a message built by BuildMIMEMessage
+func MIMEMessageHTML(message []byte) (string, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(string(message)))
+	if err != nil {
+		return "", err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		body, err := io.ReadAll(msg.Body)
+		return string(body), err
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return "", errors.New("message without an HTML part")
+		} else if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "text/html") {
+			body, err := io.ReadAll(part)
+			return string(body), err
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileMailVendor(t *testing.T) {
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	m := &FileMailVendor{Dir: filepath.Join(t.TempDir(), "mailbox"), Now: func() time.Time { return now }}
+	mails := []MailItem{newTestSMTPMail("first@sejiwo.com", "second@sejiwo.com"), newTestSMTPMail("third@sejiwo.com")}
+	mails[1].CorrelationID = "mail-1"
+	res, err := m.SendEmails(mails)
+	if err != nil || len(res) != 2 || res[0].Err != nil || res[1].CorrelationID != "mail-1" {
+		t.Fatalf("The emails should be written: %+v %v", res, err)
+	}
+	if res, err = m.SendEmails(generateCorrelatedMails(1)); err != nil || res[0].Err != nil {
+		t.Fatalf("The email should be written: %+v %v", res, err)
+	}
+	index, err := m.Index()
+	if err != nil || len(index) != 3 {
+		t.Fatalf("Expected 3 emails in the index: %+v %v", index, err)
+	}
+	first := index[0]
+	if first.ID != "20261018T090000-1" || index[2].ID != "20261018T090000-3" || fmt.Sprint(first.To) != "[first@sejiwo.com second@sejiwo.com]" ||
+		first.Subject != mails[0].Subject || first.IdempotencyKey != mails[0].IdempotencyKey {
+		t.Fatalf("Unexpected index: %+v", index)
+	}
+	entry, message, err := m.Read(first.ID)
+	if err != nil || entry.File != "20261018T090000-1.eml" {
+		t.Fatalf("Cannot read the email: %+v %v", entry, err)
+	}
+	if html, err := MIMEMessageHTML(message); err != nil || html != mails[0].HtmlContent {
+		t.Fatalf("Unexpected HTML: %q %v", html, err)
+	}
+	if _, _, err = m.Read("../index"); !errors.Is(err, ErrFileMailNotFound) {
+		t.Fatalf("Only the emails of the index can be read: %v", err)
+	}
+	files, _ := os.ReadDir(m.Dir)
+	if len(files) != 4 {
+		t.Fatalf("Expected 3 .eml files & the index: %d", len(files))
+	}
+}
@@ -0,0 +1,122 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	httpVendorTimeout        = 30 * time.Second
+	httpVendorDefaultRetries = 3
+	// A longer wait is not waited for, the emails are left for another vendor or the next run
+	httpVendorMaxRetryAfter = 30 * time.Second
+	// Of the error responses, the success responses are tiny
+	httpVendorMaxResponseSize = 1 << 20
+)
+
+// VendorAPIError is an error response of the API of a mail vendor
+type VendorAPIError struct {
+	VendorID   string
+	StatusCode int
+	// The error type of the vendor, e.g. "MessageRejected", empty if it has none
+	Code    string
+	Message string
+}
+
+func (e *VendorAPIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s API error %d: %s", e.VendorID, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s API error %d %s: %s", e.VendorID, e.StatusCode, e.Code, e.Message)
+}
+
+// sendEachEmail sends the emails in order. Once send returns the error of the vendor, e.g. a broken connection or
+// a suspended account, the next emails get a transient error so another vendor can send them.
+// The error of the vendor is the critical error only when no email is sent & it is not transient.
+func sendEachEmail(vendorID string, mails []MailItem, send func(MailItem) (SendEmailsResponse, error)) (res []SendEmailsResponse, criticalError error) {
+	isSent := false
+	var vendorErr error
+	for _, mail := range mails {
+		if vendorErr == nil {
+			var emailRes SendEmailsResponse
+			if emailRes, vendorErr = send(mail); vendorErr == nil {
+				isSent = true
+				res = append(res, emailRes)
+				continue
+			}
+			log.Printf("%s failed, %d emails are not sent: %+v\n", vendorID, len(mails)-len(res), vendorErr)
+		}
+		unsentErr := vendorErr
+		if !errors.Is(unsentErr, ErrTransient) {
+			unsentErr = fmt.Errorf("%w: %w", ErrTransient, vendorErr)
+		}
+		res = append(res, NewSendEmailsResponse(mail, vendorID, unsentErr))
+	}
+	if !isSent && vendorErr != nil && !errors.Is(vendorErr, ErrTransient) {
+		return nil, vendorErr
+	}
+	return res, nil
+}
+
+// httpVendor makes the API calls of a vendor sending one email per call
+type httpVendor struct {
+	client     *http.Client
+	limiter    *TokenBucket
+	maxRetries int
+}
+
+func newHTTPVendor(client *http.Client, limiter *TokenBucket, maxRetries int) httpVendor {
+	if client == nil {
+		client = &http.Client{Timeout: httpVendorTimeout}
+	}
+	if maxRetries == 0 {
+		maxRetries = httpVendorDefaultRetries
+	}
+	return httpVendor{client: client, limiter: limiter, maxRetries: maxRetries}
+}
+
+// do makes the request built by newRequest, it is built again for every retry of a 429 response,
+// the last 429 response is returned once the retries are over
+func (v httpVendor) do(newRequest func() (*http.Request, error)) (statusCode int, header http.Header, body []byte, err error) {
+	for attempt := 0; ; attempt++ {
+		v.limiter.Wait()
+		req, err := newRequest()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		res, err := v.client.Do(req)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		body, err = io.ReadAll(io.LimitReader(res.Body, httpVendorMaxResponseSize))
+		res.Body.Close()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if res.StatusCode != http.StatusTooManyRequests {
+			return res.StatusCode, res.Header, body, nil
+		}
+		retryAfter := retryAfterOf(res.Header, time.Now())
+		if attempt >= v.maxRetries || retryAfter > httpVendorMaxRetryAfter {
+			return res.StatusCode, res.Header, body, nil
+		}
+		// The other calls wait too
+		v.limiter.Pause(retryAfter)
+	}
+}
+
+// retryAfterOf reads Retry-After, or X-RateLimit-Reset in Unix seconds like SendGrid, one second if there is none
+func retryAfterOf(header http.Header, now time.Time) time.Duration {
+	if value := header.Get("Retry-After"); value != "" {
+		return parseRetryAfter(value, now)
+	}
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		return max(time.Unix(reset, 0).Sub(now), 0)
+	}
+	return time.Second
+}
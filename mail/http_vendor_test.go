@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestLimiter does not sleep, every sleep is added to slept
+func newTestLimiter(slept *time.Duration) *TokenBucket {
+	now := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	limiter := NewTokenBucket(1, 2)
+	limiter.Now = func() time.Time { return now }
+	limiter.Sleep = func(d time.Duration) {
+		*slept += d
+		now = now.Add(d)
+	}
+	return limiter
+}
+
+// fakeVendorAPI serves the requests of a fake vendor API one at a time & counts them.
+// The limiters of its vendors do not sleep, every sleep is added to slept.
+type fakeVendorAPI struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+	slept    time.Duration
+}
+
+func newFakeVendorAPI(t *testing.T, handler http.HandlerFunc) *fakeVendorAPI {
+	f := &fakeVendorAPI{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.requests++
+		handler(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeVendorAPI) newLimiter() *TokenBucket {
+	return newTestLimiter(&f.slept)
+}
+
+func TestRetryAfterOf(t *testing.T) {
+	now := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	for expected, header := range map[time.Duration]http.Header{
+		7 * time.Second:  {"Retry-After": {"7"}},
+		12 * time.Second: {"X-Ratelimit-Reset": {"1792227612"}},
+		0:                {"X-Ratelimit-Reset": {"1792227000"}},
+		time.Second:      {},
+	} {
+		if d := retryAfterOf(header, now); d != expected {
+			t.Fatalf("%v should wait %s, got %s", header, expected, d)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package mail
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"math"
 	"net/mail"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/asendia/legacy-api/simple"
 )
 
 type MailAddress struct {
@@ -18,6 +25,10 @@ type MailItem struct {
 	To          []MailAddress
 	Subject     string
 	HtmlContent string
+	// Forwarded to vendors that accept a custom ID so a retried email can be traced
+	IdempotencyKey string
+	// Set by the caller & returned in the SendEmailsResponse of this email
+	CorrelationID string `json:"-"`
 }
 
 type Mail interface {
@@ -27,21 +38,47 @@ type Mail interface {
 }
 
 type SendEmailsResponse struct {
-	Err      error
-	Emails   []string
-	VendorID string
+	Err    error
+	Emails []string
+	// The recipients rejected while the email is sent to Emails, e.g. the joined *SMTPRecipientError,
+	// it is transient when every rejected recipient can be retried. Err stays nil, the email is not sent again.
+	RejectedErr error
+	VendorID    string
+	// CorrelationID of the MailItem, the responses are not guaranteed to be in the order of the emails
+	CorrelationID string
+}
+
+// Sender sends emails, one response per email, e.g. SendMailConfig
+type Sender interface {
+	SendEmails(mails []MailItem) (res []SendEmailsResponse)
+}
+
+// Throttled is a Mail which sends a limited number of emails per second
+type Throttled interface {
+	EmailsWithin(d time.Duration) int
 }
 
 type SendMailConfig struct {
 	Vendors []SendMailVendorConfig
+	// Optional, the DailyLimit of every vendor applies to each SendEmails call without it
+	Quota QuotaStore
+	// Of the Quota calls, context.Background() if nil
+	Context context.Context
 }
 type SendMailVendorConfig struct {
-	Vendor     Mail
+	Vendor Mail
+	// Emails per day, 0 means no limit
 	DailyLimit int
+	// Optional, the vendor is skipped while its circuit is open
+	Breaker *CircuitBreaker
 }
 
-// Send emails using multiple vendors
-func SendEmails(mails []MailItem) (res []SendEmailsResponse) {
+// LoadSendMailConfigFromEnv returns the vendors configured by their API key envs
+func LoadSendMailConfigFromEnv() SendMailConfig {
+	// The development emails are written to MAIL_FILE_DIR instead of being sent, see /dev/mailbox
+	if dir := os.Getenv("MAIL_FILE_DIR"); dir != "" && os.Getenv("ENVIRONMENT") != "prod" {
+		return SendMailConfig{Vendors: []SendMailVendorConfig{{Vendor: &FileMailVendor{Dir: dir}}}}
+	}
 	vendorMailjet := Mailjet{APIKey: os.Getenv("MAILJET_API_KEY"),
 		SecretKey:   os.Getenv("MAILJET_SECRET_KEY"),
 		SandboxMode: os.Getenv("ENVIRONMENT") != "prod"}
@@ -50,47 +87,267 @@ func SendEmails(mails []MailItem) (res []SendEmailsResponse) {
 			{
 				Vendor:     &vendorMailjet,
 				DailyLimit: 200,
+				Breaker:    VendorCircuitBreaker(vendorMailjet.GetVendorID()),
 			},
 		},
 	}
-	totalDailyLimit := 0
+	appendVendor := func(vendor Mail, dailyLimitEnv string) {
+		// 0 means no limit
+		dailyLimit, _ := strconv.Atoi(os.Getenv(dailyLimitEnv))
+		cfg.Vendors = append(cfg.Vendors, SendMailVendorConfig{
+			Vendor:     vendor,
+			DailyLimit: dailyLimit,
+			Breaker:    VendorCircuitBreaker(vendor.GetVendorID()),
+		})
+	}
+	// The other vendors are used when they are configured, a misconfigured one is left out
+	if vendorSES, err := LoadSESFromEnv(); err != nil {
+		log.Printf("Cannot load the SES vendor: %v\n", err)
+	} else if vendorSES.HasAPIKey() {
+		appendVendor(vendorSES, "SES_DAILY_LIMIT")
+	}
+	if vendorSendGrid := LoadSendGridFromEnv(); vendorSendGrid.HasAPIKey() {
+		appendVendor(vendorSendGrid, "SENDGRID_DAILY_LIMIT")
+	}
+	// The SMTP relay of a self-hosted server
+	if vendorSMTP, err := LoadSMTPFromEnv(); err != nil {
+		log.Printf("Cannot load the SMTP vendor: %v\n", err)
+	} else if vendorSMTP != nil {
+		appendVendor(vendorSMTP, "SMTP_DAILY_LIMIT")
+	}
+	return cfg
+}
+
+// EmailsWithin is how many emails the slowest vendor can send within d, any email might be sent by it.
+// It is -1 when no vendor is throttled.
+func (cfg SendMailConfig) EmailsWithin(d time.Duration) int {
+	count := -1
 	for _, v := range cfg.Vendors {
-		if v.Vendor.HasAPIKey() {
-			totalDailyLimit += v.DailyLimit
+		if throttled, ok := v.Vendor.(Throttled); ok && v.Vendor.HasAPIKey() {
+			if emails := throttled.EmailsWithin(d); count < 0 || emails < count {
+				count = emails
+			}
 		}
 	}
-	currentMailIndex := 0
-	// Distribute emails across vendors based on DailyLimit
+	return count
+}
+
+// Send emails using the vendors configured by the envs
+func SendEmails(mails []MailItem) (res []SendEmailsResponse) {
+	return LoadSendMailConfigFromEnv().SendEmails(mails)
+}
+
+// ErrTransient marks the error of an email which might be sent by another vendor, e.g. a rate limit
+var ErrTransient = errors.New("transient error")
+
+var ErrNoMailVendor = errors.New("no healthy mail vendor")
+
+// mailRouting is the state of one SendEmails call, the emails are referred to by their index
+type mailRouting struct {
+	cfg      SendMailConfig
+	mails    []MailItem
+	capacity []int
+	healthy  []bool
+	// Vendors which have been tried for every email
+	tried []map[int]bool
+	res   []*SendEmailsResponse
+	// Daily quotas reserved from cfg.Quota & the emails sent by every vendor
+	day      time.Time
+	reserved []int
+	sent     []int
+	// The last error of cfg.Quota, the emails which are not sent are retried instead of deferred
+	quotaErr error
+}
+
+// Send emails using multiple vendors. The emails are distributed across the healthy vendors based on their DailyLimit,
+// the emails of a vendor with a critical error & the emails with a transient error are sent again by the next healthy
+// vendor. The emails over the limit of every vendor fail with ErrDailyQuotaExceeded, the quota of a vendor is only
+// reserved for the emails assigned to it. There is one response per email, the responses are not in the order of the emails.
+func (cfg SendMailConfig) SendEmails(mails []MailItem) (res []SendEmailsResponse) {
+	r := mailRouting{
+		cfg:      cfg,
+		mails:    mails,
+		capacity: make([]int, len(cfg.Vendors)),
+		healthy:  make([]bool, len(cfg.Vendors)),
+		tried:    make([]map[int]bool, len(mails)),
+		res:      make([]*SendEmailsResponse, len(mails)),
+		reserved: make([]int, len(cfg.Vendors)),
+		sent:     make([]int, len(cfg.Vendors)),
+	}
 	for id, v := range cfg.Vendors {
-		if !v.Vendor.HasAPIKey() {
-			continue
+		r.capacity[id] = v.DailyLimit
+		if v.DailyLimit <= 0 {
+			r.capacity[id] = len(mails)
+		}
+		r.healthy[id] = v.Vendor.HasAPIKey() && (v.Breaker == nil || v.Breaker.Allow())
+	}
+	r.day = simple.TimeTodayUTC()
+	pending := []int{}
+	for id := range mails {
+		r.tried[id] = map[int]bool{}
+		pending = append(pending, id)
+	}
+	assignment := r.distribute(pending)
+	for len(assignment) > 0 {
+		retry := map[int][]int{}
+		for vendorID, v := range cfg.Vendors {
+			if len(assignment[vendorID]) == 0 {
+				continue
+			}
+			for _, mailID := range r.send(vendorID, v, assignment[vendorID]) {
+				retry[vendorID] = append(retry[vendorID], mailID)
+			}
+		}
+		assignment = r.reroute(retry)
+	}
+	if cfg.Quota != nil {
+		r.releaseQuotas()
+	}
+	// An email is not sent by any vendor when every vendor is down or reached its daily limit
+	errNotSent := ErrNoMailVendor
+	for _, isHealthy := range r.healthy {
+		if isHealthy {
+			errNotSent = ErrDailyQuotaExceeded
+		}
+	}
+	if errNotSent == ErrDailyQuotaExceeded && r.quotaErr != nil {
+		// The daily limits might not be reached
+		errNotSent = fmt.Errorf("%w: cannot reserve the daily quota: %w", ErrTransient, r.quotaErr)
+	}
+	for id, mail := range mails {
+		if r.res[id] == nil {
+			smRes := NewSendEmailsResponse(mail, "", errNotSent)
+			r.res[id] = &smRes
 		}
-		// Break if there is no more email to send
-		if currentMailIndex >= len(mails) {
-			break
+		smRes := *r.res[id]
+		smRes.CorrelationID = mail.CorrelationID
+		res = append(res, smRes)
+	}
+	return res
+}
+
+// distribute splits the emails across the healthy vendors proportionally to their daily limit
+func (r *mailRouting) distribute(pending []int) map[int][]int {
+	assignment := map[int][]int{}
+	total := 0
+	for id := range r.cfg.Vendors {
+		if r.healthy[id] {
+			total += r.capacity[id]
 		}
-		totalMailsForThisVendor := int(math.Floor(float64(v.DailyLimit) / float64(totalDailyLimit) * float64(len(mails))))
-		targetMailIndex := currentMailIndex + totalMailsForThisVendor
-		// If target exceeds the emails length, or it is the last vendor
-		if targetMailIndex > len(mails) || id+1 == len(cfg.Vendors) {
-			targetMailIndex = len(mails)
+	}
+	if total == 0 {
+		return assignment
+	}
+	next := 0
+	for id := range r.cfg.Vendors {
+		if !r.healthy[id] {
+			continue
 		}
-		emailsUsingThisVendor := mails[currentMailIndex:targetMailIndex]
-		r, cErr := v.Vendor.SendEmails(emailsUsingThisVendor)
-		if cErr != nil {
-			for _, email := range emailsUsingThisVendor {
-				emailTos := []string{}
-				for _, mt := range email.To {
-					emailTos = append(emailTos, mt.Email)
+		share := int(math.Floor(float64(r.capacity[id]) / float64(total) * float64(len(pending))))
+		next = r.assign(assignment, id, pending, next, share)
+	}
+	// The remainder of the rounding goes to the first vendors with a remaining daily limit
+	for id := range r.cfg.Vendors {
+		if r.healthy[id] {
+			next = r.assign(assignment, id, pending, next, len(pending)-next)
+		}
+	}
+	return assignment
+}
+
+// assign gives at most count emails from pending[next:] to the vendor, it returns the next unassigned email
+func (r *mailRouting) assign(assignment map[int][]int, vendorID int, pending []int, next int, count int) int {
+	count = r.reserve(vendorID, min(count, len(pending)-next))
+	if count <= 0 {
+		return next
+	}
+	assignment[vendorID] = append(assignment[vendorID], pending[next:next+count]...)
+	return next + count
+}
+
+// reroute gives every email to the next healthy vendor which has not tried it yet
+func (r *mailRouting) reroute(retry map[int][]int) map[int][]int {
+	assignment := map[int][]int{}
+	for failedID := range r.cfg.Vendors {
+		pending := retry[failedID]
+		for i := 1; i < len(r.cfg.Vendors) && len(pending) > 0; i++ {
+			id := (failedID + i) % len(r.cfg.Vendors)
+			if !r.healthy[id] {
+				continue
+			}
+			untried, left := []int{}, []int{}
+			for _, mailID := range pending {
+				if r.tried[mailID][id] {
+					left = append(left, mailID)
+				} else {
+					untried = append(untried, mailID)
 				}
-				res = append(res, SendEmailsResponse{
-					Err:    fmt.Errorf("critical error from vendor id: %d", id),
-					Emails: emailTos,
-				})
 			}
+			count := r.reserve(id, len(untried))
+			assignment[id] = append(assignment[id], untried[:count]...)
+			pending = append(left, untried[count:]...)
 		}
-		res = append(res, r...)
-		currentMailIndex = targetMailIndex
+	}
+	return assignment
+}
+
+// send returns the emails which should be sent again by another vendor
+func (r *mailRouting) send(vendorID int, v SendMailVendorConfig, mailIDs []int) (retry []int) {
+	mails := []MailItem{}
+	for _, mailID := range mailIDs {
+		r.tried[mailID][vendorID] = true
+		// The responses of the vendor are correlated by the index of the email
+		mail := r.mails[mailID]
+		mail.CorrelationID = strconv.Itoa(mailID)
+		mails = append(mails, mail)
+	}
+	vendorRes, cErr := v.Vendor.SendEmails(mails)
+	if cErr != nil {
+		log.Printf("Critical error from vendor: %s, %d emails are rerouted: %v\n", v.Vendor.GetVendorID(), len(mails), cErr)
+		if v.Breaker != nil {
+			v.Breaker.RecordFailure()
+			r.healthy[vendorID] = v.Breaker.Allow()
+		}
+		for _, mailID := range mailIDs {
+			smRes := NewSendEmailsResponse(r.mails[mailID], v.Vendor.GetVendorID(),
+				fmt.Errorf("critical error from vendor id: %d: %w", vendorID, cErr))
+			r.res[mailID] = &smRes
+		}
+		return mailIDs
+	}
+	if v.Breaker != nil {
+		v.Breaker.RecordSuccess()
+	}
+	isResponded := map[int]bool{}
+	for _, smRes := range vendorRes {
+		mailID, err := strconv.Atoi(smRes.CorrelationID)
+		if err != nil || mailID < 0 || mailID >= len(r.mails) || !r.tried[mailID][vendorID] || isResponded[mailID] {
+			continue
+		}
+		isResponded[mailID] = true
+		r.res[mailID] = &smRes
+		if errors.Is(smRes.Err, ErrTransient) {
+			retry = append(retry, mailID)
+		} else if smRes.Err == nil {
+			r.sent[vendorID]++
+		}
+	}
+	for _, mailID := range mailIDs {
+		if !isResponded[mailID] {
+			smRes := NewSendEmailsResponse(r.mails[mailID], v.Vendor.GetVendorID(),
+				fmt.Errorf("%w: no response from vendor", ErrTransient))
+			r.res[mailID] = &smRes
+			retry = append(retry, mailID)
+		}
+	}
+	return retry
+}
+
+// NewSendEmailsResponse is the response of one email, correlated by its CorrelationID
+func NewSendEmailsResponse(email MailItem, vendorID string, err error) SendEmailsResponse {
+	res := SendEmailsResponse{Err: err, VendorID: vendorID, CorrelationID: email.CorrelationID}
+	for _, to := range email.To {
+		res.Emails = append(res.Emails, to.Email)
 	}
 	return res
 }
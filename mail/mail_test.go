@@ -1,9 +1,11 @@
 package mail
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/asendia/legacy-api/simple"
 )
@@ -54,6 +56,128 @@ func TestSendEmailsMultipleEmailsMultipleTos(t *testing.T) {
 	}
 }
 
+// fakeMail responds in the reverse order of the emails, it fails all of them with criticalError
+// or the ones sent to transientTo with a transient error
+type fakeMail struct {
+	vendorID      string
+	criticalError error
+	transientTo   string
+	sent          []MailItem
+}
+
+func (m *fakeMail) GetVendorID() string {
+	return m.vendorID
+}
+
+func (m *fakeMail) HasAPIKey() bool {
+	return true
+}
+
+func (m *fakeMail) SendEmails(mails []MailItem) (res []SendEmailsResponse, criticalError error) {
+	if m.criticalError != nil {
+		return res, m.criticalError
+	}
+	for id := len(mails) - 1; id >= 0; id-- {
+		var err error
+		if mails[id].To[0].Email == m.transientTo {
+			err = fmt.Errorf("%w: rate limited", ErrTransient)
+		} else {
+			m.sent = append(m.sent, mails[id])
+		}
+		res = append(res, NewSendEmailsResponse(mails[id], m.vendorID, err))
+	}
+	return res, nil
+}
+
+func generateCorrelatedMails(count int) (mails []MailItem) {
+	for id := 0; id < count; id++ {
+		mails = append(mails, MailItem{
+			To:            []MailAddress{{Email: fmt.Sprintf("receiver-%d@sejiwo.com", id)}},
+			CorrelationID: fmt.Sprintf("mail-%d", id),
+		})
+	}
+	return mails
+}
+
+// resultsByCorrelationID checks there is one response per email with the receivers of the email
+func resultsByCorrelationID(t *testing.T, mails []MailItem, res []SendEmailsResponse) map[string]SendEmailsResponse {
+	results := map[string]SendEmailsResponse{}
+	for _, r := range res {
+		var id int
+		if _, err := fmt.Sscanf(r.CorrelationID, "mail-%d", &id); err != nil || r.Emails[0] != mails[id].To[0].Email {
+			t.Fatalf("The response is not correlated to its email: %+v", r)
+		}
+		results[r.CorrelationID] = r
+	}
+	if len(res) != len(mails) || len(results) != len(mails) {
+		t.Fatalf("Expected one response per email: %+v", res)
+	}
+	return results
+}
+
+func TestSendEmailsFailover(t *testing.T) {
+	broken := &fakeMail{vendorID: "BROKEN", criticalError: errors.New("unauthorized")}
+	healthy := &fakeMail{vendorID: "HEALTHY"}
+	breaker := NewCircuitBreaker(1, time.Hour)
+	cfg := SendMailConfig{Vendors: []SendMailVendorConfig{
+		{Vendor: broken, DailyLimit: 2, Breaker: breaker},
+		{Vendor: healthy, DailyLimit: 4},
+	}}
+	mails := generateCorrelatedMails(4)
+	for key, r := range resultsByCorrelationID(t, mails, cfg.SendEmails(mails)) {
+		if r.Err != nil || r.VendorID != "HEALTHY" {
+			t.Fatalf("%s should be rerouted to the healthy vendor: %+v", key, r)
+		}
+	}
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("The circuit of the broken vendor should be open: %s", breaker.State())
+	}
+	// The open circuit is skipped, so the emails over the daily limit of the healthy vendor are not sent
+	mails = generateCorrelatedMails(6)
+	results := resultsByCorrelationID(t, mails, cfg.SendEmails(mails))
+	failed := 0
+	for _, r := range results {
+		if errors.Is(r.Err, ErrDailyQuotaExceeded) {
+			failed++
+		} else if r.Err != nil || r.VendorID != "HEALTHY" {
+			t.Fatalf("Unexpected result: %+v", r)
+		}
+	}
+	if failed != 2 || len(healthy.sent) != 8 {
+		t.Fatalf("Expected 2 emails over the daily limit & 8 sent emails, got %d & %d", failed, len(healthy.sent))
+	}
+}
+
+func TestSendEmailsTransientError(t *testing.T) {
+	first := &fakeMail{vendorID: "FIRST", transientTo: "receiver-0@sejiwo.com"}
+	second := &fakeMail{vendorID: "SECOND", transientTo: "receiver-0@sejiwo.com"}
+	cfg := SendMailConfig{Vendors: []SendMailVendorConfig{
+		{Vendor: first, DailyLimit: 10},
+		{Vendor: second},
+	}}
+	mails := generateCorrelatedMails(2)
+	results := resultsByCorrelationID(t, mails, cfg.SendEmails(mails))
+	// Every vendor is tried once, the error of the last one is returned
+	if r := results["mail-0"]; !errors.Is(r.Err, ErrTransient) || r.VendorID != "FIRST" && r.VendorID != "SECOND" {
+		t.Fatalf("mail-0 should fail on every vendor: %+v", r)
+	}
+	if r := results["mail-1"]; r.Err != nil {
+		t.Fatalf("mail-1 should be sent: %+v", r)
+	}
+	if len(first.sent)+len(second.sent) != 1 {
+		t.Fatalf("Only mail-1 should be sent: %+v %+v", first.sent, second.sent)
+	}
+	first.transientTo = ""
+	second.transientTo = "receiver-1@sejiwo.com"
+	cfg.Vendors[0].DailyLimit = 1
+	results = resultsByCorrelationID(t, mails, cfg.SendEmails(mails))
+	for key, r := range results {
+		if r.Err != nil || r.VendorID != "FIRST" && key == "mail-1" {
+			t.Fatalf("%s should be sent, mail-1 by the first vendor: %+v", key, r)
+		}
+	}
+}
+
 func TestParseAddress(t *testing.T) {
 	email := "isvalid@email.com"
 	a, err := ParseAddress(email)
@@ -161,3 +285,33 @@ func generateSingleEmailMultipleTos(toList []string, vendorID string) ([]MailIte
 	})
 	return mails, nil
 }
+
+func TestLoadSendMailConfigFromEnv(t *testing.T) {
+	t.Setenv("MAIL_FILE_DIR", "")
+	t.Setenv("SES_ACCESS_KEY_ID", "key")
+	t.Setenv("SES_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("SES_DAILY_LIMIT", "50000")
+	t.Setenv("SENDGRID_API_KEY", "")
+	t.Setenv("SMTP_HOST", "localhost")
+	t.Setenv("SMTP_DAILY_LIMIT", "")
+	t.Setenv("DKIM_PRIVATE_KEY", "")
+	vendors := []string{}
+	for _, v := range LoadSendMailConfigFromEnv().Vendors {
+		vendors = append(vendors, fmt.Sprintf("%s:%d", v.Vendor.GetVendorID(), v.DailyLimit))
+	}
+	if fmt.Sprint(vendors) != "[MAILJET:200 SES:50000 SMTP:0]" {
+		t.Fatalf("Unexpected vendors: %v", vendors)
+	}
+	t.Setenv("SES_MAX_SEND_RATE", "fast")
+	if vendors := LoadSendMailConfigFromEnv().Vendors; len(vendors) != 2 {
+		t.Fatalf("A misconfigured vendor should be left out: %d", len(vendors))
+	}
+	t.Setenv("MAIL_FILE_DIR", t.TempDir())
+	if vendors := LoadSendMailConfigFromEnv().Vendors; len(vendors) != 1 || vendors[0].Vendor.GetVendorID() != FileMailVendorID {
+		t.Fatalf("Only the file vendor should be used: %+v", vendors)
+	}
+	t.Setenv("ENVIRONMENT", "prod")
+	if vendors := LoadSendMailConfigFromEnv().Vendors; vendors[0].Vendor.GetVendorID() != "MAILJET" {
+		t.Fatalf("The file vendor should not be used in prod: %+v", vendors)
+	}
+}
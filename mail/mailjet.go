@@ -2,15 +2,40 @@ package mail
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/asendia/legacy-api/simple"
 	"github.com/mailjet/mailjet-apiv3-go/v4"
 )
 
+const (
+	// The Send API v3.1 rejects a call with more messages
+	mailjetMaxMessagesPerCall = 50
+	mailjetDefaultRetries     = 3
+	// A longer Retry-After is not waited for, the emails are left for another vendor or the next run
+	mailjetMaxRetryAfter = 30 * time.Second
+	mailjetTimeout       = 30 * time.Second
+)
+
+// Shared by every Mailjet vendor without a Limiter
+var mailjetLimiter = NewTokenBucket(3, 3)
+
 type Mailjet struct {
 	APIKey      string
 	SecretKey   string
 	SandboxMode bool
+	// Optional, e.g. an httptest server, https://api.mailjet.com/v3 if empty
+	BaseURL    string
+	HTTPClient *http.Client
+	// Throttles the Send API calls, mailjetLimiter if nil
+	Limiter *TokenBucket
+	// Retries of a call rejected with 429, mailjetDefaultRetries if 0
+	MaxRetries int
 }
 
 func (m *Mailjet) GetVendorID() string {
@@ -21,41 +46,158 @@ func (m *Mailjet) HasAPIKey() bool {
 	return m.APIKey != "" && m.SecretKey != ""
 }
 
+func (m *Mailjet) limiter() *TokenBucket {
+	if m.Limiter != nil {
+		return m.Limiter
+	}
+	return mailjetLimiter
+}
+
+// EmailsWithin is how many emails the limiter allows within d
+func (m *Mailjet) EmailsWithin(d time.Duration) int {
+	return m.limiter().CallsWithin(d) * mailjetMaxMessagesPerCall
+}
+
+// SendEmails sends the emails in calls of at most 50 messages, the responses are in the order of the emails.
+// Once a call fails, the emails of the next calls are not sent & get a transient error so another vendor can send them.
+// The critical error is returned only when no email is sent.
 func (m *Mailjet) SendEmails(mails []MailItem) (res []SendEmailsResponse, criticalError error) {
 	if !m.HasAPIKey() {
 		return res, ErrMailNoAPIKey
 	}
-	client := mailjet.NewMailjetClient(m.APIKey, m.SecretKey)
+	httpClient := m.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: mailjetTimeout}
+	}
+	transport := &mailjetTransport{base: httpClient.Transport}
+	var client *mailjet.Client
+	if m.BaseURL != "" {
+		client = mailjet.NewMailjetClient(m.APIKey, m.SecretKey, m.BaseURL)
+	} else {
+		client = mailjet.NewMailjetClient(m.APIKey, m.SecretKey)
+	}
+	client.SetClient(&http.Client{Transport: transport, Timeout: httpClient.Timeout})
+	isSent := false
+	var callErr error
+	for start := 0; start < len(mails); start += mailjetMaxMessagesPerCall {
+		chunk := mails[start:min(start+mailjetMaxMessagesPerCall, len(mails))]
+		if callErr == nil {
+			var chunkRes []SendEmailsResponse
+			if chunkRes, callErr = m.sendChunk(client, transport, chunk); callErr == nil {
+				isSent = true
+				res = append(res, chunkRes...)
+				continue
+			}
+			log.Printf("Mailjet call failed, %d emails are not sent: %+v\n", len(mails)-start, callErr)
+		}
+		unsentErr := callErr
+		if !errors.Is(unsentErr, ErrTransient) {
+			unsentErr = fmt.Errorf("%w: %w", ErrTransient, callErr)
+		}
+		for _, mail := range chunk {
+			res = append(res, NewSendEmailsResponse(mail, m.GetVendorID(), unsentErr))
+		}
+	}
+	if !isSent && callErr != nil && !errors.Is(callErr, ErrTransient) {
+		return nil, callErr
+	}
+	return res, nil
+}
+
+// sendChunk makes one Send API call, it is retried while it is rate limited
+func (m *Mailjet) sendChunk(client *mailjet.Client, transport *mailjetTransport, mails []MailItem) (res []SendEmailsResponse, err error) {
 	messages := mailjet.MessagesV31{Info: convertMailItemsToMailjet(mails),
 		SandBoxMode: m.SandboxMode}
-	_, criticalError = client.SendMailV31(&messages)
+	maxRetries := m.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = mailjetDefaultRetries
+	}
+	for attempt := 0; ; attempt++ {
+		m.limiter().Wait()
+		transport.reset()
+		_, err = client.SendMailV31(&messages)
+		statusCode, retryAfter := transport.result()
+		if statusCode != http.StatusTooManyRequests {
+			break
+		}
+		if attempt >= maxRetries || retryAfter > mailjetMaxRetryAfter {
+			return nil, fmt.Errorf("%w: mailjet rate limit, retry after %s", ErrTransient, retryAfter)
+		}
+		// The other calls wait too
+		m.limiter().Pause(retryAfter)
+	}
 	errFeedbackList := &mailjet.APIFeedbackErrorsV31{}
-	isErrFeedbacklist := errors.As(criticalError, &errFeedbackList)
-	if isErrFeedbacklist {
-		// Do nothing
-	} else if criticalError != nil {
-		log.Printf("Critical, cannot send emails: %+v\n", criticalError)
-		return res, criticalError
+	isErrFeedbacklist := errors.As(err, &errFeedbackList)
+	if err != nil && !isErrFeedbacklist {
+		return nil, err
 	}
 	for id, mail := range mails {
-		emailRes := SendEmailsResponse{VendorID: m.GetVendorID()}
-		if mail.To != nil {
-			for _, m := range mail.To {
-				emailRes.Emails = append(emailRes.Emails, m.Email)
-			}
-		}
+		emailRes := NewSendEmailsResponse(mail, m.GetVendorID(), nil)
 		isError := isErrFeedbacklist &&
 			len(errFeedbackList.Messages) > id &&
 			len(errFeedbackList.Messages[id].Errors) > 0
 		if isError {
-			// TODO: how to handle this error properly
-			emailRes.Err = errors.New(errFeedbackList.Messages[id].Errors[0].ErrorMessage)
+			apiErr := errFeedbackList.Messages[id].Errors[0]
+			emailRes.Err = errors.New(apiErr.ErrorMessage)
+			// Another vendor might send it
+			if apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= http.StatusInternalServerError {
+				emailRes.Err = fmt.Errorf("%w: %s", ErrTransient, apiErr.ErrorMessage)
+			}
 		}
 		res = append(res, emailRes)
 	}
 	return res, nil
 }
 
+// mailjetTransport keeps the status & the Retry-After of the last call, the client of mailjet-apiv3-go hides them
+type mailjetTransport struct {
+	base http.RoundTripper
+
+	mu         sync.Mutex
+	statusCode int
+	retryAfter string
+}
+
+func (t *mailjetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if err == nil {
+		t.mu.Lock()
+		t.statusCode = res.StatusCode
+		t.retryAfter = res.Header.Get("Retry-After")
+		t.mu.Unlock()
+	}
+	return res, err
+}
+
+func (t *mailjetTransport) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.statusCode = 0
+	t.retryAfter = ""
+}
+
+// result returns the status of the last call & its Retry-After, one second if it has none
+func (t *mailjetTransport) result() (statusCode int, retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.statusCode, parseRetryAfter(t.retryAfter, time.Now())
+}
+
+// parseRetryAfter reads the seconds or the HTTP date of a Retry-After header
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return time.Second
+}
+
 func convertMailItemsToMailjet(mails []MailItem) (mailjetMails []mailjet.InfoMessagesV31) {
 	for _, m := range mails {
 		mailjetTo := mailjet.RecipientsV31{}
@@ -73,7 +215,7 @@ func convertMailItemsToMailjet(mails []MailItem) (mailjetMails []mailjet.InfoMes
 			To:       &mailjetTo,
 			Subject:  m.Subject,
 			HTMLPart: m.HtmlContent,
-			CustomID: "legacy-reminder",
+			CustomID: simple.DefaultString(m.IdempotencyKey, "legacy-reminder"),
 		})
 	}
 	return
@@ -1,13 +1,95 @@
 package mail
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/asendia/legacy-api/simple"
+	"github.com/mailjet/mailjet-apiv3-go/v4"
 )
 
+// fakeMailjet emulates the Send API v3.1, a message to an invalid address gets an error like the real API.
+// The first rateLimited calls are rejected with 429 & the Retry-After of retryAfter.
+type fakeMailjet struct {
+	*fakeVendorAPI
+	calls       [][]mailjet.InfoMessagesV31
+	rateLimited int
+	retryAfter  string
+}
+
+func newFakeMailjet(t *testing.T) *fakeMailjet {
+	f := &fakeMailjet{}
+	f.fakeVendorAPI = newFakeVendorAPI(t, f.serveHTTP)
+	return f
+}
+
+func (f *fakeMailjet) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if key, secret, ok := r.BasicAuth(); r.Method != http.MethodPost || r.URL.Path != "/v3.1/send" || !ok || key != "key" || secret != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(mailjet.ErrorInfoV31{Message: "API key authentication/authorization failure", StatusCode: 401})
+		return
+	}
+	if f.rateLimited > 0 {
+		f.rateLimited--
+		w.Header().Set("Retry-After", f.retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(mailjet.ErrorInfoV31{Message: "Too many requests", StatusCode: 429})
+		return
+	}
+	var body mailjet.MessagesV31
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Info) > mailjetMaxMessagesPerCall {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(mailjet.ErrorInfoV31{Message: "Invalid request", StatusCode: 400})
+		return
+	}
+	f.calls = append(f.calls, body.Info)
+	feedback := mailjet.APIFeedbackErrorsV31{}
+	isError := false
+	for _, msg := range body.Info {
+		msgFeedback := mailjet.APIFeedbackErrorV31{Errors: []mailjet.APIErrorDetailsV31{}}
+		for id, to := range *msg.To {
+			if _, err := ParseAddress(to.Email); err != nil {
+				isError = true
+				msgFeedback.Errors = append(msgFeedback.Errors, mailjet.APIErrorDetailsV31{
+					ErrorCode:      "mj-0013",
+					ErrorMessage:   fmt.Sprintf("%q is an invalid email address.", to.Email),
+					ErrorRelatedTo: []string{fmt.Sprintf("To[%d].Email", id)},
+					StatusCode:     400,
+				})
+			}
+		}
+		feedback.Messages = append(feedback.Messages, msgFeedback)
+	}
+	if isError {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(feedback)
+		return
+	}
+	results := mailjet.ResultsV31{}
+	for _, msg := range body.Info {
+		results.ResultsV31 = append(results.ResultsV31, mailjet.ResultV31{Status: "success", CustomID: msg.CustomID})
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+func (f *fakeMailjet) callSizes() (sizes []int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, call := range f.calls {
+		sizes = append(sizes, len(call))
+	}
+	return sizes
+}
+
+func newTestMailjet(f *fakeMailjet) *Mailjet {
+	return &Mailjet{APIKey: "key", SecretKey: "secret", BaseURL: f.URL + "/v3", Limiter: f.newLimiter()}
+}
+
 func TestMailjetSingleEmailSingleTo(t *testing.T) {
 	param := ReminderEmailParams{
 		Title:              "Reminder to extend the delivery schedule of sejiwo.com testament",
@@ -91,3 +173,152 @@ func TestMailjetSingleEmailMultipleTos(t *testing.T) {
 		t.Fatal("Email should be invalid")
 	}
 }
+
+// The next tests run against a fake Send API
+
+func TestMailjetSendEmails(t *testing.T) {
+	param := ReminderEmailParams{
+		Title:              "Reminder to extend the delivery schedule of sejiwo.com testament",
+		FullName:           "Sejiwo Team",
+		InactiveAt:         simple.TimeTodayUTC().Add(simple.DaysToDuration(90)).Local().Format("2006-01-02"),
+		TestamentReceivers: []string{"test@sejiwo.com", "noreply@sejiwo.com"},
+		ExtensionURL:       "https://sejiwo.com/extend?id=some-id&secret=some-secret"}
+	htmlContent, err := GenerateReminderEmail(param)
+	if err != nil {
+		t.Fatalf("Cannot generate email from template: %v", err)
+	}
+	mails := []MailItem{
+		{
+			From: MailAddress{
+				Email: "noreply@sejiwo.com",
+				Name:  "Sejiwo Team",
+			},
+			To: []MailAddress{
+				{
+					Email: "test@sejiwo.com",
+					Name:  "Sejiwo User",
+				},
+			},
+			Subject:        param.Title,
+			HtmlContent:    htmlContent,
+			IdempotencyKey: "reminder:some-id:2026-10-17",
+		},
+	}
+	f := newFakeMailjet(t)
+	res, err := newTestMailjet(f).SendEmails(mails)
+	if err != nil {
+		t.Fatalf("Cannot send emails: %+v\n", err)
+	}
+	if len(res) != 1 || res[0].Err != nil || res[0].Emails[0] != "test@sejiwo.com" {
+		t.Fatalf("The email should be sent: %+v", res)
+	}
+	if call := f.calls[0][0]; call.CustomID != "reminder:some-id:2026-10-17" || call.Subject != param.Title || call.HTMLPart != htmlContent {
+		t.Fatalf("Unexpected message: %+v", call)
+	}
+}
+
+func TestMailjetInvalidEmails(t *testing.T) {
+	f := newFakeMailjet(t)
+	m := newTestMailjet(f)
+	toList := []string{"asendia@sejiwo.com", "should@beinvalid", "test@sejiwo.com"}
+	mails, err := generateMultipleEmailsMultipleTos(toList, m.GetVendorID())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	res, err := m.SendEmails(mails)
+	if err != nil {
+		t.Fatalf("Mailjet error %+v\n", err)
+	}
+	if res[0].Err != nil || res[1].Err == nil || res[2].Err != nil || errors.Is(res[1].Err, ErrTransient) {
+		t.Fatalf("Only the second email should be invalid: %+v", res)
+	}
+}
+
+func TestMailjetInvalidTo(t *testing.T) {
+	f := newFakeMailjet(t)
+	m := newTestMailjet(f)
+	toList := []string{"asendia@sejiwo.com", "invalid@emailformat", "test@sejiwo.com"}
+	mails, err := generateSingleEmailMultipleTos(toList, m.GetVendorID())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	res, err := m.SendEmails(mails)
+	if err != nil {
+		t.Fatalf("Mailjet error %+v\n", err)
+	}
+	if res[0].Err == nil {
+		t.Fatal("Email should be invalid")
+	}
+}
+
+func TestMailjetChunks(t *testing.T) {
+	f := newFakeMailjet(t)
+	mails := generateCorrelatedMails(120)
+	mails[70].To[0].Email = "should@beinvalid"
+	res, err := newTestMailjet(f).SendEmails(mails)
+	if err != nil {
+		t.Fatalf("Mailjet error %+v\n", err)
+	}
+	if sizes := f.callSizes(); fmt.Sprint(sizes) != "[50 50 20]" {
+		t.Fatalf("Expected calls of 50, 50 & 20 messages: %v", sizes)
+	}
+	// The burst of 2 calls then 1 call per second
+	if f.slept != time.Second {
+		t.Fatalf("The third call should wait for a second: %s", f.slept)
+	}
+	for id, r := range res {
+		if r.CorrelationID != mails[id].CorrelationID || (r.Err != nil) != (id == 70) {
+			t.Fatalf("Unexpected response %d: %+v", id, r)
+		}
+	}
+}
+
+func TestMailjetRetryAfter(t *testing.T) {
+	f := newFakeMailjet(t)
+	f.rateLimited, f.retryAfter = 2, "5"
+	mails := generateCorrelatedMails(3)
+	res, err := newTestMailjet(f).SendEmails(mails)
+	if err != nil || len(res) != 3 || res[0].Err != nil {
+		t.Fatalf("The emails should be sent after the rate limit: %+v %v", res, err)
+	}
+	if f.slept != 10*time.Second || len(f.calls) != 1 {
+		t.Fatalf("Expected 2 waits of 5 seconds & 1 successful call: %s %d", f.slept, len(f.calls))
+	}
+	// The emails are left for another vendor when the rate limit is too long
+	f.rateLimited, f.retryAfter = 1, "3600"
+	res, err = newTestMailjet(f).SendEmails(mails)
+	if err != nil || len(res) != 3 || !errors.Is(res[2].Err, ErrTransient) || res[2].CorrelationID != "mail-2" {
+		t.Fatalf("The emails should get a transient error: %+v %v", res, err)
+	}
+}
+
+func TestMailjetCriticalError(t *testing.T) {
+	f := newFakeMailjet(t)
+	m := newTestMailjet(f)
+	m.SecretKey = "wrong"
+	if res, err := m.SendEmails(generateCorrelatedMails(60)); err == nil || len(res) != 0 {
+		t.Fatalf("No email is sent, the error should be critical: %+v", res)
+	}
+	if f.requests != 1 {
+		t.Fatalf("The second call should not be made: %d", f.requests)
+	}
+	m.SecretKey = "secret"
+	if _, err := (&Mailjet{}).SendEmails(generateCorrelatedMails(1)); !errors.Is(err, ErrMailNoAPIKey) {
+		t.Fatalf("Expected ErrMailNoAPIKey: %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"7":                             7 * time.Second,
+		"Sat, 17 Oct 2026 09:00:30 GMT": 30 * time.Second,
+		"Sat, 17 Oct 2026 08:00:00 GMT": 0,
+		"":                              time.Second,
+		"soon":                          time.Second,
+	} {
+		if d := parseRetryAfter(value, now); d != expected {
+			t.Fatalf("Retry-After %q should be %s, got %s", value, expected, d)
+		}
+	}
+}
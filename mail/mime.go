@@ -0,0 +1,102 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// BuildMIMEMessage renders the email as an RFC 5322 message, multipart/alternative with a text & an HTML part
+func BuildMIMEMessage(m MailItem, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	to := []string{}
+	for _, addr := range m.To {
+		to = append(to, (&mail.Address{Name: addr.Name, Address: addr.Email}).String())
+	}
+	body := multipart.NewWriter(&buf)
+	headers := [][2]string{
+		{"From", (&mail.Address{Name: m.From.Name, Address: m.From.Email}).String()},
+		{"To", strings.Join(to, ",\r\n ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", messageID(m)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=\"" + body.Boundary() + "\""},
+	}
+	var header bytes.Buffer
+	for _, h := range headers {
+		fmt.Fprintf(&header, "%s: %s\r\n", h[0], h[1])
+	}
+	header.WriteString("\r\n")
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", HTMLToText(m.HtmlContent)},
+		{"text/html; charset=utf-8", m.HtmlContent},
+	} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err = qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err = qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return append(header.Bytes(), buf.Bytes()...), nil
+}
+
+// messageID is derived from the idempotency key, so a retried email has the same Message-ID
+func messageID(m MailItem) string {
+	seed := []byte(m.IdempotencyKey)
+	if m.IdempotencyKey == "" {
+		seed = make([]byte, 16)
+		rand.Read(seed)
+	}
+	sum := sha256.Sum256(seed)
+	domain := "localhost"
+	if at := strings.LastIndex(m.From.Email, "@"); at >= 0 {
+		domain = m.From.Email[at+1:]
+	}
+	return "<" + hex.EncodeToString(sum[:16]) + "@" + domain + ">"
+}
+
+var (
+	htmlInvisibleRegexp  = regexp.MustCompile(`(?is)<(head|style|script)\b.*?</(head|style|script)>`)
+	htmlLinkRegexp       = regexp.MustCompile(`(?is)<a\b[^>]*?href="([^"]*)"[^>]*>(.*?)</a>`)
+	htmlLineBreakRegexp  = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|tr|h[1-6]|li|table)>`)
+	htmlTagRegexp        = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacesRegexp         = regexp.MustCompile(`[ \t\r]+`)
+	blankLinesRegexp     = regexp.MustCompile(`\n\s*\n\s*(\n\s*)+`)
+	lineEdgeSpacesRegexp = regexp.MustCompile(`(?m)^ +| +$`)
+)
+
+// HTMLToText is the text alternative of an HTML email, the links are kept as "text (url)"
+func HTMLToText(htmlContent string) string {
+	text := htmlInvisibleRegexp.ReplaceAllString(htmlContent, "")
+	text = htmlLinkRegexp.ReplaceAllString(text, "$2 ($1)")
+	text = htmlLineBreakRegexp.ReplaceAllString(text, "\n")
+	text = htmlTagRegexp.ReplaceAllString(text, "")
+	text = spacesRegexp.ReplaceAllString(html.UnescapeString(text), " ")
+	text = lineEdgeSpacesRegexp.ReplaceAllString(text, "")
+	text = blankLinesRegexp.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
@@ -0,0 +1,71 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/asendia/legacy-api/simple"
+)
+
+// ErrDailyQuotaExceeded is the error of an email which can not be sent today, it should be sent again the next UTC day
+var ErrDailyQuotaExceeded = errors.New("every healthy mail vendor reached its daily limit")
+
+// QuotaStore counts the emails of every vendor per UTC day, shared by every instance
+type QuotaStore interface {
+	// ReserveQuota reserves at most count emails under the daily limit of the vendor & returns the reserved count
+	ReserveQuota(ctx context.Context, vendorID string, day time.Time, count int, dailyLimit int) (int, error)
+	// ReleaseQuota gives back the reserved emails which were not sent
+	ReleaseQuota(ctx context.Context, vendorID string, day time.Time, count int) error
+}
+
+// NextQuotaDay is when the emails deferred by ErrDailyQuotaExceeded can be sent
+func NextQuotaDay() time.Time {
+	return simple.TimeTodayUTC().Add(simple.DaysToDuration(1))
+}
+
+func (cfg SendMailConfig) quotaContext() context.Context {
+	if cfg.Context != nil {
+		return cfg.Context
+	}
+	return context.Background()
+}
+
+// reserve takes count emails from the capacity of the vendor & reserves them under its daily limit once they are
+// assigned to it, it returns the count the vendor can send. A vendor which reached its daily limit gets no more emails,
+// neither does one whose quota can not be reserved, its emails are not sent & retried later.
+func (r *mailRouting) reserve(vendorID int, count int) int {
+	count = min(count, r.capacity[vendorID])
+	v := r.cfg.Vendors[vendorID]
+	if r.cfg.Quota == nil || v.DailyLimit <= 0 || count <= 0 {
+		r.capacity[vendorID] -= max(count, 0)
+		return max(count, 0)
+	}
+	reserved, err := r.cfg.Quota.ReserveQuota(r.cfg.quotaContext(), v.Vendor.GetVendorID(), r.day, count, v.DailyLimit)
+	if err != nil {
+		log.Printf("Cannot reserve the daily quota of vendor: %s: %v\n", v.Vendor.GetVendorID(), err)
+		r.quotaErr = err
+		reserved = 0
+	}
+	r.reserved[vendorID] += reserved
+	r.capacity[vendorID] -= reserved
+	if reserved < count {
+		r.capacity[vendorID] = 0
+	}
+	return reserved
+}
+
+// releaseQuotas gives back the reserved emails which were not sent, the failed ones included
+func (r *mailRouting) releaseQuotas() {
+	for id, v := range r.cfg.Vendors {
+		unsent := r.reserved[id] - r.sent[id]
+		if unsent <= 0 {
+			continue
+		}
+		// Released even when the run is canceled, the sent emails were counted
+		if err := r.cfg.Quota.ReleaseQuota(context.WithoutCancel(r.cfg.quotaContext()), v.Vendor.GetVendorID(), r.day, unsent); err != nil {
+			log.Printf("Cannot release the daily quota of vendor: %s: %v\n", v.Vendor.GetVendorID(), err)
+		}
+	}
+}
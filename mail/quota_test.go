@@ -0,0 +1,95 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asendia/legacy-api/simple"
+)
+
+// memoryQuotaStore is a QuotaStore of one instance
+type memoryQuotaStore struct {
+	sent map[string]int
+	// The count of every reservation & the error of the store
+	requested int
+	err       error
+}
+
+func (s *memoryQuotaStore) key(vendorID string, day time.Time) string {
+	return vendorID + ":" + day.Format("2006-01-02")
+}
+
+func (s *memoryQuotaStore) ReserveQuota(ctx context.Context, vendorID string, day time.Time, count int, dailyLimit int) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.requested += count
+	reserved := min(count, max(dailyLimit-s.sent[s.key(vendorID, day)], 0))
+	s.sent[s.key(vendorID, day)] += reserved
+	return reserved, nil
+}
+
+func (s *memoryQuotaStore) ReleaseQuota(ctx context.Context, vendorID string, day time.Time, count int) error {
+	s.sent[s.key(vendorID, day)] -= count
+	return nil
+}
+
+func TestSendEmailsDailyQuota(t *testing.T) {
+	store := &memoryQuotaStore{sent: map[string]int{}}
+	first := &fakeMail{vendorID: "FIRST", transientTo: "receiver-0@sejiwo.com"}
+	second := &fakeMail{vendorID: "SECOND", transientTo: "receiver-0@sejiwo.com"}
+	cfg := SendMailConfig{Quota: store, Vendors: []SendMailVendorConfig{
+		{Vendor: first, DailyLimit: 3},
+		{Vendor: second, DailyLimit: 2},
+	}}
+	// mail-0 fails on both vendors, so its reservations are released
+	mails := generateCorrelatedMails(3)
+	resultsByCorrelationID(t, mails, cfg.SendEmails(mails))
+	today := store.key("FIRST", simple.TimeTodayUTC())
+	if sent := store.sent[today] + store.sent[store.key("SECOND", simple.TimeTodayUTC())]; sent != 2 {
+		t.Fatalf("Only the 2 sent emails should count, got %d", sent)
+	}
+	// The 3 emails left today are sent, across runs & vendors, the others are deferred
+	mails = generateCorrelatedMails(6)[1:]
+	deferred := 0
+	for _, r := range cfg.SendEmails(mails) {
+		if errors.Is(r.Err, ErrDailyQuotaExceeded) {
+			deferred++
+		} else if r.Err != nil {
+			t.Fatalf("Unexpected result: %+v", r)
+		}
+	}
+	if deferred != 2 || len(first.sent) != 3 || len(second.sent) != 2 {
+		t.Fatalf("Expected 2 deferred emails, 3 & 2 sent by the vendors: %d %d %d", deferred, len(first.sent), len(second.sent))
+	}
+	if store.sent[today] != 3 {
+		t.Fatalf("The first vendor should reach its daily limit: %d", store.sent[today])
+	}
+}
+
+func TestSendEmailsReservesAssignedQuota(t *testing.T) {
+	store := &memoryQuotaStore{sent: map[string]int{}}
+	first := &fakeMail{vendorID: "FIRST"}
+	second := &fakeMail{vendorID: "SECOND"}
+	cfg := SendMailConfig{Quota: store, Vendors: []SendMailVendorConfig{
+		{Vendor: first, DailyLimit: 100},
+		{Vendor: second, DailyLimit: 100},
+	}}
+	mails := generateCorrelatedMails(4)
+	resultsByCorrelationID(t, mails, cfg.SendEmails(mails))
+	if store.requested != len(mails) || len(first.sent)+len(second.sent) != len(mails) {
+		t.Fatalf("Only the assigned emails should be reserved: %d %d %d", store.requested, len(first.sent), len(second.sent))
+	}
+	// The emails are retried when the quota can not be reserved, they are not deferred to the next day
+	store.err = errors.New("connection refused")
+	for _, r := range cfg.SendEmails(generateCorrelatedMails(2)) {
+		if !errors.Is(r.Err, ErrTransient) || errors.Is(r.Err, ErrDailyQuotaExceeded) {
+			t.Fatalf("Expected a transient error: %+v", r)
+		}
+	}
+	if len(first.sent)+len(second.sent) != len(mails) {
+		t.Fatalf("No email should be sent without a reserved quota: %d %d", len(first.sent), len(second.sent))
+	}
+}
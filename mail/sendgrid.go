@@ -0,0 +1,180 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Shared by every SendGrid vendor without a Limiter
+var sendGridLimiter = NewTokenBucket(10, 10)
+
+// SendGrid sends the emails with the v3 mail/send API, one call per email
+type SendGrid struct {
+	APIKey      string
+	SandboxMode bool
+	// Optional, e.g. an httptest server, https://api.sendgrid.com if empty
+	BaseURL    string
+	HTTPClient *http.Client
+	// Throttles the calls, sendGridLimiter if nil
+	Limiter *TokenBucket
+	// Retries of a call rejected with 429, httpVendorDefaultRetries if 0
+	MaxRetries int
+}
+
+func LoadSendGridFromEnv() *SendGrid {
+	return &SendGrid{APIKey: os.Getenv("SENDGRID_API_KEY"), SandboxMode: os.Getenv("ENVIRONMENT") != "prod"}
+}
+
+func (m *SendGrid) GetVendorID() string {
+	return "SENDGRID"
+}
+
+func (m *SendGrid) HasAPIKey() bool {
+	return m.APIKey != ""
+}
+
+func (m *SendGrid) limiter() *TokenBucket {
+	if m.Limiter != nil {
+		return m.Limiter
+	}
+	return sendGridLimiter
+}
+
+// EmailsWithin is how many emails the limiter allows within d
+func (m *SendGrid) EmailsWithin(d time.Duration) int {
+	return m.limiter().CallsWithin(d)
+}
+
+// SendEmails sends the emails in order, the responses are in the order of the emails.
+// A rejected email fails alone, a rejected API key leaves the next emails for another vendor.
+// The critical error is returned only when no email is sent.
+func (m *SendGrid) SendEmails(mails []MailItem) (res []SendEmailsResponse, criticalError error) {
+	if !m.HasAPIKey() {
+		return res, ErrMailNoAPIKey
+	}
+	client := newHTTPVendor(m.HTTPClient, m.limiter(), m.MaxRetries)
+	return sendEachEmail(m.GetVendorID(), mails, func(mail MailItem) (SendEmailsResponse, error) {
+		return m.send(client, mail)
+	})
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridMailSendRequest struct {
+	Personalizations []struct {
+		To []sendGridAddress `json:"to"`
+	} `json:"personalizations"`
+	From    sendGridAddress   `json:"from"`
+	Subject string            `json:"subject"`
+	Content []sendGridContent `json:"content"`
+	// Returned by the event webhook, the values have to be strings
+	CustomArgs   map[string]string `json:"custom_args,omitempty"`
+	MailSettings struct {
+		SandboxMode struct {
+			Enable bool `json:"enable"`
+		} `json:"sandbox_mode"`
+	} `json:"mail_settings"`
+}
+
+// send returns the result of the email, or the error of the API key
+func (m *SendGrid) send(client httpVendor, mail MailItem) (res SendEmailsResponse, vendorErr error) {
+	res = NewSendEmailsResponse(mail, m.GetVendorID(), nil)
+	body, err := json.Marshal(convertMailItemToSendGrid(mail, m.SandboxMode))
+	if err != nil {
+		res.Err = err
+		return res, nil
+	}
+	baseURL := m.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.sendgrid.com"
+	}
+	statusCode, _, resBody, err := client.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/v3/mail/send", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+m.APIKey)
+		return req, nil
+	})
+	if err != nil {
+		return res, err
+	}
+	// 200 in the sandbox mode
+	if statusCode == http.StatusAccepted || statusCode == http.StatusOK {
+		return res, nil
+	}
+	apiErr := parseSendGridError(statusCode, resBody)
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return res, fmt.Errorf("%w: %w", ErrTransient, apiErr)
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		// An invalid API key or an unverified sender, every email fails the same way
+		return res, apiErr
+	case statusCode >= http.StatusInternalServerError:
+		// Another vendor might send it
+		res.Err = fmt.Errorf("%w: %w", ErrTransient, apiErr)
+	default:
+		// e.g. 400 of an invalid address or 413 of a too large email
+		res.Err = apiErr
+	}
+	return res, nil
+}
+
+// parseSendGridError joins the messages of {"errors": [{"message": "...", "field": "..."}]}
+func parseSendGridError(statusCode int, body []byte) *VendorAPIError {
+	var errBody struct {
+		Errors []struct {
+			Message string `json:"message"`
+			Field   string `json:"field"`
+		} `json:"errors"`
+	}
+	json.Unmarshal(body, &errBody)
+	messages := []string{}
+	fields := []string{}
+	for _, e := range errBody.Errors {
+		messages = append(messages, e.Message)
+		if e.Field != "" {
+			fields = append(fields, e.Field)
+		}
+	}
+	message := strings.Join(messages, "; ")
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+	return &VendorAPIError{VendorID: "SENDGRID", StatusCode: statusCode, Code: strings.Join(fields, ","), Message: message}
+}
+
+func convertMailItemToSendGrid(m MailItem, sandboxMode bool) (req sendGridMailSendRequest) {
+	req.Personalizations = make([]struct {
+		To []sendGridAddress `json:"to"`
+	}, 1)
+	for _, to := range m.To {
+		req.Personalizations[0].To = append(req.Personalizations[0].To, sendGridAddress{Email: to.Email, Name: to.Name})
+	}
+	req.From = sendGridAddress{Email: m.From.Email, Name: m.From.Name}
+	req.Subject = m.Subject
+	// The text part has to be the first one
+	req.Content = []sendGridContent{
+		{Type: "text/plain", Value: HTMLToText(m.HtmlContent)},
+		{Type: "text/html", Value: m.HtmlContent},
+	}
+	if m.IdempotencyKey != "" {
+		req.CustomArgs = map[string]string{"idempotency_key": m.IdempotencyKey}
+	}
+	req.MailSettings.SandboxMode.Enable = sandboxMode
+	return req
+}
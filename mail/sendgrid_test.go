@@ -0,0 +1,161 @@
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSendGrid emulates the v3 mail/send API. A recipient starting with "fail" gets a 500,
+// the first rateLimited calls get a 429 with X-RateLimit-Reset in rateLimitReset seconds.
+type fakeSendGrid struct {
+	*fakeVendorAPI
+	sent           []sendGridMailSendRequest
+	rateLimited    int
+	rateLimitReset int
+}
+
+func newFakeSendGrid(t *testing.T) *fakeSendGrid {
+	f := &fakeSendGrid{}
+	f.fakeVendorAPI = newFakeVendorAPI(t, f.serveHTTP)
+	return f
+}
+
+type sendGridTestError struct {
+	Message string  `json:"message"`
+	Field   *string `json:"field"`
+	Help    *string `json:"help"`
+}
+
+func (f *fakeSendGrid) reply(w http.ResponseWriter, statusCode int, errs ...sendGridTestError) {
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string][]sendGridTestError{"errors": errs})
+}
+
+func (f *fakeSendGrid) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v3/mail/send" || r.Header.Get("Authorization") != "Bearer key" {
+		f.reply(w, http.StatusUnauthorized, sendGridTestError{Message: "The provided authorization grant is invalid, expired, or revoked"})
+		return
+	}
+	if f.rateLimited > 0 {
+		f.rateLimited--
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprint(time.Now().Unix()+int64(f.rateLimitReset)))
+		f.reply(w, http.StatusTooManyRequests, sendGridTestError{Message: "too many requests"})
+		return
+	}
+	var req sendGridMailSendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Personalizations) == 0 {
+		f.reply(w, http.StatusBadRequest, sendGridTestError{Message: "Bad Request"})
+		return
+	}
+	if req.From.Email != "noreply@sejiwo.com" {
+		f.reply(w, http.StatusForbidden, sendGridTestError{
+			Message: "The from address does not match a verified Sender Identity."})
+		return
+	}
+	errs := []sendGridTestError{}
+	for id, to := range req.Personalizations[0].To {
+		field := fmt.Sprintf("personalizations.0.to.%d.email", id)
+		if _, err := ParseAddress(to.Email); err != nil {
+			errs = append(errs, sendGridTestError{Message: "Does not contain a valid address.", Field: &field})
+		} else if strings.HasPrefix(to.Email, "fail") {
+			f.reply(w, http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(errs) > 0 {
+		f.reply(w, http.StatusBadRequest, errs...)
+		return
+	}
+	f.sent = append(f.sent, req)
+	w.Header().Set("X-Message-Id", fmt.Sprintf("message-%d", len(f.sent)))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// generateSendGridMails are sent by the verified sender
+func generateSendGridMails(count int) []MailItem {
+	mails := generateCorrelatedMails(count)
+	for id := range mails {
+		mails[id].From = MailAddress{Email: "noreply@sejiwo.com", Name: "Sejiwo Team"}
+	}
+	return mails
+}
+
+func newTestSendGrid(f *fakeSendGrid) *SendGrid {
+	return &SendGrid{APIKey: "key", SandboxMode: true, BaseURL: f.URL, Limiter: f.newLimiter()}
+}
+
+func TestSendGridSendEmails(t *testing.T) {
+	f := newFakeSendGrid(t)
+	mails := []MailItem{
+		newTestSMTPMail("first@sejiwo.com", "second@sejiwo.com"),
+		newTestSMTPMail("first@sejiwo.com", "should@beinvalid"),
+		newTestSMTPMail("fail@sejiwo.com"),
+		newTestSMTPMail("third@sejiwo.com"),
+	}
+	res, err := newTestSendGrid(f).SendEmails(mails)
+	if err != nil || len(res) != 4 {
+		t.Fatalf("Expected 4 responses: %+v %v", res, err)
+	}
+	if res[0].Err != nil || res[3].Err != nil || fmt.Sprint(res[0].Emails) != "[first@sejiwo.com second@sejiwo.com]" {
+		t.Fatalf("The first & the last emails should be sent: %+v", res)
+	}
+	var apiErr *VendorAPIError
+	if !errors.As(res[1].Err, &apiErr) || apiErr.Code != "personalizations.0.to.1.email" || errors.Is(res[1].Err, ErrTransient) {
+		t.Fatalf("The second email should be invalid: %+v", res[1])
+	}
+	if !errors.Is(res[2].Err, ErrTransient) {
+		t.Fatalf("A 500 should be transient: %+v", res[2])
+	}
+	sent := f.sent[0]
+	if sent.Subject != mails[0].Subject || len(sent.Content) != 2 || sent.Content[0].Type != "text/plain" ||
+		sent.Content[1].Value != mails[0].HtmlContent || sent.CustomArgs["idempotency_key"] != mails[0].IdempotencyKey ||
+		!sent.MailSettings.SandboxMode.Enable {
+		t.Fatalf("Unexpected request: %+v", sent)
+	}
+}
+
+func TestSendGridRateLimit(t *testing.T) {
+	f := newFakeSendGrid(t)
+	f.rateLimited, f.rateLimitReset = 1, 5
+	res, err := newTestSendGrid(f).SendEmails(generateSendGridMails(1))
+	if err != nil || res[0].Err != nil || f.requests != 2 {
+		t.Fatalf("The email should be sent after the rate limit: %+v %v %d", res, err, f.requests)
+	}
+	// X-RateLimit-Reset has a precision of a second
+	if f.slept < 4*time.Second || f.slept > 5*time.Second {
+		t.Fatalf("Expected a wait until the reset: %s", f.slept)
+	}
+	f.rateLimited, f.rateLimitReset = 1, 3600
+	res, err = newTestSendGrid(f).SendEmails(generateSendGridMails(2))
+	if err != nil || !errors.Is(res[0].Err, ErrTransient) || !errors.Is(res[1].Err, ErrTransient) {
+		t.Fatalf("The emails should be left for another vendor: %+v %v", res, err)
+	}
+}
+
+func TestSendGridCriticalError(t *testing.T) {
+	f := newFakeSendGrid(t)
+	m := newTestSendGrid(f)
+	m.APIKey = "wrong"
+	var apiErr *VendorAPIError
+	if res, err := m.SendEmails(generateSendGridMails(3)); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || res != nil {
+		t.Fatalf("No email is sent, the error should be critical: %+v %v", res, err)
+	}
+	if f.requests != 1 {
+		t.Fatalf("The next emails should not be sent: %d", f.requests)
+	}
+	m.APIKey = "key"
+	mails := generateSendGridMails(2)
+	mails[1].From.Email = "unverified@sejiwo.com"
+	res, err := m.SendEmails(mails)
+	if err != nil || res[0].Err != nil || !errors.Is(res[1].Err, ErrTransient) {
+		t.Fatalf("An unverified sender should leave the email for another vendor: %+v %v", res, err)
+	}
+	if _, err = (&SendGrid{}).SendEmails(mails); !errors.Is(err, ErrMailNoAPIKey) {
+		t.Fatalf("Expected ErrMailNoAPIKey: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The sending rate of an account in the SES sandbox
+var sesLimiter = NewTokenBucket(1, 1)
+
+// The errors of the account rather than of an email, the next emails are left for another vendor
+var sesAccountErrors = map[string]bool{
+	"AccountSuspendedException":          true,
+	"SendingPausedException":             true,
+	"MailFromDomainNotVerifiedException": true,
+	"UnrecognizedClientException":        true,
+	"InvalidSignatureException":          true,
+	"SignatureDoesNotMatch":              true,
+	"AccessDeniedException":              true,
+	"ExpiredTokenException":              true,
+}
+
+// SES sends the emails with the SendEmail action of the Amazon SES API v2, one call per email
+type SES struct {
+	Credentials AWSCredentials
+	// us-east-1 if empty
+	Region string
+	// Optional, e.g. to publish the sending events
+	ConfigurationSetName string
+	// Optional, e.g. an httptest server, https://email.[Region].amazonaws.com if empty
+	BaseURL    string
+	HTTPClient *http.Client
+	// Throttles the calls to the maximum send rate of the account, sesLimiter if nil
+	Limiter *TokenBucket
+	// Retries of a call rejected with 429, httpVendorDefaultRetries if 0
+	MaxRetries int
+}
+
+// LoadSESFromEnv reads SES_ACCESS_KEY_ID & the other SES envs, SES_MAX_SEND_RATE is the max send rate of the account
+func LoadSESFromEnv() (*SES, error) {
+	m := &SES{
+		Credentials: AWSCredentials{
+			AccessKeyID:     os.Getenv("SES_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("SES_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("SES_SESSION_TOKEN"),
+		},
+		Region:               os.Getenv("SES_REGION"),
+		ConfigurationSetName: os.Getenv("SES_CONFIGURATION_SET"),
+	}
+	if rate := os.Getenv("SES_MAX_SEND_RATE"); rate != "" {
+		maxSendRate, err := strconv.ParseFloat(rate, 64)
+		if err != nil || maxSendRate <= 0 {
+			return nil, fmt.Errorf("invalid SES_MAX_SEND_RATE: %s", rate)
+		}
+		m.Limiter = NewTokenBucket(maxSendRate, max(int(maxSendRate), 1))
+	}
+	return m, nil
+}
+
+func (m *SES) GetVendorID() string {
+	return "SES"
+}
+
+func (m *SES) HasAPIKey() bool {
+	return m.Credentials.AccessKeyID != "" && m.Credentials.SecretAccessKey != ""
+}
+
+func (m *SES) region() string {
+	if m.Region != "" {
+		return m.Region
+	}
+	return "us-east-1"
+}
+
+func (m *SES) limiter() *TokenBucket {
+	if m.Limiter != nil {
+		return m.Limiter
+	}
+	return sesLimiter
+}
+
+// EmailsWithin is how many emails the limiter allows within d
+func (m *SES) EmailsWithin(d time.Duration) int {
+	return m.limiter().CallsWithin(d)
+}
+
+// SendEmails sends the emails in order, the responses are in the order of the emails.
+// A rejected email fails alone, an error of the account leaves the next emails for another vendor.
+// The critical error is returned only when no email is sent.
+func (m *SES) SendEmails(mails []MailItem) (res []SendEmailsResponse, criticalError error) {
+	if !m.HasAPIKey() {
+		return res, ErrMailNoAPIKey
+	}
+	client := newHTTPVendor(m.HTTPClient, m.limiter(), m.MaxRetries)
+	return sendEachEmail(m.GetVendorID(), mails, func(mail MailItem) (SendEmailsResponse, error) {
+		return m.send(client, mail)
+	})
+}
+
+type sesContent struct {
+	Data    string
+	Charset string
+}
+
+type sesSendEmailRequest struct {
+	FromEmailAddress string
+	Destination      struct{ ToAddresses []string }
+	Content          struct {
+		Simple struct {
+			Subject sesContent
+			Body    struct{ Html, Text sesContent }
+		}
+	}
+	ConfigurationSetName string `json:",omitempty"`
+}
+
+// send returns the result of the email, or the error of the account
+func (m *SES) send(client httpVendor, mail MailItem) (res SendEmailsResponse, vendorErr error) {
+	res = NewSendEmailsResponse(mail, m.GetVendorID(), nil)
+	body, err := json.Marshal(convertMailItemToSES(mail, m.ConfigurationSetName))
+	if err != nil {
+		res.Err = err
+		return res, nil
+	}
+	baseURL := m.BaseURL
+	if baseURL == "" {
+		baseURL = "https://email." + m.region() + ".amazonaws.com"
+	}
+	statusCode, header, resBody, err := client.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/v2/email/outbound-emails", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		signAWSV4(req, body, m.Credentials, m.region(), "ses", time.Now())
+		return req, nil
+	})
+	if err != nil {
+		return res, err
+	}
+	if statusCode == http.StatusOK {
+		return res, nil
+	}
+	apiErr := parseSESError(statusCode, header, resBody)
+	switch {
+	case statusCode == http.StatusTooManyRequests || apiErr.Code == "TooManyRequestsException" ||
+		apiErr.Code == "LimitExceededException":
+		return res, fmt.Errorf("%w: %w", ErrTransient, apiErr)
+	case sesAccountErrors[apiErr.Code] || statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return res, apiErr
+	case statusCode >= http.StatusInternalServerError:
+		// Another vendor might send it
+		res.Err = fmt.Errorf("%w: %w", ErrTransient, apiErr)
+	default:
+		// e.g. MessageRejected or BadRequestException of an invalid address
+		res.Err = apiErr
+	}
+	return res, nil
+}
+
+// parseSESError reads the error type from X-Amzn-ErrorType or the body, e.g. "MessageRejected:http://..."
+func parseSESError(statusCode int, header http.Header, body []byte) *VendorAPIError {
+	var errBody struct {
+		Type         string `json:"__type"`
+		Code         string `json:"code"`
+		Message      string `json:"message"`
+		MessageUpper string `json:"Message"`
+	}
+	json.Unmarshal(body, &errBody)
+	code := header.Get("X-Amzn-ErrorType")
+	for _, c := range []string{errBody.Type, errBody.Code} {
+		if code == "" {
+			code = c
+		}
+	}
+	code, _, _ = strings.Cut(code, ":")
+	code = code[strings.LastIndex(code, "#")+1:]
+	message := errBody.Message
+	if message == "" {
+		message = errBody.MessageUpper
+	}
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+	return &VendorAPIError{VendorID: "SES", StatusCode: statusCode, Code: code, Message: message}
+}
+
+func convertMailItemToSES(m MailItem, configurationSetName string) (req sesSendEmailRequest) {
+	req.FromEmailAddress = (&mail.Address{Name: m.From.Name, Address: m.From.Email}).String()
+	for _, to := range m.To {
+		req.Destination.ToAddresses = append(req.Destination.ToAddresses,
+			(&mail.Address{Name: to.Name, Address: to.Email}).String())
+	}
+	req.Content.Simple.Subject = sesContent{Data: m.Subject, Charset: "UTF-8"}
+	req.Content.Simple.Body.Html = sesContent{Data: m.HtmlContent, Charset: "UTF-8"}
+	req.Content.Simple.Body.Text = sesContent{Data: HTMLToText(m.HtmlContent), Charset: "UTF-8"}
+	req.ConfigurationSetName = configurationSetName
+	return req
+}
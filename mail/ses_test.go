@@ -0,0 +1,165 @@
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAWSCredentials = AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+
+// fakeSES emulates the SendEmail action of the SES API v2, the requests signed with other credentials are rejected.
+// A recipient starting with "reject" gets MessageRejected & one starting with "fail" gets a 500.
+// The first rateLimited calls get a 429, the calls after sendingPausedAfter sent emails get SendingPausedException.
+type fakeSES struct {
+	*fakeVendorAPI
+	sent               []sesSendEmailRequest
+	rateLimited        int
+	sendingPausedAfter int
+}
+
+func newFakeSES(t *testing.T) *fakeSES {
+	f := &fakeSES{sendingPausedAfter: -1}
+	f.fakeVendorAPI = newFakeVendorAPI(t, f.serveHTTP)
+	return f
+}
+
+func (f *fakeSES) reply(w http.ResponseWriter, statusCode int, errorType string, message string) {
+	w.Header().Set("X-Amzn-ErrorType", errorType+":http://internal.amazon.com/coral/com.amazonaws.sesv2/")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func (f *fakeSES) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	date, _ := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	expected, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.Path, nil)
+	expected.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	signAWSV4(expected, body, testAWSCredentials, "eu-west-1", "ses", date)
+	if r.Method != http.MethodPost || r.URL.Path != "/v2/email/outbound-emails" ||
+		r.Header.Get("Authorization") != expected.Header.Get("Authorization") {
+		f.reply(w, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		return
+	}
+	if f.rateLimited > 0 {
+		f.rateLimited--
+		f.reply(w, http.StatusTooManyRequests, "TooManyRequestsException", "Too many requests")
+		return
+	}
+	if f.sendingPausedAfter >= 0 && len(f.sent) >= f.sendingPausedAfter {
+		f.reply(w, http.StatusBadRequest, "SendingPausedException", "Sending is paused for this account.")
+		return
+	}
+	var req sesSendEmailRequest
+	if err := json.Unmarshal(body, &req); err != nil || len(req.Destination.ToAddresses) == 0 {
+		f.reply(w, http.StatusBadRequest, "BadRequestException", "Invalid request")
+		return
+	}
+	for _, to := range req.Destination.ToAddresses {
+		addr, err := ParseAddress(to)
+		switch {
+		case err != nil:
+			f.reply(w, http.StatusBadRequest, "BadRequestException", "Illegal address")
+			return
+		case strings.HasPrefix(addr.Address, "reject"):
+			f.reply(w, http.StatusBadRequest, "MessageRejected", "Email address is not verified. The following identities failed the check: "+addr.Address)
+			return
+		case strings.HasPrefix(addr.Address, "fail"):
+			f.reply(w, http.StatusInternalServerError, "InternalFailure", "Internal failure")
+			return
+		}
+	}
+	f.sent = append(f.sent, req)
+	json.NewEncoder(w).Encode(map[string]string{"MessageId": fmt.Sprintf("message-%d", len(f.sent))})
+}
+
+func newTestSES(f *fakeSES) *SES {
+	return &SES{Credentials: testAWSCredentials, Region: "eu-west-1", ConfigurationSetName: "legacy",
+		BaseURL: f.URL, Limiter: f.newLimiter()}
+}
+
+func TestSESSendEmails(t *testing.T) {
+	f := newFakeSES(t)
+	mails := []MailItem{
+		newTestSMTPMail("first@sejiwo.com", "second@sejiwo.com"),
+		newTestSMTPMail("reject@sejiwo.com"),
+		newTestSMTPMail("fail@sejiwo.com"),
+		newTestSMTPMail("third@sejiwo.com"),
+	}
+	res, err := newTestSES(f).SendEmails(mails)
+	if err != nil || len(res) != 4 {
+		t.Fatalf("Expected 4 responses: %+v %v", res, err)
+	}
+	var apiErr *VendorAPIError
+	if res[0].Err != nil || res[3].Err != nil || fmt.Sprint(res[0].Emails) != "[first@sejiwo.com second@sejiwo.com]" {
+		t.Fatalf("The first & the last emails should be sent: %+v", res)
+	}
+	if !errors.As(res[1].Err, &apiErr) || apiErr.Code != "MessageRejected" || errors.Is(res[1].Err, ErrTransient) {
+		t.Fatalf("The second email should be rejected: %+v", res[1])
+	}
+	if !errors.Is(res[2].Err, ErrTransient) {
+		t.Fatalf("A 500 should be transient: %+v", res[2])
+	}
+	sent := f.sent[0]
+	simple := sent.Content.Simple
+	if sent.FromEmailAddress != `"Sejiwo Team" <noreply@sejiwo.com>` || sent.ConfigurationSetName != "legacy" ||
+		simple.Subject.Data != mails[0].Subject || simple.Body.Html.Data != mails[0].HtmlContent ||
+		!strings.Contains(simple.Body.Text.Data, "extend (https://sejiwo.com/extend?id=1&secret=2)") {
+		t.Fatalf("Unexpected request: %+v", sent)
+	}
+}
+
+func TestSESRateLimit(t *testing.T) {
+	f := newFakeSES(t)
+	f.rateLimited = 2
+	res, err := newTestSES(f).SendEmails(generateCorrelatedMails(1))
+	if err != nil || res[0].Err != nil || f.requests != 3 {
+		t.Fatalf("The email should be sent after 2 retries: %+v %v %d", res, err, f.requests)
+	}
+	if f.slept != 2*time.Second {
+		t.Fatalf("Expected 2 waits of a second: %s", f.slept)
+	}
+	f.rateLimited = 10
+	res, err = newTestSES(f).SendEmails(generateCorrelatedMails(2))
+	if err != nil || !errors.Is(res[0].Err, ErrTransient) || !errors.Is(res[1].Err, ErrTransient) {
+		t.Fatalf("The emails should be left for another vendor: %+v %v", res, err)
+	}
+}
+
+func TestSESAccountError(t *testing.T) {
+	f := newFakeSES(t)
+	f.sendingPausedAfter = 1
+	mails := generateCorrelatedMails(3)
+	res, err := newTestSES(f).SendEmails(mails)
+	if err != nil || res[0].Err != nil || !errors.Is(res[1].Err, ErrTransient) || !errors.Is(res[2].Err, ErrTransient) {
+		t.Fatalf("The emails after the pause should be left for another vendor: %+v %v", res, err)
+	}
+	if f.requests != 2 || res[2].CorrelationID != "mail-2" {
+		t.Fatalf("The third email should not be sent: %d %+v", f.requests, res[2])
+	}
+	var apiErr *VendorAPIError
+	if res, err = newTestSES(f).SendEmails(mails); !errors.As(err, &apiErr) || apiErr.Code != "SendingPausedException" || res != nil {
+		t.Fatalf("No email is sent, the error should be critical: %+v %v", res, err)
+	}
+	m := newTestSES(f)
+	m.Credentials.SecretAccessKey = "wrong"
+	if _, err = m.SendEmails(mails); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("A wrong signature should be a critical error: %v", err)
+	}
+	if _, err = (&SES{}).SendEmails(mails); !errors.Is(err, ErrMailNoAPIKey) {
+		t.Fatalf("Expected ErrMailNoAPIKey: %v", err)
+	}
+}
+
+func TestParseSESError(t *testing.T) {
+	body := []byte(`{"__type":"com.amazonaws.sesv2#LimitExceededException","Message":"Daily quota exceeded"}`)
+	apiErr := parseSESError(http.StatusBadRequest, http.Header{}, body)
+	if apiErr.Code != "LimitExceededException" || apiErr.Message != "Daily quota exceeded" {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+}
@@ -0,0 +1,25 @@
+package mail
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The get-vanilla & get-vanilla-query-order-key-case cases of the AWS Signature Version 4 test suite
+func TestSignAWSV4(t *testing.T) {
+	creds := AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for url, expected := range map[string]string{
+		"https://example.amazonaws.com/": "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		"https://example.amazonaws.com/?Param2=value2&Param1=value1": "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		signAWSV4(req, nil, creds, "us-east-1", "service", now)
+		if req.Header.Get("X-Amz-Date") != "20150830T123600Z" || req.Header.Get("Authorization") != expected {
+			t.Fatalf("Unexpected signature of %s: %s", url, req.Header.Get("Authorization"))
+		}
+	}
+}
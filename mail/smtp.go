@@ -0,0 +1,313 @@
+package mail
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SMTPSecurityStartTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+	// Only for a relay on the same host or network, the credentials are sent in clear text
+	SMTPSecurityNone = "none"
+
+	SMTPAuthPlain = "plain"
+	SMTPAuthLogin = "login"
+
+	defaultSMTPTimeout = 30 * time.Second
+)
+
+// SMTP sends every email of a SendEmails call through one connection to Host
+type SMTP struct {
+	Host string
+	// 587 for starttls, 465 for tls & 25 for none if 0
+	Port     int
+	Username string
+	Password string
+	// SMTPSecurityStartTLS if empty
+	Security string
+	// SMTPAuthPlain if empty, no authentication without Username
+	Auth string
+	// Sent with EHLO, "localhost" if empty
+	HelloName string
+	// Optional, e.g. the RootCAs of a test server
+	TLSConfig *tls.Config
+	// Optional DKIM signature of every email
+	DKIM *DKIMSigner
+	// Of every command, defaultSMTPTimeout if 0
+	Timeout time.Duration
+}
+
+// LoadSMTPFromEnv returns nil when SMTP_HOST is not set
+func LoadSMTPFromEnv() (*SMTP, error) {
+	if os.Getenv("SMTP_HOST") == "" {
+		return nil, nil
+	}
+	m := &SMTP{
+		Host:     os.Getenv("SMTP_HOST"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		Security: os.Getenv("SMTP_SECURITY"),
+		Auth:     os.Getenv("SMTP_AUTH"),
+	}
+	if port := os.Getenv("SMTP_PORT"); port != "" {
+		var err error
+		if m.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid SMTP_PORT: %w", err)
+		}
+	}
+	if pemKey := os.Getenv("DKIM_PRIVATE_KEY"); pemKey != "" {
+		key, err := ParseDKIMPrivateKey(pemKey)
+		if err != nil {
+			return nil, err
+		}
+		m.DKIM = &DKIMSigner{Domain: os.Getenv("DKIM_DOMAIN"), Selector: os.Getenv("DKIM_SELECTOR"), Key: key}
+	}
+	return m, nil
+}
+
+func (m *SMTP) GetVendorID() string {
+	return "SMTP"
+}
+
+func (m *SMTP) HasAPIKey() bool {
+	return m.Host != ""
+}
+
+// SMTPRecipientError is the reply of the server rejecting a recipient
+type SMTPRecipientError struct {
+	Email string
+	Reply *textproto.Error
+}
+
+func (e *SMTPRecipientError) Error() string {
+	return fmt.Sprintf("recipient %s is rejected: %d %s", e.Email, e.Reply.Code, e.Reply.Msg)
+}
+
+func (e *SMTPRecipientError) Unwrap() error {
+	return e.Reply
+}
+
+// SendEmails sends the emails in order, an email with a rejected recipient is sent to the accepted ones.
+// Once the connection breaks, the next emails get a transient error so another vendor can send them.
+// The critical error is returned only when no email is sent.
+func (m *SMTP) SendEmails(mails []MailItem) (res []SendEmailsResponse, criticalError error) {
+	if !m.HasAPIKey() {
+		return res, ErrMailNoAPIKey
+	}
+	conn, c, err := m.dial()
+	if err != nil {
+		log.Printf("Critical, cannot connect to the SMTP server: %+v\n", err)
+		return res, err
+	}
+	defer c.Close()
+	isBroken := false
+	res, criticalError = sendEachEmail(m.GetVendorID(), mails, func(mail MailItem) (SendEmailsResponse, error) {
+		conn.SetDeadline(time.Now().Add(m.timeout()))
+		emailRes, connErr := m.send(c, mail)
+		isBroken = connErr != nil
+		return emailRes, connErr
+	})
+	if !isBroken {
+		conn.SetDeadline(time.Now().Add(m.timeout()))
+		c.Quit()
+	}
+	return res, criticalError
+}
+
+func (m *SMTP) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return defaultSMTPTimeout
+}
+
+func (m *SMTP) tlsConfig() *tls.Config {
+	cfg := &tls.Config{}
+	if m.TLSConfig != nil {
+		cfg = m.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = m.Host
+	}
+	return cfg
+}
+
+// dial connects, secures the connection & authenticates
+func (m *SMTP) dial() (net.Conn, *smtp.Client, error) {
+	security := m.Security
+	if security == "" {
+		security = SMTPSecurityStartTLS
+	}
+	port := m.Port
+	if port == 0 {
+		port = map[string]int{SMTPSecurityStartTLS: 587, SMTPSecurityTLS: 465, SMTPSecurityNone: 25}[security]
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: m.timeout()}
+	var conn net.Conn
+	var err error
+	switch security {
+	case SMTPSecurityTLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, m.tlsConfig())
+	case SMTPSecurityStartTLS, SMTPSecurityNone:
+		conn, err = dialer.Dial("tcp", addr)
+	default:
+		return nil, nil, fmt.Errorf("invalid smtp security: %s", security)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(m.timeout()))
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err = m.start(c, security); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return conn, c, nil
+}
+
+func (m *SMTP) start(c *smtp.Client, security string) error {
+	helloName := m.HelloName
+	if helloName == "" {
+		helloName = "localhost"
+	}
+	if err := c.Hello(helloName); err != nil {
+		return err
+	}
+	if security == SMTPSecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := c.StartTLS(m.tlsConfig()); err != nil {
+			return err
+		}
+	}
+	if m.Username == "" {
+		return nil
+	}
+	switch m.Auth {
+	case "", SMTPAuthPlain:
+		return c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+	case SMTPAuthLogin:
+		return c.Auth(&loginAuth{username: m.Username, password: m.Password, host: m.Host})
+	}
+	return fmt.Errorf("invalid smtp auth: %s", m.Auth)
+}
+
+// send returns the result of the email, or the error of the connection
+func (m *SMTP) send(c *smtp.Client, mail MailItem) (res SendEmailsResponse, connErr error) {
+	res = NewSendEmailsResponse(mail, m.GetVendorID(), nil)
+	message, err := BuildMIMEMessage(mail, time.Now())
+	if err == nil && m.DKIM != nil {
+		message, err = m.DKIM.Sign(message)
+	}
+	if err != nil {
+		res.Err = err
+		return res, nil
+	}
+	if err = c.Mail(mail.From.Email); err != nil {
+		return m.reject(c, res, err)
+	}
+	accepted := []string{}
+	rejected := []error{}
+	isTransient := true
+	for _, to := range mail.To {
+		err = c.Rcpt(to.Email)
+		var reply *textproto.Error
+		if errors.As(err, &reply) {
+			rejected = append(rejected, &SMTPRecipientError{Email: to.Email, Reply: reply})
+			isTransient = isTransient && reply.Code/100 == 4
+			continue
+		} else if err != nil {
+			return res, err
+		}
+		accepted = append(accepted, to.Email)
+	}
+	if len(accepted) == 0 {
+		res.Err = recipientsError(rejected, isTransient)
+		return res, c.Reset()
+	}
+	w, err := c.Data()
+	if err != nil {
+		return m.reject(c, res, err)
+	}
+	if _, err = w.Write(message); err != nil {
+		return res, err
+	}
+	if err = w.Close(); err != nil {
+		return m.reject(c, res, err)
+	}
+	if len(rejected) > 0 {
+		res.RejectedErr = recipientsError(rejected, isTransient)
+		log.Printf("Email is sent without the rejected recipients: %v\n", res.RejectedErr)
+	}
+	res.Emails = accepted
+	return res, nil
+}
+
+// recipientsError joins the errors of the rejected recipients, it is transient when every reply is 4xx
+func recipientsError(rejected []error, isTransient bool) error {
+	err := errors.Join(rejected...)
+	if isTransient {
+		return fmt.Errorf("%w: %w", ErrTransient, err)
+	}
+	return err
+}
+
+// reject maps a reply of the server to the error of the email, any other error is the error of the connection
+func (m *SMTP) reject(c *smtp.Client, res SendEmailsResponse, err error) (SendEmailsResponse, error) {
+	var reply *textproto.Error
+	if !errors.As(err, &reply) {
+		return res, err
+	}
+	res.Err = err
+	if reply.Code/100 == 4 {
+		res.Err = fmt.Errorf("%w: %w", ErrTransient, err)
+	}
+	return res, c.Reset()
+}
+
+// loginAuth is the AUTH LOGIN mechanism, only over TLS or to localhost like smtp.PlainAuth
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	isLocalhost := server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+	if !server.TLS && !isLocalhost {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected AUTH LOGIN challenge: %s", fromServer)
+}
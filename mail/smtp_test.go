@@ -0,0 +1,334 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSMTPMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// fakeSMTP is an in-process SMTP server, it rejects the recipients starting with "reject" with 550
+// & the recipients starting with "busy" with 451
+type fakeSMTP struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	username    string
+	password    string
+
+	mu          sync.Mutex
+	connections int
+	authMethods []string
+	messages    []fakeSMTPMessage
+}
+
+func newFakeSMTP(t *testing.T, implicitTLS bool) (*fakeSMTP, *tls.Config) {
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	if implicitTLS {
+		listener = tls.NewListener(listener, serverTLS)
+	}
+	f := &fakeSMTP{listener: listener, tlsConfig: serverTLS, implicitTLS: implicitTLS, username: "user", password: "pass"}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, clientTLS
+}
+
+func (f *fakeSMTP) port() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	f.mu.Lock()
+	f.connections++
+	f.mu.Unlock()
+	tp := textproto.NewConn(conn)
+	isTLS := f.implicitTLS
+	var msg fakeSMTPMessage
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "EHLO":
+			tp.PrintfLine("250-fake")
+			if !isTLS {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN LOGIN")
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			tp, isTLS = textproto.NewConn(tlsConn), true
+		case "AUTH":
+			f.auth(tp, arg)
+		case "MAIL":
+			msg = fakeSMTPMessage{From: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			to := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			switch {
+			case strings.HasPrefix(to, "reject"):
+				tp.PrintfLine("550 5.1.1 mailbox unavailable")
+			case strings.HasPrefix(to, "busy"):
+				tp.PrintfLine("451 4.3.0 try again later")
+			default:
+				msg.To = append(msg.To, to)
+				tp.PrintfLine("250 ok")
+			}
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			// ReadDotBytes turns CRLF into LF, the messages are signed with CRLF
+			msg.Data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+			f.mu.Lock()
+			f.messages = append(f.messages, msg)
+			f.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+func (f *fakeSMTP) auth(tp *textproto.Conn, arg string) {
+	method, initial, _ := strings.Cut(arg, " ")
+	var username, password string
+	switch method {
+	case "PLAIN":
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		if parts := strings.Split(string(decoded), "\x00"); len(parts) == 3 {
+			username, password = parts[1], parts[2]
+		}
+	case "LOGIN":
+		for _, prompt := range []string{"Username:", "Password:"} {
+			tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+			line, _ := tp.ReadLine()
+			decoded, _ := base64.StdEncoding.DecodeString(line)
+			if prompt == "Username:" {
+				username = string(decoded)
+			} else {
+				password = string(decoded)
+			}
+		}
+	}
+	if username != f.username || password != f.password {
+		tp.PrintfLine("535 5.7.8 authentication failed")
+		return
+	}
+	f.mu.Lock()
+	f.authMethods = append(f.authMethods, method)
+	f.mu.Unlock()
+	tp.PrintfLine("235 authenticated")
+}
+
+// newTestTLSConfigs returns a self-signed certificate of 127.0.0.1 & a client config trusting it
+func newTestTLSConfigs(t *testing.T) (server *tls.Config, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate a key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Cannot create a certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: roots}
+}
+
+func newTestSMTPMail(to ...string) MailItem {
+	m := MailItem{
+		From:           MailAddress{Email: "noreply@sejiwo.com", Name: "Sejiwo Team"},
+		Subject:        "Reminder to extend the delivery schedule of sejiwo.com testament",
+		HtmlContent:    `<p>Hi,</p><p>Please <a href="https://sejiwo.com/extend?id=1&amp;secret=2">extend</a> it.</p>`,
+		IdempotencyKey: "reminder:some-id:2026-10-17",
+	}
+	for _, email := range to {
+		m.To = append(m.To, MailAddress{Email: email, Name: "Sejiwo User"})
+	}
+	return m
+}
+
+func TestSMTPStartTLS(t *testing.T) {
+	f, clientTLS := newFakeSMTP(t, false)
+	m := &SMTP{Host: "127.0.0.1", Port: f.port(), Username: "user", Password: "pass", TLSConfig: clientTLS}
+	mails := []MailItem{
+		newTestSMTPMail("first@sejiwo.com"),
+		newTestSMTPMail("reject@sejiwo.com"),
+		newTestSMTPMail("busy@sejiwo.com"),
+		newTestSMTPMail("second@sejiwo.com", "reject-too@sejiwo.com"),
+	}
+	res, err := m.SendEmails(mails)
+	if err != nil || len(res) != 4 {
+		t.Fatalf("Expected 4 responses: %+v %v", res, err)
+	}
+	var recipientErr *SMTPRecipientError
+	if res[0].Err != nil || !errors.As(res[1].Err, &recipientErr) || recipientErr.Reply.Code != 550 || errors.Is(res[1].Err, ErrTransient) {
+		t.Fatalf("Only the second email should be rejected permanently: %+v", res)
+	}
+	if !errors.Is(res[2].Err, ErrTransient) {
+		t.Fatalf("A 451 reply should be transient: %+v", res[2])
+	}
+	if res[3].Err != nil || len(res[3].Emails) != 1 || res[3].Emails[0] != "second@sejiwo.com" {
+		t.Fatalf("The fourth email should be sent to the accepted recipient: %+v", res[3])
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connections != 1 || len(f.messages) != 2 || fmt.Sprint(f.authMethods) != "[PLAIN]" {
+		t.Fatalf("Expected 2 emails sent over 1 authenticated connection: %d %d %v", f.connections, len(f.messages), f.authMethods)
+	}
+}
+
+func TestSMTPRejectedRecipient(t *testing.T) {
+	f, clientTLS := newFakeSMTP(t, false)
+	m := &SMTP{Host: "127.0.0.1", Port: f.port(), TLSConfig: clientTLS}
+	res, err := m.SendEmails([]MailItem{
+		newTestSMTPMail("first@sejiwo.com", "reject@sejiwo.com"),
+		newTestSMTPMail("second@sejiwo.com", "busy@sejiwo.com"),
+	})
+	if err != nil || len(res) != 2 || res[0].Err != nil || res[1].Err != nil {
+		t.Fatalf("The emails should be sent to the accepted recipients: %+v %v", res, err)
+	}
+	var recipientErr *SMTPRecipientError
+	if fmt.Sprint(res[0].Emails) != "[first@sejiwo.com]" || !errors.As(res[0].RejectedErr, &recipientErr) ||
+		recipientErr.Email != "reject@sejiwo.com" || recipientErr.Reply.Code != 550 || errors.Is(res[0].RejectedErr, ErrTransient) {
+		t.Fatalf("The 550 recipient should be rejected permanently: %+v", res[0])
+	}
+	if !errors.As(res[1].RejectedErr, &recipientErr) || recipientErr.Email != "busy@sejiwo.com" || !errors.Is(res[1].RejectedErr, ErrTransient) {
+		t.Fatalf("The 451 recipient should be rejected transiently: %+v", res[1])
+	}
+}
+
+func TestSMTPImplicitTLSLogin(t *testing.T) {
+	f, clientTLS := newFakeSMTP(t, true)
+	m := &SMTP{Host: "127.0.0.1", Port: f.port(), Username: "user", Password: "pass", Security: SMTPSecurityTLS,
+		Auth: SMTPAuthLogin, TLSConfig: clientTLS}
+	res, err := m.SendEmails([]MailItem{newTestSMTPMail("first@sejiwo.com")})
+	if err != nil || res[0].Err != nil {
+		t.Fatalf("The email should be sent: %+v %v", res, err)
+	}
+	f.mu.Lock()
+	authMethods := fmt.Sprint(f.authMethods)
+	f.mu.Unlock()
+	if authMethods != "[LOGIN]" {
+		t.Fatalf("Expected AUTH LOGIN: %s", authMethods)
+	}
+	m.Password = "wrong"
+	if _, err = m.SendEmails([]MailItem{newTestSMTPMail("first@sejiwo.com")}); err == nil {
+		t.Fatalf("A failed authentication should be a critical error")
+	}
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	m.Port = port
+	if _, err = m.SendEmails([]MailItem{newTestSMTPMail("first@sejiwo.com")}); err == nil {
+		t.Fatalf("A closed port should be a critical error")
+	}
+}
+
+func TestSMTPMIMEAndDKIM(t *testing.T) {
+	f, clientTLS := newFakeSMTP(t, false)
+	signer := &DKIMSigner{Domain: "sejiwo.com", Selector: "legacy", Key: newTestRSAKey(t)}
+	m := &SMTP{Host: "127.0.0.1", Port: f.port(), Username: "user", Password: "pass", TLSConfig: clientTLS, DKIM: signer}
+	sent := newTestSMTPMail("first@sejiwo.com")
+	sent.Subject = "Pesan dari sejiwo.com — testament"
+	if res, err := m.SendEmails([]MailItem{sent}); err != nil || res[0].Err != nil {
+		t.Fatalf("The email should be sent: %+v %v", res, err)
+	}
+	f.mu.Lock()
+	data := f.messages[0].Data
+	f.mu.Unlock()
+	verifyTestDKIMSignature(t, data, signer)
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("Invalid message: %v", err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != sent.Subject || msg.Header.Get("To") != `"Sejiwo User" <first@sejiwo.com>` ||
+		msg.Header.Get("Message-ID") != messageID(sent) {
+		t.Fatalf("Unexpected headers: %+v", msg.Header)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Unexpected content type: %s", mediaType)
+	}
+	parts := map[string]string{}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Invalid part: %v", err)
+		}
+		content, _ := io.ReadAll(part)
+		parts[part.Header.Get("Content-Type")] = strings.ReplaceAll(string(content), "\r\n", "\n")
+	}
+	if parts["text/html; charset=utf-8"] != sent.HtmlContent {
+		t.Fatalf("Unexpected HTML part: %q", parts["text/html; charset=utf-8"])
+	}
+	if text := parts["text/plain; charset=utf-8"]; text != "Hi,\nPlease extend (https://sejiwo.com/extend?id=1&secret=2) it.\n" {
+		t.Fatalf("Unexpected text part: %q", text)
+	}
+}
@@ -0,0 +1,87 @@
+package mail
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket throttles the API calls of a vendor to Rate calls per second, with bursts of Burst calls
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+	Now   func() time.Time
+	Sleep func(time.Duration)
+
+	mu          sync.Mutex
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{Rate: rate, Burst: burst}
+}
+
+func (b *TokenBucket) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+func (b *TokenBucket) sleep(d time.Duration) {
+	if b.Sleep != nil {
+		b.Sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// Wait blocks until a call is allowed
+func (b *TokenBucket) Wait() {
+	for {
+		delay := b.take()
+		if delay <= 0 {
+			return
+		}
+		b.sleep(delay)
+	}
+}
+
+// take takes a token, otherwise it returns how long to wait for the next one
+func (b *TokenBucket) take() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.last.IsZero() {
+		b.tokens = float64(b.Burst)
+		b.last = now
+	}
+	if now.Before(b.pausedUntil) {
+		return b.pausedUntil.Sub(now)
+	}
+	b.tokens = min(float64(b.Burst), b.tokens+now.Sub(b.last).Seconds()*b.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.Rate * float64(time.Second))
+}
+
+// CallsWithin is how many calls a full bucket allows within d
+func (b *TokenBucket) CallsWithin(d time.Duration) int {
+	return b.Burst + int(max(d, 0).Seconds()*b.Rate)
+}
+
+// Pause holds every call for d, e.g. the Retry-After of a rate limited call, then allows one call
+func (b *TokenBucket) Pause(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until := b.now().Add(d)
+	if until.After(b.pausedUntil) {
+		b.pausedUntil = until
+		b.last = until
+		b.tokens = 1
+	}
+}
@@ -0,0 +1,53 @@
+package mail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	var slept time.Duration
+	b := NewTokenBucket(2, 2)
+	b.Now = func() time.Time { return now }
+	b.Sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	b.Wait()
+	b.Wait()
+	if slept != 0 {
+		t.Fatalf("The burst should not wait: %s", slept)
+	}
+	b.Wait()
+	if slept != 500*time.Millisecond {
+		t.Fatalf("The third call should wait for the next token: %s", slept)
+	}
+	now = now.Add(time.Hour)
+	b.Pause(3 * time.Second)
+	slept = 0
+	b.Wait()
+	b.Wait()
+	if slept != 3500*time.Millisecond {
+		t.Fatalf("A pause should hold the calls & leave one token: %s", slept)
+	}
+}
+
+func TestSendMailConfigEmailsWithin(t *testing.T) {
+	cfg := SendMailConfig{Vendors: []SendMailVendorConfig{
+		{Vendor: &Mailjet{APIKey: "key", SecretKey: "secret", Limiter: NewTokenBucket(3, 3)}},
+		{Vendor: &SES{Credentials: AWSCredentials{AccessKeyID: "id", SecretAccessKey: "secret"}, Limiter: NewTokenBucket(1, 1)}},
+		{Vendor: &SendGrid{Limiter: NewTokenBucket(0.1, 1)}},
+		{Vendor: &fakeMail{vendorID: "FAKE"}},
+	}}
+	// SES is the slowest vendor with an API key
+	if count := cfg.EmailsWithin(10 * time.Second); count != 11 {
+		t.Fatalf("Expected 11 emails within 10s: %d", count)
+	}
+	if count := cfg.Vendors[0].Vendor.(Throttled).EmailsWithin(time.Second); count != 300 {
+		t.Fatalf("Mailjet should send 6 calls of 50 emails: %d", count)
+	}
+	if count := (SendMailConfig{Vendors: cfg.Vendors[3:]}).EmailsWithin(time.Second); count != -1 {
+		t.Fatalf("Without a throttled vendor there is no limit: %d", count)
+	}
+}
@@ -0,0 +1,202 @@
+package p
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asendia/legacy-api/cron"
+	"github.com/asendia/legacy-api/data"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	cronLeaderLockName      = "scheduler:cron-leader"
+	defaultCronPollInterval = 30 * time.Second
+	cronRecordTimeout       = 10 * time.Second
+)
+
+// Actions of the in-process scheduler, each one is scheduled by its env, e.g. CRON_SEND_REMINDER_MESSAGES="0 9 * * *"
+var cronActions = []string{"send-reminder-messages", "send-testaments", "dispatch-emails"}
+
+type CronJob struct {
+	Action   string
+	Schedule cron.Schedule
+}
+
+// CronScheduler runs the scheduler actions of a self-hosted server. Only the replica holding the leader advisory lock
+// runs them, the last scheduled time of every job is stored so a leader catches up the runs missed during a downtime.
+type CronScheduler struct {
+	DB   *pgxpool.Pool
+	Jobs []CronJob
+	// The followers try to become the leader & the leader checks the jobs on every tick
+	PollInterval time.Duration
+	Run          func(ctx context.Context, m PubSubMessage) error
+	Now          func() time.Time
+}
+
+// LoadCronSchedulerFromEnv reads the CRON_<ACTION> expressions in CRON_TIME_ZONE (UTC by default),
+// it returns nil when no job is scheduled
+func LoadCronSchedulerFromEnv(ctx context.Context) (*CronScheduler, error) {
+	jobs, err := loadCronJobsFromEnv()
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	db, err := data.ConnectDB(ctx, data.LoadDBURLConfig())
+	if err != nil {
+		return nil, err
+	}
+	s := &CronScheduler{DB: db, Jobs: jobs, PollInterval: defaultCronPollInterval}
+	s.Run = func(ctx context.Context, m PubSubMessage) error {
+		_, err := runSchedulerAction(ctx, s.DB, m)
+		return err
+	}
+	return s, nil
+}
+
+func loadCronJobsFromEnv() (jobs []CronJob, err error) {
+	loc, err := time.LoadLocation(os.Getenv("CRON_TIME_ZONE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRON_TIME_ZONE: %w", err)
+	}
+	for _, action := range cronActions {
+		env := "CRON_" + strings.ToUpper(strings.ReplaceAll(action, "-", "_"))
+		expression := os.Getenv(env)
+		if expression == "" {
+			continue
+		}
+		schedule, err := cron.Parse(expression, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", env, err)
+		}
+		jobs = append(jobs, CronJob{Action: action, Schedule: schedule})
+	}
+	return jobs, nil
+}
+
+func (s *CronScheduler) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// Start blocks until ctx is done, a running action is not canceled but the next one is not started
+func (s *CronScheduler) Start(ctx context.Context) {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = defaultCronPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var leader *pgxpool.Conn
+	defer func() {
+		if leader != nil {
+			s.resign(leader)
+		}
+	}()
+	for {
+		leader = s.tick(ctx, leader)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick returns the connection holding the leader lock, nil while another replica is the leader
+func (s *CronScheduler) tick(ctx context.Context, leader *pgxpool.Conn) *pgxpool.Conn {
+	if leader == nil {
+		leader = s.elect(ctx)
+		if leader == nil {
+			return nil
+		}
+	}
+	for _, job := range s.Jobs {
+		if ctx.Err() != nil {
+			return leader
+		}
+		if err := s.runIfDue(ctx, leader, job); err != nil {
+			// The lock might be lost with the connection, closing the session releases it anyway
+			log.Printf("Cron leader lost, action: %s, %v\n", job.Action, err)
+			leader.Hijack().Close(context.Background())
+			return nil
+		}
+	}
+	return leader
+}
+
+// elect holds a session advisory lock, the connection is kept out of the pool while it is the leader
+func (s *CronScheduler) elect(ctx context.Context) *pgxpool.Conn {
+	conn, err := s.DB.Acquire(ctx)
+	if err != nil {
+		log.Printf("Cannot acquire a connection for the cron leader lock: %v\n", err)
+		return nil
+	}
+	isLocked, err := data.New(conn).TryAdvisoryLock(ctx, cronLeaderLockName)
+	if err != nil || !isLocked {
+		if err != nil {
+			log.Printf("Cannot take the cron leader lock: %v\n", err)
+		}
+		conn.Release()
+		return nil
+	}
+	log.Printf("Became the cron leader")
+	return conn
+}
+
+func (s *CronScheduler) resign(leader *pgxpool.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), cronRecordTimeout)
+	defer cancel()
+	if isUnlocked, err := data.New(leader).AdvisoryUnlock(ctx, cronLeaderLockName); err != nil || !isUnlocked {
+		leader.Hijack().Close(ctx)
+		return
+	}
+	leader.Release()
+	log.Printf("Resigned as the cron leader")
+}
+
+// runIfDue runs the job once for its last scheduled time, however many runs were missed since the previous one.
+// The run is recorded even when it fails, the next scheduled run picks up the messages which are still due.
+func (s *CronScheduler) runIfDue(ctx context.Context, leader *pgxpool.Conn, job CronJob) error {
+	now := s.now()
+	queries := data.New(leader)
+	// A new job waits for its next scheduled time
+	err := queries.InsertCronJobIfNotExists(ctx, data.InsertCronJobIfNotExistsParams{Action: job.Action, LastScheduledAt: now})
+	if err != nil {
+		return err
+	}
+	row, err := queries.SelectCronJob(ctx, job.Action)
+	if err != nil {
+		return err
+	}
+	scheduledAt := job.Schedule.Last(row.LastScheduledAt, now)
+	if scheduledAt.IsZero() {
+		return nil
+	}
+	if missed := job.Schedule.Next(row.LastScheduledAt); !missed.Equal(scheduledAt) {
+		log.Printf("Catching up action: %s, missed since: %s", job.Action, missed.Format(time.RFC3339))
+	}
+	runCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), schedulerTimeout())
+	defer cancel()
+	runErr := s.Run(runCtx, PubSubMessage{
+		Attributes: map[string]string{"action": job.Action},
+		MessageID:  "cron:" + job.Action + ":" + scheduledAt.Format(time.RFC3339),
+	})
+	lastError := ""
+	if runErr != nil {
+		lastError = runErr.Error()
+		log.Printf("Cron action: %s failed: %v\n", job.Action, runErr)
+	}
+	recordCtx, cancelRecord := context.WithTimeout(context.WithoutCancel(ctx), cronRecordTimeout)
+	defer cancelRecord()
+	return queries.UpdateCronJobAfterRun(recordCtx, data.UpdateCronJobAfterRunParams{
+		LastScheduledAt: scheduledAt,
+		LastError:       lastError,
+		Action:          job.Action,
+	})
+}
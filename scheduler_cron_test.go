@@ -0,0 +1,42 @@
+package p
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asendia/legacy-api/cron"
+)
+
+func TestLoadCronJobsFromEnv(t *testing.T) {
+	t.Setenv("CRON_SEND_REMINDER_MESSAGES", "")
+	t.Setenv("CRON_SEND_TESTAMENTS", "")
+	t.Setenv("CRON_DISPATCH_EMAILS", "")
+	t.Setenv("CRON_TIME_ZONE", "")
+	if jobs, err := loadCronJobsFromEnv(); err != nil || len(jobs) != 0 {
+		t.Fatalf("No job should be scheduled by default: %+v %v", jobs, err)
+	}
+	t.Setenv("CRON_SEND_REMINDER_MESSAGES", "0 9 * * *")
+	t.Setenv("CRON_SEND_TESTAMENTS", "@daily")
+	t.Setenv("CRON_TIME_ZONE", "Asia/Jakarta")
+	jobs, err := loadCronJobsFromEnv()
+	if err != nil {
+		t.Fatalf("Cannot load the jobs: %v", err)
+	}
+	if len(jobs) != 2 || jobs[0].Action != "send-reminder-messages" || jobs[1].Action != "send-testaments" {
+		t.Fatalf("Unexpected jobs: %+v", jobs)
+	}
+	next := jobs[0].Schedule.Next(time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC))
+	if !next.Equal(time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC)) {
+		t.Fatalf("The job should run at 09:00 in Jakarta, got: %v", next)
+	}
+	t.Setenv("CRON_TIME_ZONE", "Nowhere/Nothing")
+	if _, err = loadCronJobsFromEnv(); err == nil {
+		t.Fatalf("An unknown time zone should be invalid")
+	}
+	t.Setenv("CRON_TIME_ZONE", "")
+	t.Setenv("CRON_SEND_TESTAMENTS", "0 9 * *")
+	if _, err = loadCronJobsFromEnv(); !errors.Is(err, cron.ErrInvalidExpression) {
+		t.Fatalf("An invalid expression should fail, got: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package secure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrDevAuthInProd = errors.New("dev-static authenticator is not allowed in prod")
+
+// ErrNetlifyKeysRequired refuses to check every token by calling Netlify in prod
+var ErrNetlifyKeysRequired = errors.New("env NETLIFY_JWT_SECRET or NETLIFY_JWKS_URL is required in prod")
+
+// Identity is the user of a frontend request, the same fields for every authentication provider
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	DisplayName   string
+	// Provider is the authenticator which verified the identity, e.g. "netlify"
+	Provider string
+}
+
+// ToJWTResponse keeps APIForFrontend independent from the authentication provider
+func (i Identity) ToJWTResponse() JWTResponse {
+	return JWTResponse{
+		ID:           i.Subject,
+		Email:        i.Email,
+		AppMetadata:  JWTAppMetaData{Provider: i.Provider},
+		UserMetadata: JWTUserMetadata{FullName: i.DisplayName},
+	}
+}
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, authHeader string) (Identity, error)
+}
+
+// LoadAuthenticatorFromEnv picks the authenticator of AUTH_PROVIDER: netlify, supabase, oidc or dev-static.
+// The default is netlify in prod & dev-static elsewhere. JWKS keys are refreshed until ctx is done.
+func LoadAuthenticatorFromEnv(ctx context.Context, client HTTPClient) (Authenticator, error) {
+	isProd := os.Getenv("ENVIRONMENT") == "prod"
+	provider := os.Getenv("AUTH_PROVIDER")
+	if provider == "" {
+		provider = "dev-static"
+		if isProd {
+			provider = "netlify"
+		}
+	}
+	switch provider {
+	case "netlify":
+		verifier, isConfigured, err := LoadLocalJWTVerifierFromEnv(client)
+		if err != nil {
+			return nil, err
+		}
+		if !isConfigured && isProd {
+			return nil, ErrNetlifyKeysRequired
+		}
+		a := NetlifyAuthenticator{Client: client}
+		if isConfigured {
+			startJWKSCache(ctx, verifier.Keys)
+			a.Verifier = &verifier
+		}
+		return a, nil
+	case "supabase":
+		a, err := NewSupabaseAuthenticator(os.Getenv("SUPABASE_URL"), os.Getenv("SUPABASE_JWT_SECRET"), client)
+		if err != nil {
+			return nil, err
+		}
+		startJWKSCache(ctx, a.Verifier.Keys)
+		return a, nil
+	case "oidc":
+		return NewOIDCAuthenticator(ctx, os.Getenv("OIDC_ISSUER_URL"), os.Getenv("OIDC_CLIENT_ID"), client)
+	case "dev-static":
+		if isProd {
+			return nil, ErrDevAuthInProd
+		}
+		email := os.Getenv("DEV_AUTH_EMAIL")
+		if email == "" {
+			email = "test@sejiwo.com"
+		}
+		return DevStaticAuthenticator{Identity: Identity{Subject: email, Email: email, EmailVerified: true}}, nil
+	default:
+		return nil, fmt.Errorf("unknown AUTH_PROVIDER: %s", provider)
+	}
+}
+
+func startJWKSCache(ctx context.Context, keys JWTKeySource) {
+	if jwksCache, ok := keys.(*JWKSCache); ok {
+		jwksCache.Start(ctx)
+	}
+}
+
+func parseBearerToken(authHeader string) (string, error) {
+	authHeaderSlice := strings.Split(authHeader, " ")
+	if len(authHeaderSlice) != 2 || authHeaderSlice[0] != "Bearer" {
+		return "", errors.New("Invalid authorization header")
+	}
+	return authHeaderSlice[1], nil
+}
+
+// DevStaticAuthenticator logs every request in as the same user, for tests & local development
+type DevStaticAuthenticator struct {
+	Identity Identity
+}
+
+func (a DevStaticAuthenticator) Authenticate(ctx context.Context, authHeader string) (Identity, error) {
+	if os.Getenv("ENVIRONMENT") == "prod" {
+		return Identity{}, ErrDevAuthInProd
+	}
+	identity := a.Identity
+	identity.Provider = "dev-static"
+	return identity, nil
+}
+
+type NetlifyAuthenticator struct {
+	// Nil Verifier checks every token by calling Netlify, outside prod only
+	Verifier *LocalJWTVerifier
+	Client   HTTPClient
+}
+
+func (a NetlifyAuthenticator) Authenticate(ctx context.Context, authHeader string) (identity Identity, err error) {
+	var jwtRes JWTResponse
+	if a.Verifier != nil {
+		jwtRes, err = a.Verifier.VerifyAuthHeader(ctx, authHeader)
+	} else if os.Getenv("ENVIRONMENT") == "prod" {
+		return identity, ErrNetlifyKeysRequired
+	} else {
+		jwtRes, err = VerifyNetlifyJWT(a.Client, authHeader)
+	}
+	if err != nil {
+		return identity, err
+	}
+	// GoTrue only issues tokens to confirmed users
+	return Identity{
+		Subject:       jwtRes.ID,
+		Email:         jwtRes.Email,
+		EmailVerified: jwtRes.Email != "",
+		DisplayName:   jwtRes.UserMetadata.FullName,
+		Provider:      "netlify",
+	}, nil
+}
+
+type supabaseJWTClaims struct {
+	Email       string `json:"email"`
+	IsAnonymous bool   `json:"is_anonymous"`
+	AppMetadata struct {
+		Provider string `json:"provider"`
+	} `json:"app_metadata"`
+	UserMetadata struct {
+		FullName      string   `json:"full_name"`
+		Name          string   `json:"name"`
+		EmailVerified jsonBool `json:"email_verified"`
+	} `json:"user_metadata"`
+	JWTRegisteredClaims
+}
+
+type SupabaseAuthenticator struct {
+	Verifier LocalJWTVerifier
+}
+
+// NewSupabaseAuthenticator verifies with the legacy HS256 jwtSecret when it is set, otherwise with the project JWKS
+func NewSupabaseAuthenticator(projectURL string, jwtSecret string, client HTTPClient) (a SupabaseAuthenticator, err error) {
+	if projectURL == "" {
+		return a, errors.New("SUPABASE_URL is required")
+	}
+	issuer := strings.TrimSuffix(projectURL, "/") + "/auth/v1"
+	a.Verifier.Options = JWTVerifyOptions{Issuer: issuer, Audiences: []string{"authenticated"}}
+	if jwtSecret != "" {
+		a.Verifier.Keys = StaticJWTKeys{"": []byte(jwtSecret)}
+	} else {
+		a.Verifier.Keys = NewJWKSCache(issuer+"/.well-known/jwks.json", client)
+	}
+	return a, nil
+}
+
+func (a SupabaseAuthenticator) Authenticate(ctx context.Context, authHeader string) (identity Identity, err error) {
+	claims := supabaseJWTClaims{}
+	if err = a.Verifier.Verify(ctx, authHeader, &claims); err != nil {
+		return identity, err
+	}
+	if claims.Email == "" || claims.IsAnonymous {
+		return identity, fmt.Errorf("%w: email claim is required", ErrInvalidJWT)
+	}
+	displayName := claims.UserMetadata.FullName
+	if displayName == "" {
+		displayName = claims.UserMetadata.Name
+	}
+	// Email sign-ins are confirmed before a token is issued, OAuth providers report it in the user metadata
+	return Identity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.AppMetadata.Provider == "email" || bool(claims.UserMetadata.EmailVerified),
+		DisplayName:   displayName,
+		Provider:      "supabase",
+	}, nil
+}
+
+type oidcJWTClaims struct {
+	Email         string   `json:"email"`
+	EmailVerified jsonBool `json:"email_verified"`
+	Name          string   `json:"name"`
+	JWTRegisteredClaims
+}
+
+// OIDCAuthenticator verifies the ID tokens of any OpenID Connect provider, the JWKS URL comes from its discovery document
+type OIDCAuthenticator struct {
+	IssuerURL string
+	ClientID  string
+	Client    HTTPClient
+
+	ctx      context.Context
+	mu       sync.Mutex
+	verifier *LocalJWTVerifier
+}
+
+func NewOIDCAuthenticator(ctx context.Context, issuerURL string, clientID string, client HTTPClient) (*OIDCAuthenticator, error) {
+	if issuerURL == "" || clientID == "" {
+		return nil, errors.New("OIDC_ISSUER_URL & OIDC_CLIENT_ID are required")
+	}
+	return &OIDCAuthenticator{IssuerURL: issuerURL, ClientID: clientID, Client: client, ctx: ctx}, nil
+}
+
+// loadVerifier fetches the discovery document on the first request, a failed one is retried by the next request
+func (a *OIDCAuthenticator) loadVerifier(ctx context.Context) (*LocalJWTVerifier, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.verifier != nil {
+		return a.verifier, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(a.IssuerURL, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected OIDC discovery status code: %d", res.StatusCode)
+	}
+	discovery := struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != a.IssuerURL || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("invalid OIDC discovery document of %s", a.IssuerURL)
+	}
+	jwksCache := NewJWKSCache(discovery.JWKSURI, a.Client)
+	if a.ctx != nil {
+		jwksCache.Start(a.ctx)
+	}
+	a.verifier = &LocalJWTVerifier{
+		Keys:    jwksCache,
+		Options: JWTVerifyOptions{Issuer: discovery.Issuer, Audiences: []string{a.ClientID}},
+	}
+	return a.verifier, nil
+}
+
+func (a *OIDCAuthenticator) Authenticate(ctx context.Context, authHeader string) (identity Identity, err error) {
+	verifier, err := a.loadVerifier(ctx)
+	if err != nil {
+		return identity, err
+	}
+	claims := oidcJWTClaims{}
+	if err = verifier.Verify(ctx, authHeader, &claims); err != nil {
+		return identity, err
+	}
+	if claims.Email == "" {
+		return identity, fmt.Errorf("%w: email claim is required", ErrInvalidJWT)
+	}
+	return Identity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		DisplayName:   claims.Name,
+		Provider:      "oidc",
+	}, nil
+}
+
+// jsonBool also accepts "true" & "false" strings, some providers send email_verified as a string
+type jsonBool bool
+
+func (b *jsonBool) UnmarshalJSON(data []byte) error {
+	var value bool
+	if err := json.Unmarshal(data, &value); err == nil {
+		*b = jsonBool(value)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*b = jsonBool(str == "true")
+	return nil
+}
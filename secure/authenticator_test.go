@@ -0,0 +1,155 @@
+package secure
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadAuthenticatorFromEnv(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.Setenv("ENVIRONMENT", "test")
+	t.Setenv("AUTH_PROVIDER", "")
+	a, err := LoadAuthenticatorFromEnv(ctx, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to load the default authenticator: %v", err)
+	}
+	identity, err := a.Authenticate(ctx, "")
+	if err != nil || identity.Email != "test@sejiwo.com" || !identity.EmailVerified {
+		t.Fatalf("Dev authenticator should log in as test@sejiwo.com: %+v %v", identity, err)
+	}
+	t.Setenv("ENVIRONMENT", "prod")
+	t.Setenv("NETLIFY_JWT_SECRET", "")
+	t.Setenv("NETLIFY_JWKS_URL", "")
+	t.Setenv("JWT_AUDIENCES", "sejiwo")
+	// Every request would call Netlify without the keys
+	if _, err = LoadAuthenticatorFromEnv(ctx, http.DefaultClient); !errors.Is(err, ErrNetlifyKeysRequired) {
+		t.Fatalf("Netlify without local keys should be refused in prod, got: %v", err)
+	}
+	if _, err = (NetlifyAuthenticator{}).Authenticate(ctx, "Bearer token"); !errors.Is(err, ErrNetlifyKeysRequired) {
+		t.Fatalf("Netlify should not be called in prod, got: %v", err)
+	}
+	t.Setenv("NETLIFY_JWT_SECRET", testJWTSecret)
+	if a, _ = LoadAuthenticatorFromEnv(ctx, http.DefaultClient); a == nil {
+		t.Fatalf("Netlify should be the default authenticator in prod")
+	} else if netlify, ok := a.(NetlifyAuthenticator); !ok || netlify.Verifier == nil {
+		t.Fatalf("Netlify with a local verifier should be the default authenticator in prod, got: %T", a)
+	}
+	t.Setenv("AUTH_PROVIDER", "dev-static")
+	if _, err = LoadAuthenticatorFromEnv(ctx, http.DefaultClient); !errors.Is(err, ErrDevAuthInProd) {
+		t.Fatalf("Dev authenticator should be refused in prod, got: %v", err)
+	}
+	t.Setenv("AUTH_PROVIDER", "unknown")
+	if _, err = LoadAuthenticatorFromEnv(ctx, http.DefaultClient); err == nil {
+		t.Fatalf("Unknown AUTH_PROVIDER should be refused")
+	}
+}
+
+func TestNetlifyAuthenticator(t *testing.T) {
+	a := NetlifyAuthenticator{Verifier: &LocalJWTVerifier{
+		Keys:    StaticJWTKeys{"": []byte(testJWTSecret)},
+		Options: JWTVerifyOptions{Audiences: []string{"sejiwo"}},
+	}}
+	token := mintHS256JWT(t, []byte(testJWTSecret), generateNetlifyClaims(time.Hour))
+	identity, err := a.Authenticate(context.Background(), "Bearer "+token)
+	if err != nil {
+		t.Fatalf("Netlify authentication is failed: %v", err)
+	}
+	expected := Identity{Subject: "abc", Email: "test@sejiwo.com", EmailVerified: true, DisplayName: "Sir Legacy", Provider: "netlify"}
+	if identity != expected {
+		t.Fatalf("Unexpected identity: %+v", identity)
+	}
+	if jwtRes := identity.ToJWTResponse(); jwtRes.Email != expected.Email || jwtRes.UserMetadata.FullName != expected.DisplayName {
+		t.Fatalf("Unexpected JWT response: %+v", jwtRes)
+	}
+}
+
+func TestSupabaseAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/auth/v1/.well-known/jwks.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(generateJWKS(map[string]any{"supabase-key": &key.PublicKey}))
+	}))
+	defer server.Close()
+	a, err := NewSupabaseAuthenticator(server.URL, "", server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create the Supabase authenticator: %v", err)
+	}
+	claims := map[string]any{
+		"sub":           "supabase-user",
+		"iss":           server.URL + "/auth/v1",
+		"aud":           "authenticated",
+		"exp":           time.Now().Add(time.Hour).Unix(),
+		"email":         "test@sejiwo.com",
+		"app_metadata":  map[string]any{"provider": "google"},
+		"user_metadata": map[string]any{"name": "Sir Legacy", "email_verified": true},
+	}
+	identity, err := a.Authenticate(ctx, "Bearer "+mintES256JWT(t, key, "supabase-key", claims))
+	if err != nil {
+		t.Fatalf("Supabase authentication is failed: %v", err)
+	}
+	expected := Identity{Subject: "supabase-user", Email: "test@sejiwo.com", EmailVerified: true, DisplayName: "Sir Legacy", Provider: "supabase"}
+	if identity != expected {
+		t.Fatalf("Unexpected identity: %+v", identity)
+	}
+	claims["aud"] = "anon"
+	if _, err = a.Authenticate(ctx, "Bearer "+mintES256JWT(t, key, "supabase-key", claims)); !errors.Is(err, ErrJWTAudience) {
+		t.Fatalf("Token of another audience should be rejected, got: %v", err)
+	}
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/keys"})
+		case "/keys":
+			w.Write(generateJWKS(map[string]any{"oidc-key": &key.PublicKey}))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	a, err := NewOIDCAuthenticator(ctx, server.URL, "legacy-client", server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create the OIDC authenticator: %v", err)
+	}
+	claims := map[string]any{
+		"sub":            "oidc-user",
+		"iss":            server.URL,
+		"aud":            "legacy-client",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"email":          "test@sejiwo.com",
+		"email_verified": "false",
+		"name":           "Sir Legacy",
+	}
+	identity, err := a.Authenticate(ctx, "Bearer "+mintRS256JWT(t, key, "oidc-key", claims))
+	if err != nil {
+		t.Fatalf("OIDC authentication is failed: %v", err)
+	}
+	expected := Identity{Subject: "oidc-user", Email: "test@sejiwo.com", EmailVerified: false, DisplayName: "Sir Legacy", Provider: "oidc"}
+	if identity != expected {
+		t.Fatalf("Unexpected identity: %+v", identity)
+	}
+	claims["iss"] = "https://evil.example.com"
+	if _, err = a.Authenticate(ctx, "Bearer "+mintRS256JWT(t, key, "oidc-key", claims)); !errors.Is(err, ErrJWTIssuer) {
+		t.Fatalf("Token of another issuer should be rejected, got: %v", err)
+	}
+}
@@ -6,7 +6,17 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+)
+
+var (
+	ErrInvalidCiphertext   = errors.New("invalid ciphertext")
+	ErrUnsupportedEnvelope = errors.New("unsupported ciphertext envelope")
+	ErrDecryptionFailed    = errors.New("decryption failed, wrong key or tampered ciphertext")
+	ErrUnknownKey          = errors.New("unknown encryption key id")
 )
 
 type EncryptResult struct {
@@ -18,7 +28,8 @@ func Encode(b []byte) string {
 	return base64.StdEncoding.EncodeToString(b)
 }
 
-// Encrypt method is to encrypt or hide any classified text
+// Encrypt method is to encrypt or hide any classified text.
+// Deprecated: AES-CFB is unauthenticated, use SealEnvelope instead.
 func Encrypt(text, secret string) (EncryptResult, error) {
 	block, err := aes.NewCipher([]byte(secret))
 	if err != nil {
@@ -36,27 +47,130 @@ func Encrypt(text, secret string) (EncryptResult, error) {
 	return EncryptResult{Text: Encode(cipherText), IV: hex.EncodeToString(iv)}, nil
 }
 
-func Decode(s string) []byte {
+func Decode(s string) ([]byte, error) {
 	data, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
 	}
-	return data
+	return data, nil
 }
 
-// Decrypt method is to extract back the encrypted text
+// Decrypt method is to extract back the text encrypted by Encrypt
 func Decrypt(encryptResult EncryptResult, secret string) (string, error) {
 	block, err := aes.NewCipher([]byte(secret))
 	if err != nil {
 		return "", err
 	}
-	cipherText := Decode(encryptResult.Text)
-	iv, err := hex.DecodeString(encryptResult.IV)
+	cipherText, err := Decode(encryptResult.Text)
 	if err != nil {
-		return "", nil
+		return "", err
+	}
+	iv, err := hex.DecodeString(encryptResult.IV)
+	if err != nil || len(iv) != aes.BlockSize {
+		return "", fmt.Errorf("%w: invalid iv", ErrInvalidCiphertext)
 	}
 	cfb := cipher.NewCFBDecrypter(block, iv)
 	plainText := make([]byte, len(cipherText))
 	cfb.XORKeyStream(plainText, cipherText)
 	return string(plainText), nil
 }
+
+const (
+	EnvelopeVersion   = "v2"
+	EnvelopeAlgorithm = "gcm"
+)
+
+// Envelope is the parsed form of "v2:gcm:<keyid>:<nonce>:<ciphertext>",
+// nonce & ciphertext are base64 encoded in the string form
+type Envelope struct {
+	Version    string
+	Algorithm  string
+	KeyID      string
+	Nonce      []byte
+	CipherText []byte
+}
+
+func IsEnvelope(s string) bool {
+	return strings.HasPrefix(s, EnvelopeVersion+":")
+}
+
+// EnvelopePrefix is the common prefix of every envelope sealed with keyID
+func EnvelopePrefix(keyID string) string {
+	return EnvelopeVersion + ":" + EnvelopeAlgorithm + ":" + keyID + ":"
+}
+
+func ParseEnvelope(s string) (env Envelope, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 5 {
+		return env, fmt.Errorf("%w: expected 5 envelope parts, got %d", ErrInvalidCiphertext, len(parts))
+	}
+	env.Version, env.Algorithm, env.KeyID = parts[0], parts[1], parts[2]
+	if env.Version != EnvelopeVersion || env.Algorithm != EnvelopeAlgorithm {
+		return env, fmt.Errorf("%w: %s:%s", ErrUnsupportedEnvelope, env.Version, env.Algorithm)
+	}
+	if env.KeyID == "" {
+		return env, fmt.Errorf("%w: empty key id", ErrInvalidCiphertext)
+	}
+	if env.Nonce, err = Decode(parts[3]); err != nil {
+		return env, err
+	}
+	if env.CipherText, err = Decode(parts[4]); err != nil {
+		return env, err
+	}
+	return env, nil
+}
+
+func (env Envelope) String() string {
+	return EnvelopePrefix(env.KeyID) + Encode(env.Nonce) + ":" + Encode(env.CipherText)
+}
+
+// The envelope header is authenticated, so a ciphertext cannot be relabeled with another key id
+func (env Envelope) additionalData() []byte {
+	return []byte(EnvelopePrefix(env.KeyID))
+}
+
+// SealEnvelope encrypts the text with AES-GCM, secret must be 16, 24 or 32 bytes
+func SealEnvelope(text, keyID, secret string) (string, error) {
+	if keyID == "" || strings.Contains(keyID, ":") {
+		return "", fmt.Errorf("invalid key id: %q", keyID)
+	}
+	aead, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+	env := Envelope{
+		Version:   EnvelopeVersion,
+		Algorithm: EnvelopeAlgorithm,
+		KeyID:     keyID,
+		Nonce:     make([]byte, aead.NonceSize()),
+	}
+	if _, err := io.ReadFull(rand.Reader, env.Nonce); err != nil {
+		return "", err
+	}
+	env.CipherText = aead.Seal(nil, env.Nonce, []byte(text), env.additionalData())
+	return env.String(), nil
+}
+
+// OpenEnvelope decrypts & authenticates the envelope with the secret of env.KeyID
+func OpenEnvelope(env Envelope, secret string) (string, error) {
+	aead, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return "", fmt.Errorf("%w: invalid nonce size", ErrInvalidCiphertext)
+	}
+	plainText, err := aead.Open(nil, env.Nonce, env.CipherText, env.additionalData())
+	if err != nil {
+		return "", ErrDecryptionFailed
+	}
+	return string(plainText), nil
+}
+
+func newGCM(secret string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher([]byte(secret))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
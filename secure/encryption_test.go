@@ -1,6 +1,8 @@
 package secure
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -44,3 +46,77 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Fatalf("Source string does not match with decrypted string:\n%s\n%s\n", plainText, decryptedText)
 	}
 }
+
+func TestSealOpenEnvelope(t *testing.T) {
+	secret, err := GenerateRandomString(32)
+	if err != nil {
+		t.Fatalf("Error generating random string: %v", err)
+	}
+	for _, plainText := range []string{"Hallo Inka, kamu adalah kentut", ""} {
+		sealed, err := SealEnvelope(plainText, "default", secret)
+		if err != nil {
+			t.Fatalf("Encryption error: %v\n", err)
+		}
+		if !strings.HasPrefix(sealed, "v2:gcm:default:") {
+			t.Fatalf("Envelope should start with v2:gcm:default:, got %s", sealed)
+		}
+		env, err := ParseEnvelope(sealed)
+		if err != nil {
+			t.Fatalf("Cannot parse envelope %s: %v", sealed, err)
+		}
+		decryptedText, err := OpenEnvelope(env, secret)
+		if err != nil {
+			t.Fatalf("Decryption error: %v\n", err)
+		}
+		if plainText != decryptedText {
+			t.Fatalf("Source string does not match with decrypted string:\n%s\n%s\n", plainText, decryptedText)
+		}
+	}
+}
+
+func TestOpenEnvelopeTampered(t *testing.T) {
+	secret, _ := GenerateRandomString(32)
+	sealed, err := SealEnvelope("Hallo Inka", "default", secret)
+	if err != nil {
+		t.Fatalf("Encryption error: %v\n", err)
+	}
+	env, _ := ParseEnvelope(sealed)
+	env.CipherText[0] ^= 1
+	if _, err = OpenEnvelope(env, secret); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("Tampered ciphertext should fail with ErrDecryptionFailed, got %v", err)
+	}
+	env, _ = ParseEnvelope(sealed)
+	env.KeyID = "other"
+	if _, err = OpenEnvelope(env, secret); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("Relabeled key id should fail with ErrDecryptionFailed, got %v", err)
+	}
+	otherSecret, _ := GenerateRandomString(32)
+	env, _ = ParseEnvelope(sealed)
+	if _, err = OpenEnvelope(env, otherSecret); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("Wrong secret should fail with ErrDecryptionFailed, got %v", err)
+	}
+}
+
+func TestParseEnvelopeInvalid(t *testing.T) {
+	cases := map[string]error{
+		"v2:gcm:default:nonce":           ErrInvalidCiphertext,
+		"v2:gcm::AAAA:AAAA":              ErrInvalidCiphertext,
+		"v2:gcm:default:!!!:AAAA":        ErrInvalidCiphertext,
+		"v3:gcm:default:AAAA:AAAA":       ErrUnsupportedEnvelope,
+		"v2:chacha20:default:AAAA:AAAA":  ErrUnsupportedEnvelope,
+		"0123456789abcdef.not base64!!!": ErrInvalidCiphertext,
+	}
+	for s, expectedErr := range cases {
+		if _, err := ParseEnvelope(s); !errors.Is(err, expectedErr) {
+			t.Fatalf("Parsing %s should fail with %v, got %v", s, expectedErr, err)
+		}
+	}
+}
+
+func TestDecryptInvalidBase64(t *testing.T) {
+	secret, _ := GenerateRandomString(32)
+	_, err := Decrypt(EncryptResult{IV: "00112233445566778899aabbccddeeff", Text: "not base64!!!"}, secret)
+	if !errors.Is(err, ErrInvalidCiphertext) {
+		t.Fatalf("Invalid base64 should fail with ErrInvalidCiphertext instead of panicking, got %v", err)
+	}
+}
@@ -0,0 +1,482 @@
+package secure
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidJWT      = errors.New("invalid jwt")
+	ErrJWTExpired      = errors.New("jwt is expired")
+	ErrJWTAudience     = errors.New("jwt audience is not accepted")
+	ErrJWTIssuer       = errors.New("jwt issuer is not accepted")
+	ErrJWTKeyNotFound  = errors.New("jwt signing key not found")
+	ErrJWTBadSignature = errors.New("jwt signature is invalid")
+)
+
+const (
+	DefaultJWKSRefreshInterval = time.Hour
+	// An unknown kid triggers a refresh, at most once per interval, e.g. right after a key rotation
+	minJWKSRefreshInterval = 30 * time.Second
+	defaultJWTLeeway       = 30 * time.Second
+)
+
+// JWTAudience accepts both the string & the array form of the aud claim
+type JWTAudience []string
+
+func (a *JWTAudience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = JWTAudience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// JWTRegisteredClaims are the claims checked by VerifyJWT
+type JWTRegisteredClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  JWTAudience `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	IssuedAt  int64       `json:"iat"`
+}
+
+// NetlifyJWTClaims are the claims of a GoTrue (Netlify Identity) access token
+type NetlifyJWTClaims struct {
+	JWTRegisteredClaims
+	Email        string          `json:"email"`
+	Role         string          `json:"role"`
+	AppMetadata  JWTAppMetaData  `json:"app_metadata"`
+	UserMetadata JWTUserMetadata `json:"user_metadata"`
+}
+
+func (c NetlifyJWTClaims) ToJWTResponse() JWTResponse {
+	res := JWTResponse{
+		ID:           c.Subject,
+		Role:         c.Role,
+		Email:        c.Email,
+		AppMetadata:  c.AppMetadata,
+		UserMetadata: c.UserMetadata,
+	}
+	if len(c.Audience) > 0 {
+		res.Aud = c.Audience[0]
+	}
+	return res
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// JWTKeySource returns the key of a token: []byte for HS256, *rsa.PublicKey for RS256, *ecdsa.PublicKey for ES256
+type JWTKeySource interface {
+	JWTKey(ctx context.Context, alg string, kid string) (any, error)
+}
+
+// StaticJWTKeys maps a kid to its key, "" matches the tokens without a kid
+type StaticJWTKeys map[string]any
+
+func (k StaticJWTKeys) JWTKey(ctx context.Context, alg string, kid string) (any, error) {
+	key, ok := k[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: kid %q", ErrJWTKeyNotFound, kid)
+	}
+	return key, nil
+}
+
+type JWTVerifyOptions struct {
+	// Empty accepts any audience
+	Audiences []string
+	// Empty accepts any issuer
+	Issuer string
+	Leeway time.Duration
+	Now    func() time.Time
+}
+
+// VerifyJWT checks the signature, expiry, audience & issuer of the token, then decodes its payload into claims
+func VerifyJWT(ctx context.Context, token string, keys JWTKeySource, opts JWTVerifyOptions, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: token should have 3 segments", ErrInvalidJWT)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJWT, err)
+	}
+	header := jwtHeader{}
+	if err = json.Unmarshal(headerJSON, &header); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJWT, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJWT, err)
+	}
+	key, err := keys.JWTKey(ctx, header.Alg, header.Kid)
+	if err != nil {
+		return err
+	}
+	if err = verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJWT, err)
+	}
+	registered := JWTRegisteredClaims{}
+	if err = json.Unmarshal(payload, &registered); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJWT, err)
+	}
+	if err = validateJWTClaims(registered, opts); err != nil {
+		return err
+	}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJWT, err)
+	}
+	return nil
+}
+
+// The key type decides the algorithm, a token can not pick HS256 to be checked against an RSA public key
+func verifyJWTSignature(alg string, key any, signingInput string, signature []byte) error {
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("%w: HS256 is not allowed for this key", ErrInvalidJWT)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrJWTBadSignature
+		}
+		return nil
+	case "RS256":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: RS256 is not allowed for this key", ErrInvalidJWT)
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return ErrJWTBadSignature
+		}
+		return nil
+	case "ES256":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || publicKey.Curve != elliptic.P256() {
+			return fmt.Errorf("%w: ES256 is not allowed for this key", ErrInvalidJWT)
+		}
+		// The signature is r & s, 32 bytes each
+		if len(signature) != 64 {
+			return ErrJWTBadSignature
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return ErrJWTBadSignature
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported alg %q", ErrInvalidJWT, alg)
+	}
+}
+
+func validateJWTClaims(c JWTRegisteredClaims, opts JWTVerifyOptions) error {
+	now := time.Now()
+	if opts.Now != nil {
+		now = opts.Now()
+	}
+	leeway := opts.Leeway
+	if leeway == 0 {
+		leeway = defaultJWTLeeway
+	}
+	if c.ExpiresAt == 0 {
+		return fmt.Errorf("%w: exp claim is required", ErrInvalidJWT)
+	}
+	if now.After(time.Unix(c.ExpiresAt, 0).Add(leeway)) {
+		return ErrJWTExpired
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return fmt.Errorf("%w: token is not valid yet", ErrInvalidJWT)
+	}
+	if opts.Issuer != "" && c.Issuer != opts.Issuer {
+		return ErrJWTIssuer
+	}
+	if len(opts.Audiences) == 0 {
+		return nil
+	}
+	for _, aud := range c.Audience {
+		for _, accepted := range opts.Audiences {
+			if aud == accepted {
+				return nil
+			}
+		}
+	}
+	return ErrJWTAudience
+}
+
+// JWKSCache keeps the RSA & EC keys of a JWKS endpoint, refreshed by Start & whenever an unknown kid shows up
+type JWKSCache struct {
+	URL             string
+	Client          HTTPClient
+	RefreshInterval time.Duration
+
+	mu   sync.RWMutex
+	keys map[string]any
+	// The last fetch, failed or not
+	fetchedAt time.Time
+	// The refresh of an unknown kid, shared by the tokens waiting for it
+	refreshing *jwksRefresh
+}
+
+type jwksRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+func NewJWKSCache(url string, client HTTPClient) *JWKSCache {
+	return &JWKSCache{URL: url, Client: client, RefreshInterval: DefaultJWKSRefreshInterval}
+}
+
+// Start refreshes the keys on a timer until ctx is done
+func (c *JWKSCache) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(c.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.Refresh(ctx); err != nil {
+					fmt.Printf("Failed to refresh JWKS %s: %v\n", c.URL, err)
+				}
+			}
+		}
+	}()
+}
+
+func (c *JWKSCache) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected JWKS status code: %d", res.StatusCode)
+	}
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&jwks); err != nil {
+		return err
+	}
+	keys := map[string]any{}
+	invalidErrs := []error{}
+	for _, jwk := range jwks.Keys {
+		// Encryption keys are not used to sign the tokens
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var publicKey any
+		switch jwk.Kty {
+		case "RSA":
+			publicKey, err = jwk.rsaPublicKey()
+		case "EC":
+			publicKey, err = jwk.ecPublicKey()
+		default:
+			continue
+		}
+		if err != nil {
+			// One bad key of the provider should not break the others
+			err = fmt.Errorf("invalid JWKS key %q: %w", jwk.Kid, err)
+			fmt.Printf("Skipped a key of JWKS %s: %v\n", c.URL, err)
+			invalidErrs = append(invalidErrs, err)
+			continue
+		}
+		keys[jwk.Kid] = publicKey
+	}
+	if len(keys) == 0 && len(invalidErrs) > 0 {
+		return fmt.Errorf("no usable JWKS key: %w", errors.Join(invalidErrs...))
+	}
+	c.mu.Lock()
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// JWTKey refreshes the keys when kid is unknown, once per minJWKSRefreshInterval.
+// Concurrent tokens with an unknown kid wait for the same refresh.
+func (c *JWKSCache) JWTKey(ctx context.Context, alg string, kid string) (any, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	if ok {
+		c.mu.Unlock()
+		return key, nil
+	}
+	refresh := c.refreshing
+	if refresh == nil {
+		if time.Since(c.fetchedAt) < minJWKSRefreshInterval {
+			c.mu.Unlock()
+			return nil, fmt.Errorf("%w: kid %q", ErrJWTKeyNotFound, kid)
+		}
+		refresh = &jwksRefresh{done: make(chan struct{})}
+		c.refreshing = refresh
+		c.fetchedAt = time.Now()
+		c.mu.Unlock()
+		// A canceled request does not fail the tokens waiting for the refresh
+		refresh.err = c.Refresh(context.WithoutCancel(ctx))
+		c.mu.Lock()
+		c.refreshing = nil
+		c.mu.Unlock()
+		close(refresh.done)
+	} else {
+		c.mu.Unlock()
+	}
+	select {
+	case <-refresh.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if refresh.err != nil {
+		return nil, refresh.err
+	}
+	c.mu.RLock()
+	key, ok = c.keys[kid]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: kid %q", ErrJWTKeyNotFound, kid)
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 {
+		return nil, errors.New("invalid RSA modulus or exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+func (k jsonWebKey) ecPublicKey() (*ecdsa.PublicKey, error) {
+	if k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+		return nil, errors.New("EC point is not on the curve")
+	}
+	return publicKey, nil
+}
+
+// LocalJWTVerifier verifies Netlify Identity tokens without calling Netlify
+type LocalJWTVerifier struct {
+	Keys    JWTKeySource
+	Options JWTVerifyOptions
+}
+
+// LoadLocalJWTVerifierFromEnv uses the GoTrue HS256 secret of NETLIFY_JWT_SECRET, or the RS256 keys of NETLIFY_JWKS_URL.
+// JWT_AUDIENCES is a comma separated list of the accepted audiences, required with either key.
+// isConfigured is false when neither key is set.
+func LoadLocalJWTVerifierFromEnv(client HTTPClient) (v LocalJWTVerifier, isConfigured bool, err error) {
+	for _, aud := range strings.Split(os.Getenv("JWT_AUDIENCES"), ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			v.Options.Audiences = append(v.Options.Audiences, aud)
+		}
+	}
+	secret := os.Getenv("NETLIFY_JWT_SECRET")
+	jwksURL := os.Getenv("NETLIFY_JWKS_URL")
+	switch {
+	case secret != "" && jwksURL != "":
+		return v, false, errors.New("set either NETLIFY_JWT_SECRET or NETLIFY_JWKS_URL, not both")
+	case secret != "":
+		v.Keys = StaticJWTKeys{"": []byte(secret)}
+	case jwksURL != "":
+		v.Keys = NewJWKSCache(jwksURL, client)
+	default:
+		return v, false, nil
+	}
+	if len(v.Options.Audiences) == 0 {
+		return v, false, errors.New("env JWT_AUDIENCES is required to verify the JWTs locally")
+	}
+	return v, true, nil
+}
+
+// Verify verifies the bearer token of an authorization header & decodes its payload into claims,
+// unlike VerifyJWT an audience is always required
+func (v LocalJWTVerifier) Verify(ctx context.Context, authHeader string, claims any) error {
+	if len(v.Options.Audiences) == 0 {
+		return errors.New("jwt audiences are required")
+	}
+	token, err := parseBearerToken(authHeader)
+	if err != nil {
+		return err
+	}
+	return VerifyJWT(ctx, token, v.Keys, v.Options, claims)
+}
+
+// VerifyAuthHeader verifies the Netlify Identity token of an authorization header
+func (v LocalJWTVerifier) VerifyAuthHeader(ctx context.Context, authHeader string) (jwtRes JWTResponse, err error) {
+	claims := NetlifyJWTClaims{}
+	if err = v.Verify(ctx, authHeader, &claims); err != nil {
+		return jwtRes, err
+	}
+	if claims.Email == "" {
+		return jwtRes, fmt.Errorf("%w: email claim is required", ErrInvalidJWT)
+	}
+	return claims.ToJWTResponse(), nil
+}
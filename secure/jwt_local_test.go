@@ -0,0 +1,309 @@
+package secure
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "gotrue jwt secret for the tests"
+
+func TestVerifyLocalJWTHS256(t *testing.T) {
+	v := LocalJWTVerifier{Keys: StaticJWTKeys{"": []byte(testJWTSecret)}, Options: JWTVerifyOptions{Audiences: []string{"sejiwo"}}}
+	token := mintHS256JWT(t, []byte(testJWTSecret), generateNetlifyClaims(time.Hour))
+	jwtRes, err := v.VerifyAuthHeader(context.Background(), "Bearer "+token)
+	if err != nil {
+		t.Fatalf("JWT verification is failed, %v", err)
+	}
+	if jwtRes.Email != "test@sejiwo.com" || jwtRes.ID != "abc" ||
+		jwtRes.AppMetadata.Provider != "email" || jwtRes.UserMetadata.FullName != "Sir Legacy" {
+		t.Fatalf("Unexpected JWT response: %+v", jwtRes)
+	}
+}
+
+func TestVerifyLocalJWTFailed(t *testing.T) {
+	ctx := context.Background()
+	v := LocalJWTVerifier{
+		Keys:    StaticJWTKeys{"": []byte(testJWTSecret)},
+		Options: JWTVerifyOptions{Audiences: []string{"sejiwo"}},
+	}
+	validClaims := generateNetlifyClaims(time.Hour)
+	validClaims["aud"] = []string{"other", "sejiwo"}
+	if _, err := v.VerifyAuthHeader(ctx, "Bearer "+mintHS256JWT(t, []byte(testJWTSecret), validClaims)); err != nil {
+		t.Fatalf("Token with an accepted audience should be valid: %v", err)
+	}
+	expiredClaims := generateNetlifyClaims(-time.Hour)
+	expiredClaims["aud"] = "sejiwo"
+	wrongAudClaims := generateNetlifyClaims(time.Hour)
+	wrongAudClaims["aud"] = "other"
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload, _ := json.Marshal(validClaims)
+	testCases := []struct {
+		name        string
+		authHeader  string
+		expectedErr error
+	}{
+		{"expired", "Bearer " + mintHS256JWT(t, []byte(testJWTSecret), expiredClaims), ErrJWTExpired},
+		{"wrong audience", "Bearer " + mintHS256JWT(t, []byte(testJWTSecret), wrongAudClaims), ErrJWTAudience},
+		{"wrong secret", "Bearer " + mintHS256JWT(t, []byte("another secret"), validClaims), ErrJWTBadSignature},
+		{"alg none", "Bearer " + noneHeader + "." + base64.RawURLEncoding.EncodeToString(payload) + ".", ErrInvalidJWT},
+		{"malformed", "Bearer InvalidToken", ErrInvalidJWT},
+	}
+	for _, tc := range testCases {
+		if _, err := v.VerifyAuthHeader(ctx, tc.authHeader); !errors.Is(err, tc.expectedErr) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expectedErr, err)
+		}
+	}
+	if _, err := v.VerifyAuthHeader(ctx, "Basic abc"); err == nil {
+		t.Errorf("Non bearer authorization header should be rejected")
+	}
+	// Any audience is never accepted
+	v.Options.Audiences = nil
+	if _, err := v.VerifyAuthHeader(ctx, "Bearer "+mintHS256JWT(t, []byte(testJWTSecret), validClaims)); err == nil {
+		t.Errorf("A verifier without audiences should reject every token")
+	}
+}
+
+func TestLoadLocalJWTVerifierFromEnv(t *testing.T) {
+	t.Setenv("NETLIFY_JWKS_URL", "")
+	t.Setenv("NETLIFY_JWT_SECRET", "")
+	t.Setenv("JWT_AUDIENCES", "")
+	if _, isConfigured, err := LoadLocalJWTVerifierFromEnv(http.DefaultClient); isConfigured || err != nil {
+		t.Fatalf("Local verification should not be configured without a key: %v %v", isConfigured, err)
+	}
+	t.Setenv("NETLIFY_JWT_SECRET", testJWTSecret)
+	if _, isConfigured, err := LoadLocalJWTVerifierFromEnv(http.DefaultClient); isConfigured || err == nil {
+		t.Fatalf("Local verification without an audience should be refused: %v %v", isConfigured, err)
+	}
+	t.Setenv("JWT_AUDIENCES", "sejiwo, ")
+	v, isConfigured, err := LoadLocalJWTVerifierFromEnv(http.DefaultClient)
+	if !isConfigured || err != nil || len(v.Options.Audiences) != 1 || v.Options.Audiences[0] != "sejiwo" {
+		t.Fatalf("Local verification should be configured: %+v %v %v", v.Options, isConfigured, err)
+	}
+}
+
+func TestVerifyLocalJWTRS256WithJWKS(t *testing.T) {
+	ctx := context.Background()
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := map[string]any{"old": &oldKey.PublicKey}
+	var fetchCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetchCount, 1)
+		w.Write(generateJWKS(jwks))
+	}))
+	defer server.Close()
+	cache := NewJWKSCache(server.URL, server.Client())
+	v := LocalJWTVerifier{Keys: cache, Options: JWTVerifyOptions{Audiences: []string{"sejiwo"}}}
+	claims := generateNetlifyClaims(time.Hour)
+	if _, err := v.VerifyAuthHeader(ctx, "Bearer "+mintRS256JWT(t, oldKey, "old", claims)); err != nil {
+		t.Fatalf("RS256 verification is failed, %v", err)
+	}
+	if _, err := v.VerifyAuthHeader(ctx, "Bearer "+mintRS256JWT(t, oldKey, "old", claims)); err != nil {
+		t.Fatalf("RS256 verification is failed, %v", err)
+	}
+	if atomic.LoadInt32(&fetchCount) != 1 {
+		t.Fatalf("JWKS should be fetched once, got: %d", fetchCount)
+	}
+	// The new key is published after the last refresh, the unknown kid refreshes the keys
+	jwks["new"] = &newKey.PublicKey
+	cache.mu.Lock()
+	cache.fetchedAt = time.Now().Add(-2 * minJWKSRefreshInterval)
+	cache.mu.Unlock()
+	if _, err := v.VerifyAuthHeader(ctx, "Bearer "+mintRS256JWT(t, newKey, "new", claims)); err != nil {
+		t.Fatalf("Token of the rotated key should be verified, %v", err)
+	}
+	// Unknown kids can not make every request fetch the JWKS
+	if _, err := v.VerifyAuthHeader(ctx, "Bearer "+mintRS256JWT(t, newKey, "unknown", claims)); !errors.Is(err, ErrJWTKeyNotFound) {
+		t.Fatalf("Unknown kid should be rejected, got: %v", err)
+	}
+	if atomic.LoadInt32(&fetchCount) != 2 {
+		t.Fatalf("JWKS should be fetched twice, got: %d", fetchCount)
+	}
+	// HS256 signed with the public key must not pass as RS256
+	publicKeyDER := x509.MarshalPKCS1PublicKey(&oldKey.PublicKey)
+	confusedToken := mintJWT(t, map[string]string{"alg": "HS256", "kid": "old"}, claims, func(input []byte) []byte {
+		mac := hmac.New(sha256.New, publicKeyDER)
+		mac.Write(input)
+		return mac.Sum(nil)
+	})
+	if _, err := v.VerifyAuthHeader(ctx, "Bearer "+confusedToken); !errors.Is(err, ErrInvalidJWT) {
+		t.Fatalf("HS256 token should be rejected for an RSA key, got: %v", err)
+	}
+}
+
+func TestJWKSCacheSkipsInvalidKey(t *testing.T) {
+	ctx := context.Background()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	invalidKey := jsonWebKey{Kty: "EC", Use: "sig", Crv: "secp256k1", X: "AA", Y: "AA"}
+	jwks := map[string]any{"valid": &key.PublicKey, "invalid": invalidKey}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(generateJWKS(jwks))
+	}))
+	defer server.Close()
+	cache := NewJWKSCache(server.URL, server.Client())
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatalf("An invalid key should be skipped: %v", err)
+	}
+	if _, err := cache.JWTKey(ctx, "RS256", "valid"); err != nil {
+		t.Fatalf("The valid key should be usable: %v", err)
+	}
+	// The keys are kept when none of the new ones is usable
+	jwks = map[string]any{"invalid": invalidKey}
+	if err := cache.Refresh(ctx); err == nil {
+		t.Fatalf("A JWKS without a usable key should fail")
+	}
+	if _, err := cache.JWTKey(ctx, "RS256", "valid"); err != nil {
+		t.Fatalf("The last keys should be kept: %v", err)
+	}
+}
+
+func TestJWKSCacheRefreshOnce(t *testing.T) {
+	ctx := context.Background()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var fetchCount int32
+	isDown := atomic.Bool{}
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetchCount, 1)
+		<-release
+		if isDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(generateJWKS(map[string]any{"new": &key.PublicKey}))
+	}))
+	defer server.Close()
+	cache := NewJWKSCache(server.URL, server.Client())
+	// Every token waits for the same refresh
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := cache.JWTKey(ctx, "RS256", "new")
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("The key should be found by the shared refresh: %v", err)
+		}
+	}
+	if atomic.LoadInt32(&fetchCount) != 1 {
+		t.Fatalf("JWKS should be fetched once, got: %d", fetchCount)
+	}
+	// A failed refresh is not retried before the cooldown
+	isDown.Store(true)
+	cache.mu.Lock()
+	cache.fetchedAt = time.Now().Add(-2 * minJWKSRefreshInterval)
+	cache.mu.Unlock()
+	if _, err := cache.JWTKey(ctx, "RS256", "unknown"); err == nil || errors.Is(err, ErrJWTKeyNotFound) {
+		t.Fatalf("The failed refresh should be returned, got: %v", err)
+	}
+	if _, err := cache.JWTKey(ctx, "RS256", "unknown"); !errors.Is(err, ErrJWTKeyNotFound) {
+		t.Fatalf("Unknown kid should be rejected during the cooldown, got: %v", err)
+	}
+	if atomic.LoadInt32(&fetchCount) != 2 {
+		t.Fatalf("JWKS should be fetched twice, got: %d", fetchCount)
+	}
+}
+
+func generateNetlifyClaims(expiresIn time.Duration) map[string]any {
+	return map[string]any{
+		"sub":           "abc",
+		"aud":           "sejiwo",
+		"email":         "test@sejiwo.com",
+		"exp":           time.Now().Add(expiresIn).Unix(),
+		"app_metadata":  map[string]any{"provider": "email"},
+		"user_metadata": map[string]any{"full_name": "Sir Legacy"},
+	}
+}
+
+func mintHS256JWT(t *testing.T, secret []byte, claims map[string]any) string {
+	return mintJWT(t, map[string]string{"alg": "HS256", "typ": "JWT"}, claims, func(input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	})
+}
+
+func mintRS256JWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	return mintJWT(t, map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid}, claims, func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("Failed to sign the token: %v", err)
+		}
+		return signature
+	})
+}
+
+func mintES256JWT(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]any) string {
+	return mintJWT(t, map[string]string{"alg": "ES256", "typ": "JWT", "kid": kid}, claims, func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("Failed to sign the token: %v", err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	})
+}
+
+func mintJWT(t *testing.T, header map[string]string, claims map[string]any, sign func([]byte) []byte) string {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("Failed to marshal the header: %v", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("Failed to marshal the claims: %v", err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func generateJWKS(keys map[string]any) []byte {
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	for kid, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, jsonWebKey{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		case jsonWebKey:
+			key.Kid = kid
+			jwks.Keys = append(jwks.Keys, key)
+		case *ecdsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, jsonWebKey{
+				Kty: "EC",
+				Kid: kid,
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	b, _ := json.Marshal(jwks)
+	return b
+}
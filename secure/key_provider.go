@@ -0,0 +1,101 @@
+package secure
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Envelope key id of the content encrypted with its own data key,
+// the data key itself is stored wrapped by a KeyProvider
+const DataKeyID = "dek"
+
+const DataKeySize = 32
+
+var ErrDataKeyNotFound = errors.New("data key not found, the content might have been crypto-shredded")
+
+// KeyProvider wraps data keys with a key-encryption key (KEK).
+// Rotating the KEK only re-wraps the data keys, the content stays as is.
+type KeyProvider interface {
+	// ActiveKeyID is the id of the KEK used by WrapKey, wrapped keys with another id need re-wrapping
+	ActiveKeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) (wrappedKey string, keyID string, err error)
+	UnwrapKey(ctx context.Context, wrappedKey string) ([]byte, error)
+}
+
+// LoadKeyProviderFromEnv picks the KeyProvider by KEY_PROVIDER, "local" if empty.
+// A cloud KMS provider can be added here, e.g. KEY_PROVIDER=gcp-kms.
+func LoadKeyProviderFromEnv() (KeyProvider, error) {
+	switch provider := os.Getenv("KEY_PROVIDER"); provider {
+	case "", "local":
+		keyring, err := LoadKeyringFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return LocalKeyProvider{Keyring: keyring}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key provider: %s", provider)
+	}
+}
+
+func GenerateDataKey() ([]byte, error) {
+	dataKey := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	return dataKey, nil
+}
+
+// LocalKeyProvider uses the keys of a Keyring as KEKs, see LoadKeyringFromEnv
+type LocalKeyProvider struct {
+	Keyring Keyring
+}
+
+func (p LocalKeyProvider) ActiveKeyID() string {
+	return p.Keyring.ActiveKeyID
+}
+
+func (p LocalKeyProvider) WrapKey(ctx context.Context, dataKey []byte) (wrappedKey string, keyID string, err error) {
+	wrappedKey, err = p.Keyring.Seal(Encode(dataKey))
+	return wrappedKey, p.Keyring.ActiveKeyID, err
+}
+
+func (p LocalKeyProvider) UnwrapKey(ctx context.Context, wrappedKey string) ([]byte, error) {
+	encoded, err := p.Keyring.Open(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := Decode(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataKey) != DataKeySize {
+		return nil, fmt.Errorf("%w: invalid data key size", ErrInvalidCiphertext)
+	}
+	return dataKey, nil
+}
+
+// SealWithDataKey encrypts the text with a new data key, the returned data key should be wrapped & stored
+func SealWithDataKey(text string) (sealed string, dataKey []byte, err error) {
+	dataKey, err = GenerateDataKey()
+	if err != nil {
+		return "", nil, err
+	}
+	sealed, err = SealEnvelope(text, DataKeyID, string(dataKey))
+	return sealed, dataKey, err
+}
+
+// OpenWithDataKey decrypts an envelope sealed by SealWithDataKey
+func OpenWithDataKey(s string, dataKey []byte) (string, error) {
+	env, err := ParseEnvelope(s)
+	if err != nil {
+		return "", err
+	}
+	if env.KeyID != DataKeyID {
+		return "", fmt.Errorf("%w: %s is not a data key", ErrUnknownKey, env.KeyID)
+	}
+	return OpenEnvelope(env, string(dataKey))
+}
@@ -0,0 +1,75 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalKeyProviderFromFile(t *testing.T) {
+	ctx := context.Background()
+	oldSecret, _ := GenerateRandomString(32)
+	newSecret, _ := GenerateRandomString(32)
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	err := os.WriteFile(keysFile, []byte(`{"2026-09":"`+oldSecret+`"}`), 0600)
+	if err != nil {
+		t.Fatalf("Cannot write keys file: %v", err)
+	}
+	t.Setenv("KEY_PROVIDER", "local")
+	t.Setenv("ENCRYPTION_KEY", "")
+	t.Setenv("ENCRYPTION_KEYS", "")
+	t.Setenv("ENCRYPTION_KEYS_FILE", keysFile)
+	t.Setenv("ENCRYPTION_ACTIVE_KEY_ID", "2026-09")
+	oldProvider, err := LoadKeyProviderFromEnv()
+	if err != nil {
+		t.Fatalf("Cannot load key provider: %v", err)
+	}
+	sealed, dataKey, err := SealWithDataKey("Hallo Inka")
+	if err != nil {
+		t.Fatalf("SealWithDataKey failed: %v", err)
+	}
+	wrappedKey, keyID, err := oldProvider.WrapKey(ctx, dataKey)
+	if err != nil || keyID != "2026-09" {
+		t.Fatalf("WrapKey should use the active key: %s %v", keyID, err)
+	}
+
+	// Rotate the KEK, the old one stays readable
+	err = os.WriteFile(keysFile, []byte(`{"2026-09":"`+oldSecret+`","2026-10":"`+newSecret+`"}`), 0600)
+	if err != nil {
+		t.Fatalf("Cannot write keys file: %v", err)
+	}
+	t.Setenv("ENCRYPTION_ACTIVE_KEY_ID", "2026-10")
+	newProvider, err := LoadKeyProviderFromEnv()
+	if err != nil {
+		t.Fatalf("Cannot load key provider: %v", err)
+	}
+	unwrappedKey, err := newProvider.UnwrapKey(ctx, wrappedKey)
+	if err != nil {
+		t.Fatalf("Data key wrapped by the retired KEK should be unwrapped: %v", err)
+	}
+	rewrappedKey, keyID, err := newProvider.WrapKey(ctx, unwrappedKey)
+	if err != nil || keyID != newProvider.ActiveKeyID() {
+		t.Fatalf("Re-wrapping should use the active key: %s %v", keyID, err)
+	}
+	unwrappedKey, err = newProvider.UnwrapKey(ctx, rewrappedKey)
+	if err != nil {
+		t.Fatalf("UnwrapKey failed: %v", err)
+	}
+	text, err := OpenWithDataKey(sealed, unwrappedKey)
+	if err != nil || text != "Hallo Inka" {
+		t.Fatalf("Content should be decrypted with the re-wrapped data key: %s %v", text, err)
+	}
+	otherDataKey, _ := GenerateDataKey()
+	if _, err = OpenWithDataKey(sealed, otherDataKey); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("Another data key should fail with ErrDecryptionFailed, got %v", err)
+	}
+}
+
+func TestLoadKeyProviderFromEnvUnsupported(t *testing.T) {
+	t.Setenv("KEY_PROVIDER", "unknown-kms")
+	if _, err := LoadKeyProviderFromEnv(); err == nil {
+		t.Fatal("Unsupported key provider should be rejected")
+	}
+}
@@ -0,0 +1,99 @@
+package secure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/asendia/legacy-api/simple"
+)
+
+// Key id of the single ENCRYPTION_KEY, the legacy AES-CFB rows are encrypted with it
+const LegacyKeyID = "default"
+
+// Keyring holds the encryption keys by id, every key can decrypt
+// but only the active one encrypts new values
+type Keyring struct {
+	ActiveKeyID string
+	Keys        map[string]string
+}
+
+func NewKeyring(activeKeyID string, keys map[string]string) (Keyring, error) {
+	for keyID, secret := range keys {
+		if keyID == "" || keyID == DataKeyID || strings.Contains(keyID, ":") {
+			return Keyring{}, fmt.Errorf("invalid key id: %q", keyID)
+		}
+		if l := len(secret); l != 16 && l != 24 && l != 32 {
+			return Keyring{}, fmt.Errorf("key %s should be 16, 24 or 32 bytes, got %d", keyID, l)
+		}
+	}
+	if _, ok := keys[activeKeyID]; !ok {
+		return Keyring{}, fmt.Errorf("%w: active key %s", ErrUnknownKey, activeKeyID)
+	}
+	return Keyring{ActiveKeyID: activeKeyID, Keys: keys}, nil
+}
+
+// LoadKeyringFromEnv reads ENCRYPTION_KEYS, a JSON object of key id to key,
+// e.g. {"2026-10":"32 characters..."}, or the same JSON from the ENCRYPTION_KEYS_FILE file.
+// ENCRYPTION_KEY is added as the "default" key.
+// ENCRYPTION_ACTIVE_KEY_ID picks the key for new values, "default" if empty.
+func LoadKeyringFromEnv() (Keyring, error) {
+	keys := map[string]string{}
+	keysJSON := os.Getenv("ENCRYPTION_KEYS")
+	if keysFile := os.Getenv("ENCRYPTION_KEYS_FILE"); keysJSON == "" && keysFile != "" {
+		b, err := os.ReadFile(keysFile)
+		if err != nil {
+			return Keyring{}, fmt.Errorf("env ENCRYPTION_KEYS_FILE is invalid: %w", err)
+		}
+		keysJSON = string(b)
+	}
+	if keysJSON != "" {
+		if err := json.Unmarshal([]byte(keysJSON), &keys); err != nil {
+			return Keyring{}, fmt.Errorf("env ENCRYPTION_KEYS is invalid: %w", err)
+		}
+	}
+	if legacyKey := os.Getenv("ENCRYPTION_KEY"); legacyKey != "" {
+		if secret, ok := keys[LegacyKeyID]; ok && secret != legacyKey {
+			return Keyring{}, errors.New("env ENCRYPTION_KEY conflicts with the default key of ENCRYPTION_KEYS")
+		}
+		keys[LegacyKeyID] = legacyKey
+	}
+	return NewKeyring(simple.DefaultString(os.Getenv("ENCRYPTION_ACTIVE_KEY_ID"), LegacyKeyID), keys)
+}
+
+func (k Keyring) Secret(keyID string) (string, error) {
+	secret, ok := k.Keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	return secret, nil
+}
+
+// ActivePrefix is the prefix of every envelope sealed with the active key
+func (k Keyring) ActivePrefix() string {
+	return EnvelopePrefix(k.ActiveKeyID)
+}
+
+// Seal encrypts the text with the active key
+func (k Keyring) Seal(text string) (string, error) {
+	secret, err := k.Secret(k.ActiveKeyID)
+	if err != nil {
+		return "", err
+	}
+	return SealEnvelope(text, k.ActiveKeyID, secret)
+}
+
+// Open decrypts an envelope with the key recorded in it
+func (k Keyring) Open(s string) (string, error) {
+	env, err := ParseEnvelope(s)
+	if err != nil {
+		return "", err
+	}
+	secret, err := k.Secret(env.KeyID)
+	if err != nil {
+		return "", err
+	}
+	return OpenEnvelope(env, secret)
+}
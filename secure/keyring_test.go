@@ -0,0 +1,64 @@
+package secure
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	oldSecret, _ := GenerateRandomString(32)
+	newSecret, _ := GenerateRandomString(32)
+	t.Setenv("ENCRYPTION_KEYS_FILE", "")
+	t.Setenv("ENCRYPTION_KEY", oldSecret)
+	t.Setenv("ENCRYPTION_KEYS", "")
+	t.Setenv("ENCRYPTION_ACTIVE_KEY_ID", "")
+	oldKeyring, err := LoadKeyringFromEnv()
+	if err != nil {
+		t.Fatalf("Cannot load keyring: %v", err)
+	}
+	sealed, err := oldKeyring.Seal("Hallo Inka")
+	if err != nil || !strings.HasPrefix(sealed, EnvelopePrefix(LegacyKeyID)) {
+		t.Fatalf("Keyring without ENCRYPTION_KEYS should seal with the default key: %s %v", sealed, err)
+	}
+
+	t.Setenv("ENCRYPTION_KEYS", `{"2026-10":"`+newSecret+`"}`)
+	t.Setenv("ENCRYPTION_ACTIVE_KEY_ID", "2026-10")
+	newKeyring, err := LoadKeyringFromEnv()
+	if err != nil {
+		t.Fatalf("Cannot load keyring: %v", err)
+	}
+	if text, err := newKeyring.Open(sealed); err != nil || text != "Hallo Inka" {
+		t.Fatalf("Retired key should still decrypt: %s %v", text, err)
+	}
+	resealed, err := newKeyring.Seal("Hallo Inka")
+	if err != nil || !strings.HasPrefix(resealed, newKeyring.ActivePrefix()) ||
+		newKeyring.ActivePrefix() != "v2:gcm:2026-10:" {
+		t.Fatalf("Keyring should seal with the active key: %s %v", resealed, err)
+	}
+	if _, err = oldKeyring.Open(resealed); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Keyring without the new key should fail with ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestLoadKeyringFromEnvInvalid(t *testing.T) {
+	secret, _ := GenerateRandomString(32)
+	t.Setenv("ENCRYPTION_KEYS_FILE", "")
+	cases := []map[string]string{
+		{"ENCRYPTION_KEY": "", "ENCRYPTION_KEYS": "", "ENCRYPTION_ACTIVE_KEY_ID": ""},
+		{"ENCRYPTION_KEY": "too short", "ENCRYPTION_KEYS": "", "ENCRYPTION_ACTIVE_KEY_ID": ""},
+		{"ENCRYPTION_KEY": secret, "ENCRYPTION_KEYS": "not json", "ENCRYPTION_ACTIVE_KEY_ID": ""},
+		{"ENCRYPTION_KEY": secret, "ENCRYPTION_KEYS": "", "ENCRYPTION_ACTIVE_KEY_ID": "missing"},
+		{"ENCRYPTION_KEY": secret, "ENCRYPTION_KEYS": `{"a:b":"` + secret + `"}`, "ENCRYPTION_ACTIVE_KEY_ID": ""},
+		{"ENCRYPTION_KEY": secret, "ENCRYPTION_KEYS": `{"dek":"` + secret + `"}`, "ENCRYPTION_ACTIVE_KEY_ID": ""},
+		{"ENCRYPTION_KEY": secret, "ENCRYPTION_KEYS": `{"default":"` + strings.ToUpper(secret) + `x"}`, "ENCRYPTION_ACTIVE_KEY_ID": ""},
+	}
+	for _, env := range cases {
+		for k, v := range env {
+			t.Setenv(k, v)
+		}
+		if _, err := LoadKeyringFromEnv(); err == nil {
+			t.Fatalf("Keyring env should be rejected: %v", env)
+		}
+	}
+}
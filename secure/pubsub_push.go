@@ -0,0 +1,81 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// GoogleJWKSURL serves the keys of the OIDC tokens Google signs, e.g. for Pub/Sub push subscriptions
+const GoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// GoogleOIDCClaims are the claims of the token of a Pub/Sub push request, email is the service account of the subscription
+type GoogleOIDCClaims struct {
+	Email         string   `json:"email"`
+	EmailVerified jsonBool `json:"email_verified"`
+	JWTRegisteredClaims
+}
+
+// PubSubPushVerifier verifies the Google signed OIDC token of the Pub/Sub push requests
+type PubSubPushVerifier struct {
+	Keys JWTKeySource
+	// The audience set on the push subscription, the push endpoint URL by default
+	Audiences []string
+	// The service account of the push subscription, required, any Google account can mint a token for any audience
+	ServiceAccountEmail string
+	Now                 func() time.Time
+}
+
+// LoadPubSubPushVerifierFromEnv reads the comma separated PUBSUB_PUSH_AUDIENCES & PUBSUB_PUSH_SERVICE_ACCOUNT,
+// the keys are fetched from GoogleJWKSURL
+func LoadPubSubPushVerifierFromEnv(client HTTPClient) (v PubSubPushVerifier, err error) {
+	for _, aud := range strings.Split(os.Getenv("PUBSUB_PUSH_AUDIENCES"), ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			v.Audiences = append(v.Audiences, aud)
+		}
+	}
+	if len(v.Audiences) == 0 {
+		return v, errors.New("env PUBSUB_PUSH_AUDIENCES is required")
+	}
+	v.ServiceAccountEmail = os.Getenv("PUBSUB_PUSH_SERVICE_ACCOUNT")
+	if v.ServiceAccountEmail == "" {
+		return v, errors.New("env PUBSUB_PUSH_SERVICE_ACCOUNT is required")
+	}
+	v.Keys = NewJWKSCache(GoogleJWKSURL, client)
+	return v, nil
+}
+
+// Verify verifies the bearer token of an authorization header, unlike VerifyJWT an audience & the service account
+// are always required
+func (v PubSubPushVerifier) Verify(ctx context.Context, authHeader string) (claims GoogleOIDCClaims, err error) {
+	if len(v.Audiences) == 0 {
+		return claims, errors.New("pubsub push audiences are required")
+	}
+	if v.ServiceAccountEmail == "" {
+		return claims, errors.New("pubsub push service account is required")
+	}
+	token, err := parseBearerToken(authHeader)
+	if err != nil {
+		return claims, err
+	}
+	opts := JWTVerifyOptions{Audiences: v.Audiences, Now: v.Now}
+	if err = VerifyJWT(ctx, token, v.Keys, opts, &claims); err != nil {
+		return claims, err
+	}
+	isGoogleIssuer := false
+	for _, iss := range googleIssuers {
+		isGoogleIssuer = isGoogleIssuer || claims.Issuer == iss
+	}
+	if !isGoogleIssuer {
+		return claims, ErrJWTIssuer
+	}
+	if claims.Email != v.ServiceAccountEmail || !bool(claims.EmailVerified) {
+		return claims, fmt.Errorf("%w: unexpected service account %q", ErrInvalidJWT, claims.Email)
+	}
+	return claims, nil
+}
@@ -0,0 +1,100 @@
+package secure
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	testPushAudience       = "https://legacy-api.example.com/legacy-api-scheduler-push"
+	testPushServiceAccount = "scheduler-push@monarch-public.iam.gserviceaccount.com"
+)
+
+func TestPubSubPushVerifier(t *testing.T) {
+	ctx := context.Background()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	v := PubSubPushVerifier{
+		Keys:                StaticJWTKeys{"google": &key.PublicKey},
+		Audiences:           []string{testPushAudience},
+		ServiceAccountEmail: testPushServiceAccount,
+	}
+	claims, err := v.Verify(ctx, "Bearer "+mintRS256JWT(t, key, "google", generatePushClaims()))
+	if err != nil {
+		t.Fatalf("Push token should be valid: %v", err)
+	}
+	if claims.Email != testPushServiceAccount {
+		t.Fatalf("Unexpected service account: %s", claims.Email)
+	}
+	failedCases := []struct {
+		name   string
+		update func(claims map[string]any)
+		err    error
+	}{
+		{"other audience", func(c map[string]any) { c["aud"] = "https://example.com" }, ErrJWTAudience},
+		{"other issuer", func(c map[string]any) { c["iss"] = "https://example.com" }, ErrJWTIssuer},
+		{"other service account", func(c map[string]any) { c["email"] = "someone@example.com" }, ErrInvalidJWT},
+		{"unverified service account", func(c map[string]any) { c["email_verified"] = false }, ErrInvalidJWT},
+		{"expired", func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, ErrJWTExpired},
+	}
+	for _, c := range failedCases {
+		claims := generatePushClaims()
+		c.update(claims)
+		if _, err := v.Verify(ctx, "Bearer "+mintRS256JWT(t, key, "google", claims)); !errors.Is(err, c.err) {
+			t.Fatalf("Token with %s should be rejected with %v, got: %v", c.name, c.err, err)
+		}
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := v.Verify(ctx, "Bearer "+mintRS256JWT(t, otherKey, "google", generatePushClaims())); !errors.Is(err, ErrJWTBadSignature) {
+		t.Fatalf("Token signed by another key should be rejected, got: %v", err)
+	}
+	// Any Google account can mint a token for our audience, only the subscription service account is accepted
+	otherClaims := generatePushClaims()
+	otherClaims["email"], otherClaims["sub"] = "attacker@gmail.com", "104256482342364719382"
+	if _, err := v.Verify(ctx, "Bearer "+mintRS256JWT(t, key, "google", otherClaims)); !errors.Is(err, ErrInvalidJWT) {
+		t.Fatalf("Token of another Google account should be rejected, got: %v", err)
+	}
+	// The service account is required, otherwise such a token would be accepted
+	noServiceAccount := v
+	noServiceAccount.ServiceAccountEmail = ""
+	if _, err := noServiceAccount.Verify(ctx, "Bearer "+mintRS256JWT(t, key, "google", generatePushClaims())); err == nil {
+		t.Fatalf("Verifier without service account should reject every token")
+	}
+	// An audience is required, otherwise a token minted for any other service would be accepted
+	v.Audiences = nil
+	if _, err := v.Verify(ctx, "Bearer "+mintRS256JWT(t, key, "google", generatePushClaims())); err == nil {
+		t.Fatalf("Verifier without audiences should reject every token")
+	}
+}
+
+func TestLoadPubSubPushVerifierFromEnv(t *testing.T) {
+	t.Setenv("PUBSUB_PUSH_AUDIENCES", "")
+	if _, err := LoadPubSubPushVerifierFromEnv(nil); err == nil {
+		t.Fatalf("PUBSUB_PUSH_AUDIENCES should be required")
+	}
+	t.Setenv("PUBSUB_PUSH_AUDIENCES", testPushAudience+", https://example.com")
+	t.Setenv("PUBSUB_PUSH_SERVICE_ACCOUNT", "")
+	if _, err := LoadPubSubPushVerifierFromEnv(nil); err == nil {
+		t.Fatalf("PUBSUB_PUSH_SERVICE_ACCOUNT should be required")
+	}
+	t.Setenv("PUBSUB_PUSH_SERVICE_ACCOUNT", testPushServiceAccount)
+	v, err := LoadPubSubPushVerifierFromEnv(nil)
+	if err != nil || len(v.Audiences) != 2 || v.Audiences[1] != "https://example.com" || v.ServiceAccountEmail != testPushServiceAccount {
+		t.Fatalf("Audiences & service account should be loaded: %+v %v", v, err)
+	}
+}
+
+func generatePushClaims() map[string]any {
+	return map[string]any{
+		"iss":            "https://accounts.google.com",
+		"aud":            testPushAudience,
+		"sub":            "113774264463038321964",
+		"email":          testPushServiceAccount,
+		"email_verified": true,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+}
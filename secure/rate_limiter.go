@@ -0,0 +1,185 @@
+package secure
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AttemptState is the request count of the current window & the consecutive failures of a key
+type AttemptState struct {
+	Hits        int
+	WindowStart time.Time
+	Failures    int
+	LockedUntil time.Time
+}
+
+// AttemptStore keeps the AttemptState of every key, e.g. in memory for a single instance or in Postgres
+type AttemptStore interface {
+	// Hit counts a request of key, the count restarts once the window is over
+	Hit(ctx context.Context, key string, now time.Time, window time.Duration) (AttemptState, error)
+	// Fail counts a consecutive failure of key & locks it for lockout(failures)
+	Fail(ctx context.Context, key string, now time.Time, lockout func(failures int) time.Duration) (AttemptState, error)
+	// Reset clears the failures & the lock of key
+	Reset(ctx context.Context, key string) error
+}
+
+type RateLimitPolicy struct {
+	Window  time.Duration
+	MaxHits int
+	// Failures before the first lockout, every later failure doubles the lockout up to MaxLockout
+	MaxFailures int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+}
+
+var DefaultRateLimitPolicy = RateLimitPolicy{
+	Window:      time.Minute,
+	MaxHits:     20,
+	MaxFailures: 5,
+	BaseLockout: time.Minute,
+	MaxLockout:  24 * time.Hour,
+}
+
+func (p RateLimitPolicy) LockoutDuration(failures int) time.Duration {
+	if failures < p.MaxFailures {
+		return 0
+	}
+	lockout := p.BaseLockout
+	for i := p.MaxFailures; i < failures && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > p.MaxLockout {
+		return p.MaxLockout
+	}
+	return lockout
+}
+
+type RateLimiter struct {
+	Store  AttemptStore
+	Policy RateLimitPolicy
+	Now    func() time.Time
+}
+
+func (l RateLimiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// Allow counts a request of every key, retryAfter is positive when one of them is over the limit or locked
+func (l RateLimiter) Allow(ctx context.Context, keys ...string) (retryAfter time.Duration, err error) {
+	now := l.now()
+	for _, key := range keys {
+		state, err := l.Store.Hit(ctx, key, now, l.Policy.Window)
+		if err != nil {
+			return 0, err
+		}
+		if wait := state.LockedUntil.Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+		if state.Hits > l.Policy.MaxHits {
+			if wait := state.WindowStart.Add(l.Policy.Window).Sub(now); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	return retryAfter, nil
+}
+
+// Fail counts a failed attempt of every key & returns the highest consecutive failures count
+func (l RateLimiter) Fail(ctx context.Context, keys ...string) (failures int, err error) {
+	now := l.now()
+	for _, key := range keys {
+		state, err := l.Store.Fail(ctx, key, now, l.Policy.LockoutDuration)
+		if err != nil {
+			return failures, err
+		}
+		if state.Failures > failures {
+			failures = state.Failures
+		}
+	}
+	return failures, nil
+}
+
+// Succeed clears the failures of every key
+func (l RateLimiter) Succeed(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := l.Store.Reset(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Idle keys are forgotten after this, including their failures
+const memoryAttemptRetention = 24 * time.Hour
+
+// MemoryAttemptStore only limits the requests reaching this instance
+type MemoryAttemptStore struct {
+	mu        sync.Mutex
+	states    map[string]*memoryAttemptState
+	sweptAt   time.Time
+	retention time.Duration
+}
+
+type memoryAttemptState struct {
+	AttemptState
+	updatedAt time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{states: map[string]*memoryAttemptState{}, retention: memoryAttemptRetention}
+}
+
+func (s *MemoryAttemptStore) state(key string, now time.Time) *memoryAttemptState {
+	if now.Sub(s.sweptAt) > time.Minute {
+		for k, st := range s.states {
+			if now.Sub(st.updatedAt) > s.retention && now.After(st.LockedUntil) {
+				delete(s.states, k)
+			}
+		}
+		s.sweptAt = now
+	}
+	st := s.states[key]
+	if st == nil {
+		st = &memoryAttemptState{AttemptState: AttemptState{WindowStart: now}}
+		s.states[key] = st
+	}
+	st.updatedAt = now
+	return st
+}
+
+func (s *MemoryAttemptStore) Hit(ctx context.Context, key string, now time.Time, window time.Duration) (AttemptState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.state(key, now)
+	if !st.WindowStart.After(now.Add(-window)) {
+		st.WindowStart = now
+		st.Hits = 0
+	}
+	st.Hits++
+	return st.AttemptState, nil
+}
+
+func (s *MemoryAttemptStore) Fail(ctx context.Context, key string, now time.Time, lockout func(failures int) time.Duration) (AttemptState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.state(key, now)
+	st.Failures++
+	if lockedUntil := now.Add(lockout(st.Failures)); lockedUntil.After(st.LockedUntil) {
+		st.LockedUntil = lockedUntil
+	}
+	return st.AttemptState, nil
+}
+
+func (s *MemoryAttemptStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.states[key]; st != nil {
+		st.Failures = 0
+		st.LockedUntil = time.Time{}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package secure
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimitPolicyLockoutDuration(t *testing.T) {
+	p := RateLimitPolicy{MaxFailures: 3, BaseLockout: time.Minute, MaxLockout: 10 * time.Minute}
+	expected := map[int]time.Duration{
+		1:  0,
+		2:  0,
+		3:  time.Minute,
+		4:  2 * time.Minute,
+		5:  4 * time.Minute,
+		6:  8 * time.Minute,
+		7:  10 * time.Minute,
+		50: 10 * time.Minute,
+	}
+	for failures, lockout := range expected {
+		if got := p.LockoutDuration(failures); got != lockout {
+			t.Errorf("Lockout of %d failures should be %v, got: %v", failures, lockout, got)
+		}
+	}
+}
+
+func TestRateLimiterWithMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	l := RateLimiter{
+		Store:  NewMemoryAttemptStore(),
+		Policy: RateLimitPolicy{Window: time.Minute, MaxHits: 3, MaxFailures: 2, BaseLockout: time.Minute, MaxLockout: time.Hour},
+		Now:    func() time.Time { return now },
+	}
+	for i := 0; i < 3; i++ {
+		if retryAfter, err := l.Allow(ctx, "ip:1", "message:1"); err != nil || retryAfter != 0 {
+			t.Fatalf("Request %d should be allowed: %v %v", i, retryAfter, err)
+		}
+	}
+	if retryAfter, _ := l.Allow(ctx, "ip:2", "message:1"); retryAfter != time.Minute {
+		t.Fatalf("Requests of one message over the limit should wait for the next window, got: %v", retryAfter)
+	}
+	now = now.Add(time.Minute)
+	if retryAfter, _ := l.Allow(ctx, "ip:1", "message:1"); retryAfter != 0 {
+		t.Fatalf("The limit should restart in the next window, got: %v", retryAfter)
+	}
+	// Failures lock the keys out, each one doubles the lockout
+	if failures, _ := l.Fail(ctx, "ip:1", "message:1"); failures != 1 {
+		t.Fatalf("Expected 1 failure, got: %d", failures)
+	}
+	if retryAfter, _ := l.Allow(ctx, "ip:1"); retryAfter != 0 {
+		t.Fatalf("A single failure should not lock out, got: %v", retryAfter)
+	}
+	l.Fail(ctx, "ip:1", "message:1")
+	now = now.Add(time.Second)
+	if retryAfter, _ := l.Allow(ctx, "ip:3", "message:1"); retryAfter != time.Minute-time.Second {
+		t.Fatalf("The message should be locked out for a minute, got: %v", retryAfter)
+	}
+	l.Fail(ctx, "ip:1", "message:1")
+	if retryAfter, _ := l.Allow(ctx, "ip:1"); retryAfter != 2*time.Minute {
+		t.Fatalf("The lockout should be doubled, got: %v", retryAfter)
+	}
+	// A valid secret clears the failures
+	if err := l.Succeed(ctx, "ip:1", "message:1"); err != nil {
+		t.Fatalf("Succeed failed: %v", err)
+	}
+	now = now.Add(time.Minute)
+	if retryAfter, _ := l.Allow(ctx, "ip:1", "message:1"); retryAfter != 0 {
+		t.Fatalf("Success should clear the lockout, got: %v", retryAfter)
+	}
+	if failures, _ := l.Fail(ctx, "message:1"); failures != 1 {
+		t.Fatalf("Success should clear the failures, got: %d", failures)
+	}
+}
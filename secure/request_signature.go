@@ -0,0 +1,135 @@
+package secure
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Unix seconds of the request, part of the signed content
+	RequestTimestampHeader = "X-Legacy-Timestamp"
+	// Comma separated "v1=<hex HMAC-SHA256>" of "<timestamp>.<body>", one per signing secret
+	RequestSignatureHeader = "X-Legacy-Signature"
+	// Requests older or newer than this are rejected, signatures are remembered for twice as long
+	DefaultRequestSignatureTolerance = 5 * time.Minute
+
+	requestSignatureVersion       = "v1="
+	minRequestSigningSecretLength = 32
+)
+
+var (
+	ErrRequestSignatureMissing  = errors.New("request signature is missing")
+	ErrRequestSignatureInvalid  = errors.New("request signature is invalid")
+	ErrRequestSignatureExpired  = errors.New("request timestamp is outside of the tolerance")
+	ErrRequestSignatureReplayed = errors.New("request signature was already used")
+)
+
+// LoadSchedulerSigningSecretsFromEnv reads the comma separated SCHEDULER_SIGNING_SECRETS, or STATIC_SECRET if it is empty.
+// During a rotation both the new & the old secret are set, the first one signs.
+func LoadSchedulerSigningSecretsFromEnv() ([]string, error) {
+	env := os.Getenv("SCHEDULER_SIGNING_SECRETS")
+	if env == "" {
+		env = os.Getenv("STATIC_SECRET")
+	}
+	var secrets []string
+	for _, secret := range strings.Split(env, ",") {
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			continue
+		}
+		if len(secret) < minRequestSigningSecretLength {
+			return nil, errors.New("scheduler signing secrets should be at least 32 characters")
+		}
+		secrets = append(secrets, secret)
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("env SCHEDULER_SIGNING_SECRETS or STATIC_SECRET is required")
+	}
+	return secrets, nil
+}
+
+// SignRequestBody returns the "v1=<hex>" signature of the body sent at timestamp
+func SignRequestBody(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return requestSignatureVersion + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the timestamp & the signature headers of a request with the body
+func SignRequest(header http.Header, secret string, now time.Time, body []byte) {
+	timestamp := now.Unix()
+	header.Set(RequestTimestampHeader, strconv.FormatInt(timestamp, 10))
+	header.Set(RequestSignatureHeader, SignRequestBody(secret, timestamp, body))
+}
+
+// RequestVerifier checks the signed requests, any of Secrets is accepted
+type RequestVerifier struct {
+	Secrets   []string
+	Tolerance time.Duration
+	// Remembers the signed requests, a second Hit of one is a replay. Nil disables the replay protection.
+	Signatures AttemptStore
+	Now        func() time.Time
+}
+
+func (v RequestVerifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// Verify returns nil when the body is signed by one of the secrets within the tolerance & was not seen before
+func (v RequestVerifier) Verify(ctx context.Context, header http.Header, body []byte) error {
+	timestampStr := header.Get(RequestTimestampHeader)
+	signatures := header.Get(RequestSignatureHeader)
+	if timestampStr == "" || signatures == "" {
+		return ErrRequestSignatureMissing
+	}
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return ErrRequestSignatureInvalid
+	}
+	tolerance := v.Tolerance
+	if tolerance <= 0 {
+		tolerance = DefaultRequestSignatureTolerance
+	}
+	now := v.now()
+	if age := now.Sub(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return ErrRequestSignatureExpired
+	}
+	matched := false
+	for _, secret := range v.Secrets {
+		expected := []byte(SignRequestBody(secret, timestamp, body))
+		for _, signature := range strings.Split(signatures, ",") {
+			if hmac.Equal(expected, []byte(strings.TrimSpace(signature))) {
+				matched = true
+			}
+		}
+	}
+	if !matched {
+		return ErrRequestSignatureInvalid
+	}
+	if v.Signatures == nil {
+		return nil
+	}
+	// Keyed by the signed content rather than the signature, which differs per secret
+	content := sha256.Sum256([]byte(strconv.FormatInt(timestamp, 10) + "." + string(body)))
+	state, err := v.Signatures.Hit(ctx, "signature:"+hex.EncodeToString(content[:]), now, 2*tolerance+time.Second)
+	if err != nil {
+		return err
+	}
+	if state.Hits > 1 {
+		return ErrRequestSignatureReplayed
+	}
+	return nil
+}
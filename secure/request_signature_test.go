@@ -0,0 +1,105 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const (
+	testSigningSecret    = "69 chars Bitcoin is not the future Bitcoin is not the future is baaad"
+	testOldSigningSecret = "the scheduler signing secret before the rotation"
+)
+
+func TestVerifySignedRequest(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1792300000, 0)
+	body := []byte(`{"attributes":{"action":"send-reminder-messages"}}`)
+	v := RequestVerifier{
+		Secrets:    []string{testSigningSecret, testOldSigningSecret},
+		Signatures: NewMemoryAttemptStore(),
+		Now:        func() time.Time { return now },
+	}
+	header := http.Header{}
+	SignRequest(header, testSigningSecret, now, body)
+	if err := v.Verify(ctx, header, body); err != nil {
+		t.Fatalf("Signed request should be valid: %v", err)
+	}
+	if err := v.Verify(ctx, header, body); !errors.Is(err, ErrRequestSignatureReplayed) {
+		t.Fatalf("Second use of a request should be a replay, got: %v", err)
+	}
+	// The old secret is still accepted during the rotation
+	header = http.Header{}
+	SignRequest(header, testOldSigningSecret, now.Add(-time.Minute), body)
+	if err := v.Verify(ctx, header, body); err != nil {
+		t.Fatalf("Request signed with the old secret should be valid: %v", err)
+	}
+	header = http.Header{}
+	SignRequest(header, testSigningSecret, now, []byte(`{"attributes":{"action":"send-testaments"}}`))
+	if err := v.Verify(ctx, header, body); !errors.Is(err, ErrRequestSignatureInvalid) {
+		t.Fatalf("Tampered body should be invalid, got: %v", err)
+	}
+	header = http.Header{}
+	SignRequest(header, "not one of the scheduler signing secrets at all", now, body)
+	if err := v.Verify(ctx, header, body); !errors.Is(err, ErrRequestSignatureInvalid) {
+		t.Fatalf("Unknown secret should be invalid, got: %v", err)
+	}
+	for _, sentAt := range []time.Time{now.Add(-6 * time.Minute), now.Add(6 * time.Minute)} {
+		header = http.Header{}
+		SignRequest(header, testSigningSecret, sentAt, body)
+		if err := v.Verify(ctx, header, body); !errors.Is(err, ErrRequestSignatureExpired) {
+			t.Fatalf("Request sent at %v should be expired, got: %v", sentAt, err)
+		}
+	}
+	if err := v.Verify(ctx, http.Header{}, body); !errors.Is(err, ErrRequestSignatureMissing) {
+		t.Fatalf("Unsigned request should be rejected, got: %v", err)
+	}
+}
+
+func TestVerifySignedRequestReplayWithAnotherSignature(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1792300000, 0)
+	body := []byte(`{"attributes":{"action":"dispatch-emails"}}`)
+	v := RequestVerifier{
+		Secrets:    []string{testSigningSecret, testOldSigningSecret},
+		Signatures: NewMemoryAttemptStore(),
+		Now:        func() time.Time { return now },
+	}
+	// Signed with both secrets during the rotation
+	header := http.Header{}
+	header.Set(RequestTimestampHeader, "1792300000")
+	header.Set(RequestSignatureHeader, SignRequestBody(testSigningSecret, now.Unix(), body)+","+
+		SignRequestBody(testOldSigningSecret, now.Unix(), body))
+	if err := v.Verify(ctx, header, body); err != nil {
+		t.Fatalf("Request signed with both secrets should be valid: %v", err)
+	}
+	// Replaying only one of the signatures, or with a reformatted timestamp, is still a replay
+	header.Set(RequestSignatureHeader, SignRequestBody(testOldSigningSecret, now.Unix(), body))
+	if err := v.Verify(ctx, header, body); !errors.Is(err, ErrRequestSignatureReplayed) {
+		t.Fatalf("Replay with the other signature should be rejected, got: %v", err)
+	}
+	header.Set(RequestTimestampHeader, "01792300000")
+	if err := v.Verify(ctx, header, body); !errors.Is(err, ErrRequestSignatureReplayed) {
+		t.Fatalf("Replay with a reformatted timestamp should be rejected, got: %v", err)
+	}
+}
+
+func TestLoadSchedulerSigningSecretsFromEnv(t *testing.T) {
+	t.Setenv("STATIC_SECRET", testSigningSecret)
+	t.Setenv("SCHEDULER_SIGNING_SECRETS", "")
+	secrets, err := LoadSchedulerSigningSecretsFromEnv()
+	if err != nil || len(secrets) != 1 || secrets[0] != testSigningSecret {
+		t.Fatalf("STATIC_SECRET should be the fallback: %v %v", secrets, err)
+	}
+	t.Setenv("SCHEDULER_SIGNING_SECRETS", testOldSigningSecret+", "+testSigningSecret)
+	secrets, err = LoadSchedulerSigningSecretsFromEnv()
+	if err != nil || len(secrets) != 2 || secrets[0] != testOldSigningSecret {
+		t.Fatalf("Both rotated secrets should be loaded in order: %v %v", secrets, err)
+	}
+	t.Setenv("SCHEDULER_SIGNING_SECRETS", "too short")
+	if _, err = LoadSchedulerSigningSecretsFromEnv(); err == nil {
+		t.Fatalf("Short secret should be rejected")
+	}
+}
@@ -0,0 +1,44 @@
+package secure
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+)
+
+const minSecretPepperLength = 32
+
+// SecretHasher hashes the secrets of the email links, only the hashes are stored
+type SecretHasher struct {
+	pepper []byte
+}
+
+func NewSecretHasher(pepper string) (SecretHasher, error) {
+	if len(pepper) < minSecretPepperLength {
+		return SecretHasher{}, errors.New("secret pepper should be at least 32 characters")
+	}
+	return SecretHasher{pepper: []byte(pepper)}, nil
+}
+
+// LoadSecretHasherFromEnv reads the pepper from SECRET_PEPPER
+func LoadSecretHasherFromEnv() (SecretHasher, error) {
+	return NewSecretHasher(os.Getenv("SECRET_PEPPER"))
+}
+
+// Hash returns the hex HMAC-SHA256 of the secret keyed with the pepper
+func (h SecretHasher) Hash(secret string) string {
+	mac := hmac.New(sha256.New, h.pepper)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateHashedSecret returns a new random secret for an email link & its hash to store
+func (h SecretHasher) GenerateHashedSecret(length int) (secret string, hash string, err error) {
+	secret, err = GenerateRandomString(length)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, h.Hash(secret), nil
+}
@@ -0,0 +1,29 @@
+package secure
+
+import "testing"
+
+func TestSecretHasher(t *testing.T) {
+	if _, err := NewSecretHasher("short pepper"); err == nil {
+		t.Fatal("Short pepper should be rejected")
+	}
+	pepper, _ := GenerateRandomString(32)
+	h, err := NewSecretHasher(pepper)
+	if err != nil {
+		t.Fatalf("Cannot create secret hasher: %v", err)
+	}
+	secret, hash, err := h.GenerateHashedSecret(69)
+	if err != nil {
+		t.Fatalf("Cannot generate hashed secret: %v", err)
+	}
+	if len(secret) != 69 || len(hash) != 64 || secret == hash {
+		t.Fatalf("Unexpected secret or hash: %s %s", secret, hash)
+	}
+	if h.Hash(secret) != hash {
+		t.Fatal("Hashing the same secret should return the same hash")
+	}
+	otherPepper, _ := GenerateRandomString(32)
+	other, _ := NewSecretHasher(otherPepper)
+	if other.Hash(secret) == hash {
+		t.Fatal("Hash should depend on the pepper")
+	}
+}